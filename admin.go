@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rafaelmdurante/lenslocked/cli"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// runAdmin runs `lenslocked admin`, with the same configuration as the server.
+func runAdmin(args []string) error {
+	cfg, args, err := commandConfig("lenslocked admin", cli.AdminUsage, args)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db, err := models.Open(cfg.PSQL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = checkSchema(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	admin := cli.Admin{
+		Users: &models.UserService{
+			DB:           db,
+			QueryTimeout: cfg.PSQL.QueryTimeout,
+		},
+		Sessions: &models.SessionService{
+			DB:           db,
+			QueryTimeout: cfg.PSQL.QueryTimeout,
+		},
+		PasswordResets: &models.PasswordResetService{
+			DB:           db,
+			QueryTimeout: cfg.PSQL.QueryTimeout,
+		},
+		Emails: models.NewEmailService(cfg.SMTP),
+		Audit: &models.AuditService{
+			DB:           db,
+			QueryTimeout: cfg.PSQL.QueryTimeout,
+		},
+		Galleries: &models.GalleryService{
+			DB:           db,
+			QueryTimeout: cfg.PSQL.QueryTimeout,
+		},
+		Stats: &models.StatsService{
+			DB:           db,
+			QueryTimeout: cfg.PSQL.QueryTimeout,
+		},
+		Transactor: &models.Transactor{DB: db},
+		BaseURL:    cfg.App.BaseURL,
+		Out:        os.Stdout,
+		Err:        os.Stderr,
+	}
+
+	return admin.Run(ctx, args)
+}
@@ -0,0 +1,533 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/rand"
+)
+
+// AdminUsage lists the admin commands. Every command also takes
+// --format table|json.
+const AdminUsage = `Usage: lenslocked admin [config flags] <command> [flags] [args]
+
+Commands:
+  users list [--limit N] [--offset N]    list users by id
+  users find <id|email>                  show a user and how many galleries they have
+  users create [--password P] <email>    create a user, without --password they are
+                                         emailed a link to choose one
+  users disable <id|email>               stop a user from signing in and sign them out
+  users enable <id|email>                undo users disable
+  users set-role <id|email> <role>       make a user a user, moderator or admin
+  users reset-password <id|email>        replace the password with a random one, sign
+                                         the user out and email them a reset link
+  sessions revoke <id|email>             sign a user out everywhere
+  galleries transfer --to <id|email> (--from <id|email> | <gallery id>...)
+                                         give galleries to another user
+  stats                                  count users, sessions and galleries
+`
+
+// Admin runs the admin commands, which let operators manage the data without
+// opening psql.
+type Admin struct {
+	Users          UserService
+	Sessions       SessionService
+	PasswordResets PasswordResetService
+	Emails         EmailService
+	Galleries      GalleryService
+	Stats          StatsService
+	Audit          AuditService
+	Transactor     Transactor
+	// BaseURL is the public URL of the app, used to build links in emails
+	BaseURL string
+
+	// Out receives the command output, Err the usage and flag errors
+	Out io.Writer
+	Err io.Writer
+}
+
+// Run runs the command in args, e.g. ["users", "find", "bob@example.com"].
+func (a *Admin) Run(ctx context.Context, args []string) error {
+	commands := map[string]func(ctx context.Context, args []string) error{
+		"users list":           a.usersList,
+		"users find":           a.usersFind,
+		"users create":         a.usersCreate,
+		"users disable":        a.usersDisable,
+		"users enable":         a.usersEnable,
+		"users set-role":       a.usersSetRole,
+		"users reset-password": a.usersResetPassword,
+		"sessions revoke":      a.sessionsRevoke,
+		"galleries transfer":   a.galleriesTransfer,
+	}
+
+	if len(args) >= 1 && args[0] == "stats" {
+		return a.stats(ctx, args[1:])
+	}
+	if len(args) >= 2 {
+		if command, ok := commands[args[0]+" "+args[1]]; ok {
+			return command(ctx, args[2:])
+		}
+	}
+
+	fmt.Fprint(a.Err, AdminUsage)
+	if len(args) == 0 {
+		return errors.New("no command given")
+	}
+	return fmt.Errorf("unknown command %q", args)
+}
+
+// userView is how users are shown, without their password hash.
+type userView struct {
+	ID         int         `json:"id"`
+	Email      string      `json:"email"`
+	Role       models.Role `json:"role"`
+	DisabledAt *time.Time  `json:"disabled_at,omitempty"`
+	// Galleries is only set by users find
+	Galleries *int `json:"galleries,omitempty"`
+}
+
+func newUserView(user *models.User) userView {
+	return userView{ID: user.ID, Email: user.Email, Role: user.Role,
+		DisabledAt: user.DisabledAt}
+}
+
+func (uv userView) row() []string {
+	status := "active"
+	if uv.DisabledAt != nil {
+		status = "disabled since " + uv.DisabledAt.Format(time.DateTime)
+	}
+	return []string{strconv.Itoa(uv.ID), uv.Email, string(uv.Role), status}
+}
+
+var userHeader = []string{"ID", "EMAIL", "ROLE", "STATUS"}
+
+func (a *Admin) printUser(format string, user *models.User) error {
+	view := newUserView(user)
+	return output(a.Out, format, view, userHeader, [][]string{view.row()})
+}
+
+// user looks a user up by id or email.
+func (a *Admin) user(ctx context.Context, ref string) (*models.User, error) {
+	return findUser(ctx, a.Users, ref)
+}
+
+func findUser(ctx context.Context, users UserService, ref string) (*models.User, error) {
+	var user *models.User
+	id, err := strconv.Atoi(ref)
+	if err == nil {
+		user, err = users.ByID(ctx, id)
+	} else {
+		user, err = users.ByEmail(ctx, ref)
+	}
+	if errors.Is(err, models.ErrNotFound) {
+		return nil, fmt.Errorf("user %s not found", ref)
+	}
+
+	return user, err
+}
+
+// userArg parses the flags of a command taking a single user as argument.
+func (a *Admin) userArg(ctx context.Context, name string, args []string) (*models.User, string, error) {
+	flags, format := newFlagSet(name, a.Err)
+	positional, err := parse(flags, args)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(positional) != 1 {
+		return nil, "", fmt.Errorf("%s: want a single user id or email, got %d arguments",
+			name, len(positional))
+	}
+
+	user, err := a.user(ctx, positional[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", name, err)
+	}
+
+	return user, *format, nil
+}
+
+func (a *Admin) usersList(ctx context.Context, args []string) error {
+	flags, format := newFlagSet("users list", a.Err)
+	limit := flags.Int("limit", 50, "maximum number of users")
+	offset := flags.Int("offset", 0, "number of users to skip")
+	_, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if *limit < 0 || *offset < 0 {
+		return errors.New("users list: --limit and --offset can't be negative")
+	}
+
+	users, err := a.Users.List(ctx, *limit, *offset)
+	if err != nil {
+		return fmt.Errorf("users list: %w", err)
+	}
+
+	views := make([]userView, 0, len(users))
+	rows := make([][]string, 0, len(users))
+	for i := range users {
+		view := newUserView(&users[i])
+		views = append(views, view)
+		rows = append(rows, view.row())
+	}
+
+	return output(a.Out, *format, views, userHeader, rows)
+}
+
+func (a *Admin) usersFind(ctx context.Context, args []string) error {
+	user, format, err := a.userArg(ctx, "users find", args)
+	if err != nil {
+		return err
+	}
+
+	galleries, err := a.Galleries.ByUserID(ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("users find: %w", err)
+	}
+
+	view := newUserView(user)
+	count := len(galleries)
+	view.Galleries = &count
+
+	return output(a.Out, format, view,
+		append(userHeader, "GALLERIES"),
+		[][]string{append(view.row(), strconv.Itoa(count))})
+}
+
+func (a *Admin) usersCreate(ctx context.Context, args []string) error {
+	flags, format := newFlagSet("users create", a.Err)
+	password := flags.String("password", "",
+		"password of the user, without it they are emailed a reset link")
+	positional, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("users create: want a single email, got %d arguments",
+			len(positional))
+	}
+	email := positional[0]
+
+	invite := *password == ""
+	if invite {
+		// nobody knows this password, the user sets their own through the
+		// reset link
+		*password, err = rand.String(models.MinBytesPerToken)
+		if err != nil {
+			return fmt.Errorf("users create: %w", err)
+		}
+	}
+
+	var user *models.User
+	var reset *models.PasswordReset
+	err = a.Transactor.InTx(ctx, func(ctx context.Context) error {
+		user, err = a.Users.Create(ctx, email, *password)
+		if err != nil {
+			return err
+		}
+		if invite {
+			reset, err = a.PasswordResets.Create(ctx, user.Email)
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("users create: %w", err)
+	}
+
+	if reset != nil {
+		err = a.sendReset(ctx, user.Email, reset.Token)
+		if err != nil {
+			return fmt.Errorf("users create: user %d created but %w", user.ID, err)
+		}
+	}
+
+	return a.printUser(*format, user)
+}
+
+func (a *Admin) usersDisable(ctx context.Context, args []string) error {
+	user, format, err := a.userArg(ctx, "users disable", args)
+	if err != nil {
+		return err
+	}
+
+	err = a.Transactor.InTx(ctx, func(ctx context.Context) error {
+		err := a.Users.Disable(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		// disabled users' sessions are ignored anyway, there is no point in
+		// keeping them around
+		err = a.Sessions.DeleteByUserID(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		return a.audit(ctx, models.EventSessionsRevoked, user)
+	})
+	if err != nil {
+		return fmt.Errorf("users disable: %w", err)
+	}
+
+	user, err = a.Users.ByID(ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("users disable: %w", err)
+	}
+
+	return a.printUser(format, user)
+}
+
+func (a *Admin) usersEnable(ctx context.Context, args []string) error {
+	user, format, err := a.userArg(ctx, "users enable", args)
+	if err != nil {
+		return err
+	}
+
+	err = a.Transactor.InTx(ctx, func(ctx context.Context) error {
+		err := a.Users.Enable(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		return a.audit(ctx, models.EventUserEnabled, user)
+	})
+	if err != nil {
+		return fmt.Errorf("users enable: %w", err)
+	}
+	user.DisabledAt = nil
+
+	return a.printUser(format, user)
+}
+
+func (a *Admin) usersSetRole(ctx context.Context, args []string) error {
+	flags, format := newFlagSet("users set-role", a.Err)
+	positional, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return fmt.Errorf("users set-role: want a user id or email and a role, got %d arguments",
+			len(positional))
+	}
+
+	role, err := models.ParseRole(positional[1])
+	if err != nil {
+		return fmt.Errorf("users set-role: %w", err)
+	}
+	user, err := a.user(ctx, positional[0])
+	if err != nil {
+		return fmt.Errorf("users set-role: %w", err)
+	}
+
+	err = a.Transactor.InTx(ctx, func(ctx context.Context) error {
+		err := a.Users.SetRole(ctx, user.ID, role)
+		if err != nil {
+			return err
+		}
+		return a.audit(ctx, models.EventRoleChanged, user)
+	})
+	if err != nil {
+		return fmt.Errorf("users set-role: %w", err)
+	}
+	user.Role = role
+
+	return a.printUser(*format, user)
+}
+
+func (a *Admin) usersResetPassword(ctx context.Context, args []string) error {
+	user, format, err := a.userArg(ctx, "users reset-password", args)
+	if err != nil {
+		return err
+	}
+
+	password, err := rand.String(models.MinBytesPerToken)
+	if err != nil {
+		return fmt.Errorf("users reset-password: %w", err)
+	}
+
+	// the current password and sessions stop working at once, the user can
+	// only get back in through the emailed link
+	var reset *models.PasswordReset
+	err = a.Transactor.InTx(ctx, func(ctx context.Context) error {
+		err := a.Users.UpdatePassword(ctx, user.ID, password)
+		if err != nil {
+			return err
+		}
+		err = a.Sessions.DeleteByUserID(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		reset, err = a.PasswordResets.Create(ctx, user.Email)
+		if err != nil {
+			return err
+		}
+		err = a.audit(ctx, models.EventSessionsRevoked, user)
+		if err != nil {
+			return err
+		}
+		return a.audit(ctx, models.EventPasswordResetRequested, user)
+	})
+	if err != nil {
+		return fmt.Errorf("users reset-password: %w", err)
+	}
+
+	// emails can't be rolled back, so it is only sent once the reset is
+	// committed. If it fails, running the command again sends a new link.
+	err = a.sendReset(ctx, user.Email, reset.Token)
+	if err != nil {
+		return fmt.Errorf("users reset-password: %w", err)
+	}
+
+	return a.printUser(format, user)
+}
+
+// audit records an event the command caused for the user. Commands have no
+// IP address or request, the user agent tells their events apart.
+func (a *Admin) audit(ctx context.Context, typ models.AuditEventType, user *models.User) error {
+	return a.Audit.Record(ctx, models.AuditEvent{
+		Type:      typ,
+		UserID:    user.ID,
+		Email:     user.Email,
+		UserAgent: "lenslocked admin",
+	})
+}
+
+func (a *Admin) sendReset(ctx context.Context, email, token string) error {
+	resetURL := a.BaseURL + "/reset-pw?" + url.Values{"token": {token}}.Encode()
+	err := a.Emails.ForgotPassword(ctx, email, resetURL)
+	if err != nil {
+		return fmt.Errorf("sending password reset email: %w", err)
+	}
+
+	return nil
+}
+
+func (a *Admin) sessionsRevoke(ctx context.Context, args []string) error {
+	user, format, err := a.userArg(ctx, "sessions revoke", args)
+	if err != nil {
+		return err
+	}
+
+	err = a.Transactor.InTx(ctx, func(ctx context.Context) error {
+		err := a.Sessions.DeleteByUserID(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		return a.audit(ctx, models.EventSessionsRevoked, user)
+	})
+	if err != nil {
+		return fmt.Errorf("sessions revoke: %w", err)
+	}
+
+	return a.printUser(format, user)
+}
+
+// galleryView is how galleries are shown.
+type galleryView struct {
+	ID     int    `json:"id"`
+	Title  string `json:"title"`
+	UserID int    `json:"user_id"`
+}
+
+func (a *Admin) galleriesTransfer(ctx context.Context, args []string) error {
+	flags, format := newFlagSet("galleries transfer", a.Err)
+	to := flags.String("to", "", "id or email of the user receiving the galleries")
+	from := flags.String("from", "", "id or email of the user giving away all of their galleries")
+	positional, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if *to == "" {
+		return errors.New("galleries transfer: --to is required")
+	}
+	if (*from == "") == (len(positional) == 0) {
+		return errors.New("galleries transfer: want either --from or gallery ids")
+	}
+
+	toUser, err := a.user(ctx, *to)
+	if err != nil {
+		return fmt.Errorf("galleries transfer: %w", err)
+	}
+
+	var galleries []models.Gallery
+	if *from != "" {
+		fromUser, err := a.user(ctx, *from)
+		if err != nil {
+			return fmt.Errorf("galleries transfer: %w", err)
+		}
+		galleries, err = a.Galleries.ByUserID(ctx, fromUser.ID)
+		if err != nil {
+			return fmt.Errorf("galleries transfer: %w", err)
+		}
+	}
+	for _, arg := range positional {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("galleries transfer: invalid gallery id %q", arg)
+		}
+		gallery, err := a.Galleries.ByID(ctx, id)
+		if errors.Is(err, models.ErrNotFound) {
+			return fmt.Errorf("galleries transfer: gallery %d not found", id)
+		}
+		if err != nil {
+			return fmt.Errorf("galleries transfer: %w", err)
+		}
+		galleries = append(galleries, *gallery)
+	}
+
+	// either every gallery moves or none does
+	err = a.Transactor.InTx(ctx, func(ctx context.Context) error {
+		for _, gallery := range galleries {
+			err := a.Galleries.Transfer(ctx, gallery.ID, toUser.ID)
+			if err != nil {
+				return fmt.Errorf("gallery %d: %w", gallery.ID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("galleries transfer: %w", err)
+	}
+
+	views := make([]galleryView, 0, len(galleries))
+	rows := make([][]string, 0, len(galleries))
+	for _, gallery := range galleries {
+		views = append(views, galleryView{ID: gallery.ID, Title: gallery.Title, UserID: toUser.ID})
+		rows = append(rows, []string{strconv.Itoa(gallery.ID), gallery.Title, toUser.Email})
+	}
+
+	return output(a.Out, *format, views, []string{"ID", "TITLE", "OWNER"}, rows)
+}
+
+func (a *Admin) stats(ctx context.Context, args []string) error {
+	flags, format := newFlagSet("stats", a.Err)
+	_, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+
+	stats, err := a.Stats.Stats(ctx)
+	if err != nil {
+		return fmt.Errorf("stats: %w", err)
+	}
+
+	view := struct {
+		Users         int `json:"users"`
+		DisabledUsers int `json:"disabled_users"`
+		Sessions      int `json:"sessions"`
+		PendingResets int `json:"pending_resets"`
+		Galleries     int `json:"galleries"`
+	}(*stats)
+	rows := [][]string{
+		{"users", strconv.Itoa(stats.Users)},
+		{"disabled users", strconv.Itoa(stats.DisabledUsers)},
+		{"sessions", strconv.Itoa(stats.Sessions)},
+		{"pending password resets", strconv.Itoa(stats.PendingResets)},
+		{"galleries", strconv.Itoa(stats.Galleries)},
+	}
+
+	return output(a.Out, *format, view, []string{"STAT", "COUNT"}, rows)
+}
@@ -0,0 +1,436 @@
+package cli_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/cli"
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/models/memory"
+)
+
+type testAdmin struct {
+	*cli.Admin
+	store     *memory.Store
+	users     *memory.UserService
+	sessions  *memory.SessionService
+	galleries *memory.GalleryService
+	emails    *memory.EmailService
+	audit     *memory.AuditService
+	out       *bytes.Buffer
+}
+
+func newTestAdmin(t *testing.T) *testAdmin {
+	t.Helper()
+
+	store := memory.NewStore()
+	ta := &testAdmin{
+		store:     store,
+		users:     &memory.UserService{Store: store},
+		sessions:  &memory.SessionService{Store: store},
+		galleries: &memory.GalleryService{Store: store},
+		emails:    &memory.EmailService{},
+		audit:     &memory.AuditService{Store: store},
+		out:       &bytes.Buffer{},
+	}
+	ta.Admin = &cli.Admin{
+		Users:          ta.users,
+		Sessions:       ta.sessions,
+		PasswordResets: &memory.PasswordResetService{Store: store},
+		Emails:         ta.emails,
+		Galleries:      ta.galleries,
+		Stats:          &memory.StatsService{Store: store},
+		Audit:          ta.audit,
+		Transactor:     &memory.Transactor{Store: store},
+		BaseURL:        "http://lenslocked.test",
+		Out:            ta.out,
+		Err:            &bytes.Buffer{},
+	}
+
+	return ta
+}
+
+// run runs the command and returns its output.
+func (ta *testAdmin) run(t *testing.T, args ...string) string {
+	t.Helper()
+
+	ta.out.Reset()
+	err := ta.Run(context.Background(), args)
+	if err != nil {
+		t.Fatalf("%s: %v", strings.Join(args, " "), err)
+	}
+
+	return ta.out.String()
+}
+
+func (ta *testAdmin) createUser(t *testing.T, email string) *models.User {
+	t.Helper()
+
+	user, err := ta.users.Create(context.Background(), email, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+func TestUsersList(t *testing.T) {
+	ta := newTestAdmin(t)
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		ta.createUser(t, email)
+	}
+
+	out := ta.run(t, "users", "list")
+	for _, want := range []string{"ID", "EMAIL", "a@example.com", "b@example.com", "c@example.com", "active"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+
+	out = ta.run(t, "users", "list", "--limit", "1", "--offset", "1", "--format", "json")
+	var users []struct {
+		ID    int    `json:"id"`
+		Email string `json:"email"`
+	}
+	err := json.Unmarshal([]byte(out), &users)
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+	if len(users) != 1 || users[0].Email != "b@example.com" {
+		t.Errorf("got %+v, want only b@example.com", users)
+	}
+	if strings.Contains(out, "password") {
+		t.Errorf("output contains the password hash:\n%s", out)
+	}
+}
+
+func TestUsersFind(t *testing.T) {
+	ta := newTestAdmin(t)
+	bob := ta.createUser(t, "bob@example.com")
+	_, err := ta.galleries.Create(context.Background(), "Holidays", bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"by email", []string{"users", "find", "BOB@example.com", "--format", "json"}},
+		{"by id", []string{"users", "find", "--format", "json", "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got struct {
+				ID        int    `json:"id"`
+				Email     string `json:"email"`
+				Galleries int    `json:"galleries"`
+			}
+			err := json.Unmarshal([]byte(ta.run(t, tt.args...)), &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != bob.ID || got.Email != bob.Email || got.Galleries != 1 {
+				t.Errorf("got %+v", got)
+			}
+		})
+	}
+
+	err = ta.Run(context.Background(), []string{"users", "find", "alice@example.com"})
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("unknown user: got error %v", err)
+	}
+}
+
+func TestUsersCreate(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("with password", func(t *testing.T) {
+		ta := newTestAdmin(t)
+		ta.run(t, "users", "create", "--password", "secret", "bob@example.com")
+
+		_, err := ta.users.Authenticate(ctx, "bob@example.com", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(ta.emails.Outbox()); n != 0 {
+			t.Errorf("sent %d emails, want none", n)
+		}
+	})
+
+	t.Run("invite", func(t *testing.T) {
+		ta := newTestAdmin(t)
+		ta.run(t, "users", "create", "bob@example.com")
+
+		outbox := ta.emails.Outbox()
+		if len(outbox) != 1 || outbox[0].To != "bob@example.com" {
+			t.Fatalf("got outbox %+v, want a reset email to bob", outbox)
+		}
+		if !strings.Contains(outbox[0].Plaintext, "http://lenslocked.test/reset-pw?token=") {
+			t.Errorf("no reset link in %q", outbox[0].Plaintext)
+		}
+	})
+
+	t.Run("email taken", func(t *testing.T) {
+		ta := newTestAdmin(t)
+		ta.createUser(t, "bob@example.com")
+
+		err := ta.Run(ctx, []string{"users", "create", "bob@example.com"})
+		if err == nil {
+			t.Fatal("got no error")
+		}
+		if n := len(ta.emails.Outbox()); n != 0 {
+			t.Errorf("sent %d emails, want none", n)
+		}
+	})
+}
+
+func TestUsersDisableEnable(t *testing.T) {
+	ctx := context.Background()
+	ta := newTestAdmin(t)
+	bob := ta.createUser(t, "bob@example.com")
+	session, err := ta.sessions.Create(ctx, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := ta.run(t, "users", "disable", "bob@example.com")
+	if !strings.Contains(out, "disabled since") {
+		t.Errorf("output does not show the user as disabled:\n%s", out)
+	}
+	_, err = ta.users.Authenticate(ctx, "bob@example.com", "secret")
+	if err != models.ErrDisabled {
+		t.Errorf("authenticate: got error %v, want %v", err, models.ErrDisabled)
+	}
+
+	ta.run(t, "users", "enable", "bob@example.com")
+	_, err = ta.users.Authenticate(ctx, "bob@example.com", "secret")
+	if err != nil {
+		t.Errorf("authenticate: %v", err)
+	}
+	// the sessions were deleted, enabling doesn't bring them back
+	_, err = ta.sessions.User(ctx, session.Token)
+	if err == nil {
+		t.Error("session survived disabling the user")
+	}
+
+	events, err := ta.audit.List(ctx, models.AuditFilter{UserID: bob.ID}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the latest first
+	if len(events) != 2 || events[0].Type != models.EventUserEnabled ||
+		events[1].Type != models.EventSessionsRevoked {
+		t.Errorf("got audit events %+v, want the enabling and the revocation", events)
+	}
+}
+
+func TestUsersSetRole(t *testing.T) {
+	ctx := context.Background()
+	ta := newTestAdmin(t)
+	ta.createUser(t, "bob@example.com")
+
+	out := ta.run(t, "users", "set-role", "bob@example.com", "moderator")
+	if !strings.Contains(out, "moderator") {
+		t.Errorf("output does not show the new role:\n%s", out)
+	}
+	bob, err := ta.users.ByEmail(ctx, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.Role != models.RoleModerator {
+		t.Errorf("got role %q, want %q", bob.Role, models.RoleModerator)
+	}
+	events, err := ta.audit.List(ctx, models.AuditFilter{UserID: bob.ID}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != models.EventRoleChanged {
+		t.Errorf("got audit events %+v, want the role change", events)
+	}
+
+	err = ta.Run(ctx, []string{"users", "set-role", "bob@example.com", "owner"})
+	if err == nil || !strings.Contains(err.Error(), `unknown role "owner"`) {
+		t.Errorf("got error %v, want one about the unknown role", err)
+	}
+}
+
+func TestUsersResetPassword(t *testing.T) {
+	ctx := context.Background()
+	ta := newTestAdmin(t)
+	bob := ta.createUser(t, "bob@example.com")
+	session, err := ta.sessions.Create(ctx, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ta.run(t, "users", "reset-password", "1")
+
+	_, err = ta.users.Authenticate(ctx, "bob@example.com", "secret")
+	if err == nil {
+		t.Error("old password still works")
+	}
+	_, err = ta.sessions.User(ctx, session.Token)
+	if err == nil {
+		t.Error("session survived the reset")
+	}
+	if n := len(ta.emails.Outbox()); n != 1 {
+		t.Errorf("sent %d emails, want 1", n)
+	}
+}
+
+func TestSessionsRevoke(t *testing.T) {
+	ctx := context.Background()
+	ta := newTestAdmin(t)
+	bob := ta.createUser(t, "bob@example.com")
+	session, err := ta.sessions.Create(ctx, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ta.run(t, "sessions", "revoke", "bob@example.com")
+
+	_, err = ta.sessions.User(ctx, session.Token)
+	if err == nil {
+		t.Error("session survived")
+	}
+	_, err = ta.users.Authenticate(ctx, "bob@example.com", "secret")
+	if err != nil {
+		t.Errorf("authenticate: %v", err)
+	}
+
+	events, err := ta.audit.List(ctx, models.AuditFilter{UserID: bob.ID}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != models.EventSessionsRevoked ||
+		events[0].UserAgent != "lenslocked admin" {
+		t.Errorf("got audit events %+v, want the revocation", events)
+	}
+}
+
+func TestGalleriesTransfer(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T) (*testAdmin, *models.User, []int) {
+		ta := newTestAdmin(t)
+		bob := ta.createUser(t, "bob@example.com")
+		ta.createUser(t, "alice@example.com")
+		var ids []int
+		for _, title := range []string{"Holidays", "Wedding", "Pets"} {
+			gallery, err := ta.galleries.Create(ctx, title, bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, gallery.ID)
+		}
+		return ta, bob, ids
+	}
+	owners := func(t *testing.T, ta *testAdmin, ids []int) []int {
+		var owners []int
+		for _, id := range ids {
+			gallery, err := ta.galleries.ByID(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			owners = append(owners, gallery.UserID)
+		}
+		return owners
+	}
+
+	t.Run("by id", func(t *testing.T) {
+		ta, _, ids := setup(t)
+		out := ta.run(t, "galleries", "transfer", "--to", "alice@example.com", "1", "3")
+		if !strings.Contains(out, "Holidays") || !strings.Contains(out, "Pets") {
+			t.Errorf("output does not list the galleries:\n%s", out)
+		}
+		if got := owners(t, ta, ids); got[0] != 2 || got[1] != 1 || got[2] != 2 {
+			t.Errorf("got owners %v, want [2 1 2]", got)
+		}
+	})
+
+	t.Run("all from a user", func(t *testing.T) {
+		ta, _, ids := setup(t)
+		ta.run(t, "galleries", "transfer", "--from", "bob@example.com", "--to", "2")
+		if got := owners(t, ta, ids); got[0] != 2 || got[1] != 2 || got[2] != 2 {
+			t.Errorf("got owners %v, want [2 2 2]", got)
+		}
+	})
+
+	t.Run("unknown gallery moves nothing", func(t *testing.T) {
+		ta, bob, ids := setup(t)
+		err := ta.Run(ctx, []string{"galleries", "transfer", "--to", "2", "1", "99"})
+		if err == nil {
+			t.Fatal("got no error")
+		}
+		for _, owner := range owners(t, ta, ids) {
+			if owner != bob.ID {
+				t.Fatalf("gallery moved to %d", owner)
+			}
+		}
+	})
+
+	t.Run("needs galleries", func(t *testing.T) {
+		ta, _, _ := setup(t)
+		err := ta.Run(ctx, []string{"galleries", "transfer", "--to", "2"})
+		if err == nil {
+			t.Fatal("got no error")
+		}
+	})
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	ta := newTestAdmin(t)
+	bob := ta.createUser(t, "bob@example.com")
+	alice := ta.createUser(t, "alice@example.com")
+	_, err := ta.galleries.Create(ctx, "Holidays", bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ta.sessions.Create(ctx, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ta.users.Disable(ctx, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]int
+	err = json.Unmarshal([]byte(ta.run(t, "stats", "--format", "json")), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{
+		"users":          2,
+		"disabled_users": 1,
+		"sessions":       1,
+		"pending_resets": 0,
+		"galleries":      1,
+	}
+	for key, n := range want {
+		if got[key] != n {
+			t.Errorf("%s: got %d, want %d", key, got[key], n)
+		}
+	}
+
+	out := ta.run(t, "stats")
+	if !strings.Contains(out, "disabled users") {
+		t.Errorf("table output:\n%s", out)
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	ta := newTestAdmin(t)
+
+	for _, args := range [][]string{nil, {"users"}, {"users", "nuke"}, {"stats", "--format", "xml"}} {
+		err := ta.Run(context.Background(), args)
+		if err == nil {
+			t.Errorf("%v: got no error", args)
+		}
+	}
+}
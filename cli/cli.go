@@ -0,0 +1,111 @@
+// Package cli implements the subcommands of the lenslocked binary besides the
+// server itself. Commands work with the same models as the web app, through
+// the interfaces below, so they can be tested with the models/memory services.
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+type UserService interface {
+	Create(ctx context.Context, email, password string) (*models.User, error)
+	UpdatePassword(ctx context.Context, userID int, password string) error
+	ByID(ctx context.Context, id int) (*models.User, error)
+	ByEmail(ctx context.Context, email string) (*models.User, error)
+	List(ctx context.Context, limit, offset int) ([]models.User, error)
+	Disable(ctx context.Context, id int) error
+	Enable(ctx context.Context, id int) error
+	SetRole(ctx context.Context, id int, role models.Role) error
+}
+
+type AuditService interface {
+	Record(ctx context.Context, event models.AuditEvent) error
+}
+
+type SessionService interface {
+	DeleteByUserID(ctx context.Context, userID int) error
+}
+
+type PasswordResetService interface {
+	Create(ctx context.Context, email string) (*models.PasswordReset, error)
+}
+
+type EmailService interface {
+	ForgotPassword(ctx context.Context, to, resetURL string) error
+}
+
+type GalleryService interface {
+	Create(ctx context.Context, title string, userID int) (*models.Gallery, error)
+	ByID(ctx context.Context, id int) (*models.Gallery, error)
+	ByUserID(ctx context.Context, userID int) ([]models.Gallery, error)
+	Transfer(ctx context.Context, id, toUserID int) error
+}
+
+type StatsService interface {
+	Stats(ctx context.Context) (*models.Stats, error)
+}
+
+type Transactor interface {
+	InTx(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+)
+
+// newFlagSet returns the flag set of a command, with the --format flag every
+// command has. Errors are returned rather than exiting, usage goes to w.
+func newFlagSet(name string, w io.Writer) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(w)
+	format := flags.String("format", FormatTable, "output format, table or json")
+	return flags, format
+}
+
+// parse parses the flags wherever they are among args, so both
+// `users find --format json bob@example.com` and
+// `users find bob@example.com --format json` work. It returns the positional
+// arguments.
+func parse(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// output writes v as JSON, or the header and rows as an aligned table.
+func output(w io.Writer, format string, v any, header []string, rows [][]string) error {
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case FormatTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+		for _, row := range rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown format %q, want %s or %s", format, FormatTable, FormatJSON)
+	}
+}
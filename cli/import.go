@@ -0,0 +1,208 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rafaelmdurante/lenslocked/importer"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// ImportUsage describes the import command.
+const ImportUsage = `Usage: lenslocked import [config flags] --user <id|email> --gallery <id|title> <dir|zip>
+
+Adds the images of a directory, and its subdirectories, or of a ZIP archive to
+a gallery of the user. A gallery given by title is created unless the user
+already has one with that title. Images replace those with the same filename.
+Hidden files are skipped, anything but a JPEG, PNG, GIF or WebP image is
+reported and left out.
+
+Flags:
+  --user <id|email>       owner of the gallery
+  --gallery <id|title>    gallery the images go to
+  --format table|json     output format
+`
+
+// Import runs the import command, the local counterpart of the import of the
+// gallery edit page.
+type Import struct {
+	Users     UserService
+	Galleries GalleryService
+	Images    importer.ImageService
+
+	// User, Gallery and Format are the flags, see Flags
+	User    string
+	Gallery string
+	Format  string
+
+	// Out receives the command output, Err the progress, usage and flag
+	// errors
+	Out io.Writer
+	Err io.Writer
+}
+
+// Flags defines the flags of the command on flags. It lets them go along
+// with the config flags, before the path, and Run parses those after it.
+func (im *Import) Flags(flags *flag.FlagSet) {
+	if im.Format == "" {
+		im.Format = FormatTable
+	}
+	flags.StringVar(&im.User, "user", im.User, "id or email of the owner of the gallery")
+	flags.StringVar(&im.Gallery, "gallery", im.Gallery, "id or title of the gallery, created when no gallery has the title")
+	flags.StringVar(&im.Format, "format", im.Format, "output format, table or json")
+}
+
+// importView is how the files of the import are shown.
+type importView struct {
+	File  string `json:"file"`
+	Image string `json:"image,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Run imports the directory or archive in args, e.g.
+// ["--user", "bob@example.com", "--gallery", "Holiday", "photos/"].
+func (im *Import) Run(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(im.Err)
+	flags.Usage = func() { fmt.Fprint(flags.Output(), ImportUsage) }
+	im.Flags(flags)
+	paths, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(paths) != 1 {
+		fmt.Fprint(im.Err, ImportUsage)
+		return fmt.Errorf("import: want a single directory or ZIP archive, got %d arguments", len(paths))
+	}
+	if im.User == "" || im.Gallery == "" {
+		fmt.Fprint(im.Err, ImportUsage)
+		return errors.New("import: --user and --gallery are required")
+	}
+
+	user, err := findUser(ctx, im.Users, im.User)
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	gallery, err := im.gallery(ctx, user)
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+
+	// the files are the operator's own, only single images stay bounded
+	imp := importer.Importer{
+		Images: im.Images,
+		Limits: importer.Limits{MaxFiles: math.MaxInt, MaxTotalSize: math.MaxInt64},
+		Progress: func(done, total int, file importer.File) {
+			fmt.Fprintf(im.Err, "[%d/%d] %s: %s\n", done, total, file.Name, importResult(file))
+		},
+	}
+	var report *importer.Report
+	path := paths[0]
+	if strings.EqualFold(filepath.Ext(path), ".zip") {
+		report, err = importZip(ctx, &imp, gallery.ID, path)
+	} else {
+		report, err = imp.Dir(ctx, gallery.ID, path)
+	}
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+
+	views := make([]importView, 0, len(report.Files))
+	rows := make([][]string, 0, len(report.Files))
+	for _, f := range report.Files {
+		view := importView{File: f.Name}
+		if f.Err != nil {
+			view.Error = importResult(f)
+		} else {
+			view.Image = f.Image.Filename
+		}
+		views = append(views, view)
+		rows = append(rows, []string{f.Name, importResult(f)})
+	}
+	err = output(im.Out, im.Format, views, []string{"FILE", "RESULT"}, rows)
+	if err != nil {
+		return err
+	}
+
+	if failed := len(report.Failed()); failed > 0 {
+		return fmt.Errorf("import: %d of %d files could not be imported into gallery %d",
+			failed, len(report.Files), gallery.ID)
+	}
+	fmt.Fprintf(im.Err, "imported %d files into gallery %d, %q\n", len(report.Files), gallery.ID, gallery.Title)
+
+	return nil
+}
+
+// gallery finds the gallery of the --gallery flag, which has to be the
+// user's, or creates it when it is a title no gallery has.
+func (im *Import) gallery(ctx context.Context, user *models.User) (*models.Gallery, error) {
+	id, err := strconv.Atoi(im.Gallery)
+	if err == nil {
+		gallery, err := im.Galleries.ByID(ctx, id)
+		if errors.Is(err, models.ErrNotFound) {
+			return nil, fmt.Errorf("gallery %d not found", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if gallery.UserID != user.ID {
+			return nil, fmt.Errorf("gallery %d is not %s's", id, user.Email)
+		}
+		return gallery, nil
+	}
+
+	galleries, err := im.Galleries.ByUserID(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, gallery := range galleries {
+		if gallery.Title == im.Gallery {
+			return &gallery, nil
+		}
+	}
+
+	return im.Galleries.Create(ctx, im.Gallery, user.ID)
+}
+
+func importZip(ctx context.Context, imp *importer.Importer, galleryID int, path string) (*importer.Report, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return imp.Zip(ctx, galleryID, f, info.Size())
+}
+
+// importResult says what became of a file.
+func importResult(f importer.File) string {
+	switch {
+	case f.Err == nil:
+		return "imported"
+	case errors.Is(f.Err, models.ErrNotImage):
+		return "not a JPEG, PNG, GIF or WebP image"
+	case errors.Is(f.Err, importer.ErrFileTooLarge):
+		return fmt.Sprintf("larger than %d MB", importer.DefaultLimits.MaxFileSize>>20)
+	case errors.Is(f.Err, importer.ErrNotRegular):
+		return "not a regular file"
+	case errors.Is(f.Err, importer.ErrUnsafePath):
+		return "the path points outside of the archive"
+	case errors.Is(f.Err, importer.ErrDuplicate):
+		return "another file has the same name"
+	default:
+		return f.Err.Error()
+	}
+}
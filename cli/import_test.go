@@ -0,0 +1,215 @@
+package cli_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/cli"
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/models/memory"
+)
+
+type testImport struct {
+	*cli.Import
+	galleries *memory.GalleryService
+	images    *memory.ImageService
+	out       *bytes.Buffer
+	errOut    *bytes.Buffer
+	userID    int
+}
+
+func newTestImport(t *testing.T) *testImport {
+	t.Helper()
+
+	store := memory.NewStore()
+	users := &memory.UserService{Store: store}
+	user, err := users.Create(context.Background(), "bob@example.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti := &testImport{
+		galleries: &memory.GalleryService{Store: store},
+		images:    &memory.ImageService{Store: store, Files: models.ImageFiles{Dir: t.TempDir()}},
+		out:       &bytes.Buffer{},
+		errOut:    &bytes.Buffer{},
+		userID:    user.ID,
+	}
+	ti.Import = &cli.Import{
+		Users:     users,
+		Galleries: ti.galleries,
+		Images:    ti.images,
+		Out:       ti.out,
+		Err:       ti.errOut,
+	}
+
+	return ti
+}
+
+// writeFiles writes the files under dir, by slash separated name.
+func writeFiles(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, contents, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func pngImage(t *testing.T) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 2, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestImportDir(t *testing.T) {
+	ti := newTestImport(t)
+	dir := t.TempDir()
+	img := pngImage(t)
+	writeFiles(t, dir, map[string][]byte{
+		"cat.png":       img,
+		"day2/dog.png":  img,
+		"day2/notes.md": []byte("# notes"),
+	})
+
+	// the flags go before the path, with the config ones, or after it
+	ti.User = "bob@example.com"
+	err := ti.Run(context.Background(), []string{dir, "--gallery", "Holiday", "--format", "json"})
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 files could not be imported") {
+		t.Errorf("got %v, want the failed file reported", err)
+	}
+	var views []struct {
+		File  string
+		Image string
+		Error string
+	}
+	err = json.Unmarshal(ti.out.Bytes(), &views)
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, ti.out)
+	}
+	if len(views) != 3 || views[0].Image != "cat.png" || views[2].File != "day2/notes.md" ||
+		views[2].Error != "not a JPEG, PNG, GIF or WebP image" {
+		t.Errorf("got %+v", views)
+	}
+	if !strings.Contains(ti.errOut.String(), "[2/3] day2/dog.png: imported") {
+		t.Errorf("got progress:\n%s", ti.errOut)
+	}
+
+	galleries, err := ti.galleries.ByUserID(context.Background(), ti.userID)
+	if err != nil || len(galleries) != 1 || galleries[0].Title != "Holiday" {
+		t.Fatalf("got galleries %+v, %v, want Holiday created", galleries, err)
+	}
+	images, err := ti.images.ByGalleryID(context.Background(), galleries[0].ID)
+	if err != nil || len(images) != 2 {
+		t.Errorf("got images %+v, %v", images, err)
+	}
+
+	// the gallery is found again by title
+	writeFiles(t, dir, map[string][]byte{"day2/notes.md": img})
+	err = ti.Run(context.Background(), []string{"--format", "table", dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	galleries, _ = ti.galleries.ByUserID(context.Background(), ti.userID)
+	if len(galleries) != 1 {
+		t.Errorf("got %d galleries, want Holiday reused", len(galleries))
+	}
+}
+
+func TestImportZip(t *testing.T) {
+	ti := newTestImport(t)
+	gallery, err := ti.galleries.Create(context.Background(), "Cats", ti.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, name := range []string{"cat.png", "../evil.png"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write(pngImage(t))
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cats.ZIP")
+	err = os.WriteFile(path, b.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ti.Run(context.Background(), []string{"--user", "bob@example.com", "--gallery", "1", path})
+	if err == nil {
+		t.Fatal("got no error, want the unsafe path reported")
+	}
+	if !strings.Contains(ti.out.String(), "the path points outside of the archive") {
+		t.Errorf("got output:\n%s", ti.out)
+	}
+	images, err := ti.images.ByGalleryID(context.Background(), gallery.ID)
+	if err != nil || len(images) != 1 || images[0].Filename != "cat.png" {
+		t.Errorf("got images %+v, %v", images, err)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	ti := newTestImport(t)
+	carol, err := ti.Users.Create(context.Background(), "carol@example.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	birds, err := ti.galleries.Create(context.Background(), "Birds", carol.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"No path", []string{"--user", "bob@example.com", "--gallery", "Cats"}, "want a single directory"},
+		{"No user", []string{"--gallery", "Cats", dir}, "--user and --gallery are required"},
+		{"Unknown user", []string{"--user", "dan@example.com", "--gallery", "Cats", dir}, "user dan@example.com not found"},
+		{"Unknown gallery", []string{"--user", "bob@example.com", "--gallery", "99", dir}, "gallery 99 not found"},
+		{"Someone else's gallery", []string{"--user", "bob@example.com", "--gallery", strconv.Itoa(birds.ID), dir},
+			"is not bob@example.com's"},
+		{"Missing directory", []string{"--user", "bob@example.com", "--gallery", "Cats", filepath.Join(dir, "missing")},
+			"no such file or directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the flags are fields, each run starts from none
+			im := &cli.Import{Users: ti.Users, Galleries: ti.galleries, Images: ti.images,
+				Out: &bytes.Buffer{}, Err: &bytes.Buffer{}}
+			err := im.Run(context.Background(), tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"time"
+
+	"github.com/pressly/goose/v3"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// MigrateUsage lists the migrate commands.
+const MigrateUsage = `Usage: lenslocked migrate [config flags] <command> [args]
+
+Commands:
+  up                    apply every pending migration
+  down                  roll back the last migration
+  status [--format F]   list migrations and whether they are applied
+  redo                  roll back the last migration and apply it again
+  to <version>          migrate up or down to version, 0 rolls back everything
+  create [--dir D] <name>
+                        write a new sql migration to D, numbered after the
+                        last one
+`
+
+// Migrate runs the migrate commands against DB with the migrations embedded
+// in FS.
+type Migrate struct {
+	DB *sql.DB
+	FS fs.FS
+	// Dir is where create writes new migrations, the source directory of FS
+	Dir string
+
+	// Out receives the command output, Err the usage and flag errors
+	Out io.Writer
+	Err io.Writer
+}
+
+// Run runs the command in args, e.g. ["to", "3"].
+func (m *Migrate) Run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(m.Err, MigrateUsage)
+		return errors.New("no command given")
+	}
+
+	commands := map[string]func(ctx context.Context, provider *goose.Provider, args []string) error{
+		"up":     m.up,
+		"down":   m.down,
+		"status": m.status,
+		"redo":   m.redo,
+		"to":     m.to,
+	}
+
+	// create only writes a file, it must work without a database
+	if args[0] == "create" {
+		return m.create(args[1:])
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprint(m.Err, MigrateUsage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	provider, err := models.NewMigrationProvider(m.DB, m.FS)
+	if err != nil {
+		return err
+	}
+
+	return command(ctx, provider, args[1:])
+}
+
+// noArgs fails when a command that takes no arguments gets some.
+func noArgs(command string, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("%s: unexpected arguments %q", command, args)
+	}
+	return nil
+}
+
+func (m *Migrate) print(results ...*goose.MigrationResult) {
+	for _, result := range results {
+		fmt.Fprintln(m.Out, result)
+	}
+}
+
+func (m *Migrate) up(ctx context.Context, provider *goose.Provider, args []string) error {
+	if err := noArgs("up", args); err != nil {
+		return err
+	}
+
+	results, err := provider.Up(ctx)
+	m.print(results...)
+	if err != nil {
+		return fmt.Errorf("up: %w", err)
+	}
+	if len(results) == 0 {
+		fmt.Fprintln(m.Out, "no migrations to run")
+	}
+
+	return nil
+}
+
+func (m *Migrate) down(ctx context.Context, provider *goose.Provider, args []string) error {
+	if err := noArgs("down", args); err != nil {
+		return err
+	}
+
+	result, err := provider.Down(ctx)
+	if errors.Is(err, goose.ErrNoNextVersion) {
+		return errors.New("down: no migrations to roll back")
+	}
+	if err != nil {
+		return fmt.Errorf("down: %w", err)
+	}
+	m.print(result)
+
+	return nil
+}
+
+func (m *Migrate) redo(ctx context.Context, provider *goose.Provider, args []string) error {
+	if err := noArgs("redo", args); err != nil {
+		return err
+	}
+
+	down, err := provider.Down(ctx)
+	if errors.Is(err, goose.ErrNoNextVersion) {
+		return errors.New("redo: no migrations to redo")
+	}
+	if err != nil {
+		return fmt.Errorf("redo: %w", err)
+	}
+	m.print(down)
+
+	up, err := provider.ApplyVersion(ctx, down.Source.Version, true)
+	if err != nil {
+		return fmt.Errorf("redo: %w", err)
+	}
+	m.print(up)
+
+	return nil
+}
+
+func (m *Migrate) to(ctx context.Context, provider *goose.Provider, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("to: want a single version, got %d arguments", len(args))
+	}
+	version, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || version < 0 {
+		return fmt.Errorf("to: invalid version %q", args[0])
+	}
+
+	current, err := provider.GetDBVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("to: %w", err)
+	}
+
+	var results []*goose.MigrationResult
+	switch {
+	case version > current:
+		results, err = provider.UpTo(ctx, version)
+	case version < current:
+		results, err = provider.DownTo(ctx, version)
+	}
+	m.print(results...)
+	if err != nil {
+		return fmt.Errorf("to: %w", err)
+	}
+	if len(results) == 0 {
+		fmt.Fprintf(m.Out, "already at version %d\n", current)
+	}
+
+	return nil
+}
+
+// migrationView is how migrations are shown by status.
+type migrationView struct {
+	Version   int64      `json:"version"`
+	Name      string     `json:"name"`
+	State     string     `json:"state"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+func (m *Migrate) status(ctx context.Context, provider *goose.Provider, args []string) error {
+	flags, format := newFlagSet("status", m.Err)
+	positional, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if err := noArgs("status", positional); err != nil {
+		return err
+	}
+
+	statuses, err := provider.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("status: %w", err)
+	}
+
+	views := make([]migrationView, 0, len(statuses))
+	rows := make([][]string, 0, len(statuses))
+	for _, status := range statuses {
+		view := migrationView{
+			Version: status.Source.Version,
+			Name:    status.Source.Path,
+			State:   string(status.State),
+		}
+		appliedAt := "-"
+		if status.State == goose.StateApplied {
+			view.AppliedAt = &status.AppliedAt
+			appliedAt = status.AppliedAt.Format(time.DateTime)
+		}
+		views = append(views, view)
+		rows = append(rows, []string{
+			strconv.FormatInt(view.Version, 10), view.Name, view.State, appliedAt,
+		})
+	}
+
+	return output(m.Out, *format, views, []string{"VERSION", "NAME", "STATE", "APPLIED AT"}, rows)
+}
+
+func (m *Migrate) create(args []string) error {
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	flags.SetOutput(m.Err)
+	dir := flags.String("dir", m.Dir, "directory of the migration files")
+	positional, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("create: want a single name, got %d arguments", len(positional))
+	}
+
+	// the existing migrations are numbered, not timestamped
+	goose.SetSequential(true)
+	err = goose.Create(nil, *dir, positional[0], "sql")
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package cli_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/cli"
+	"github.com/rafaelmdurante/lenslocked/migrations"
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/models/pgtest"
+)
+
+func TestMigrateCreate(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+	}{
+		{name: "first migration"},
+		{name: "after the existing ones", existing: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			next := 1
+			if tt.existing {
+				next += copyMigrations(t, dir)
+			}
+			want := []string{
+				fmt.Sprintf("%05d_add_images.sql", next),
+				fmt.Sprintf("%05d_add_captions.sql", next+1),
+			}
+			m := cli.Migrate{Dir: dir, Out: &bytes.Buffer{}, Err: &bytes.Buffer{}}
+
+			for _, name := range []string{"add_images", "add captions"} {
+				err := m.Run(context.Background(), []string{"create", name})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, name := range want {
+				_, err := os.Stat(filepath.Join(dir, name))
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateUnknownCommand(t *testing.T) {
+	m := cli.Migrate{Out: &bytes.Buffer{}, Err: &bytes.Buffer{}}
+
+	for _, args := range [][]string{nil, {"sideways"}, {"create"}} {
+		err := m.Run(context.Background(), args)
+		if err == nil {
+			t.Errorf("%v: got no error", args)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dsn := os.Getenv(pgtest.EnvDSN)
+	if dsn == "" {
+		t.Skipf("%s is not set", pgtest.EnvDSN)
+	}
+
+	// the commands change the schema, so they get a database of their own
+	ctx := context.Background()
+	db, err := pgtest.New(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, latest, err := models.MigrationVersions(ctx, db.DB, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	m := cli.Migrate{DB: db.DB, FS: migrations.FS, Out: out, Err: &bytes.Buffer{}}
+	run := func(args ...string) string {
+		t.Helper()
+		out.Reset()
+		err := m.Run(ctx, args)
+		if err != nil {
+			t.Fatalf("%s: %v", strings.Join(args, " "), err)
+		}
+		return out.String()
+	}
+	version := func() int64 {
+		t.Helper()
+		current, _, err := models.MigrationVersions(ctx, db.DB, migrations.FS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return current
+	}
+
+	steps := []struct {
+		args        []string
+		wantVersion int64
+		wantOutput  string
+	}{
+		{[]string{"up"}, latest, "no migrations to run"},
+		{[]string{"down"}, latest - 1, "down"},
+		{[]string{"redo"}, latest - 1, "up"},
+		{[]string{"to", "1"}, 1, "00002_sessions.sql"},
+		{[]string{"to", "1"}, 1, "already at version 1"},
+		{[]string{"to", "0"}, 0, "00001_users.sql"},
+		{[]string{"up"}, latest, "00001_users.sql"},
+	}
+	for _, step := range steps {
+		got := run(step.args...)
+		if !strings.Contains(got, step.wantOutput) {
+			t.Errorf("%v: output does not contain %q:\n%s", step.args, step.wantOutput, got)
+		}
+		if v := version(); v != step.wantVersion {
+			t.Fatalf("%v: got version %d, want %d", step.args, v, step.wantVersion)
+		}
+	}
+
+	var statuses []struct {
+		Version int64  `json:"version"`
+		State   string `json:"state"`
+	}
+	err = json.Unmarshal([]byte(run("status", "--format", "json")), &statuses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(statuses)) != latest {
+		t.Fatalf("got %d migrations, want %d", len(statuses), latest)
+	}
+	for _, status := range statuses {
+		if status.State != "applied" {
+			t.Errorf("migration %d is %s", status.Version, status.State)
+		}
+	}
+}
+
+// copyMigrations copies the embedded migrations into dir and returns how many
+// there are.
+func copyMigrations(t *testing.T, dir string) int {
+	t.Helper()
+
+	names, err := fs.Glob(migrations.FS, "*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		b, err := fs.ReadFile(migrations.FS, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, name), b, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return len(names)
+}
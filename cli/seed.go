@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/rafaelmdurante/lenslocked/seed"
+)
+
+// SeedUsage lists the seed commands.
+const SeedUsage = `Usage: lenslocked seed [config flags] <command> [args]
+
+Seeding is idempotent, running a command again only adds what is missing.
+
+Commands:
+  load <fixture>...         create the users, galleries and images of YAML or
+                            JSON fixture files, see fixtures/dev.yaml
+  generate [--users N] [--galleries N] [--images N] [--password P]
+                            create N users, user1@example.com and so on, with
+                            galleries of plain coloured images, for load
+                            testing
+
+Both take --concurrency N, the users seeded at once, and --format F.
+`
+
+// Seed runs the seed commands.
+type Seed struct {
+	Seeder *seed.Seeder
+
+	// Out receives the command output, Err the progress, usage and flag
+	// errors
+	Out io.Writer
+	Err io.Writer
+}
+
+// Run runs the command in args, e.g. ["load", "fixtures/dev.yaml"].
+func (s *Seed) Run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(s.Err, SeedUsage)
+		return errors.New("no command given")
+	}
+
+	switch args[0] {
+	case "load":
+		return s.load(ctx, args[1:])
+	case "generate":
+		return s.generate(ctx, args[1:])
+	default:
+		fmt.Fprint(s.Err, SeedUsage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func (s *Seed) load(ctx context.Context, args []string) error {
+	flags, format := newFlagSet("load", s.Err)
+	concurrency := concurrencyFlag(flags)
+	paths, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return errors.New("load: no fixture given")
+	}
+
+	// every file is checked before anything is written
+	var fixture seed.Fixture
+	for _, path := range paths {
+		f, err := seed.Load(path)
+		if err != nil {
+			return err
+		}
+		fixture.Users = append(fixture.Users, f.Users...)
+	}
+
+	return s.seed(ctx, &fixture, *concurrency, *format)
+}
+
+func (s *Seed) generate(ctx context.Context, args []string) error {
+	flags, format := newFlagSet("generate", s.Err)
+	concurrency := concurrencyFlag(flags)
+	users := flags.Int("users", 10, "number of users")
+	galleries := flags.Int("galleries", 2, "galleries of each user")
+	images := flags.Int("images", 3, "images in each gallery")
+	password := flags.String("password", "password", "password of every user")
+	_, err := parse(flags, args)
+	if err != nil {
+		return err
+	}
+	if *users < 0 || *galleries < 0 || *images < 0 {
+		return errors.New("generate: counts can't be negative")
+	}
+
+	fixture := seed.Generate(*users, *galleries, *images, *password)
+
+	return s.seed(ctx, fixture, *concurrency, *format)
+}
+
+func concurrencyFlag(flags *flag.FlagSet) *int {
+	return flags.Int("concurrency", 0, "users seeded at once, defaults to the number of CPUs")
+}
+
+func (s *Seed) seed(ctx context.Context, fixture *seed.Fixture, concurrency int, format string) error {
+	// progress is reported about every 5%, a line per user would flood the
+	// terminal when generating thousands
+	total := len(fixture.Users)
+	step := max(total/20, 1)
+	var mu sync.Mutex
+	done := 0
+
+	seeder := *s.Seeder
+	seeder.Concurrency = concurrency
+	seeder.Progress = func(email string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		done++
+		if done%step == 0 || done == total {
+			fmt.Fprintf(s.Err, "seeded %d/%d users\n", done, total)
+		}
+	}
+
+	result, err := seeder.Seed(ctx, fixture)
+	if err != nil {
+		return err
+	}
+
+	rows := [][]string{
+		{"users", strconv.Itoa(result.Users), strconv.Itoa(result.UsersCreated)},
+		{"galleries", strconv.Itoa(result.Galleries), strconv.Itoa(result.GalleriesCreated)},
+		{"images", strconv.Itoa(result.Images), ""},
+	}
+
+	return output(s.Out, format, result, []string{"SEEDED", "TOTAL", "CREATED"}, rows)
+}
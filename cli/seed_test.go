@@ -0,0 +1,95 @@
+package cli_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/cli"
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/models/memory"
+	"github.com/rafaelmdurante/lenslocked/seed"
+)
+
+func newTestSeed(t *testing.T) (*cli.Seed, *bytes.Buffer) {
+	t.Helper()
+
+	store := memory.NewStore()
+	out := &bytes.Buffer{}
+	s := &cli.Seed{
+		Seeder: &seed.Seeder{
+			Users:     &memory.UserService{Store: store},
+			Galleries: &memory.GalleryService{Store: store},
+			Images: &memory.ImageService{
+				Store: store,
+				Files: models.ImageFiles{Dir: t.TempDir()},
+			},
+			Transactor: &memory.Transactor{Store: store},
+		},
+		Out: out,
+		Err: &bytes.Buffer{},
+	}
+
+	return s, out
+}
+
+func TestSeedLoad(t *testing.T) {
+	s, out := newTestSeed(t)
+
+	// the sample data of the README, loaded twice
+	for _, created := range []string{"3", "0"} {
+		out.Reset()
+		err := s.Run(context.Background(), []string{"load", "--concurrency", "1", "../fixtures/dev.yaml"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n")[1:] {
+			fields := strings.Fields(line)
+			if fields[0] == "users" && fields[2] != created {
+				t.Errorf("got %s users created, want %s:\n%s", fields[2], created, out)
+			}
+		}
+	}
+}
+
+func TestSeedGenerate(t *testing.T) {
+	s, out := newTestSeed(t)
+
+	err := s.Run(context.Background(), []string{"generate",
+		"--users", "4", "--galleries", "1", "--images", "2",
+		"--concurrency", "1", "--format", "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result seed.Result
+	err = json.Unmarshal(out.Bytes(), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := seed.Result{Users: 4, UsersCreated: 4, Galleries: 4, GalleriesCreated: 4, Images: 8}
+	if result != want {
+		t.Errorf("got %+v, want %+v", result, want)
+	}
+}
+
+func TestSeedErrors(t *testing.T) {
+	tests := [][]string{
+		{},
+		{"plant"},
+		{"load"},
+		{"load", "missing.yaml"},
+		{"generate", "--users", "-1"},
+	}
+
+	for _, args := range tests {
+		s, _ := newTestSeed(t)
+		err := s.Run(context.Background(), args)
+		if err == nil {
+			t.Errorf("%q: got no error", args)
+		}
+	}
+}
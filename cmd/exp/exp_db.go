@@ -1,6 +1,9 @@
+//go:build ignore
+
 package main
 
 import (
+	"context"
 	"fmt"
 	_ "github.com/jackc/pgx/v4/stdlib"
 	"github.com/rafaelmdurante/lenslocked/models"
@@ -30,7 +33,7 @@ func main() {
 
 	// create user
 	us := models.UserService{DB: db}
-	user, err := us.Create("bob@email.com", "my secret password")
+	user, err := us.Create(context.Background(), "bob@email.com", "my secret password")
 	if err != nil {
 		panic(err)
 	}
@@ -1,6 +1,9 @@
+//go:build ignore
+
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -33,7 +36,7 @@ func main() {
         Password: password,
     })
 
-    err = es.ForgotPassword("pipersyd@proton.me", "https://lenslocked.com/reset-pw?token=abc123")
+    err = es.ForgotPassword(context.Background(), "pipersyd@proton.me", "https://lenslocked.com/reset-pw?token=abc123")
     if err != nil {
         panic(err)
     }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/rafaelmdurante/lenslocked/config"
+	"github.com/rafaelmdurante/lenslocked/logging"
+	"github.com/rafaelmdurante/lenslocked/migrations"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// commandConfig parses the config flags of a subcommand, which go before the
+// command itself, e.g. `lenslocked admin --config prod.yaml users list`. It
+// returns the config and the remaining arguments, and sets up logging to
+// stderr so logs never mix with the output, which may be piped into jq.
+// define adds the flags of commands that take theirs along with the config
+// ones, like `lenslocked import --user bob@example.com photos/`.
+func commandConfig(name, usage string, args []string, define ...func(*flag.FlagSet)) (config.Config, []string, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	loadConfig := config.Flags(flags)
+	for _, fn := range define {
+		fn(flags)
+	}
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		fmt.Fprintln(flags.Output(), "\nConfig flags:")
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return config.Config{}, nil, err
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return config.Config{}, nil, err
+	}
+
+	logger, err := logging.New(os.Stderr, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		return config.Config{}, nil, err
+	}
+	slog.SetDefault(logger)
+
+	return cfg, flags.Args(), nil
+}
+
+// checkSchema fails unless the database is at the latest migration. Commands
+// expect the schema of this binary, an older database would fail halfway
+// through them.
+func checkSchema(ctx context.Context, db *sql.DB) error {
+	current, latest, err := models.MigrationVersions(ctx, db, migrations.FS)
+	if err != nil {
+		return err
+	}
+	if current != latest {
+		return fmt.Errorf("database is at version %d, latest is %d: run the migrations first",
+			current, latest)
+	}
+
+	return nil
+}
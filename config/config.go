@@ -0,0 +1,175 @@
+// Package config loads the application configuration. Values are resolved in
+// the following order of precedence, where later sources override earlier
+// ones:
+//
+//  1. built-in defaults (see Default)
+//  2. an optional YAML or TOML file, given by --config or CONFIG_FILE
+//  3. environment variables, including the ones in an optional .env file
+//  4. command-line flags
+//
+// Every setting has a key such as `psql.host`. The same key is used in the
+// config file (as nested tables), as the flag name (`--psql.host`) and, upper
+// cased with dots replaced by underscores, as the environment variable
+// (`PSQL_HOST`).
+package config
+
+import (
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/tracing"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// EnvDevelopment is the default environment. It allows insecure cookies
+	// and the development CSRF key.
+	EnvDevelopment = "development"
+	// EnvProduction enforces secure settings during validation.
+	EnvProduction = "production"
+
+	// devCSRFKey is only accepted outside of production so the server can
+	// start without any configuration on a developer's machine.
+	devCSRFKey = "dev-only-csrf-key-do-not-use-it!"
+)
+
+type Config struct {
+	App struct {
+		Env string `usage:"environment the app runs in: development or production"`
+		// BaseURL is used to build absolute links, like the ones sent by email.
+		BaseURL string `cfg:"base_url" usage:"public URL the app is reachable at"`
+	}
+	PSQL models.PostgresConfig
+	SMTP models.SMTPConfig
+	CSRF struct {
+		// Key must be exactly 32 bytes long.
+		Key    string `secret:"true" usage:"32-byte key used to sign CSRF tokens"`
+		Secure bool   `usage:"only send the CSRF cookie over https"`
+	}
+	Server struct {
+		Address           string        `usage:"address the HTTP server listens on"`
+		ReadTimeout       time.Duration `cfg:"read_timeout" usage:"maximum time to read a whole request, including the body"`
+		ReadHeaderTimeout time.Duration `cfg:"read_header_timeout" usage:"maximum time to read the request headers"`
+		WriteTimeout      time.Duration `cfg:"write_timeout" usage:"maximum time to write a response"`
+		IdleTimeout       time.Duration `cfg:"idle_timeout" usage:"how long keep-alive connections wait for the next request"`
+		MaxHeaderBytes    int           `cfg:"max_header_bytes" usage:"maximum size of the request headers"`
+		// ShutdownTimeout is the grace period given to in-flight requests and
+		// background workers once a SIGINT or SIGTERM is received.
+		ShutdownTimeout time.Duration `cfg:"shutdown_timeout" usage:"grace period to drain connections on shutdown"`
+		// DrainDelay keeps the server accepting requests after /readyz starts
+		// failing, giving load balancers time to notice before it stops.
+		DrainDelay time.Duration `cfg:"drain_delay" usage:"time to keep serving after readiness fails on shutdown"`
+	}
+	Storage struct {
+		Dir string `usage:"directory where uploaded images are stored"`
+	}
+	// Metrics are served on their own listener when Address is set, which
+	// should not be reachable from the internet. Otherwise they are served at
+	// /metrics on the app listener, but only when Token is set. Without
+	// either, they are not served at all.
+	Metrics struct {
+		Address string `usage:"private address serving /metrics, e.g. localhost:9090"`
+		Token   string `secret:"true" usage:"bearer token required for /metrics on the app listener"`
+	}
+	// API.Validate rejects the API requests that don't match the OpenAPI
+	// document served at /api/openapi.json, before they reach the handlers.
+	API struct {
+		Validate bool `usage:"reject API requests that don't match the OpenAPI document"`
+	}
+	// Webhooks.AllowPrivate lets webhooks reach loopback and private
+	// addresses, which are refused so users can't probe the internal network.
+	Webhooks struct {
+		AllowPrivate bool `cfg:"allow_private" usage:"let webhooks be delivered to private and loopback addresses"`
+	}
+	// Uploads bounds the resumable uploads of the API. The Quota holds for
+	// the imports too, zero leaves the storage of users unlimited.
+	Uploads struct {
+		MaxSize int64         `cfg:"max_size" usage:"largest file a resumable upload can be, in bytes"`
+		Expiry  time.Duration `usage:"how long an unfinished upload is kept after its last chunk"`
+		Quota   int64         `usage:"bytes of images and unfinished uploads each user can store, 0 for no limit"`
+	}
+	TLS     TLSConfig
+	Tracing tracing.Config
+	Log     struct {
+		Level  string `usage:"minimum level logged: debug, info, warn or error"`
+		Format string `usage:"log output format: text or json"`
+	}
+}
+
+const (
+	// TLSModeFiles serves https with a certificate and key read from disk.
+	TLSModeFiles = "files"
+	// TLSModeACME obtains and renews certificates automatically from an ACME
+	// server such as Let's Encrypt.
+	TLSModeACME = "acme"
+)
+
+type TLSConfig struct {
+	// Mode is empty when TLS is off, or one of the TLSMode constants.
+	Mode     string `usage:"empty to serve plain http, 'files' or 'acme'"`
+	CertFile string `cfg:"cert_file" usage:"PEM certificate used in 'files' mode"`
+	KeyFile  string `cfg:"key_file" usage:"PEM private key used in 'files' mode"`
+	// RedirectAddress is a plain http listener that redirects to https. In
+	// 'acme' mode it also answers the HTTP-01 challenges, so it is required.
+	RedirectAddress string        `cfg:"redirect_address" usage:"address of the http listener redirecting to https, empty to disable"`
+	HSTSMaxAge      time.Duration `cfg:"hsts_max_age" usage:"max-age of the Strict-Transport-Security header, 0 to disable"`
+	ACME            struct {
+		DirectoryURL string   `cfg:"directory_url" usage:"ACME directory, e.g. Pebble's https://localhost:14000/dir for testing"`
+		Email        string   `usage:"contact email registered with the ACME account"`
+		Domains      []string `usage:"comma separated domains to request certificates for"`
+		CacheDir     string   `cfg:"cache_dir" usage:"directory where certificates are cached"`
+		// CARoot lets the ACME client trust a test server, like Pebble, whose
+		// certificate isn't signed by a public CA.
+		CARoot string `cfg:"ca_root" usage:"extra PEM CA certificate trusted when talking to the ACME server"`
+	}
+}
+
+// Enabled reports whether the server should serve https.
+func (tc TLSConfig) Enabled() bool {
+	return tc.Mode != ""
+}
+
+// Default returns the configuration used when nothing else is provided. It is
+// suitable for local development against the docker-compose database.
+func Default() Config {
+	var cfg Config
+
+	cfg.App.Env = EnvDevelopment
+	cfg.App.BaseURL = "http://localhost:3000"
+
+	cfg.PSQL = models.DefaultPostgresConfig()
+
+	cfg.SMTP.Port = 587
+
+	cfg.CSRF.Key = devCSRFKey
+	cfg.CSRF.Secure = false
+
+	cfg.Server.Address = ":3000"
+	cfg.Server.ReadTimeout = 30 * time.Second
+	cfg.Server.ReadHeaderTimeout = 5 * time.Second
+	cfg.Server.WriteTimeout = 30 * time.Second
+	cfg.Server.IdleTimeout = 2 * time.Minute
+	cfg.Server.MaxHeaderBytes = 1 << 20
+	cfg.Server.ShutdownTimeout = 15 * time.Second
+
+	cfg.Storage.Dir = "images"
+
+	cfg.Uploads.MaxSize = 256 << 20
+	cfg.Uploads.Expiry = 24 * time.Hour
+
+	cfg.Metrics.Address = "localhost:9090"
+
+	cfg.Tracing.Endpoint = "localhost:4318"
+	cfg.Tracing.SampleRatio = 1
+	cfg.Tracing.ServiceName = "lenslocked"
+
+	cfg.Log.Level = "info"
+	cfg.Log.Format = "text"
+
+	cfg.TLS.RedirectAddress = ":80"
+	cfg.TLS.HSTSMaxAge = 365 * 24 * time.Hour
+	cfg.TLS.ACME.DirectoryURL = acme.LetsEncryptURL
+	cfg.TLS.ACME.CacheDir = "certs"
+
+	return cfg
+}
@@ -0,0 +1,249 @@
+package config_test
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/config"
+)
+
+// load builds the config from args, like main does, with env set and the
+// config file, if any, written under the name file.
+func load(t *testing.T, file, contents string, env map[string]string, args ...string) (config.Config, error) {
+	t.Helper()
+
+	// the tests only see the environment they set
+	var printed bytes.Buffer
+	_ = config.Print(&printed, config.Default())
+	for _, e := range os.Environ() {
+		name, _, _ := strings.Cut(e, "=")
+		if name == "CONFIG_FILE" || strings.Contains(printed.String(), "# "+name+"\n") {
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+	if file != "" {
+		path := filepath.Join(t.TempDir(), file)
+		err := os.WriteFile(path, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, arg := range args {
+			args[i] = strings.ReplaceAll(arg, "$FILE", path)
+		}
+		for name, v := range env {
+			env[name] = strings.ReplaceAll(v, "$FILE", path)
+		}
+	}
+	for name, v := range env {
+		t.Setenv(name, v)
+	}
+
+	fs := flag.NewFlagSet("lenslocked", flag.ContinueOnError)
+	build := config.Flags(fs)
+	err := fs.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return build()
+}
+
+func TestFlagsPrecedence(t *testing.T) {
+	yamlFile := "server:\n  address: \":4000\"\n  read_timeout: 1m\napp:\n  base_url: https://file.example\n"
+
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+		env      map[string]string
+		args     []string
+		address  string
+		baseURL  string
+	}{
+		{name: "Defaults", address: ":3000", baseURL: "http://localhost:3000"},
+		{name: "File over defaults", file: "lenslocked.yaml", contents: yamlFile,
+			args: []string{"--config", "$FILE"}, address: ":4000", baseURL: "https://file.example"},
+		{name: "File from the environment", file: "lenslocked.yml", contents: yamlFile,
+			env: map[string]string{"CONFIG_FILE": "$FILE"}, address: ":4000", baseURL: "https://file.example"},
+		{name: "Environment over file", file: "lenslocked.yaml", contents: yamlFile,
+			env: map[string]string{"SERVER_ADDRESS": ":5000"}, args: []string{"--config", "$FILE"},
+			address: ":5000", baseURL: "https://file.example"},
+		{name: "Flag over environment", file: "lenslocked.yaml", contents: yamlFile,
+			env:     map[string]string{"SERVER_ADDRESS": ":5000", "APP_BASE_URL": "https://env.example"},
+			args:    []string{"--config", "$FILE", "--server.address", ":6000"},
+			address: ":6000", baseURL: "https://env.example"},
+		{name: "TOML", file: "lenslocked.toml", contents: "[server]\naddress = \":7000\"\n",
+			args: []string{"--config=$FILE"}, address: ":7000", baseURL: "http://localhost:3000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := load(t, tt.file, tt.contents, tt.env, tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Server.Address != tt.address || cfg.App.BaseURL != tt.baseURL {
+				t.Errorf("got %q and %q, want %q and %q", cfg.Server.Address, cfg.App.BaseURL,
+					tt.address, tt.baseURL)
+			}
+			// the keys left out keep their defaults
+			if cfg.Server.WriteTimeout != config.Default().Server.WriteTimeout {
+				t.Errorf("got write timeout %v, want the default", cfg.Server.WriteTimeout)
+			}
+		})
+	}
+}
+
+func TestFlagsTypes(t *testing.T) {
+	file := `
+[tls]
+mode = "acme"
+[tls.acme]
+domains = ["a.example", "b.example"]
+[tracing]
+sample_ratio = 0.5
+`
+	cfg, err := load(t, "lenslocked.toml", file, map[string]string{"UPLOADS_QUOTA": "1024"},
+		"--config", "$FILE", "--server.read_timeout", "90s", "--api.validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cfg.TLS.ACME.Domains, " "); got != "a.example b.example" {
+		t.Errorf("got domains %q", got)
+	}
+	if cfg.Tracing.SampleRatio != 0.5 || cfg.Uploads.Quota != 1024 ||
+		cfg.Server.ReadTimeout != 90*time.Second || !cfg.API.Validate {
+		t.Errorf("got %v, %d, %v, %v", cfg.Tracing.SampleRatio, cfg.Uploads.Quota,
+			cfg.Server.ReadTimeout, cfg.API.Validate)
+	}
+	// the CSRF cookie follows TLS
+	if !cfg.CSRF.Secure {
+		t.Error("got an insecure CSRF cookie with TLS on")
+	}
+}
+
+func TestFlagsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+		env      map[string]string
+		args     []string
+		want     string
+	}{
+		{"Unknown key", "lenslocked.yaml", "server:\n  adress: \":4000\"\n", nil,
+			[]string{"--config", "$FILE"}, `unknown key "server.adress"`},
+		{"Unsupported extension", "lenslocked.json", "{}", nil,
+			[]string{"--config", "$FILE"}, `unsupported extension ".json"`},
+		{"Missing file", "", "", nil, []string{"--config", "missing.yaml"}, "config file:"},
+		{"Invalid file value", "lenslocked.yaml", "smtp:\n  port: many\n", nil,
+			[]string{"--config", "$FILE"}, "smtp.port"},
+		{"Invalid environment value", "", "", map[string]string{"SERVER_READ_TIMEOUT": "soon"}, nil,
+			"env SERVER_READ_TIMEOUT"},
+		{"Invalid flag value", "", "", nil, []string{"--csrf.secure=maybe"}, "flag --csrf.secure"},
+		{"Invalid result", "", "", map[string]string{"APP_ENV": "staging"}, nil, `app.env must be`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := load(t, tt.file, tt.contents, tt.env, tt.args...)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	production := func(cfg *config.Config) {
+		cfg.App.Env = config.EnvProduction
+		cfg.CSRF.Key = strings.Repeat("k", 32)
+		cfg.CSRF.Secure = true
+		cfg.SMTP.Host = "smtp.example"
+	}
+
+	tests := []struct {
+		name   string
+		change func(*config.Config)
+		// want are parts of the error, none when valid
+		want []string
+	}{
+		{"Defaults", func(*config.Config) {}, nil},
+		{"Production", production, nil},
+		{"Short CSRF key", func(cfg *config.Config) { cfg.CSRF.Key = "short" },
+			[]string{"csrf.key must be 32 bytes, got 5"}},
+		{"Insecure CSRF cookie in production", func(cfg *config.Config) {
+			production(cfg)
+			cfg.CSRF.Secure = false
+		}, []string{"csrf.secure must be true in production"}},
+		{"Development key in production", func(cfg *config.Config) {
+			production(cfg)
+			cfg.CSRF.Key = config.Default().CSRF.Key
+		}, []string{"csrf.key must be set in production"}},
+		{"TLS files", func(cfg *config.Config) { cfg.TLS.Mode = config.TLSModeFiles },
+			[]string{"tls.cert_file and tls.key_file are required"}},
+		{"Drain delay", func(cfg *config.Config) { cfg.Server.DrainDelay = cfg.Server.ShutdownTimeout },
+			[]string{"server.drain_delay must be shorter"}},
+		{"Every problem at once", func(cfg *config.Config) {
+			cfg.App.BaseURL = "localhost"
+			cfg.Log.Level = "loud"
+			cfg.Uploads.Quota = -1
+		}, []string{"app.base_url must be an absolute URL", "log.level must be", "uploads.quota cannot be negative"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			tt.change(&cfg)
+			err := cfg.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Errorf("got %v, want a valid config", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("got a valid config, want %q", tt.want)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("got %v, want %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPrint(t *testing.T) {
+	cfg := config.Default()
+	cfg.CSRF.Key = "my-very-secret-csrf-key-32-bytes"
+	cfg.SMTP.Password = "smtp-password"
+	cfg.Metrics.Token = ""
+
+	var b bytes.Buffer
+	err := config.Print(&b, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+
+	if strings.Contains(out, cfg.CSRF.Key) || strings.Contains(out, cfg.SMTP.Password) {
+		t.Errorf("got secrets in\n%s", out)
+	}
+	for _, want := range []string{
+		"csrf.key", "= ********", "# CSRF_KEY",
+		"server.read_timeout", "= 30s", "# SERVER_READ_TIMEOUT",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("got\n%s\nwant %q", out, want)
+		}
+	}
+	// an empty secret is shown as empty, so it is clear it isn't set
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "metrics.token ") && strings.Contains(line, "********") {
+			t.Errorf("got the empty token masked: %q", line)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// field is a single configurable value, addressed by its dotted key.
+type field struct {
+	key    string
+	secret bool
+	usage  string
+	value  reflect.Value
+}
+
+// EnvName returns the environment variable that sets the field.
+func (f field) EnvName() string {
+	return strings.ToUpper(strings.ReplaceAll(f.key, ".", "_"))
+}
+
+// Flags registers one flag per configuration key on flagSet, plus the --config
+// flag. The returned function must be called after flagSet.Parse and builds the
+// final, validated Config from every source.
+func Flags(flagSet *flag.FlagSet) func() (Config, error) {
+	configFile := flagSet.String("config", "",
+		"path to a YAML or TOML config file (env CONFIG_FILE)")
+
+	var tmp Config
+	flags := map[string]*flagValue{}
+	for _, f := range fields(&tmp) {
+		fv := &flagValue{isBool: f.value.Kind() == reflect.Bool}
+		flags[f.key] = fv
+		flagSet.Var(fv, f.key, fmt.Sprintf("%s (env %s)", f.usage, f.EnvName()))
+	}
+
+	return func() (Config, error) {
+		cfg := Default()
+
+		// the .env file is a convenience for development, so it is fine if
+		// it does not exist
+		err := godotenv.Load()
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return cfg, fmt.Errorf("load .env: %w", err)
+		}
+
+		path := *configFile
+		if path == "" {
+			path = os.Getenv("CONFIG_FILE")
+		}
+		if path != "" {
+			err = loadFile(&cfg, path)
+			if err != nil {
+				return cfg, err
+			}
+		}
+
+		for _, f := range fields(&cfg) {
+			v, ok := os.LookupEnv(f.EnvName())
+			if !ok {
+				continue
+			}
+			err = f.set(v)
+			if err != nil {
+				return cfg, fmt.Errorf("env %s: %w", f.EnvName(), err)
+			}
+		}
+
+		for _, f := range fields(&cfg) {
+			fv := flags[f.key]
+			if !fv.set {
+				continue
+			}
+			err = f.set(fv.raw)
+			if err != nil {
+				return cfg, fmt.Errorf("flag --%s: %w", f.key, err)
+			}
+		}
+
+		// the CSRF cookie is only sent over https when TLS is on, there is no
+		// reason to make it insecure
+		if cfg.TLS.Enabled() {
+			cfg.CSRF.Secure = true
+		}
+
+		err = cfg.Validate()
+		if err != nil {
+			return cfg, err
+		}
+
+		return cfg, nil
+	}
+}
+
+// loadFile decodes a YAML or TOML file, chosen by its extension, and applies
+// every key found in it to cfg. Unknown keys are reported as errors so typos
+// don't go unnoticed.
+func loadFile(cfg *Config, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	raw := map[string]interface{}{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &raw)
+	case ".toml":
+		err = toml.Unmarshal(b, &raw)
+	default:
+		return fmt.Errorf("config file: unsupported extension %q", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	values := map[string]string{}
+	flatten("", raw, values)
+
+	byKey := map[string]field{}
+	for _, f := range fields(cfg) {
+		byKey[f.key] = f
+	}
+
+	for key, v := range values {
+		f, ok := byKey[key]
+		if !ok {
+			return fmt.Errorf("config file %s: unknown key %q", path, key)
+		}
+		err = f.set(v)
+		if err != nil {
+			return fmt.Errorf("config file %s: %s: %w", path, key, err)
+		}
+	}
+
+	return nil
+}
+
+// flatten turns nested tables into dotted keys, e.g. {psql: {host: x}} into
+// psql.host = x.
+func flatten(prefix string, raw map[string]interface{}, out map[string]string) {
+	for k, v := range raw {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flatten(key, v, out)
+		case []interface{}:
+			parts := make([]string, len(v))
+			for i, p := range v {
+				parts[i] = fmt.Sprint(p)
+			}
+			out[key] = strings.Join(parts, ",")
+		default:
+			out[key] = fmt.Sprint(v)
+		}
+	}
+}
+
+// fields walks the Config struct and returns every leaf value. Keys come from
+// the `cfg` struct tag, or the lower cased field name when there is no tag.
+func fields(cfg *Config) []field {
+	var out []field
+	walk("", reflect.ValueOf(cfg).Elem(), &out)
+	return out
+}
+
+func walk(prefix string, v reflect.Value, out *[]field) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		name := sf.Tag.Get("cfg")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(sf.Name)
+		}
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct && fv.Type() != reflect.TypeOf(time.Time{}) {
+			walk(key, fv, out)
+			continue
+		}
+
+		usage := sf.Tag.Get("usage")
+		if usage == "" {
+			usage = "sets " + key
+		}
+
+		*out = append(*out, field{
+			key:    key,
+			secret: sf.Tag.Get("secret") == "true",
+			usage:  usage,
+			value:  fv,
+		})
+	}
+}
+
+// set parses s according to the kind of the field and stores it.
+func (f field) set(s string) error {
+	v := f.value
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int, v.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var parts []string
+		for _, p := range strings.Split(s, ",") {
+			p = strings.TrimSpace(p)
+			if p != "" {
+				parts = append(parts, p)
+			}
+		}
+		v.Set(reflect.ValueOf(parts))
+	default:
+		return fmt.Errorf("unsupported config type %s", v.Type())
+	}
+
+	return nil
+}
+
+// String formats the field value the same way it is accepted by set.
+func (f field) String() string {
+	v := f.value
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		return time.Duration(v.Int()).String()
+	case v.Kind() == reflect.Slice:
+		return strings.Join(v.Interface().([]string), ",")
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+// flagValue records the raw flag value so it can be applied after the file
+// and the environment, keeping the order of precedence.
+type flagValue struct {
+	raw    string
+	set    bool
+	isBool bool
+}
+
+func (fv *flagValue) String() string { return fv.raw }
+
+func (fv *flagValue) Set(s string) error {
+	fv.raw = s
+	fv.set = true
+	return nil
+}
+
+func (fv *flagValue) IsBoolFlag() bool { return fv.isBool }
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// mask replaces secret values when printing the configuration.
+const mask = "********"
+
+// Print writes every setting as `key = value`, together with the environment
+// variable that sets it. Secrets are masked so the output is safe to share.
+func Print(w io.Writer, cfg Config) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	for _, f := range fields(&cfg) {
+		value := f.String()
+		if f.secret && value != "" {
+			value = mask
+		}
+		fmt.Fprintf(tw, "%s\t= %s\t# %s\n", f.key, value, f.EnvName())
+	}
+
+	return tw.Flush()
+}
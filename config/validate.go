@@ -0,0 +1,138 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/rafaelmdurante/lenslocked/tracing"
+)
+
+// Validate reports every setting that would prevent the app from running
+// correctly. All problems are returned at once, joined in a single error.
+func (cfg Config) Validate() error {
+	var errs []error
+
+	switch cfg.App.Env {
+	case EnvDevelopment, EnvProduction:
+	default:
+		errs = append(errs, fmt.Errorf("app.env must be %q or %q, got %q",
+			EnvDevelopment, EnvProduction, cfg.App.Env))
+	}
+
+	u, err := url.Parse(cfg.App.BaseURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("app.base_url must be an absolute URL, got %q",
+			cfg.App.BaseURL))
+	}
+
+	if cfg.PSQL.Host == "" || cfg.PSQL.Database == "" {
+		errs = append(errs, errors.New("psql.host and psql.database are required"))
+	}
+	if cfg.PSQL.QueryTimeout <= 0 {
+		errs = append(errs, errors.New("psql.query_timeout must be positive"))
+	}
+
+	if cfg.SMTP.Port < 1 || cfg.SMTP.Port > 65535 {
+		errs = append(errs, fmt.Errorf("smtp.port must be between 1 and 65535, got %d",
+			cfg.SMTP.Port))
+	}
+
+	// gorilla/csrf requires a 32-byte authentication key
+	if len(cfg.CSRF.Key) != 32 {
+		errs = append(errs, fmt.Errorf("csrf.key must be 32 bytes, got %d",
+			len(cfg.CSRF.Key)))
+	}
+
+	if cfg.Server.Address == "" {
+		errs = append(errs, errors.New("server.address is required"))
+	}
+	if cfg.Server.ReadTimeout < 0 || cfg.Server.ReadHeaderTimeout < 0 ||
+		cfg.Server.WriteTimeout < 0 || cfg.Server.IdleTimeout < 0 {
+		errs = append(errs, errors.New("server timeouts cannot be negative"))
+	}
+	if cfg.Server.MaxHeaderBytes <= 0 {
+		errs = append(errs, errors.New("server.max_header_bytes must be positive"))
+	}
+	if cfg.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("server.shutdown_timeout must be positive"))
+	}
+	if cfg.Server.DrainDelay < 0 || cfg.Server.DrainDelay >= cfg.Server.ShutdownTimeout {
+		errs = append(errs, errors.New("server.drain_delay must be shorter than server.shutdown_timeout"))
+	}
+
+	if cfg.Storage.Dir == "" {
+		errs = append(errs, errors.New("storage.dir is required"))
+	}
+	if cfg.Uploads.MaxSize <= 0 || cfg.Uploads.Expiry <= 0 {
+		errs = append(errs, errors.New("uploads.max_size and uploads.expiry must be positive"))
+	}
+	if cfg.Uploads.Quota < 0 {
+		errs = append(errs, errors.New("uploads.quota cannot be negative"))
+	}
+
+	switch cfg.TLS.Mode {
+	case "":
+	case TLSModeFiles:
+		if cfg.TLS.CertFile == "" || cfg.TLS.KeyFile == "" {
+			errs = append(errs, errors.New("tls.cert_file and tls.key_file are required in 'files' mode"))
+		}
+	case TLSModeACME:
+		if len(cfg.TLS.ACME.Domains) == 0 {
+			errs = append(errs, errors.New("tls.acme.domains is required in 'acme' mode"))
+		}
+		if cfg.TLS.ACME.CacheDir == "" {
+			errs = append(errs, errors.New("tls.acme.cache_dir is required in 'acme' mode"))
+		}
+		// HTTP-01 challenges are answered on the plain http listener
+		if cfg.TLS.RedirectAddress == "" {
+			errs = append(errs, errors.New("tls.redirect_address is required in 'acme' mode"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("tls.mode must be empty, %q or %q, got %q",
+			TLSModeFiles, TLSModeACME, cfg.TLS.Mode))
+	}
+
+	switch cfg.Tracing.Exporter {
+	case "", tracing.ExporterOTLP, tracing.ExporterStdout:
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter must be empty, %q or %q, got %q",
+			tracing.ExporterOTLP, tracing.ExporterStdout, cfg.Tracing.Exporter))
+	}
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("tracing.sample_ratio must be between 0 and 1, got %v",
+			cfg.Tracing.SampleRatio))
+	}
+
+	switch strings.ToLower(cfg.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("log.level must be debug, info, warn or error, got %q",
+			cfg.Log.Level))
+	}
+	switch strings.ToLower(cfg.Log.Format) {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("log.format must be text or json, got %q",
+			cfg.Log.Format))
+	}
+
+	if cfg.App.Env == EnvProduction {
+		if !cfg.CSRF.Secure {
+			errs = append(errs, errors.New("csrf.secure must be true in production"))
+		}
+		if cfg.CSRF.Key == devCSRFKey {
+			errs = append(errs, errors.New("csrf.key must be set in production"))
+		}
+		if cfg.SMTP.Host == "" {
+			errs = append(errs, errors.New("smtp.host is required in production"))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
@@ -0,0 +1,23 @@
+package context
+
+import (
+	"context"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+const (
+	apiTokenKey key = "api_token"
+)
+
+// WithAPIToken stores the API token a request was authenticated with.
+func WithAPIToken(ctx context.Context, token *models.APIToken) context.Context {
+	return context.WithValue(ctx, apiTokenKey, token)
+}
+
+// APIToken retrieves the API token from the Context. It is nil when the
+// request was not authenticated with a token.
+func APIToken(ctx context.Context) *models.APIToken {
+	token, _ := ctx.Value(apiTokenKey).(*models.APIToken)
+	return token
+}
@@ -0,0 +1,35 @@
+package context
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	loggerKey key = "logger"
+)
+
+// WithLogger stores a request-scoped Logger in the Context.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// Logger retrieves the Logger from the Context, falling back to slog's
+// default logger when there is none. Once chi has matched a route, the route
+// pattern is added to it, as it is only known after routing.
+func Logger(ctx context.Context) *slog.Logger {
+	logger, ok := ctx.Value(loggerKey).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+
+	if rctx := chi.RouteContext(ctx); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			logger = logger.With("route", pattern)
+		}
+	}
+
+	return logger
+}
@@ -0,0 +1,545 @@
+package controllers
+
+import (
+	stdctx "context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rafaelmdurante/lenslocked/context"
+	"github.com/rafaelmdurante/lenslocked/errors"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// adminPageSize is the number of rows on each page of the admin area.
+const adminPageSize = 50
+
+// Admin is the staff area under /admin. The routes are gated with
+// UserMiddleware.RequireRole: moderators get the galleries, admins the users
+// and the impersonations too.
+type Admin struct {
+	Templates struct {
+		Users          Template
+		Galleries      Template
+		Impersonations Template
+		Audit          Template
+	}
+	UserService          UserService
+	SessionService       SessionService
+	GalleryService       GalleryService
+	ImageService         ImageService
+	ImpersonationService ImpersonationService
+	AuditService         AuditService
+	WebhookService       WebhookService
+	Transactor           Transactor
+}
+
+// pagination reads the q and page parameters of a search.
+type pagination struct {
+	Query string
+	Page  int
+	// Prev and Next link to the surrounding pages, empty when there is none
+	Prev string
+	Next string
+
+	// params are kept in the links, with page changed, so filters carry over
+	params url.Values
+}
+
+func newPagination(r *http.Request) pagination {
+	page, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	return pagination{Query: r.FormValue("q"), Page: page, params: r.URL.Query()}
+}
+
+func (p pagination) offset() int {
+	return (p.Page - 1) * adminPageSize
+}
+
+// links fills Prev and Next for a page that got n rows.
+func (p *pagination) links(path string, n int) {
+	link := func(page int) string {
+		v := url.Values{}
+		for key, values := range p.params {
+			if values[0] != "" {
+				v.Set(key, values[0])
+			}
+		}
+		v.Set("page", strconv.Itoa(page))
+		return path + "?" + v.Encode()
+	}
+	if p.Page > 1 {
+		p.Prev = link(p.Page - 1)
+	}
+	if n == adminPageSize {
+		p.Next = link(p.Page + 1)
+	}
+}
+
+// Index sends staff to the part of the area they can use the most.
+func (a Admin) Index(w http.ResponseWriter, r *http.Request) {
+	if context.User(r.Context()).Can(models.PermissionManageUsers) {
+		http.Redirect(w, r, "/admin/users", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/admin/galleries", http.StatusFound)
+}
+
+func (a Admin) Users(w http.ResponseWriter, r *http.Request) {
+	type User struct {
+		ID       int
+		Email    string
+		Role     models.Role
+		Disabled bool
+		Self     bool
+	}
+
+	var data struct {
+		pagination
+		Users []User
+		Roles []models.Role
+	}
+	data.pagination = newPagination(r)
+	data.Roles = []models.Role{models.RoleUser, models.RoleModerator, models.RoleAdmin}
+
+	users, err := a.UserService.Search(r.Context(), data.Query,
+		adminPageSize, data.offset())
+	if err != nil {
+		serverError(w, r, err, "searching users")
+		return
+	}
+	data.links("/admin/users", len(users))
+
+	current := context.User(r.Context())
+	for _, user := range users {
+		data.Users = append(data.Users, User{
+			ID:       user.ID,
+			Email:    user.Email,
+			Role:     user.Role,
+			Disabled: user.DisabledAt != nil,
+			Self:     user.ID == current.ID,
+		})
+	}
+
+	a.Templates.Users.Execute(w, r, data)
+}
+
+// targetUser looks up the user of the id URL parameter, who must be someone
+// else than the admin: admins can't lock themselves out by mistake. On error
+// the response is already written.
+func (a Admin) targetUser(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return nil, err
+	}
+
+	user, err := a.UserService.ByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return nil, err
+		}
+		serverError(w, r, err, "querying user", "user_id", id)
+		return nil, err
+	}
+
+	if user.ID == context.User(r.Context()).ID {
+		http.Error(w, "You can't do this to your own account", http.StatusBadRequest)
+		return nil, fmt.Errorf("admin %d targeting themselves", user.ID)
+	}
+
+	return user, nil
+}
+
+// redirectBack returns to the list the form was posted from, keeping the
+// search.
+func redirectBack(w http.ResponseWriter, r *http.Request, path string) {
+	if q := r.FormValue("q"); q != "" {
+		path += "?" + url.Values{"q": {q}}.Encode()
+	}
+	http.Redirect(w, r, path, http.StatusFound)
+}
+
+// DisableUser disables the account and signs the user out everywhere.
+func (a Admin) DisableUser(w http.ResponseWriter, r *http.Request) {
+	user, err := a.targetUser(w, r)
+	if err != nil {
+		return
+	}
+
+	err = a.Transactor.InTx(r.Context(), func(ctx stdctx.Context) error {
+		err := a.UserService.Disable(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		return a.SessionService.DeleteByUserID(ctx, user.ID)
+	})
+	if err != nil {
+		serverError(w, r, err, "disabling user", "user_id", user.ID)
+		return
+	}
+	record(r, a.AuditService, models.AuditEvent{
+		Type:    models.EventSessionsRevoked,
+		UserID:  user.ID,
+		Email:   user.Email,
+		ActorID: context.User(r.Context()).ID,
+	})
+	context.Logger(r.Context()).Info("admin disabled user", "user_id", user.ID)
+
+	redirectBack(w, r, "/admin/users")
+}
+
+func (a Admin) EnableUser(w http.ResponseWriter, r *http.Request) {
+	user, err := a.targetUser(w, r)
+	if err != nil {
+		return
+	}
+
+	err = a.UserService.Enable(r.Context(), user.ID)
+	if err != nil {
+		serverError(w, r, err, "enabling user", "user_id", user.ID)
+		return
+	}
+	record(r, a.AuditService, models.AuditEvent{
+		Type:    models.EventUserEnabled,
+		UserID:  user.ID,
+		Email:   user.Email,
+		ActorID: context.User(r.Context()).ID,
+	})
+	context.Logger(r.Context()).Info("admin enabled user", "user_id", user.ID)
+
+	redirectBack(w, r, "/admin/users")
+}
+
+func (a Admin) SetRole(w http.ResponseWriter, r *http.Request) {
+	user, err := a.targetUser(w, r)
+	if err != nil {
+		return
+	}
+
+	role, err := models.ParseRole(r.FormValue("role"))
+	if err != nil {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	err = a.UserService.SetRole(r.Context(), user.ID, role)
+	if err != nil {
+		serverError(w, r, err, "setting user role", "user_id", user.ID)
+		return
+	}
+	record(r, a.AuditService, models.AuditEvent{
+		Type:    models.EventRoleChanged,
+		UserID:  user.ID,
+		Email:   user.Email,
+		ActorID: context.User(r.Context()).ID,
+	})
+	context.Logger(r.Context()).Info("admin changed user role",
+		"user_id", user.ID, "from", user.Role, "to", role)
+
+	redirectBack(w, r, "/admin/users")
+}
+
+// Impersonate makes the admin's session act as the user until they stop, to
+// see the app the way the user does. Every impersonation is recorded along
+// with the reason the admin gave.
+func (a Admin) Impersonate(w http.ResponseWriter, r *http.Request) {
+	admin := context.User(r.Context())
+	if admin.Impersonator != nil {
+		http.Error(w, "Stop impersonating first", http.StatusBadRequest)
+		return
+	}
+
+	user, err := a.targetUser(w, r)
+	if err != nil {
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		http.Error(w, "A reason is required to impersonate a user", http.StatusBadRequest)
+		return
+	}
+
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+
+	err = a.Transactor.InTx(r.Context(), func(ctx stdctx.Context) error {
+		// an impersonation the admin never stopped, e.g. by signing in
+		// again, ends now
+		err := a.ImpersonationService.End(ctx, admin.ID)
+		if err != nil {
+			return err
+		}
+		_, err = a.ImpersonationService.Start(ctx, admin, user, reason)
+		if err != nil {
+			return err
+		}
+		return a.SessionService.Impersonate(ctx, token, user.ID)
+	})
+	if err != nil {
+		serverError(w, r, err, "impersonating user", "user_id", user.ID)
+		return
+	}
+	context.Logger(r.Context()).Info("admin started impersonating user",
+		"user_id", user.ID)
+
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// StopImpersonating gives the session back to the admin. It is not under
+// /admin, as the user being impersonated is usually not staff.
+func (a Admin) StopImpersonating(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if user.Impersonator == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+
+	err = a.Transactor.InTx(r.Context(), func(ctx stdctx.Context) error {
+		err := a.SessionService.StopImpersonating(ctx, token)
+		if err != nil {
+			return err
+		}
+		return a.ImpersonationService.End(ctx, user.Impersonator.ID)
+	})
+	if err != nil {
+		serverError(w, r, err, "stopping impersonation", "user_id", user.ID)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
+
+func (a Admin) Impersonations(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		pagination
+		Impersonations []models.Impersonation
+	}
+	data.pagination = newPagination(r)
+
+	impersonations, err := a.ImpersonationService.List(r.Context(),
+		adminPageSize, data.offset())
+	if err != nil {
+		serverError(w, r, err, "listing impersonations")
+		return
+	}
+	data.Impersonations = impersonations
+	data.links("/admin/impersonations", len(impersonations))
+
+	a.Templates.Impersonations.Execute(w, r, data)
+}
+
+func (a Admin) Galleries(w http.ResponseWriter, r *http.Request) {
+	type Gallery struct {
+		ID         int
+		Title      string
+		OwnerEmail string
+		Hidden     bool
+	}
+
+	var data struct {
+		pagination
+		Galleries []Gallery
+	}
+	data.pagination = newPagination(r)
+
+	galleries, err := a.GalleryService.Search(r.Context(), data.Query,
+		adminPageSize, data.offset())
+	if err != nil {
+		serverError(w, r, err, "searching galleries")
+		return
+	}
+	data.links("/admin/galleries", len(galleries))
+
+	// a page has few owners, looking them up one by one is fine
+	owners := map[int]string{}
+	for _, gallery := range galleries {
+		email, ok := owners[gallery.UserID]
+		if !ok {
+			owner, err := a.UserService.ByID(r.Context(), gallery.UserID)
+			if err != nil {
+				serverError(w, r, err, "querying gallery owner", "gallery_id", gallery.ID)
+				return
+			}
+			email = owner.Email
+			owners[gallery.UserID] = email
+		}
+
+		data.Galleries = append(data.Galleries, Gallery{
+			ID:         gallery.ID,
+			Title:      gallery.Title,
+			OwnerEmail: email,
+			Hidden:     gallery.HiddenAt != nil,
+		})
+	}
+
+	a.Templates.Galleries.Execute(w, r, data)
+}
+
+func (a Admin) HideGallery(w http.ResponseWriter, r *http.Request) {
+	a.setGalleryHidden(w, r, true)
+}
+
+func (a Admin) UnhideGallery(w http.ResponseWriter, r *http.Request) {
+	a.setGalleryHidden(w, r, false)
+}
+
+func (a Admin) setGalleryHidden(w http.ResponseWriter, r *http.Request, hidden bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+
+	gallery, err := a.GalleryService.ByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return
+		}
+		serverError(w, r, err, "querying gallery", "gallery_id", id)
+		return
+	}
+
+	err = a.GalleryService.SetHidden(r.Context(), id, hidden)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return
+		}
+		serverError(w, r, err, "hiding gallery", "gallery_id", id, "hidden", hidden)
+		return
+	}
+	event := models.EventGalleryHidden
+	if !hidden {
+		event = models.EventGalleryUnhidden
+	}
+	record(r, a.AuditService, galleryEvent(r, event, gallery))
+	context.Logger(r.Context()).Info("moderator changed gallery visibility",
+		"gallery_id", id, "hidden", hidden)
+
+	redirectBack(w, r, "/admin/galleries")
+}
+
+func (a Admin) DeleteGallery(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+
+	gallery, err := a.GalleryService.ByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return
+		}
+		serverError(w, r, err, "querying gallery", "gallery_id", id)
+		return
+	}
+
+	err = a.GalleryService.Delete(r.Context(), id)
+	if err != nil {
+		serverError(w, r, err, "deleting gallery", "gallery_id", id)
+		return
+	}
+	record(r, a.AuditService, galleryEvent(r, models.EventGalleryDeleted, gallery))
+	notify(r, a.WebhookService, gallery.UserID, models.WebhookGalleryDeleted, newAPIGallery(gallery))
+	err = a.ImageService.DeleteFiles(r.Context(), id)
+	if err != nil {
+		serverError(w, r, err, "deleting gallery images", "gallery_id", id)
+		return
+	}
+	context.Logger(r.Context()).Info("moderator deleted gallery", "gallery_id", id)
+
+	redirectBack(w, r, "/admin/galleries")
+}
+
+// auditDateLayout is the format of the since and until filters, the one of
+// date inputs.
+const auditDateLayout = "2006-01-02"
+
+// Audit lists the audit log, with filters on the user, the type of event,
+// the IP address and the dates.
+func (a Admin) Audit(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		pagination
+		UserID string
+		Email  string
+		Type   string
+		IP     string
+		Since  string
+		Until  string
+		Types  []models.AuditEventType
+		Events []models.AuditEvent
+	}
+	data.pagination = newPagination(r)
+	data.UserID = r.FormValue("user_id")
+	data.Email = r.FormValue("email")
+	data.Type = r.FormValue("type")
+	data.IP = r.FormValue("ip")
+	data.Since = r.FormValue("since")
+	data.Until = r.FormValue("until")
+	data.Types = models.AuditEventTypes
+
+	filter := models.AuditFilter{
+		Email: data.Email,
+		Type:  models.AuditEventType(data.Type),
+		IP:    data.IP,
+	}
+	var errs []error
+	if data.UserID != "" {
+		id, err := strconv.Atoi(data.UserID)
+		if err != nil {
+			errs = append(errs, errors.Public(err, "The user ID must be a number."))
+		}
+		filter.UserID = id
+	}
+	if data.Since != "" {
+		since, err := time.Parse(auditDateLayout, data.Since)
+		if err != nil {
+			errs = append(errs, errors.Public(err, "The since date is invalid."))
+		}
+		filter.Since = since
+	}
+	if data.Until != "" {
+		until, err := time.Parse(auditDateLayout, data.Until)
+		if err != nil {
+			errs = append(errs, errors.Public(err, "The until date is invalid."))
+		} else {
+			// until includes the whole day
+			filter.Until = until.AddDate(0, 0, 1)
+		}
+	}
+	if len(errs) > 0 {
+		a.Templates.Audit.Execute(w, r, data, errs...)
+		return
+	}
+
+	events, err := a.AuditService.List(r.Context(), filter, adminPageSize, data.offset())
+	if err != nil {
+		serverError(w, r, err, "listing audit events")
+		return
+	}
+	data.Events = events
+	data.links("/admin/audit", len(events))
+
+	a.Templates.Audit.Execute(w, r, data)
+}
@@ -0,0 +1,235 @@
+package controllers_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// signUpAs creates an account with the given role and returns a client signed
+// in with it.
+func (app *testApp) signUpAs(email string, role models.Role) *http.Client {
+	app.t.Helper()
+
+	client := app.newClient()
+	app.signUp(client, email, "secret")
+	user, err := app.users.ByEmail(context.Background(), email)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	err = app.users.SetRole(context.Background(), user.ID, role)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+
+	return client
+}
+
+func TestAdminRequireRole(t *testing.T) {
+	app := newTestApp(t)
+	user := app.signUpAs("user@example.com", models.RoleUser)
+	moderator := app.signUpAs("mod@example.com", models.RoleModerator)
+	admin := app.signUpAs("admin@example.com", models.RoleAdmin)
+
+	assertRedirect(t, app.get(app.client, "/admin/galleries"), "/signin")
+	assertStatus(t, app.get(user, "/admin"), http.StatusForbidden)
+	assertStatus(t, app.get(user, "/admin/galleries"), http.StatusForbidden)
+
+	// moderators only get the galleries
+	assertRedirect(t, app.get(moderator, "/admin"), "/admin/galleries")
+	assertStatus(t, app.get(moderator, "/admin/galleries"), http.StatusOK)
+	assertStatus(t, app.get(moderator, "/admin/users"), http.StatusForbidden)
+	assertStatus(t, app.post(moderator, "/admin/users/1/disable", nil), http.StatusForbidden)
+
+	assertRedirect(t, app.get(admin, "/admin"), "/admin/users")
+	for _, path := range []string{"/admin/users", "/admin/galleries", "/admin/impersonations"} {
+		assertStatus(t, app.get(admin, path), http.StatusOK)
+	}
+
+	// the header links to the admin area for staff only
+	assertContains(t, app.get(admin, "/galleries"), `href="/admin"`)
+	if resp := app.get(user, "/galleries"); strings.Contains(resp.body, `href="/admin"`) {
+		t.Error("the header links to the admin area for a user")
+	}
+}
+
+func TestAdminUsers(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApp(t)
+	admin := app.signUpAs("admin@example.com", models.RoleAdmin)
+	bobClient := app.signUpAs("bob@example.com", models.RoleUser)
+	app.signUpAs("carol@example.com", models.RoleUser)
+	bob, err := app.users.ByEmail(ctx, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	self, err := app.users.ByEmail(ctx, "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := app.get(admin, "/admin/users?q=BOB")
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, "bob@example.com")
+	if strings.Contains(resp.body, "carol@example.com") {
+		t.Error("search for bob lists carol")
+	}
+
+	path := fmt.Sprintf("/admin/users/%d", bob.ID)
+	resp = app.post(admin, path+"/role", url.Values{"role": {"moderator"}, "q": {"bob"}})
+	assertRedirect(t, resp, "/admin/users?q=bob")
+	assertStatus(t, app.get(bobClient, "/admin/galleries"), http.StatusOK)
+	assertStatus(t, app.post(admin, path+"/role", url.Values{"role": {"owner"}}), http.StatusBadRequest)
+
+	// disabling signs bob out
+	assertRedirect(t, app.post(admin, path+"/disable", nil), "/admin/users")
+	assertRedirect(t, app.get(bobClient, "/users/me"), "/signin")
+	_, err = app.users.Authenticate(ctx, "bob@example.com", "secret")
+	if err != models.ErrDisabled {
+		t.Errorf("authenticate: got error %v, want %v", err, models.ErrDisabled)
+	}
+	assertRedirect(t, app.post(admin, path+"/enable", nil), "/admin/users")
+	_, err = app.users.Authenticate(ctx, "bob@example.com", "secret")
+	if err != nil {
+		t.Errorf("authenticate: %v", err)
+	}
+	// every change is in bob's history, as done by the admin
+	events := app.events(models.AuditFilter{UserID: bob.ID})
+	if got := eventTypes(events); got != "sign_up,role_changed,sessions_revoked,user_enabled" {
+		t.Errorf("got events %s", got)
+	}
+	for _, event := range events[1:] {
+		if event.ActorID != self.ID {
+			t.Errorf("event %s: got actor %d, want the admin", event.Type, event.ActorID)
+		}
+	}
+
+	// admins can't lock themselves out
+	selfPath := fmt.Sprintf("/admin/users/%d", self.ID)
+	assertStatus(t, app.post(admin, selfPath+"/disable", nil), http.StatusBadRequest)
+	assertStatus(t, app.post(admin, selfPath+"/role", url.Values{"role": {"user"}}), http.StatusBadRequest)
+	assertStatus(t, app.post(admin, "/admin/users/999/disable", nil), http.StatusNotFound)
+}
+
+func TestAdminImpersonate(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApp(t)
+	admin := app.signUpAs("admin@example.com", models.RoleAdmin)
+	app.signUpAs("bob@example.com", models.RoleUser)
+	bob, err := app.users.ByEmail(ctx, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/admin/users/%d/impersonate", bob.ID)
+
+	assertStatus(t, app.post(admin, path, nil), http.StatusBadRequest)
+
+	resp := app.post(admin, path, url.Values{"reason": {"ticket #42"}})
+	assertRedirect(t, resp, "/galleries")
+	assertContains(t, app.get(admin, "/users/me"), "bob@example.com")
+	assertContains(t, app.get(admin, "/galleries"), "Stop impersonating")
+	// the session acts as bob, who is no admin
+	assertStatus(t, app.get(admin, "/admin/users"), http.StatusForbidden)
+
+	trail, err := app.impersonations.List(ctx, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trail) != 1 || trail[0].UserEmail != "bob@example.com" ||
+		trail[0].AdminEmail != "admin@example.com" || trail[0].Reason != "ticket #42" ||
+		trail[0].EndedAt != nil {
+		t.Fatalf("got trail %+v, want the ongoing impersonation of bob", trail)
+	}
+
+	assertRedirect(t, app.post(admin, "/impersonation/stop", nil), "/admin/users")
+	assertContains(t, app.get(admin, "/users/me"), "admin@example.com")
+
+	trail, err = app.impersonations.List(ctx, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trail) != 1 || trail[0].EndedAt == nil {
+		t.Fatalf("got trail %+v, want the impersonation ended", trail)
+	}
+	resp = app.get(admin, "/admin/impersonations")
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, "ticket #42")
+
+	// signing out while impersonating ends the impersonation too
+	app.post(admin, path, url.Values{"reason": {"ticket #43"}})
+	assertRedirect(t, app.post(admin, "/signout", nil), "/signin")
+	trail, err = app.impersonations.List(ctx, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trail) != 2 || trail[0].EndedAt == nil {
+		t.Fatalf("got trail %+v, want both impersonations ended", trail)
+	}
+}
+
+func TestAdminModerateGalleries(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApp(t)
+	app.seed("testdata/galleries.yaml")
+	owner, err := app.users.ByEmail(ctx, "owner@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	galleries, err := app.galleries.ByUserID(ctx, owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/galleries/%d", galleries[0].ID)
+	adminPath := fmt.Sprintf("/admin/galleries/%d", galleries[0].ID)
+
+	ownerClient := app.newClient()
+	assertRedirect(t, app.post(ownerClient, "/signin", url.Values{
+		"email": {"owner@example.com"}, "password": {"secret"},
+	}), "/users/me")
+	moderator := app.signUpAs("mod@example.com", models.RoleModerator)
+
+	resp := app.get(moderator, "/admin/galleries?q=colours")
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, "Primary Colours")
+	assertContains(t, resp, "owner@example.com")
+
+	assertRedirect(t, app.post(moderator, adminPath+"/hide", nil), "/admin/galleries")
+	assertStatus(t, app.get(app.newClient(), path), http.StatusNotFound)
+	assertStatus(t, app.get(app.newClient(), path+"/images/red.png"), http.StatusNotFound)
+	assertContains(t, app.get(ownerClient, path), "hidden by a moderator")
+	assertStatus(t, app.get(moderator, path), http.StatusOK)
+	// moderators can't edit someone else's gallery
+	assertStatus(t, app.get(moderator, path+"/edit"), http.StatusForbidden)
+
+	assertRedirect(t, app.post(moderator, adminPath+"/unhide", nil), "/admin/galleries")
+	assertStatus(t, app.get(app.newClient(), path), http.StatusOK)
+
+	assertRedirect(t, app.post(moderator, adminPath+"/delete", nil), "/admin/galleries")
+	assertStatus(t, app.get(ownerClient, path), http.StatusNotFound)
+	images, err := app.images.ByGalleryID(ctx, galleries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 0 {
+		t.Errorf("got %d images left after deleting the gallery", len(images))
+	}
+
+	mod, err := app.users.ByEmail(ctx, "mod@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var moderated []models.AuditEvent
+	for _, event := range app.events(models.AuditFilter{UserID: owner.ID}) {
+		if event.GalleryID == galleries[0].ID && event.ActorID == mod.ID {
+			moderated = append(moderated, event)
+		}
+	}
+	if got := eventTypes(moderated); got != "gallery_hidden,gallery_unhidden,gallery_deleted" {
+		t.Errorf("got moderation events %s", got)
+	}
+}
@@ -0,0 +1,706 @@
+package controllers
+
+import (
+	stdctx "context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rafaelmdurante/lenslocked/context"
+	"github.com/rafaelmdurante/lenslocked/errors"
+	"github.com/rafaelmdurante/lenslocked/metrics"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+const (
+	// apiPerPage is the page size when the client doesn't ask for one,
+	// apiMaxPerPage the largest it can ask for
+	apiPerPage    = 20
+	apiMaxPerPage = 100
+	// apiMaxBody bounds the JSON bodies, apiMaxImage the uploaded images
+	apiMaxBody  = 1 << 20
+	apiMaxImage = 32 << 20
+)
+
+// API is the JSON API under /api/v1, meant for scripts rather than browsers.
+// It doesn't look at the session cookie, every request carries its own
+// credentials, which is why it can live outside the CSRF protection.
+type API struct {
+	APITokenService APITokenService
+	GalleryService  GalleryService
+	ImageService    ImageService
+	AuditService    AuditService
+	WebhookService  WebhookService
+	UploadService   UploadService
+	Uploads         UploadLimits
+	Transactor      Transactor
+}
+
+// apiError is the body of every error answered by the API, along with its
+// status code:
+//
+//	{"error": {"code": "not_found", "message": "Gallery not found."}}
+//
+// Clients are meant to switch on the code, the message is for people.
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// apiErrorBody wraps apiError, as it is sent.
+type apiErrorBody struct {
+	Error apiError `json:"error"`
+}
+
+func newAPIError(status int, code, format string, args ...any) *apiError {
+	return &apiError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+var (
+	errAPIUnauthorized = newAPIError(http.StatusUnauthorized, "unauthorized",
+		"Valid credentials are required.")
+	errAPIPrecondition = newAPIError(http.StatusPreconditionFailed, "precondition_failed",
+		"The resource has changed since it was fetched.")
+)
+
+// writeJSON answers with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	// the status is already sent, there is nothing left to do on error
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers with the body of err. The errors of the models package
+// get the status code that matches them, anything unexpected is logged and
+// answered like serverError does, as JSON.
+func writeError(w http.ResponseWriter, r *http.Request, err error, msg string, args ...any) {
+	var apiErr *apiError
+	switch {
+	case errors.As(err, &apiErr):
+	case errors.Is(err, models.ErrNotFound):
+		apiErr = newAPIError(http.StatusNotFound, "not_found", "Not found.")
+	case errors.Is(err, models.ErrEmailToken):
+		apiErr = newAPIError(http.StatusConflict, "email_taken",
+			"The email address is already in use.")
+	case errors.Is(err, models.ErrNotImage):
+		apiErr = newAPIError(http.StatusUnsupportedMediaType, "not_image",
+			"Only JPEG, PNG, GIF and WebP images are accepted.")
+	default:
+		logger := context.Logger(r.Context())
+		args = append(args, "err", err)
+
+		switch {
+		case errors.Canceled(err):
+			logger.Info(msg+": request canceled by the client", args...)
+			w.WriteHeader(StatusClientClosedRequest)
+			return
+		case errors.Timeout(err):
+			logger.Warn(msg+": deadline exceeded", args...)
+			apiErr = newAPIError(http.StatusGatewayTimeout, "timeout",
+				"The request took too long, please try again.")
+		default:
+			logger.Error(msg, args...)
+			apiErr = newAPIError(http.StatusInternalServerError, "internal",
+				"Something went wrong.")
+		}
+	}
+
+	if apiErr.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="lenslocked"`)
+	}
+	writeJSON(w, apiErr.Status, apiErrorBody{*apiErr})
+}
+
+// decodeJSON reads the JSON body of r into v. Unknown fields are rejected, so
+// a typo in a field name doesn't go unnoticed.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || mediaType != "application/json" {
+			return newAPIError(http.StatusUnsupportedMediaType, "unsupported_media_type",
+				"The request body must be JSON.")
+		}
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBody))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return newAPIError(http.StatusRequestEntityTooLarge, "too_large",
+				"The request body is larger than %d bytes.", tooLarge.Limit)
+		}
+		return newAPIError(http.StatusBadRequest, "invalid_json",
+			"The request body is not valid: %v.", err)
+	}
+	if dec.More() {
+		return newAPIError(http.StatusBadRequest, "invalid_json",
+			"The request body must be a single JSON object.")
+	}
+
+	return nil
+}
+
+// etag is a strong entity tag for the JSON representation of v. It changes
+// whenever one of the fields does.
+func etag(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		// the representations are plain structs, this can't happen
+		panic(err)
+	}
+	sum := sha256.Sum256(b)
+
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// ifMatch reports whether the If-Match header of r, when there is one, lists
+// etag. Clients that don't send it get the last write wins.
+func ifMatch(r *http.Request, etag string) bool {
+	values := r.Header.Values("If-Match")
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// apiPage is a page of a list, along with the link to the next one. Pages
+// start at 1.
+type apiPage struct {
+	Page    int    `json:"page"`
+	PerPage int    `json:"per_page"`
+	Total   int    `json:"total"`
+	Next    string `json:"next,omitempty" doc:"link to the next page, unless this is the last one"`
+}
+
+// apiList is the envelope every list is answered with.
+type apiList[T any] struct {
+	Data       []T     `json:"data"`
+	Pagination apiPage `json:"pagination"`
+}
+
+// paginate returns the page of items asked for by the page and per_page query
+// parameters.
+func paginate[T any](r *http.Request, items []T) (apiList[T], error) {
+	p := apiPage{Page: 1, PerPage: apiPerPage, Total: len(items)}
+	query := r.URL.Query()
+	if s := query.Get("page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return apiList[T]{}, newAPIError(http.StatusBadRequest, "invalid_parameter",
+				"The page must be a positive number.")
+		}
+		p.Page = n
+	}
+	if s := query.Get("per_page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > apiMaxPerPage {
+			return apiList[T]{}, newAPIError(http.StatusBadRequest, "invalid_parameter",
+				"The per_page must be between 1 and %d.", apiMaxPerPage)
+		}
+		p.PerPage = n
+	}
+
+	// pages past the end are empty, checked by division so that a huge page
+	// doesn't overflow
+	start := len(items)
+	if p.Page-1 <= len(items)/p.PerPage {
+		start = min((p.Page-1)*p.PerPage, len(items))
+	}
+	end := min(start+p.PerPage, len(items))
+	if end < len(items) {
+		query.Set("page", strconv.Itoa(p.Page+1))
+		query.Set("per_page", strconv.Itoa(p.PerPage))
+		p.Next = r.URL.Path + "?" + query.Encode()
+	}
+
+	// an empty page is [] rather than null
+	data := append(make([]T, 0, end-start), items[start:end]...)
+
+	return apiList[T]{Data: data, Pagination: p}, nil
+}
+
+// SetUser authenticates the request with a personal API token, sent as
+// "Authorization: Bearer <token>". Passwords aren't taken: they would allow
+// everything, and be tried with no limit. Like UserMiddleware.SetUser it
+// doesn't limit access, RequireUser does, so failed attempts still get
+// logged.
+func (a API) SetUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, apiToken, err := a.APITokenService.User(r.Context(), strings.TrimSpace(token))
+		if err != nil {
+			if !errors.Is(err, models.ErrNotFound) {
+				context.Logger(r.Context()).Error("looking up api token", "err", err)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := context.WithUser(r.Context(), user)
+		ctx = context.WithAPIToken(ctx, apiToken)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireUser answers with a 401 unless SetUser authenticated the request.
+func (a API) RequireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if context.User(r.Context()) == nil {
+			writeError(w, r, errAPIUnauthorized, "authenticating API request")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope answers with a 403 when the token of the request lacks scope.
+// It has to come after RequireUser.
+func (a API) RequireScope(scope models.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := context.APIToken(r.Context())
+			if token == nil || !token.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate",
+					fmt.Sprintf(`Bearer realm="lenslocked", error="insufficient_scope", scope="%s"`, scope))
+				writeError(w, r, newAPIError(http.StatusForbidden, "insufficient_scope",
+					"The token doesn't have the %s scope.", scope), "")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (a API) NotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, newAPIError(http.StatusNotFound, "not_found", "Not found."), "")
+}
+
+func (a API) MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, newAPIError(http.StatusMethodNotAllowed, "method_not_allowed",
+		"The %s method is not allowed here.", r.Method), "")
+}
+
+type apiGallery struct {
+	ID          int    `json:"id"`
+	UserID      int    `json:"user_id"`
+	Title       string `json:"title"`
+	Description string `json:"description" doc:"Markdown, rendered on the gallery page"`
+	Hidden      bool   `json:"hidden"`
+	Cover       string `json:"cover,omitempty" doc:"filename of the image standing for the gallery"`
+}
+
+func newAPIGallery(gallery *models.Gallery) apiGallery {
+	return apiGallery{
+		ID:          gallery.ID,
+		UserID:      gallery.UserID,
+		Title:       gallery.Title,
+		Description: gallery.Description,
+		Hidden:      gallery.HiddenAt != nil,
+		Cover:       gallery.Cover,
+	}
+}
+
+type apiImage struct {
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type" openapi:"enum=image/jpeg|image/png|image/gif|image/webp"`
+	Size        int64     `json:"size" doc:"in bytes"`
+	CreatedAt   time.Time `json:"created_at"`
+	// URL is where the file is served
+	URL      string `json:"url" doc:"where the file is served"`
+	Position int    `json:"position" doc:"place of the image in the gallery, from 1"`
+	Caption  string `json:"caption"`
+	Alt      string `json:"alt" doc:"text describing the image to those who can't see it"`
+}
+
+func newAPIImage(image *models.Image) apiImage {
+	return apiImage{
+		Filename:    image.Filename,
+		ContentType: image.ContentType,
+		Size:        image.Size,
+		CreatedAt:   image.CreatedAt,
+		URL:         imageURL(*image),
+		Position:    image.Position,
+		Caption:     image.Caption,
+		Alt:         image.Alt,
+	}
+}
+
+// writeGallery answers with the gallery and its ETag.
+func writeGallery(w http.ResponseWriter, status int, gallery *models.Gallery) {
+	g := newAPIGallery(gallery)
+	w.Header().Set("ETag", etag(g))
+	writeJSON(w, status, g)
+}
+
+// gallery looks up the gallery of the id URL parameter. Galleries the user
+// can't see are not found, like on the website, and allowed checks what they
+// are about to do with it.
+func (a API) gallery(r *http.Request, allowed func(*models.User, *models.Gallery) bool) (*models.Gallery, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, newAPIError(http.StatusNotFound, "not_found", "Gallery not found.")
+	}
+
+	gallery, err := a.GalleryService.ByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			return nil, newAPIError(http.StatusNotFound, "not_found", "Gallery not found.")
+		}
+		return nil, fmt.Errorf("query gallery %d: %w", id, err)
+	}
+
+	user := context.User(r.Context())
+	if !user.CanViewGallery(gallery) {
+		return nil, newAPIError(http.StatusNotFound, "not_found", "Gallery not found.")
+	}
+	if allowed != nil && !allowed(user, gallery) {
+		return nil, newAPIError(http.StatusForbidden, "forbidden",
+			"You are not authorised to change this gallery.")
+	}
+
+	return gallery, nil
+}
+
+// Galleries lists the galleries of the user.
+func (a API) Galleries(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	galleries, err := a.GalleryService.ByUserID(r.Context(), user.ID)
+	if err != nil {
+		writeError(w, r, err, "querying user galleries")
+		return
+	}
+
+	data := make([]apiGallery, 0, len(galleries))
+	for i := range galleries {
+		data = append(data, newAPIGallery(&galleries[i]))
+	}
+	page, err := paginate(r, data)
+	if err != nil {
+		writeError(w, r, err, "")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+type apiCreateGallery struct {
+	Title       string `json:"title" openapi:"minLength=1"`
+	Description string `json:"description,omitempty" doc:"Markdown" openapi:"maxLength=5000"`
+}
+
+// apiUpdateGallery leaves out the fields that don't change.
+type apiUpdateGallery struct {
+	Title       *string `json:"title" openapi:"minLength=1"`
+	Description *string `json:"description" doc:"Markdown" openapi:"maxLength=5000"`
+}
+
+// galleryTitle returns the trimmed title, which can't be empty.
+func galleryTitle(title string) (string, error) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return "", newAPIError(http.StatusUnprocessableEntity, "invalid_field",
+			"The title is required.")
+	}
+	return title, nil
+}
+
+// galleryDescription checks the length of the description.
+func galleryDescription(description string) (string, error) {
+	if checkDescription(description) != nil {
+		return "", newAPIError(http.StatusUnprocessableEntity, "invalid_field",
+			fmt.Sprintf("The description can't be longer than %d characters.", maxDescriptionLength))
+	}
+	return description, nil
+}
+
+func (a API) CreateGallery(w http.ResponseWriter, r *http.Request) {
+	var in apiCreateGallery
+	err := decodeJSON(w, r, &in)
+	if err != nil {
+		writeError(w, r, err, "")
+		return
+	}
+	title, err := galleryTitle(in.Title)
+	if err != nil {
+		writeError(w, r, err, "")
+		return
+	}
+	description, err := galleryDescription(in.Description)
+	if err != nil {
+		writeError(w, r, err, "")
+		return
+	}
+
+	gallery, err := createGallery(r.Context(), a.GalleryService, a.Transactor,
+		title, description, context.User(r.Context()).ID)
+	if err != nil {
+		writeError(w, r, err, "creating gallery")
+		return
+	}
+	metrics.GalleriesCreated.Inc()
+	record(r, a.AuditService, galleryEvent(r, models.EventGalleryCreated, gallery))
+	notify(r, a.WebhookService, gallery.UserID, models.WebhookGalleryCreated, newAPIGallery(gallery))
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/galleries/%d", gallery.ID))
+	writeGallery(w, http.StatusCreated, gallery)
+}
+
+func (a API) Gallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, nil)
+	if err != nil {
+		writeError(w, r, err, "querying gallery")
+		return
+	}
+
+	writeGallery(w, http.StatusOK, gallery)
+}
+
+// UpdateGallery changes the fields of the body, leaving out the others. With
+// an If-Match header, it only does so when the gallery hasn't changed since:
+// the check and the change are one transaction, so of two clients sending the
+// same ETag only one gets through.
+func (a API) UpdateGallery(w http.ResponseWriter, r *http.Request) {
+	// the body can only be read once, the transaction can run more than once
+	var in apiUpdateGallery
+	err := decodeJSON(w, r, &in)
+	if err != nil {
+		writeError(w, r, err, "")
+		return
+	}
+
+	var gallery *models.Gallery
+	err = a.Transactor.InTx(r.Context(), func(ctx stdctx.Context) error {
+		var err error
+		gallery, err = a.gallery(r.WithContext(ctx), (*models.User).CanEditGallery)
+		if err != nil {
+			return err
+		}
+		if !ifMatch(r, etag(newAPIGallery(gallery))) {
+			return errAPIPrecondition
+		}
+
+		if in.Title != nil {
+			gallery.Title, err = galleryTitle(*in.Title)
+			if err != nil {
+				return err
+			}
+		}
+		if in.Description != nil {
+			gallery.Description, err = galleryDescription(*in.Description)
+			if err != nil {
+				return err
+			}
+		}
+		return a.GalleryService.Update(ctx, gallery)
+	})
+	if err != nil {
+		writeError(w, r, err, "updating gallery", "gallery_id", chi.URLParam(r, "id"))
+		return
+	}
+	record(r, a.AuditService, galleryEvent(r, models.EventGalleryUpdated, gallery))
+
+	writeGallery(w, http.StatusOK, gallery)
+}
+
+// DeleteGallery deletes the gallery with its images. With an If-Match header,
+// it only does so when the gallery hasn't changed since, like UpdateGallery.
+func (a API) DeleteGallery(w http.ResponseWriter, r *http.Request) {
+	var gallery *models.Gallery
+	err := a.Transactor.InTx(r.Context(), func(ctx stdctx.Context) error {
+		var err error
+		gallery, err = a.gallery(r.WithContext(ctx), (*models.User).CanDeleteGallery)
+		if err != nil {
+			return err
+		}
+		if !ifMatch(r, etag(newAPIGallery(gallery))) {
+			return errAPIPrecondition
+		}
+		return a.GalleryService.Delete(ctx, gallery.ID)
+	})
+	if err != nil {
+		writeError(w, r, err, "deleting gallery", "gallery_id", chi.URLParam(r, "id"))
+		return
+	}
+	record(r, a.AuditService, galleryEvent(r, models.EventGalleryDeleted, gallery))
+	notify(r, a.WebhookService, gallery.UserID, models.WebhookGalleryDeleted, newAPIGallery(gallery))
+	err = a.ImageService.DeleteFiles(r.Context(), gallery.ID)
+	if err != nil {
+		writeError(w, r, err, "deleting gallery images", "gallery_id", gallery.ID)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Images lists the images of a gallery in the order they were added.
+func (a API) Images(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, nil)
+	if err != nil {
+		writeError(w, r, err, "querying gallery")
+		return
+	}
+
+	images, err := a.ImageService.ByGalleryID(r.Context(), gallery.ID)
+	if err != nil {
+		writeError(w, r, err, "querying gallery images", "gallery_id", gallery.ID)
+		return
+	}
+
+	data := make([]apiImage, 0, len(images))
+	for i := range images {
+		data = append(data, newAPIImage(&images[i]))
+	}
+	page, err := paginate(r, data)
+	if err != nil {
+		writeError(w, r, err, "")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (a API) Image(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, nil)
+	if err != nil {
+		writeError(w, r, err, "querying gallery")
+		return
+	}
+
+	image, err := a.ImageService.ByFilename(r.Context(), gallery.ID, chi.URLParam(r, "filename"))
+	if err != nil {
+		writeError(w, r, err, "querying image", "gallery_id", gallery.ID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIImage(image))
+}
+
+// checkImageFilename turns down the filenames that could escape the
+// directory of the gallery, or hide in it.
+func checkImageFilename(filename string) error {
+	if filename == "" || filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") {
+		return newAPIError(http.StatusUnprocessableEntity, "invalid_field",
+			"The filename %q is not allowed.", filename)
+	}
+	return nil
+}
+
+// UploadImage stores the request body as the image with the filename of the
+// URL, replacing the one with the same name. The type is told from the bytes,
+// not from the Content-Type header.
+func (a API) UploadImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, (*models.User).CanEditGallery)
+	if err != nil {
+		writeError(w, r, err, "querying gallery")
+		return
+	}
+
+	filename := chi.URLParam(r, "filename")
+	err = checkImageFilename(filename)
+	if err != nil {
+		writeError(w, r, err, "")
+		return
+	}
+
+	status := http.StatusOK
+	var replacing int64
+	existing, err := a.ImageService.ByFilename(r.Context(), gallery.ID, filename)
+	if errors.Is(err, models.ErrNotFound) {
+		status = http.StatusCreated
+	} else if err != nil {
+		writeError(w, r, err, "querying image", "gallery_id", gallery.ID)
+		return
+	} else {
+		replacing = existing.Size
+	}
+
+	// the image being replaced makes room for the new one
+	limit := int64(apiMaxImage)
+	room, err := a.room(r, replacing)
+	if err != nil {
+		writeError(w, r, err, "checking storage quota")
+		return
+	}
+	if room >= 0 {
+		if r.ContentLength > room {
+			writeError(w, r, errAPIQuota, "")
+			return
+		}
+		limit = min(limit, room)
+	}
+
+	body := http.MaxBytesReader(w, r.Body, limit)
+	image, err := a.ImageService.Create(r.Context(), gallery.ID, filename, body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge) && tooLarge.Limit < apiMaxImage:
+			err = errAPIQuota
+		case errors.As(err, &tooLarge):
+			err = newAPIError(http.StatusRequestEntityTooLarge, "too_large",
+				"Images can't be larger than %d bytes.", tooLarge.Limit)
+		}
+		writeError(w, r, err, "creating image", "gallery_id", gallery.ID)
+		return
+	}
+	metrics.UploadedBytes.Add(float64(image.Size))
+	// drain what Create didn't read, so the connection can be reused
+	_, _ = io.Copy(io.Discard, body)
+	notify(r, a.WebhookService, gallery.UserID, models.WebhookImageUploaded,
+		webhookImage{GalleryID: gallery.ID, apiImage: newAPIImage(image)})
+
+	if status == http.StatusCreated {
+		w.Header().Set("Location", fmt.Sprintf("/api/v1/galleries/%d/images/%s",
+			gallery.ID, url.PathEscape(image.Filename)))
+	}
+	writeJSON(w, status, newAPIImage(image))
+}
+
+func (a API) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, (*models.User).CanEditGallery)
+	if err != nil {
+		writeError(w, r, err, "querying gallery")
+		return
+	}
+
+	err = a.ImageService.Delete(r.Context(), gallery.ID, chi.URLParam(r, "filename"))
+	if err != nil {
+		writeError(w, r, err, "deleting image", "gallery_id", gallery.ID)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,395 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/openapi"
+)
+
+// APIPrefix is where the API is mounted, the paths of the document start
+// with it.
+const APIPrefix = "/api/v1"
+
+// apiOperation is a route of the API along with how it is documented. Both
+// the router and the OpenAPI document are built from apiOperations, so they
+// can't disagree on what exists.
+type apiOperation struct {
+	method string
+	// pattern is relative to APIPrefix
+	pattern string
+	id      string
+	tag     string
+	summary string
+	scope   models.Scope
+	handler func(API, http.ResponseWriter, *http.Request)
+
+	// params are the query and header parameters, the path ones are told
+	// from the pattern
+	params []openapi.Parameter
+	// body is a value of the type of the JSON request body, upload is the
+	// body when it is bytes instead
+	body   any
+	upload *openapi.RequestBody
+	// responses are what the handler answers with besides the errors every
+	// operation can answer with
+	responses map[int]apiResponse
+}
+
+type apiResponse struct {
+	description string
+	// body is a value of the type of the JSON body, nil for no body
+	body    any
+	headers []string
+}
+
+var pageParams = []openapi.Parameter{
+	{Name: "page", In: "query", Description: "page to return, from 1",
+		Schema: openapi.Int(ptr(1), nil)},
+	{Name: "per_page", In: "query", Description: fmt.Sprintf("items per page, %d by default", apiPerPage),
+		Schema: openapi.Int(ptr(1), ptr(apiMaxPerPage))},
+}
+
+// apiErrors answers an error, which can be more than one.
+func apiErrors(description string) apiResponse {
+	return apiResponse{description: description, body: apiErrorBody{}}
+}
+
+var imageBody = &openapi.RequestBody{
+	Description: "The image, its type is told from its bytes.",
+	Required:    true,
+	Content:     map[string]openapi.MediaType{"application/octet-stream": {Schema: openapi.Binary()}},
+}
+
+// tusResumableParam is sent with every tus request but OPTIONS. Requests
+// without it, or with another version, are answered with a 412.
+var tusResumableParam = openapi.Parameter{
+	Name: "Tus-Resumable", In: "header",
+	Description: "version of the tus protocol, " + tusVersion,
+	Schema:      openapi.String(),
+}
+
+// tusUnsupported answers the requests made with another version of tus.
+var tusUnsupported = apiResponse{
+	description: "The Tus-Resumable header is not " + tusVersion + ".",
+	body:        apiErrorBody{}, headers: []string{"Tus-Version"},
+}
+
+var apiOperations = []apiOperation{
+	{
+		method: http.MethodGet, pattern: "/galleries",
+		id: "listGalleries", tag: "Galleries", summary: "List your galleries",
+		scope: models.ScopeReadGalleries, handler: API.Galleries,
+		params: pageParams,
+		responses: map[int]apiResponse{
+			http.StatusOK: {description: "A page of galleries.", body: apiList[apiGallery]{}},
+		},
+	},
+	{
+		method: http.MethodPost, pattern: "/galleries",
+		id: "createGallery", tag: "Galleries", summary: "Create a gallery",
+		scope: models.ScopeWriteGalleries, handler: API.CreateGallery,
+		body: apiCreateGallery{},
+		responses: map[int]apiResponse{
+			http.StatusCreated: {description: "The gallery was created.", body: apiGallery{},
+				headers: []string{"Location", "ETag"}},
+			http.StatusRequestEntityTooLarge: apiErrors("The body is too large."),
+			http.StatusUnsupportedMediaType:  apiErrors("The body is not JSON."),
+			http.StatusUnprocessableEntity:   apiErrors("The title is blank."),
+		},
+	},
+	{
+		method: http.MethodGet, pattern: "/galleries/{id}",
+		id: "getGallery", tag: "Galleries", summary: "Get a gallery",
+		scope: models.ScopeReadGalleries, handler: API.Gallery,
+		responses: map[int]apiResponse{
+			http.StatusOK:       {description: "The gallery.", body: apiGallery{}, headers: []string{"ETag"}},
+			http.StatusNotFound: apiErrors("There is no such gallery you can see."),
+		},
+	},
+	{
+		method: http.MethodPatch, pattern: "/galleries/{id}",
+		id: "updateGallery", tag: "Galleries", summary: "Change a gallery",
+		scope: models.ScopeWriteGalleries, handler: API.UpdateGallery,
+		body: apiUpdateGallery{},
+		responses: map[int]apiResponse{
+			http.StatusOK:                    {description: "The gallery as changed.", body: apiGallery{}, headers: []string{"ETag"}},
+			http.StatusNotFound:              apiErrors("There is no such gallery you can see."),
+			http.StatusPreconditionFailed:    apiErrors("The gallery changed since If-Match was fetched."),
+			http.StatusRequestEntityTooLarge: apiErrors("The body is too large."),
+			http.StatusUnsupportedMediaType:  apiErrors("The body is not JSON."),
+			http.StatusUnprocessableEntity:   apiErrors("The title is blank."),
+		},
+	},
+	{
+		method: http.MethodDelete, pattern: "/galleries/{id}",
+		id: "deleteGallery", tag: "Galleries", summary: "Delete a gallery and its images",
+		scope: models.ScopeWriteGalleries, handler: API.DeleteGallery,
+		responses: map[int]apiResponse{
+			http.StatusNoContent:          {description: "The gallery was deleted."},
+			http.StatusNotFound:           apiErrors("There is no such gallery you can see."),
+			http.StatusPreconditionFailed: apiErrors("The gallery changed since If-Match was fetched."),
+		},
+	},
+	{
+		method: http.MethodGet, pattern: "/galleries/{id}/images",
+		id: "listImages", tag: "Images", summary: "List the images of a gallery",
+		scope: models.ScopeReadGalleries, handler: API.Images,
+		params: pageParams,
+		responses: map[int]apiResponse{
+			http.StatusOK:       {description: "A page of images, in the order of the gallery.", body: apiList[apiImage]{}},
+			http.StatusNotFound: apiErrors("There is no such gallery you can see."),
+		},
+	},
+	{
+		method: http.MethodGet, pattern: "/galleries/{id}/images/{filename}",
+		id: "getImage", tag: "Images", summary: "Get the details of an image",
+		scope: models.ScopeReadGalleries, handler: API.Image,
+		responses: map[int]apiResponse{
+			http.StatusOK:       {description: "The image.", body: apiImage{}},
+			http.StatusNotFound: apiErrors("There is no such gallery you can see, or image."),
+		},
+	},
+	{
+		method: http.MethodPut, pattern: "/galleries/{id}/images/{filename}",
+		id: "uploadImage", tag: "Images", summary: "Upload an image, replacing the one with the same name",
+		scope: models.ScopeUpload, handler: API.UploadImage,
+		upload: imageBody,
+		responses: map[int]apiResponse{
+			http.StatusOK:                    {description: "The image was replaced.", body: apiImage{}},
+			http.StatusCreated:               {description: "The image was added.", body: apiImage{}, headers: []string{"Location"}},
+			http.StatusNotFound:              apiErrors("There is no such gallery you can see."),
+			http.StatusRequestEntityTooLarge: apiErrors("The image is too large, or doesn't fit in your quota."),
+			http.StatusUnsupportedMediaType:  apiErrors("The file is not a JPEG, PNG, GIF or WebP image."),
+			http.StatusUnprocessableEntity:   apiErrors("The filename is not allowed."),
+		},
+	},
+	{
+		method: http.MethodDelete, pattern: "/galleries/{id}/images/{filename}",
+		id: "deleteImage", tag: "Images", summary: "Delete an image",
+		scope: models.ScopeWriteGalleries, handler: API.DeleteImage,
+		responses: map[int]apiResponse{
+			http.StatusNoContent: {description: "The image was deleted."},
+			http.StatusNotFound:  apiErrors("There is no such gallery you can see, or image."),
+		},
+	},
+	{
+		method: http.MethodOptions, pattern: "/uploads",
+		id: "uploadOptions", tag: "Uploads", summary: "Tell what the resumable uploads support",
+		scope: models.ScopeUpload, handler: API.UploadOptions,
+		responses: map[int]apiResponse{
+			http.StatusNoContent: {description: "The tus version, extensions, largest upload and checksum algorithms.",
+				headers: []string{"Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Tus-Checksum-Algorithm"}},
+		},
+	},
+	{
+		method: http.MethodPost, pattern: "/galleries/{id}/uploads",
+		id: "createUpload", tag: "Uploads", summary: "Start a resumable upload of an image",
+		scope: models.ScopeUpload, handler: API.CreateUpload,
+		params: []openapi.Parameter{
+			tusResumableParam,
+			{Name: "Upload-Length", In: "header", Required: true, Description: "size of the file, in bytes",
+				Schema: openapi.Int(ptr(1), nil)},
+			{Name: "Upload-Metadata", In: "header", Required: true,
+				Description: "the filename, as \"filename <base64>\"", Schema: openapi.String()},
+		},
+		responses: map[int]apiResponse{
+			http.StatusCreated: {description: "The upload was created, send its bytes to the Location.",
+				headers: []string{"Location", "Upload-Expires", "Tus-Resumable"}},
+			http.StatusNotFound:              apiErrors("There is no such gallery you can see."),
+			http.StatusPreconditionFailed:    tusUnsupported,
+			http.StatusRequestEntityTooLarge: apiErrors("The file is too large, or doesn't fit in your quota."),
+			http.StatusUnprocessableEntity:   apiErrors("The filename is not allowed."),
+		},
+	},
+	{
+		method: http.MethodHead, pattern: "/uploads/{uploadID}",
+		id: "getUploadOffset", tag: "Uploads", summary: "Get how much of an upload was received",
+		scope: models.ScopeUpload, handler: API.UploadStatus,
+		params: []openapi.Parameter{tusResumableParam},
+		responses: map[int]apiResponse{
+			http.StatusOK: {description: "Where to carry on from.",
+				headers: []string{"Upload-Offset", "Upload-Length", "Upload-Expires", "Tus-Resumable"}},
+			http.StatusNotFound:           apiErrors("There is no such upload, or it expired."),
+			http.StatusPreconditionFailed: tusUnsupported,
+		},
+	},
+	{
+		method: http.MethodPatch, pattern: "/uploads/{uploadID}",
+		id: "appendUpload", tag: "Uploads", summary: "Send the next chunk of an upload",
+		scope: models.ScopeUpload, handler: API.AppendUpload,
+		params: []openapi.Parameter{
+			tusResumableParam,
+			{Name: "Upload-Offset", In: "header", Required: true, Description: "offset the chunk starts at",
+				Schema: openapi.Int(ptr(0), nil)},
+			{Name: "Upload-Checksum", In: "header",
+				Description: "checksum of the chunk, as \"sha1 <base64 digest>\" or sha256", Schema: openapi.String()},
+		},
+		upload: &openapi.RequestBody{
+			Description: "The chunk. The one completing the upload adds the image to the gallery.",
+			Required:    true,
+			Content:     map[string]openapi.MediaType{tusChunkType: {Schema: openapi.Binary()}},
+		},
+		responses: map[int]apiResponse{
+			http.StatusNoContent: {description: "The chunk was received.",
+				headers: []string{"Upload-Offset", "Upload-Expires", "Tus-Resumable"}},
+			http.StatusNotFound:              apiErrors("There is no such upload, or it expired."),
+			http.StatusConflict:              apiErrors("The offset is not the one of the upload."),
+			http.StatusPreconditionFailed:    tusUnsupported,
+			http.StatusRequestEntityTooLarge: apiErrors("The chunk goes past the length of the upload."),
+			http.StatusUnsupportedMediaType:  apiErrors("The chunk is not " + tusChunkType + ", or the file is not an image."),
+			StatusChecksumMismatch:           apiErrors("The chunk doesn't match its checksum."),
+		},
+	},
+	{
+		method: http.MethodDelete, pattern: "/uploads/{uploadID}",
+		id: "deleteUpload", tag: "Uploads", summary: "Abandon an upload",
+		scope: models.ScopeUpload, handler: API.DeleteUpload,
+		params: []openapi.Parameter{tusResumableParam},
+		responses: map[int]apiResponse{
+			http.StatusNoContent:          {description: "The upload was deleted.", headers: []string{"Tus-Resumable"}},
+			http.StatusNotFound:           apiErrors("There is no such upload."),
+			http.StatusPreconditionFailed: tusUnsupported,
+		},
+	},
+}
+
+// Routes adds the operations of the API to r, each behind the scope it
+// needs. The authentication middlewares are up to the caller.
+func (a API) Routes(r chi.Router) {
+	for _, op := range apiOperations {
+		handler := op.handler
+		r.With(a.RequireScope(op.scope)).MethodFunc(op.method, op.pattern,
+			func(w http.ResponseWriter, r *http.Request) { handler(a, w, r) })
+	}
+}
+
+var apiSpec = sync.OnceValue(func() *openapi.Document {
+	doc := openapi.New(openapi.Info{
+		Title:   "lenslocked API",
+		Version: "1",
+		Description: "Manage your galleries and their images. Authenticate with a " +
+			"personal API token, created at /users/me/tokens.",
+	})
+	doc.Components.SecuritySchemes["bearer"] = openapi.SecurityScheme{
+		Type: "http", Scheme: "bearer",
+		Description: "A personal API token, allowed what its scopes allow.",
+	}
+
+	// the types used by others come first
+	doc.Component("Error", apiErrorBody{})
+	doc.Component("Pagination", apiPage{})
+	doc.Component("Gallery", apiGallery{})
+	doc.Component("Image", apiImage{})
+	doc.Component("GalleryList", apiList[apiGallery]{})
+	doc.Component("ImageList", apiList[apiImage]{})
+
+	for _, op := range apiOperations {
+		doc.AddOperation(op.method, APIPrefix+op.pattern, op.document(doc))
+	}
+
+	return doc
+})
+
+// APISpec returns the OpenAPI document of the API. It is built once and
+// shared, so it must not be changed.
+func APISpec() *openapi.Document {
+	return apiSpec()
+}
+
+// document describes op in doc.
+func (op apiOperation) document(doc *openapi.Document) *openapi.Operation {
+	o := &openapi.Operation{
+		OperationID: op.id,
+		Summary:     op.summary,
+		Tags:        []string{op.tag},
+		Security: []openapi.SecurityRequirement{
+			{"bearer": {string(op.scope)}},
+		},
+		Responses: map[string]*openapi.Response{},
+	}
+
+	for _, segment := range strings.Split(op.pattern, "/") {
+		name, ok := strings.CutPrefix(segment, "{")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSuffix(name, "}")
+		param := openapi.Parameter{Name: name, In: "path", Required: true, Schema: openapi.String()}
+		switch name {
+		case "id":
+			param.Description = "id of the gallery"
+			param.Schema = openapi.Int(ptr(1), nil)
+		case "uploadID":
+			param.Description = "id of the upload, the last segment of its Location"
+		}
+		o.Parameters = append(o.Parameters, param)
+	}
+	o.Parameters = append(o.Parameters, op.params...)
+
+	switch {
+	case op.upload != nil:
+		o.RequestBody = op.upload
+	case op.body != nil:
+		o.RequestBody = &openapi.RequestBody{
+			Required: true,
+			Content:  map[string]openapi.MediaType{openapi.JSON: {Schema: doc.Schema(op.body)}},
+		}
+	}
+
+	responses := map[int]apiResponse{
+		http.StatusBadRequest:   apiErrors("The request is malformed, or doesn't match this document."),
+		http.StatusUnauthorized: apiErrors("The credentials are missing or wrong."),
+		http.StatusForbidden:    apiErrors("The token lacks the scope, or you can't change the gallery."),
+	}
+	for status, resp := range op.responses {
+		responses[status] = resp
+	}
+	for status, resp := range responses {
+		r := &openapi.Response{Description: resp.description}
+		for _, name := range resp.headers {
+			if r.Headers == nil {
+				r.Headers = map[string]openapi.Header{}
+			}
+			r.Headers[name] = openapi.Header{Schema: openapi.String()}
+		}
+		if resp.body != nil {
+			r.Content = map[string]openapi.MediaType{openapi.JSON: {Schema: doc.Schema(resp.body)}}
+		}
+		o.Responses[fmt.Sprint(status)] = r
+	}
+	o.Responses["default"] = &openapi.Response{
+		Description: "Something went wrong on the server.",
+		Content:     map[string]openapi.MediaType{openapi.JSON: {Schema: doc.Schema(apiErrorBody{})}},
+	}
+
+	return o
+}
+
+// OpenAPI serves the OpenAPI document of the API.
+func (a API) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, APISpec())
+}
+
+// Docs serves a page browsing the OpenAPI document.
+func (a API) Docs(w http.ResponseWriter, r *http.Request) {
+	openapi.Docs("lenslocked API", "/api/openapi.json").ServeHTTP(w, r)
+}
+
+// ValidateRequests answers with a 400 the requests that don't match the
+// OpenAPI document, before they reach the handlers.
+func (a API) ValidateRequests(next http.Handler) http.Handler {
+	return APISpec().Middleware(func(w http.ResponseWriter, r *http.Request, err error) {
+		writeError(w, r, newAPIError(http.StatusBadRequest, "invalid_request",
+			"The request doesn't match the API: %v.", err), "")
+	})(next)
+}
+
+// ptr returns a pointer to v, for the optional fields of the schemas.
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,136 @@
+package controllers_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rafaelmdurante/lenslocked/controllers"
+)
+
+func TestAPISpecServed(t *testing.T) {
+	app := newTestApp(t)
+
+	// the document is public, like the docs
+	resp := app.get(app.client, "/api/openapi.json")
+	assertStatus(t, resp, http.StatusOK)
+	var doc struct {
+		OpenAPI string
+		Paths   map[string]map[string]struct {
+			OperationID string
+			Security    []map[string][]string
+			Responses   map[string]any
+		}
+	}
+	decode(t, resp, &doc)
+	if doc.OpenAPI != "3.0.3" {
+		t.Errorf("got openapi %q", doc.OpenAPI)
+	}
+	ids := map[string]bool{}
+	for path, item := range doc.Paths {
+		if !strings.HasPrefix(path, controllers.APIPrefix+"/") {
+			t.Errorf("path %s is not under %s", path, controllers.APIPrefix)
+		}
+		for method, op := range item {
+			if op.OperationID == "" || ids[op.OperationID] {
+				t.Errorf("%s %s has a missing or duplicate operation id %q", method, path, op.OperationID)
+			}
+			ids[op.OperationID] = true
+			if len(op.Security) == 0 {
+				t.Errorf("%s %s has no security", method, path)
+			}
+			if op.Responses["401"] == nil || op.Responses["default"] == nil {
+				t.Errorf("%s %s doesn't document the errors", method, path)
+			}
+		}
+	}
+
+	resp = app.get(app.client, "/api/docs")
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, `data-spec="/api/openapi.json"`)
+}
+
+// TestAPISpecRoutes checks that the router serves the operations of the
+// document, no more and no less.
+func TestAPISpecRoutes(t *testing.T) {
+	r := chi.NewRouter()
+	controllers.API{}.Routes(r)
+
+	var routes []string
+	err := chi.Walk(r, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		routes = append(routes, method+" "+controllers.APIPrefix+route)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var documented []string
+	for path, item := range controllers.APISpec().Paths {
+		for method := range *item {
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+		}
+	}
+
+	sort.Strings(routes)
+	sort.Strings(documented)
+	if strings.Join(routes, "\n") != strings.Join(documented, "\n") {
+		t.Errorf("routes:\n%s\ndon't match the document:\n%s",
+			strings.Join(routes, "\n"), strings.Join(documented, "\n"))
+	}
+}
+
+func TestAPIValidateRequests(t *testing.T) {
+	var got string
+	h := controllers.API{}.ValidateRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got = string(b)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	tests := []struct {
+		name         string
+		method, path string
+		body         string
+		status       int
+	}{
+		{"Valid", http.MethodPost, "/api/v1/galleries", `{"title": "Cats"}`, http.StatusTeapot},
+		{"Wrong type", http.MethodPost, "/api/v1/galleries", `{"title": 3}`, http.StatusBadRequest},
+		{"Empty title", http.MethodPost, "/api/v1/galleries", `{"title": ""}`, http.StatusBadRequest},
+		{"Missing title", http.MethodPost, "/api/v1/galleries", `{}`, http.StatusBadRequest},
+		{"Unknown field", http.MethodPost, "/api/v1/galleries", `{"title": "Cats", "name": "x"}`, http.StatusBadRequest},
+		{"No body", http.MethodPost, "/api/v1/galleries", ``, http.StatusBadRequest},
+		{"Invalid JSON", http.MethodPost, "/api/v1/galleries", `{"title"`, http.StatusBadRequest},
+		{"Optional field", http.MethodPatch, "/api/v1/galleries/1", `{}`, http.StatusTeapot},
+		{"Id not a number", http.MethodGet, "/api/v1/galleries/cats", ``, http.StatusBadRequest},
+		{"Id too small", http.MethodGet, "/api/v1/galleries/0", ``, http.StatusBadRequest},
+		{"Page", http.MethodGet, "/api/v1/galleries?page=2&per_page=100", ``, http.StatusTeapot},
+		{"Page too large", http.MethodGet, "/api/v1/galleries?per_page=101", ``, http.StatusBadRequest},
+		{"Page not a number", http.MethodGet, "/api/v1/galleries?page=two", ``, http.StatusBadRequest},
+		{"Upload", http.MethodPut, "/api/v1/galleries/1/images/cat.png", `not json`, http.StatusTeapot},
+		{"Not documented", http.MethodGet, "/api/v1/nope", ``, http.StatusTeapot},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = ""
+			r := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			resp := response{status: w.Code, body: w.Body.String()}
+			if tt.status == http.StatusBadRequest {
+				assertAPIError(t, resp, http.StatusBadRequest, "invalid_request")
+				return
+			}
+			assertStatus(t, resp, tt.status)
+			if got != tt.body {
+				t.Errorf("the handler got the body %q, want %q", got, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,439 @@
+package controllers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rafaelmdurante/lenslocked/controllers"
+	"github.com/rafaelmdurante/lenslocked/metrics"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// apiRequest sends a request to the API with a token of email, allowed every
+// scope. A body that isn't an io.Reader is sent as JSON. header holds pairs
+// of names and values.
+func (app *testApp) apiRequest(method, path, email string, body any, header ...string) response {
+	app.t.Helper()
+
+	var r io.Reader
+	switch body := body.(type) {
+	case nil:
+	case io.Reader:
+		r = body
+	default:
+		b, err := json.Marshal(body)
+		if err != nil {
+			app.t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, app.server.URL+path, r)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	if email != "" {
+		req.Header.Set("Authorization", "Bearer "+app.apiToken(email))
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	resp, err := app.newClient().Do(req)
+	if err != nil {
+		app.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return app.read(resp)
+}
+
+// apiToken returns a token of email allowed every scope, created the first
+// time, right with the service so that it isn't in the audit log.
+func (app *testApp) apiToken(email string) string {
+	app.t.Helper()
+
+	if token, ok := app.apiTokens[email]; ok {
+		return token
+	}
+	user, err := app.users.ByEmail(context.Background(), email)
+	if err != nil {
+		app.t.Fatalf("user %s: %v", email, err)
+	}
+	token, err := app.tokens.Create(context.Background(), user.ID, "tests", models.Scopes, nil)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	if app.apiTokens == nil {
+		app.apiTokens = map[string]string{}
+	}
+	app.apiTokens[email] = token.Token
+
+	return token.Token
+}
+
+// decode parses the JSON body of resp into v.
+func decode(t *testing.T, resp response, v any) {
+	t.Helper()
+
+	err := json.Unmarshal([]byte(resp.body), v)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", resp.body, err)
+	}
+}
+
+// assertAPIError checks the status and the code of an error body.
+func assertAPIError(t *testing.T, resp response, status int, code string) {
+	t.Helper()
+
+	assertStatus(t, resp, status)
+	var body struct {
+		Error struct {
+			Code    string
+			Message string
+		}
+	}
+	decode(t, resp, &body)
+	if body.Error.Code != code || body.Error.Message == "" {
+		t.Fatalf("got error %+v, want code %q with a message", body.Error, code)
+	}
+}
+
+type apiGallery struct {
+	ID     int
+	UserID int `json:"user_id"`
+	Title  string
+	Hidden bool
+}
+
+func TestAPIAuthentication(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+
+	resp := app.apiRequest(http.MethodGet, "/api/v1/galleries", "", nil)
+	assertAPIError(t, resp, http.StatusUnauthorized, "unauthorized")
+	if resp.header.Get("WWW-Authenticate") == "" {
+		t.Error("401 without a WWW-Authenticate header")
+	}
+	if resp.contentType != "application/json; charset=utf-8" {
+		t.Errorf("got content type %q", resp.contentType)
+	}
+
+	// the session cookie is not enough, the API doesn't look at it
+	resp = app.read(must(t)(app.client.Get(app.server.URL + "/api/v1/galleries")))
+	assertAPIError(t, resp, http.StatusUnauthorized, "unauthorized")
+
+	req, err := http.NewRequest(http.MethodGet, app.server.URL+"/api/v1/galleries", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// passwords aren't taken, not even tried
+	req.SetBasicAuth("bob@example.com", "secret")
+	resp = app.read(must(t)(app.newClient().Do(req)))
+	assertAPIError(t, resp, http.StatusUnauthorized, "unauthorized")
+	if got := resp.header.Get("WWW-Authenticate"); got != `Bearer realm="lenslocked"` {
+		t.Errorf("got WWW-Authenticate %q, want only bearer tokens", got)
+	}
+	if failed := app.events(models.AuditFilter{Type: models.EventSignInFailed}); len(failed) != 0 {
+		t.Errorf("got failed sign ins %+v", failed)
+	}
+
+	assertStatus(t, app.apiRequest(http.MethodGet, "/api/v1/galleries", "bob@example.com", nil),
+		http.StatusOK)
+	assertAPIError(t, app.apiRequest(http.MethodGet, "/api/v1/nope", "bob@example.com", nil),
+		http.StatusNotFound, "not_found")
+	assertAPIError(t, app.apiRequest(http.MethodPost, "/api/v1/galleries/1", "bob@example.com", nil),
+		http.StatusMethodNotAllowed, "method_not_allowed")
+}
+
+// must fails the test on the error of a client call.
+func must(t *testing.T) func(*http.Response, error) *http.Response {
+	return func(resp *http.Response, err error) *http.Response {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+}
+
+func TestAPIGalleries(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	app.signUp(app.newClient(), "carol@example.com", "secret")
+	const bob = "bob@example.com"
+
+	assertAPIError(t, app.apiRequest(http.MethodPost, "/api/v1/galleries", bob,
+		map[string]string{"title": "  "}), http.StatusUnprocessableEntity, "invalid_field")
+	assertAPIError(t, app.apiRequest(http.MethodPost, "/api/v1/galleries", bob,
+		map[string]string{"name": "Cats"}), http.StatusBadRequest, "invalid_json")
+	assertAPIError(t, app.apiRequest(http.MethodPost, "/api/v1/galleries", bob,
+		bytes.NewBufferString("title=Cats"), "Content-Type", "application/x-www-form-urlencoded"),
+		http.StatusUnsupportedMediaType, "unsupported_media_type")
+
+	var ids []int
+	for _, title := range []string{"Cats", "Dogs", "Birds"} {
+		resp := app.apiRequest(http.MethodPost, "/api/v1/galleries", bob,
+			map[string]string{"title": title})
+		assertStatus(t, resp, http.StatusCreated)
+		var g apiGallery
+		decode(t, resp, &g)
+		if g.Title != title || resp.header.Get("ETag") == "" ||
+			resp.location != fmt.Sprintf("/api/v1/galleries/%d", g.ID) {
+			t.Fatalf("got %+v at %q", g, resp.location)
+		}
+		ids = append(ids, g.ID)
+	}
+	created := app.events(models.AuditFilter{Type: models.EventGalleryCreated})
+	if len(created) != 3 {
+		t.Errorf("got %d gallery_created events, want 3", len(created))
+	}
+
+	var list struct {
+		Data       []apiGallery
+		Pagination struct {
+			Page    int
+			PerPage int `json:"per_page"`
+			Total   int
+			Next    string
+		}
+	}
+	resp := app.apiRequest(http.MethodGet, "/api/v1/galleries?per_page=2", bob, nil)
+	assertStatus(t, resp, http.StatusOK)
+	decode(t, resp, &list)
+	if len(list.Data) != 2 || list.Data[0].Title != "Cats" || list.Pagination.Total != 3 ||
+		list.Pagination.Next != "/api/v1/galleries?page=2&per_page=2" {
+		t.Fatalf("got first page %+v", list)
+	}
+	resp = app.apiRequest(http.MethodGet, list.Pagination.Next, bob, nil)
+	list.Data, list.Pagination.Next = nil, ""
+	decode(t, resp, &list)
+	if len(list.Data) != 1 || list.Data[0].Title != "Birds" || list.Pagination.Next != "" {
+		t.Fatalf("got last page %+v", list)
+	}
+	resp = app.apiRequest(http.MethodGet, "/api/v1/galleries?page=9", bob, nil)
+	assertContains(t, resp, `"data":[]`)
+	assertAPIError(t, app.apiRequest(http.MethodGet, "/api/v1/galleries?per_page=1000", bob, nil),
+		http.StatusBadRequest, "invalid_parameter")
+
+	// carol doesn't see bob's galleries in her list, and can't change them
+	resp = app.apiRequest(http.MethodGet, "/api/v1/galleries", "carol@example.com", nil)
+	assertContains(t, resp, `"total":0`)
+	path := fmt.Sprintf("/api/v1/galleries/%d", ids[0])
+	assertStatus(t, app.apiRequest(http.MethodGet, path, "carol@example.com", nil), http.StatusOK)
+	assertAPIError(t, app.apiRequest(http.MethodPatch, path, "carol@example.com",
+		map[string]string{"title": "Mine"}), http.StatusForbidden, "forbidden")
+	assertAPIError(t, app.apiRequest(http.MethodDelete, path, "carol@example.com", nil),
+		http.StatusForbidden, "forbidden")
+
+	resp = app.apiRequest(http.MethodGet, path, bob, nil)
+	tag := resp.header.Get("ETag")
+
+	resp = app.apiRequest(http.MethodPatch, path, bob, map[string]string{"title": "Kittens"},
+		"If-Match", tag)
+	assertStatus(t, resp, http.StatusOK)
+	var g apiGallery
+	decode(t, resp, &g)
+	if g.Title != "Kittens" || resp.header.Get("ETag") == tag {
+		t.Fatalf("got %+v with ETag %s, want Kittens with a new ETag", g, resp.header.Get("ETag"))
+	}
+
+	// the description is Markdown, leaving it out of a change keeps it
+	resp = app.apiRequest(http.MethodPatch, path, bob, map[string]string{"description": "**Fluffy**"})
+	assertContains(t, resp, `"title":"Kittens","description":"**Fluffy**"`)
+	resp = app.apiRequest(http.MethodPatch, path, bob, map[string]string{"title": "Kittens"})
+	assertContains(t, resp, `"description":"**Fluffy**"`)
+	assertAPIError(t, app.apiRequest(http.MethodPatch, path, bob,
+		map[string]string{"description": strings.Repeat("x", 5001)}), http.StatusUnprocessableEntity, "invalid_field")
+	resp = app.apiRequest(http.MethodPost, "/api/v1/galleries", bob,
+		map[string]string{"title": "Fish", "description": "Shot *underwater*"})
+	assertStatus(t, resp, http.StatusCreated)
+	assertContains(t, resp, `"description":"Shot *underwater*"`)
+
+	// someone else changed it since the ETag was fetched
+	assertAPIError(t, app.apiRequest(http.MethodPatch, path, bob, map[string]string{"title": "Cats"},
+		"If-Match", tag), http.StatusPreconditionFailed, "precondition_failed")
+	assertAPIError(t, app.apiRequest(http.MethodDelete, path, bob, nil, "If-Match", tag),
+		http.StatusPreconditionFailed, "precondition_failed")
+
+	assertStatus(t, app.apiRequest(http.MethodDelete, path, bob, nil, "If-Match", "*"),
+		http.StatusNoContent)
+	assertAPIError(t, app.apiRequest(http.MethodGet, path, bob, nil),
+		http.StatusNotFound, "not_found")
+	assertAPIError(t, app.apiRequest(http.MethodGet, "/api/v1/galleries/abc", bob, nil),
+		http.StatusNotFound, "not_found")
+}
+
+func TestAPIHiddenGallery(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApp(t)
+	app.seed("testdata/galleries.yaml")
+	app.signUp(app.client, "bob@example.com", "secret")
+	owner, err := app.users.ByEmail(ctx, "owner@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	galleries, err := app.galleries.ByUserID(ctx, owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.galleries.SetHidden(ctx, galleries[0].ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := fmt.Sprintf("/api/v1/galleries/%d", galleries[0].ID)
+	assertAPIError(t, app.apiRequest(http.MethodGet, path, "bob@example.com", nil),
+		http.StatusNotFound, "not_found")
+	assertAPIError(t, app.apiRequest(http.MethodGet, path+"/images", "bob@example.com", nil),
+		http.StatusNotFound, "not_found")
+
+	resp := app.apiRequest(http.MethodGet, path, "owner@example.com", nil)
+	assertContains(t, resp, `"hidden":true`)
+}
+
+// slowGalleries takes its time to look galleries up, so that concurrent
+// requests all read the gallery before any of them writes it, unless
+// something runs them one after the other.
+type slowGalleries struct {
+	controllers.GalleryService
+}
+
+func (s slowGalleries) ByID(ctx context.Context, id int) (*models.Gallery, error) {
+	gallery, err := s.GalleryService.ByID(ctx, id)
+	time.Sleep(20 * time.Millisecond)
+	return gallery, err
+}
+
+func TestAPIGalleryIfMatchConcurrent(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	const bob = "bob@example.com"
+	var g apiGallery
+	decode(t, app.apiRequest(http.MethodPost, "/api/v1/galleries", bob,
+		map[string]string{"title": "Cats"}), &g)
+	path := fmt.Sprintf("/api/v1/galleries/%d", g.ID)
+	tag := app.apiRequest(http.MethodGet, path, bob, nil).header.Get("ETag")
+
+	api := controllers.API{
+		APITokenService: app.tokens,
+		GalleryService:  slowGalleries{app.galleries},
+		AuditService:    app.audit,
+		WebhookService:  app.webhooks,
+		Transactor:      app.transactor,
+	}
+	r := chi.NewRouter()
+	r.Use(api.SetUser)
+	r.Use(api.RequireUser)
+	api.Routes(r)
+	root := chi.NewRouter()
+	root.Mount(controllers.APIPrefix, r)
+	server := httptest.NewServer(root)
+	t.Cleanup(server.Close)
+
+	// clients that read the same version, only one of them gets to change it
+	statuses := make(chan int, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(statuses); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := strings.NewReader(fmt.Sprintf(`{"title": "Cats %d"}`, i))
+			req, _ := http.NewRequest(http.MethodPatch, server.URL+path, body)
+			req.Header.Set("Authorization", "Bearer "+app.apiToken(bob))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("If-Match", tag)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+	close(statuses)
+
+	got := map[int]int{}
+	for status := range statuses {
+		got[status]++
+	}
+	if got[http.StatusOK] != 1 || got[http.StatusPreconditionFailed] != cap(statuses)-1 {
+		t.Errorf("got statuses %v, want a single 200", got)
+	}
+}
+
+func TestAPIImages(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	app.signUp(app.newClient(), "carol@example.com", "secret")
+	const bob = "bob@example.com"
+
+	resp := app.apiRequest(http.MethodPost, "/api/v1/galleries", bob,
+		map[string]string{"title": "Colours"})
+	var g apiGallery
+	decode(t, resp, &g)
+	path := fmt.Sprintf("/api/v1/galleries/%d/images", g.ID)
+
+	red, err := os.ReadFile("testdata/images/red.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploaded := testutil.ToFloat64(metrics.UploadedBytes)
+	resp = app.apiRequest(http.MethodPut, path+"/red%20one.png", bob, bytes.NewReader(red))
+	assertStatus(t, resp, http.StatusCreated)
+	if resp.location != path+"/red%20one.png" {
+		t.Errorf("got location %q", resp.location)
+	}
+	if got := testutil.ToFloat64(metrics.UploadedBytes) - uploaded; got != float64(len(red)) {
+		t.Errorf("got %v bytes uploaded, want %d", got, len(red))
+	}
+	var image struct {
+		Filename    string
+		ContentType string `json:"content_type"`
+		Size        int
+		URL         string
+	}
+	decode(t, resp, &image)
+	if image.Filename != "red one.png" || image.ContentType != "image/png" ||
+		image.Size != len(red) || image.URL != fmt.Sprintf("/galleries/%d/images/red%%20one.png", g.ID) {
+		t.Errorf("got %+v", image)
+	}
+	// the same name replaces the image
+	assertStatus(t, app.apiRequest(http.MethodPut, path+"/red%20one.png", bob, bytes.NewReader(red)),
+		http.StatusOK)
+	assertStatus(t, app.get(app.newClient(), image.URL), http.StatusOK)
+
+	assertAPIError(t, app.apiRequest(http.MethodPut, path+"/notes.png", bob,
+		bytes.NewBufferString("not an image")), http.StatusUnsupportedMediaType, "not_image")
+	assertAPIError(t, app.apiRequest(http.MethodPut, path+"/.hidden.png", bob,
+		bytes.NewReader(red)), http.StatusUnprocessableEntity, "invalid_field")
+	assertAPIError(t, app.apiRequest(http.MethodPut, path+"/mine.png", "carol@example.com",
+		bytes.NewReader(red)), http.StatusForbidden, "forbidden")
+
+	resp = app.apiRequest(http.MethodGet, path, bob, nil)
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, `"filename":"red one.png"`)
+	assertContains(t, resp, `"total":1`)
+	assertStatus(t, app.apiRequest(http.MethodGet, path+"/red%20one.png", bob, nil), http.StatusOK)
+
+	assertStatus(t, app.apiRequest(http.MethodDelete, path+"/red%20one.png", bob, nil),
+		http.StatusNoContent)
+	assertAPIError(t, app.apiRequest(http.MethodDelete, path+"/red%20one.png", bob, nil),
+		http.StatusNotFound, "not_found")
+	assertAPIError(t, app.apiRequest(http.MethodGet, path+"/red%20one.png", bob, nil),
+		http.StatusNotFound, "not_found")
+	assertStatus(t, app.get(app.newClient(), image.URL), http.StatusNotFound)
+}
@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rafaelmdurante/lenslocked/context"
+	"github.com/rafaelmdurante/lenslocked/errors"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// record adds an event to the audit log, with the IP address, user agent and
+// ID of the request. While an admin impersonates the user, the admin is
+// recorded as the actor.
+//
+// The log is there to find out what happened, not to stop it from happening:
+// failing to record an event is logged and the request goes on.
+func record(r *http.Request, audit AuditService, event models.AuditEvent) {
+	event.IP = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		event.IP = host
+	}
+	event.UserAgent = r.UserAgent()
+	event.RequestID = middleware.GetReqID(r.Context())
+
+	user := context.User(r.Context())
+	if event.ActorID == 0 && user != nil && user.Impersonator != nil &&
+		user.Impersonator.ID != event.UserID {
+		event.ActorID = user.Impersonator.ID
+	}
+
+	err := audit.Record(r.Context(), event)
+	if err != nil {
+		context.Logger(r.Context()).Error("recording audit event",
+			"type", event.Type, "user_id", event.UserID, "err", err)
+	}
+}
+
+// recordFailedSignIn records a failed sign in with email. When the email is
+// the one of an account, the event is recorded as theirs, so its owner sees
+// the attempt in their activity. Nothing of it shows in the response.
+func recordFailedSignIn(r *http.Request, users UserService, audit AuditService, email string) {
+	event := models.AuditEvent{Type: models.EventSignInFailed, Email: email}
+	user, err := users.ByEmail(r.Context(), email)
+	switch {
+	case err == nil:
+		event.UserID = user.ID
+	case !errors.Is(err, models.ErrNotFound):
+		context.Logger(r.Context()).Error("looking up user of failed sign in", "err", err)
+	}
+	record(r, audit, event)
+}
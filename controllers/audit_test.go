@@ -0,0 +1,198 @@
+package controllers_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// events returns the audit events matching the filter, the oldest first.
+func (app *testApp) events(filter models.AuditFilter) []models.AuditEvent {
+	app.t.Helper()
+
+	events, err := app.audit.List(context.Background(), filter, 100, 0)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	slices.Reverse(events)
+
+	return events
+}
+
+func eventTypes(events []models.AuditEvent) string {
+	var types []string
+	for _, event := range events {
+		types = append(types, string(event.Type))
+	}
+	return strings.Join(types, ",")
+}
+
+func TestAuditAccountEvents(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	bob, err := app.users.ByEmail(context.Background(), "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := app.newClient()
+	known := app.post(client, "/signin", url.Values{"email": {"bob@example.com"}, "password": {"wrong"}})
+	unknown := app.post(client, "/signin", url.Values{"email": {"nobody@example.com"}, "password": {"wrong"}})
+	// nothing tells whether the email has an account
+	if known.status != unknown.status || known.location != unknown.location {
+		t.Errorf("got %d for an account and %d without", known.status, unknown.status)
+	}
+	assertRedirect(t, app.post(client, "/signin", url.Values{
+		"email": {"bob@example.com"}, "password": {"secret"},
+	}), "/users/me")
+	assertRedirect(t, app.post(client, "/signout", nil), "/signin")
+
+	app.post(client, "/forgot-pw", url.Values{"email": {"bob@example.com"}})
+	assertRedirect(t, app.post(client, "/reset-pw", url.Values{
+		"token": {resetToken(t, app)}, "password": {"new-secret"},
+	}), "/users/me")
+
+	// failed sign ins are found by the email that was tried, and belong to
+	// the account with that email
+	failed := app.events(models.AuditFilter{Type: models.EventSignInFailed})
+	if len(failed) != 2 || failed[0].Email != "bob@example.com" || failed[0].UserID != bob.ID ||
+		failed[1].Email != "nobody@example.com" || failed[1].UserID != 0 {
+		t.Errorf("got failed sign ins %+v", failed)
+	}
+
+	events := app.events(models.AuditFilter{UserID: bob.ID})
+	want := "sign_up,sign_in_failed,sign_in,sign_out,password_reset_requested,password_reset_consumed,sign_in"
+	if got := eventTypes(events); got != want {
+		t.Fatalf("got events %s, want %s", got, want)
+	}
+	for _, event := range events {
+		if event.IP != "127.0.0.1" || event.UserAgent == "" || event.RequestID == "" ||
+			event.Email != "bob@example.com" {
+			t.Errorf("event %s is missing where it came from: %+v", event.Type, event)
+		}
+	}
+
+	// bob only sees their own history
+	resp := app.get(client, "/users/me/activity")
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, "Reset the password")
+	assertContains(t, resp, "127.0.0.1")
+	assertContains(t, resp, "Failed to sign in")
+	if strings.Contains(resp.body, "nobody@example.com") {
+		t.Error("activity lists the failed sign in of another email")
+	}
+	assertRedirect(t, app.get(app.newClient(), "/users/me/activity"), "/signin")
+}
+
+func TestAuditGalleryEvents(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	bob, err := app.users.ByEmail(ctx, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := app.post(app.client, "/galleries", url.Values{"title": {"Cats"}})
+	var id int
+	_, err = fmt.Sscanf(resp.location, "/galleries/%d/edit", &id)
+	if err != nil {
+		t.Fatalf("create: unexpected redirect to %q", resp.location)
+	}
+	path := fmt.Sprintf("/galleries/%d", id)
+	app.post(app.client, path, url.Values{"title": {"Dogs"}})
+
+	// a moderator deleting bob's gallery is recorded as the actor
+	moderator := app.signUpAs("mod@example.com", models.RoleModerator)
+	mod, err := app.users.ByEmail(ctx, "mod@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRedirect(t, app.post(moderator, "/admin"+path+"/delete", nil), "/admin/galleries")
+
+	events := app.events(models.AuditFilter{UserID: bob.ID})
+	var got []string
+	for _, event := range events {
+		if event.GalleryID == id {
+			got = append(got, fmt.Sprintf("%s by %d", event.Type, event.ActorID))
+		}
+	}
+	want := fmt.Sprintf("gallery_created by 0,gallery_updated by 0,gallery_deleted by %d", mod.ID)
+	if strings.Join(got, ",") != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+
+	resp = app.get(app.client, "/users/me/activity")
+	assertContains(t, resp, "Deleted a gallery")
+	assertContains(t, resp, "by our staff")
+}
+
+func TestAuditImpersonation(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApp(t)
+	admin := app.signUpAs("admin@example.com", models.RoleAdmin)
+	app.signUpAs("bob@example.com", models.RoleUser)
+	bob, err := app.users.ByEmail(ctx, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	self, err := app.users.ByEmail(ctx, "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app.post(admin, fmt.Sprintf("/admin/users/%d/impersonate", bob.ID),
+		url.Values{"reason": {"ticket #42"}})
+	app.post(admin, "/galleries", url.Values{"title": {"Made by the admin"}})
+	app.post(admin, "/signout", nil)
+
+	created := app.events(models.AuditFilter{Type: models.EventGalleryCreated})
+	if len(created) != 1 || created[0].UserID != bob.ID || created[0].ActorID != self.ID {
+		t.Errorf("got %+v, want bob's gallery created by the admin", created)
+	}
+	// the admin's own session ended, not bob's
+	signOuts := app.events(models.AuditFilter{Type: models.EventSignOut})
+	if len(signOuts) != 1 || signOuts[0].UserID != self.ID || signOuts[0].ActorID != 0 {
+		t.Errorf("got %+v, want the admin signing out", signOuts)
+	}
+}
+
+func TestAdminAudit(t *testing.T) {
+	app := newTestApp(t)
+	admin := app.signUpAs("admin@example.com", models.RoleAdmin)
+	moderator := app.signUpAs("mod@example.com", models.RoleModerator)
+	app.post(app.newClient(), "/signin", url.Values{
+		"email": {"intruder@example.com"}, "password": {"guess"},
+	})
+
+	assertStatus(t, app.get(moderator, "/admin/audit"), http.StatusForbidden)
+
+	resp := app.get(admin, "/admin/audit")
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, "intruder@example.com")
+	assertContains(t, resp, "mod@example.com")
+
+	resp = app.get(admin, "/admin/audit?type=sign_in_failed")
+	assertContains(t, resp, "intruder@example.com")
+	if strings.Contains(resp.body, "mod@example.com") {
+		t.Error("filtering on failed sign ins lists a sign in")
+	}
+
+	resp = app.get(admin, "/admin/audit?email=MOD")
+	assertContains(t, resp, "mod@example.com")
+	if strings.Contains(resp.body, "intruder@example.com") {
+		t.Error("filtering on an email lists another one")
+	}
+
+	resp = app.get(admin, "/admin/audit?until=2000-01-01")
+	assertContains(t, resp, "No events found.")
+
+	resp = app.get(admin, "/admin/audit?since=yesterday")
+	assertContains(t, resp, "The since date is invalid.")
+}
@@ -12,17 +12,21 @@ const (
 	CookieSession = "session"
 )
 
-func newCookie(name, value string) *http.Cookie {
+// newCookie marks the cookie as Secure when the app is served over https, so
+// browsers never send it back over plain http. The request can't tell when TLS
+// ends at a reverse proxy, so that comes from the config.
+func newCookie(name, value string, secure bool) *http.Cookie {
 	return &http.Cookie{
 		Name:     name,
 		Value:    value,
 		Path:     "/",
 		HttpOnly: true,
+		Secure:   secure,
 	}
 }
 
-func setCookie(w http.ResponseWriter, name, value string) {
-	cookie := newCookie(name, value)
+func setCookie(w http.ResponseWriter, name, value string, secure bool) {
+	cookie := newCookie(name, value, secure)
 	http.SetCookie(w, cookie)
 }
 
@@ -35,8 +39,8 @@ func readCookie(r *http.Request, name string) (string, error) {
 	return c.Value, nil
 }
 
-func deleteCookie(w http.ResponseWriter, name string) {
-	cookie := newCookie(name, "")
+func deleteCookie(w http.ResponseWriter, name string, secure bool) {
+	cookie := newCookie(name, "", secure)
 	cookie.MaxAge = -1
 	http.SetCookie(w, cookie)
 }
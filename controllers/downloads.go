@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/rafaelmdurante/lenslocked/context"
+	"github.com/rafaelmdurante/lenslocked/errors"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// Download sends the images of the gallery as a ZIP archive, to whoever can
+// see the gallery unless its owner turned downloads off.
+//
+// The archive is streamed as it is written, nothing is stored for a plain
+// download. Resuming one with a Range request needs the whole archive to
+// seek in, so the first such request builds it in the cache and the
+// following downloads are served from there, until an image changes. Both
+// have the same bytes and the same ETag, for If-Range.
+func (g Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userCanView, userCanDownload)
+	if err != nil {
+		return
+	}
+
+	images, err := g.ImageService.ByGalleryID(r.Context(), gallery.ID)
+	if err != nil {
+		serverError(w, r, err, "querying gallery images", "gallery_id", gallery.ID)
+		return
+	}
+	if len(images) == 0 {
+		http.Error(w, "This gallery has no images to download", http.StatusNotFound)
+		return
+	}
+	key, err := models.ArchiveKey(images)
+	if err != nil {
+		serverError(w, r, err, "archiving gallery", "gallery_id", gallery.ID)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": archiveFilename(gallery)}))
+	w.Header().Set("ETag", `"`+key+`"`)
+	// large galleries take longer to send than the write timeout allows
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	f, err := g.ArchiveService.Open(gallery.ID, key)
+	if errors.Is(err, fs.ErrNotExist) && r.Header.Get("Range") != "" {
+		f, err = g.ArchiveService.Build(r.Context(), gallery.ID, key, images)
+	}
+	switch {
+	case err == nil:
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			serverError(w, r, err, "opening gallery archive", "gallery_id", gallery.ID)
+			return
+		}
+		http.ServeContent(w, r, "", stat.ModTime(), f)
+		return
+	case !errors.Is(err, fs.ErrNotExist):
+		serverError(w, r, err, "opening gallery archive", "gallery_id", gallery.ID)
+		return
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	err = models.WriteArchive(r.Context(), w, images)
+	if err != nil {
+		// the status is long gone, the client gets a truncated archive
+		logger := context.Logger(r.Context())
+		if errors.Canceled(err) {
+			logger.Info("streaming gallery archive: request canceled by the client",
+				"gallery_id", gallery.ID)
+			return
+		}
+		logger.Error("streaming gallery archive", "gallery_id", gallery.ID, "err", err)
+	}
+}
+
+// archiveFilename names the archive after the gallery, without the
+// characters file systems don't take.
+func archiveFilename(gallery *models.Gallery) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(gallery.Title))
+	if name == "" {
+		name = fmt.Sprintf("gallery-%d", gallery.ID)
+	}
+	return name + ".zip"
+}
+
+// SetDownloads turns downloading the gallery as a ZIP archive on or off.
+func (g Galleries) SetDownloads(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userCanEdit)
+	if err != nil {
+		return
+	}
+	enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+	if err != nil {
+		http.Error(w, "Invalid value of enabled", http.StatusBadRequest)
+		return
+	}
+
+	err = g.GalleryService.SetDownloads(r.Context(), gallery.ID, enabled)
+	if err != nil {
+		serverError(w, r, err, "setting gallery downloads", "gallery_id", gallery.ID)
+		return
+	}
+	record(r, g.AuditService, galleryEvent(r, models.EventGalleryUpdated, gallery))
+
+	path := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, path, http.StatusFound)
+}
+
+// userCanDownload lets only the owner download a gallery whose downloads are
+// turned off.
+func userCanDownload(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	if gallery.DownloadsDisabled && !context.User(r.Context()).CanEditGallery(gallery) {
+		http.Error(w, "Downloading this gallery is turned off", http.StatusForbidden)
+		return fmt.Errorf("downloads of gallery %d are off", gallery.ID)
+	}
+	return nil
+}
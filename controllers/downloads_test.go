@@ -0,0 +1,132 @@
+package controllers_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// getRange gets path with a Range header, and If-Range when etag is set.
+func (app *testApp) getRange(client *http.Client, path, rng, etag string) response {
+	app.t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, app.server.URL+path, nil)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	req.Header.Set("Range", rng)
+	if etag != "" {
+		req.Header.Set("If-Range", etag)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		app.t.Fatalf("GET %s: %v", path, err)
+	}
+	return app.read(resp)
+}
+
+func TestGalleryDownload(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	resp := app.post(app.client, "/galleries", url.Values{"title": {"Cats: 2024"}})
+	var galleryID int
+	fmt.Sscanf(resp.location, "/galleries/%d/edit", &galleryID)
+	path := fmt.Sprintf("/galleries/%d/download", galleryID)
+	toggle := fmt.Sprintf("/galleries/%d/downloads", galleryID)
+	anon := app.newClient()
+
+	assertStatus(t, app.get(anon, path), http.StatusNotFound)
+	for _, name := range []string{"red.png", "blue.png"} {
+		f, err := os.Open("testdata/images/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = app.images.Create(context.Background(), galleryID, name, f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertContains(t, app.get(anon, fmt.Sprintf("/galleries/%d", galleryID)), `href="`+path+`"`)
+
+	// a plain download is streamed
+	full := app.get(anon, path)
+	assertStatus(t, full, http.StatusOK)
+	etag := full.header.Get("ETag")
+	if full.contentType != "application/zip" || etag == "" || full.header.Get("Accept-Ranges") != "bytes" ||
+		full.header.Get("Content-Disposition") != `attachment; filename="Cats_ 2024.zip"` {
+		t.Errorf("got headers %v", full.header)
+	}
+	zr, err := zip.NewReader(bytes.NewReader([]byte(full.body)), int64(len(full.body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Name != "red.png" || zr.File[1].Name != "blue.png" {
+		t.Errorf("got entries %v", zr.File)
+	}
+	if entries, _ := os.ReadDir(app.archives.Dir); len(entries) != 0 {
+		t.Errorf("got %d cached archives, want none yet", len(entries))
+	}
+
+	// resuming builds the archive, with the same bytes
+	resp = app.getRange(anon, path, "bytes=100-", etag)
+	assertStatus(t, resp, http.StatusPartialContent)
+	if resp.body != full.body[100:] || resp.header.Get("ETag") != etag {
+		t.Errorf("got %d bytes with ETag %s, want the rest of the archive", len(resp.body), resp.header.Get("ETag"))
+	}
+	resp = app.get(anon, path)
+	if resp.body != full.body || resp.header.Get("Content-Length") != fmt.Sprint(len(full.body)) {
+		t.Errorf("got %d bytes, want the cached archive", len(resp.body))
+	}
+
+	// a changed gallery is a different archive
+	f, err := os.Open("testdata/images/blue.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = app.images.Create(context.Background(), galleryID, "more blue.png", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = app.getRange(anon, path, "bytes=100-", etag)
+	assertStatus(t, resp, http.StatusOK)
+	if resp.header.Get("ETag") == etag {
+		t.Error("got the ETag of the old archive")
+	}
+	if entries, _ := os.ReadDir(app.archives.Dir); len(entries) != 1 {
+		t.Errorf("got %d cached archives, want the old one replaced", len(entries))
+	}
+
+	// the owner turns downloads off, for everyone but themselves
+	carol := app.signUpAs("carol@example.com", models.RoleUser)
+	assertStatus(t, app.post(carol, toggle, url.Values{"enabled": {"false"}}), http.StatusForbidden)
+	assertContains(t, app.get(app.client, fmt.Sprintf("/galleries/%d/edit", galleryID)), "Turn downloads off")
+	resp = app.post(app.client, toggle, url.Values{"enabled": {"false"}})
+	assertRedirect(t, resp, fmt.Sprintf("/galleries/%d/edit", galleryID))
+	assertContains(t, app.get(app.client, fmt.Sprintf("/galleries/%d/edit", galleryID)), "Turn downloads on")
+	assertStatus(t, app.get(anon, path), http.StatusForbidden)
+	assertStatus(t, app.get(carol, path), http.StatusForbidden)
+	if resp := app.get(anon, fmt.Sprintf("/galleries/%d", galleryID)); strings.Contains(resp.body, path) {
+		t.Error("the gallery page links to the download")
+	}
+	assertStatus(t, app.get(app.client, path), http.StatusOK)
+	assertStatus(t, app.post(app.client, toggle, url.Values{"enabled": {"maybe"}}), http.StatusBadRequest)
+
+	// and a hidden gallery can't be downloaded either
+	app.post(app.client, toggle, url.Values{"enabled": {"true"}})
+	assertStatus(t, app.get(anon, path), http.StatusOK)
+	err = app.galleries.SetHidden(context.Background(), galleryID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStatus(t, app.get(anon, path), http.StatusNotFound)
+}
@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rafaelmdurante/lenslocked/context"
+	"github.com/rafaelmdurante/lenslocked/errors"
+)
+
+// StatusClientClosedRequest is the non-standard status code, made popular by
+// nginx, used when the client disconnects before the response is ready.
+const StatusClientClosedRequest = 499
+
+// serverError logs err along with msg and args, then answers with a generic
+// 500 that gives the request ID, for support to find the error in the logs.
+// Canceled work is not a failure of the app, so it is logged and
+// answered differently: with a 499 when the client went away and a 504 when a
+// deadline expired.
+func serverError(w http.ResponseWriter, r *http.Request, err error, msg string, args ...any) {
+	logger := context.Logger(r.Context())
+	args = append(args, "err", err)
+
+	switch {
+	case errors.Canceled(err):
+		logger.Info(msg+": request canceled by the client", args...)
+		// nobody is listening anymore, but the status is still recorded by
+		// the logging and metrics middleware
+		w.WriteHeader(StatusClientClosedRequest)
+	case errors.Timeout(err):
+		logger.Warn(msg+": deadline exceeded", args...)
+		http.Error(w, withRequestID(r, "The request took too long, please try again."),
+			http.StatusGatewayTimeout)
+	default:
+		logger.Error(msg, args...)
+		http.Error(w, withRequestID(r, "Something went wrong."), http.StatusInternalServerError)
+	}
+}
+
+// withRequestID adds the request ID to the error message, like the error
+// messages of the templates do.
+func withRequestID(r *http.Request, msg string) string {
+	if id := middleware.GetReqID(r.Context()); id != "" {
+		msg += fmt.Sprintf(" If the problem persists, contact support with the request ID %s.", id)
+	}
+	return msg
+}
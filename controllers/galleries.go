@@ -1,14 +1,21 @@
 package controllers
 
 import (
-	"errors"
+	stdctx "context"
 	"fmt"
-	"math/rand"
+	"html/template"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/rafaelmdurante/lenslocked/context"
+	"github.com/rafaelmdurante/lenslocked/errors"
+	"github.com/rafaelmdurante/lenslocked/markdown"
+	"github.com/rafaelmdurante/lenslocked/metrics"
 	"github.com/rafaelmdurante/lenslocked/models"
 )
 
@@ -19,30 +26,110 @@ type Galleries struct {
 		Index Template
 		Show  Template
 	}
-	GalleryService *models.GalleryService
+	GalleryService GalleryService
+	ImageService   ImageService
+	AuditService   AuditService
+	WebhookService WebhookService
+	ArchiveService ArchiveService
+	UploadService  UploadService
+	Transactor     Transactor
+	// BaseURL is the public URL of the app, used in the link previews
+	BaseURL string
+	// Quota is how many bytes the images and the unfinished uploads of a
+	// user can take up, imports included. Zero doesn't limit anything.
+	Quota int64
 }
 
-func (g Galleries) New(w http.ResponseWriter, r *http.Request) {
-	var data struct {
-		Title string
+// The longest captions, alt texts and descriptions, in characters. Alt texts
+// are read out by screen readers, they should be short.
+const (
+	maxCaptionLength     = 500
+	maxAltLength         = 250
+	maxDescriptionLength = 5000
+)
+
+// galleryEvent is an audit event about the gallery, done by the current user:
+// its owner, or a moderator acting on someone else's gallery.
+func galleryEvent(r *http.Request, typ models.AuditEventType, gallery *models.Gallery) models.AuditEvent {
+	event := models.AuditEvent{Type: typ, UserID: gallery.UserID, GalleryID: gallery.ID}
+	user := context.User(r.Context())
+	if user.ID == gallery.UserID {
+		event.Email = user.Email
+	} else {
+		event.ActorID = user.ID
+	}
+
+	return event
+}
+
+// galleryForm is the data of the new gallery page.
+type galleryForm struct {
+	Title                string
+	Description          string
+	DescriptionHTML      template.HTML
+	MaxDescriptionLength int
+}
+
+func newGalleryForm(r *http.Request) galleryForm {
+	description := r.FormValue("description")
+	return galleryForm{
+		Title:                r.FormValue("title"),
+		Description:          description,
+		DescriptionHTML:      markdown.Render(description),
+		MaxDescriptionLength: maxDescriptionLength,
 	}
-	data.Title = r.FormValue("title")
-	g.Templates.New.Execute(w, r, data)
+}
+
+// checkDescription returns an error for the user when the description is
+// too long.
+func checkDescription(description string) error {
+	if utf8.RuneCountInString(description) > maxDescriptionLength {
+		return errors.Public(fmt.Errorf("description too long"),
+			fmt.Sprintf("The description can't be longer than %d characters.", maxDescriptionLength))
+	}
+	return nil
+}
+
+// createGallery creates the gallery along with its description, which
+// GalleryService.Create leaves out.
+func createGallery(ctx stdctx.Context, galleries GalleryService, tx Transactor, title, description string, userID int) (*models.Gallery, error) {
+	var gallery *models.Gallery
+	err := tx.InTx(ctx, func(ctx stdctx.Context) error {
+		var err error
+		gallery, err = galleries.Create(ctx, title, userID)
+		if err != nil || description == "" {
+			return err
+		}
+		gallery.Description = description
+		return galleries.Update(ctx, gallery)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return gallery, nil
+}
+
+func (g Galleries) New(w http.ResponseWriter, r *http.Request) {
+	g.Templates.New.Execute(w, r, newGalleryForm(r))
 }
 
 func (g Galleries) Create(w http.ResponseWriter, r *http.Request) {
-	var data struct {
-		UserID int
-		Title  string
+	data := newGalleryForm(r)
+	err := checkDescription(data.Description)
+	if err != nil {
+		g.Templates.New.Execute(w, r, data, err)
+		return
 	}
-	data.UserID = context.User(r.Context()).ID
-	data.Title = r.FormValue("title")
 
-	gallery, err := g.GalleryService.Create(data.Title, data.UserID)
+	gallery, err := createGallery(r.Context(), g.GalleryService, g.Transactor,
+		data.Title, data.Description, context.User(r.Context()).ID)
 	if err != nil {
 		g.Templates.New.Execute(w, r, data, err)
 		return
 	}
+	metrics.GalleriesCreated.Inc()
+	record(r, g.AuditService, galleryEvent(r, models.EventGalleryCreated, gallery))
+	notify(r, g.WebhookService, gallery.UserID, models.WebhookGalleryCreated, newAPIGallery(gallery))
 
 	// this page doesn't exist but we'll eventually redirect here
 	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
@@ -50,77 +137,213 @@ func (g Galleries) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	gallery, err := g.galleryByID(w, r, userCanEdit)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
 		return
 	}
 
-	gallery, err := g.GalleryService.ByID(id)
+	g.renderEdit(w, r, gallery, nil)
+}
+
+// renderEdit renders the edit page of the gallery, along with the outcome of
+// an import when there was one.
+func (g Galleries) renderEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, report *importReport, errs ...error) {
+	images, err := g.ImageService.ByGalleryID(r.Context(), gallery.ID)
 	if err != nil {
-		if err == models.ErrNotFound {
-			http.Error(w, "Gallery not found", http.StatusNotFound)
-			return
-		}
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		serverError(w, r, err, "querying gallery images", "gallery_id", gallery.ID)
 		return
 	}
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "You are not authorised to edit this gallery", http.StatusForbidden)
-		return
+	type Image struct {
+		URL      string
+		Filename string
+		Caption  string
+		Alt      string
+		IsCover  bool
 	}
 
 	data := struct {
-		ID    int
-		Title string
+		ID                   int
+		Title                string
+		Description          string
+		DescriptionHTML      template.HTML
+		MaxDescriptionLength int
+		Hidden               bool
+		DownloadsDisabled    bool
+		Cover                string
+		Images               []Image
+		MaxCaptionLength     int
+		MaxAltLength         int
+		Import               *importReport
 	}{
-		ID:    gallery.ID,
-		Title: gallery.Title,
+		ID:                   gallery.ID,
+		Title:                gallery.Title,
+		Description:          gallery.Description,
+		DescriptionHTML:      markdown.Render(gallery.Description),
+		MaxDescriptionLength: maxDescriptionLength,
+		Hidden:               gallery.HiddenAt != nil,
+		DownloadsDisabled:    gallery.DownloadsDisabled,
+		Cover:                gallery.Cover,
+		MaxCaptionLength:     maxCaptionLength,
+		MaxAltLength:         maxAltLength,
+		Import:               report,
+	}
+	for _, image := range images {
+		data.Images = append(data.Images, Image{
+			URL:      imageURL(image),
+			Filename: image.Filename,
+			Caption:  image.Caption,
+			Alt:      image.Alt,
+			IsCover:  image.Filename == gallery.Cover,
+		})
 	}
 
-	g.Templates.Edit.Execute(w, r, data)
+	g.Templates.Edit.Execute(w, r, data, errs...)
 }
 
 func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	gallery, err := g.galleryByID(w, r, userCanEdit)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
 		return
 	}
 
-	gallery, err := g.GalleryService.ByID(id)
+	gallery.Title = r.FormValue("title")
+	gallery.Description = r.FormValue("description")
+	err = checkDescription(gallery.Description)
 	if err != nil {
-		if errors.Is(err, models.ErrNotFound) {
-			http.Error(w, "Gallery not found", http.StatusNotFound)
-			return
-		}
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		g.renderEdit(w, r, gallery, nil, err)
+		return
+	}
+	err = g.GalleryService.Update(r.Context(), gallery)
+	if err != nil {
+		serverError(w, r, err, "updating gallery", "gallery_id", gallery.ID)
 		return
 	}
+	record(r, g.AuditService, galleryEvent(r, models.EventGalleryUpdated, gallery))
 
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "You are not authorised to edit this gallery", http.StatusForbidden)
+	path := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, path, http.StatusFound)
+}
+
+// UpdateImages saves the order, captions and alt texts of the images of the
+// edit page along with the cover, all at once. The form lists the images in
+// the order the owner arranged them.
+func (g Galleries) UpdateImages(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userCanEdit)
+	if err != nil {
 		return
 	}
 
-	gallery.Title = r.FormValue("title")
-	err = g.GalleryService.Update(gallery)
+	// the page posts a plain form, its script a multipart one
+	err = r.ParseMultipartForm(1 << 20)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	filenames := r.PostForm["filename"]
+	captions := r.PostForm["caption"]
+	alts := r.PostForm["alt"]
+	if len(captions) != len(filenames) || len(alts) != len(filenames) {
+		http.Error(w, "Each image needs a caption and an alt text", http.StatusBadRequest)
+		return
+	}
+
+	details := make([]models.ImageDetails, 0, len(filenames))
+	seen := make(map[string]bool, len(filenames))
+	for i, filename := range filenames {
+		if seen[filename] {
+			http.Error(w, "An image is listed twice", http.StatusBadRequest)
+			return
+		}
+		seen[filename] = true
+
+		d := models.ImageDetails{
+			Filename: filename,
+			Position: i + 1,
+			Caption:  strings.TrimSpace(captions[i]),
+			Alt:      strings.TrimSpace(alts[i]),
+		}
+		var msg string
+		switch {
+		case utf8.RuneCountInString(d.Caption) > maxCaptionLength:
+			msg = fmt.Sprintf("The caption of %s can't be longer than %d characters.", filename, maxCaptionLength)
+		case utf8.RuneCountInString(d.Alt) > maxAltLength:
+			msg = fmt.Sprintf("The alt text of %s can't be longer than %d characters.", filename, maxAltLength)
+		}
+		if msg != "" {
+			g.renderEdit(w, r, gallery, nil, errors.Public(fmt.Errorf("invalid details of %s", filename), msg))
+			return
+		}
+		details = append(details, d)
+	}
+
+	err = g.Transactor.InTx(r.Context(), func(ctx stdctx.Context) error {
+		err := g.ImageService.UpdateDetails(ctx, gallery.ID, details)
+		if err != nil {
+			return err
+		}
+		return g.GalleryService.SetCover(ctx, gallery.ID, r.PostForm.Get("cover"))
+	})
+	if errors.Is(err, models.ErrNotFound) {
+		// someone deleted an image since the page was loaded
+		g.renderEdit(w, r, gallery, nil, errors.Public(err,
+			"An image is no longer in the gallery, nothing was saved. Here are the images as they are now."))
+		return
+	}
 	if err != nil {
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		serverError(w, r, err, "updating gallery images", "gallery_id", gallery.ID)
 		return
 	}
+	record(r, g.AuditService, galleryEvent(r, models.EventGalleryUpdated, gallery))
 
 	path := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
 	http.Redirect(w, r, path, http.StatusFound)
 }
 
+// Preview renders the Markdown of a description as the gallery page does,
+// for the live preview of the new and edit pages.
+func (g Galleries) Preview(w http.ResponseWriter, r *http.Request) {
+	description := r.FormValue("description")
+	if utf8.RuneCountInString(description) > maxDescriptionLength {
+		msg := fmt.Sprintf("The description can't be longer than %d characters.", maxDescriptionLength)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	fmt.Fprint(w, markdown.Render(description))
+}
+
+func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userCanDelete)
+	if err != nil {
+		return
+	}
+
+	err = g.GalleryService.Delete(r.Context(), gallery.ID)
+	if err != nil {
+		serverError(w, r, err, "deleting gallery", "gallery_id", gallery.ID)
+		return
+	}
+	record(r, g.AuditService, galleryEvent(r, models.EventGalleryDeleted, gallery))
+	notify(r, g.WebhookService, gallery.UserID, models.WebhookGalleryDeleted, newAPIGallery(gallery))
+	err = g.ImageService.DeleteFiles(r.Context(), gallery.ID)
+	if err != nil {
+		serverError(w, r, err, "deleting gallery images", "gallery_id", gallery.ID)
+		return
+	}
+
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
 func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	type Gallery struct {
-		ID    int
-		Title string
+		ID     int
+		Title  string
+		Hidden bool
+		// CoverURL is the URL of the cover image, if any
+		CoverURL string
 	}
 
 	var data struct {
@@ -128,17 +351,22 @@ func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := context.User(r.Context())
-	galleries, err := g.GalleryService.ByUserID(user.ID)
+	galleries, err := g.GalleryService.ByUserID(r.Context(), user.ID)
 	if err != nil {
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		serverError(w, r, err, "querying user galleries")
 		return
 	}
 
 	for _, gallery := range galleries {
-		data.Galleries = append(data.Galleries, Gallery{
-			ID:    gallery.ID,
-			Title: gallery.Title,
-		})
+		g := Gallery{
+			ID:     gallery.ID,
+			Title:  gallery.Title,
+			Hidden: gallery.HiddenAt != nil,
+		}
+		if gallery.Cover != "" {
+			g.CoverURL = imageURL(models.Image{GalleryID: gallery.ID, Filename: gallery.Cover})
+		}
+		data.Galleries = append(data.Galleries, g)
 	}
 
 	// TODO: Lookup the galleries we're going to render'
@@ -146,41 +374,172 @@ func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 }
 
 func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	gallery, err := g.galleryByID(w, r, userCanView)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
 		return
 	}
 
-	gallery, err := g.GalleryService.ByID(id)
+	images, err := g.ImageService.ByGalleryID(r.Context(), gallery.ID)
 	if err != nil {
-		if errors.Is(err, models.ErrNotFound) {
-			http.Error(w, "Gallery not found", http.StatusNotFound)
-			return
-		}
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		serverError(w, r, err, "querying gallery images", "gallery_id", gallery.ID)
 		return
 	}
 
+	type Image struct {
+		URL      string
+		Filename string
+		Caption  string
+		Alt      string
+	}
+
 	var data struct {
-		ID     int
-		Title  string
-		Images []string
+		ID          int
+		Title       string
+		Description template.HTML
+		Hidden      bool
+		// Download is set when the user can download the gallery as a ZIP
+		Download bool
+		Images   []Image
+		// Preview is what the social networks show of links to the gallery
+		Preview struct {
+			URL   string
+			Image string
+		}
 	}
 	data.ID = gallery.ID
 	data.Title = gallery.Title
-
-	// We are going to pseudo-randomly come up with 20 images to render for our
-	// gallery until we actually support uploading images. These images will use
-	// placecats.com, which gives us cat images.
-	for i := 0; i < 20; i++ {
-		// width and heigh are random values between 200 and 700
-		w, h := rand.Intn(500)+200, rand.Intn(500)+200
-		// using the width and height, we generate a URL
-		catImageURL := fmt.Sprintf("https://placecats.com/%d/%d", w, h)
-		// then add the URL to our images
-		data.Images = append(data.Images, catImageURL)
+	data.Description = markdown.Render(gallery.Description)
+	data.Hidden = gallery.HiddenAt != nil
+	data.Download = len(images) > 0 && (!gallery.DownloadsDisabled ||
+		context.User(r.Context()).CanEditGallery(gallery))
+	data.Preview.URL = fmt.Sprintf("%s/galleries/%d", g.BaseURL, gallery.ID)
+	for _, image := range images {
+		// the image says nothing to screen readers without some text
+		alt := image.Alt
+		if alt == "" {
+			alt = image.Caption
+		}
+		if alt == "" {
+			alt = image.Filename
+		}
+		data.Images = append(data.Images, Image{
+			URL:      imageURL(image),
+			Filename: image.Filename,
+			Caption:  image.Caption,
+			Alt:      alt,
+		})
+		// without a cover, the first image stands for the gallery
+		if image.Filename == gallery.Cover || data.Preview.Image == "" {
+			data.Preview.Image = g.BaseURL + imageURL(image)
+		}
 	}
 
 	g.Templates.Show.Execute(w, r, data)
 }
+
+// Image serves the file of an image, to whoever can see the gallery.
+func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userCanView)
+	if err != nil {
+		return
+	}
+	filename := chi.URLParam(r, "filename")
+
+	image, err := g.ImageService.ByFilename(r.Context(), gallery.ID, filename)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		serverError(w, r, err, "querying image", "gallery_id", gallery.ID)
+		return
+	}
+
+	f, err := os.Open(image.Path)
+	if err != nil {
+		serverError(w, r, err, "opening image", "gallery_id", gallery.ID, "path", image.Path)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		serverError(w, r, err, "opening image", "gallery_id", gallery.ID, "path", image.Path)
+		return
+	}
+
+	// the type was checked on upload, browsers must not guess another one
+	w.Header().Set("Content-Type", image.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, image.Filename, stat.ModTime(), f)
+}
+
+func imageURL(image models.Image) string {
+	return fmt.Sprintf("/galleries/%d/images/%s",
+		image.GalleryID, url.PathEscape(image.Filename))
+}
+
+// galleryOpt checks the gallery before a handler uses it. When the check
+// fails, it writes the response and returns an error.
+type galleryOpt func(http.ResponseWriter, *http.Request, *models.Gallery) error
+
+// galleryByID looks up the gallery of the id URL parameter and runs the checks
+// in opts on it. On error the response is already written, the handler only
+// has to return.
+func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...galleryOpt) (*models.Gallery, error) {
+	return g.galleryWithID(w, r, chi.URLParam(r, "id"), opts...)
+}
+
+// galleryWithID works like galleryByID, for the routes where chi hasn't
+// parsed the URL yet, like a middleware.
+func (g Galleries) galleryWithID(w http.ResponseWriter, r *http.Request, param string, opts ...galleryOpt) (*models.Gallery, error) {
+	id, err := strconv.Atoi(param)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return nil, err
+	}
+
+	gallery, err := g.GalleryService.ByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return nil, err
+		}
+		serverError(w, r, err, "querying gallery", "gallery_id", id)
+		return nil, err
+	}
+
+	for _, opt := range opts {
+		err = opt(w, r, gallery)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return gallery, nil
+}
+
+func userCanView(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	if !context.User(r.Context()).CanViewGallery(gallery) {
+		// a hidden gallery looks like it doesn't exist
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return fmt.Errorf("gallery %d is hidden", gallery.ID)
+	}
+	return nil
+}
+
+func userCanEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	if !context.User(r.Context()).CanEditGallery(gallery) {
+		http.Error(w, "You are not authorised to edit this gallery", http.StatusForbidden)
+		return fmt.Errorf("user cannot edit gallery %d", gallery.ID)
+	}
+	return nil
+}
+
+func userCanDelete(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	if !context.User(r.Context()).CanDeleteGallery(gallery) {
+		http.Error(w, "You are not authorised to delete this gallery", http.StatusForbidden)
+		return fmt.Errorf("user cannot delete gallery %d", gallery.ID)
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package controllers_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+func TestGalleriesRequireUser(t *testing.T) {
+	app := newTestApp(t)
+
+	for _, path := range []string{"/galleries", "/galleries/new", "/galleries/1/edit"} {
+		assertRedirect(t, app.get(app.client, path), "/signin")
+	}
+	assertRedirect(t, app.post(app.client, "/galleries", url.Values{"title": {"x"}}), "/signin")
+}
+
+func TestGalleryCRUD(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+
+	resp := app.post(app.client, "/galleries", url.Values{"title": {"Wedding"}})
+	if resp.status != http.StatusFound {
+		t.Fatalf("create: got %d, want 302", resp.status)
+	}
+	var id int
+	_, err := fmt.Sscanf(resp.location, "/galleries/%d/edit", &id)
+	if err != nil {
+		t.Fatalf("create: unexpected redirect to %q", resp.location)
+	}
+
+	resp = app.get(app.client, resp.location)
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, `value="Wedding"`)
+
+	resp = app.get(app.client, "/galleries")
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, "Wedding")
+
+	path := fmt.Sprintf("/galleries/%d", id)
+	resp = app.post(app.client, path, url.Values{"title": {"Wedding day"}})
+	assertRedirect(t, resp, path+"/edit")
+
+	// galleries can be viewed without signing in
+	resp = app.get(app.newClient(), path)
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, "Wedding day")
+
+	resp = app.post(app.client, path+"/delete", nil)
+	assertRedirect(t, resp, "/galleries")
+
+	assertStatus(t, app.get(app.client, path), http.StatusNotFound)
+	_, err = app.galleries.ByID(context.Background(), id)
+	if err == nil {
+		t.Fatal("gallery still exists after being deleted")
+	}
+}
+
+func TestGalleryOwnership(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	resp := app.post(app.client, "/galleries", url.Values{"title": {"Bob's"}})
+	if resp.status != http.StatusFound {
+		t.Fatalf("create: got %d, want 302", resp.status)
+	}
+	path := resp.location[:len(resp.location)-len("/edit")]
+
+	alice := app.newClient()
+	app.signUp(alice, "alice@example.com", "secret")
+
+	assertStatus(t, app.get(alice, path+"/edit"), http.StatusForbidden)
+	assertStatus(t, app.post(alice, path, url.Values{"title": {"Alice's"}}), http.StatusForbidden)
+	assertStatus(t, app.post(alice, path+"/delete", nil), http.StatusForbidden)
+
+	resp = app.get(alice, "/galleries")
+	assertStatus(t, resp, http.StatusOK)
+	if strings.Contains(resp.body, "Bob&#39;s") {
+		t.Fatal("alice can see bob's gallery in her list")
+	}
+
+	resp = app.get(app.client, path)
+	assertContains(t, resp, "Bob&#39;s")
+}
+
+func TestGalleryNotFound(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+
+	assertStatus(t, app.get(app.client, "/galleries/999"), http.StatusNotFound)
+	assertStatus(t, app.get(app.client, "/galleries/999/edit"), http.StatusNotFound)
+	assertStatus(t, app.get(app.client, "/galleries/abc"), http.StatusNotFound)
+}
+
+func TestGalleryImages(t *testing.T) {
+	app := newTestApp(t)
+	app.seed("testdata/galleries.yaml")
+	ctx := context.Background()
+
+	owner, err := app.users.ByEmail(ctx, "owner@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	galleries, err := app.galleries.ByUserID(ctx, owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/galleries/%d", galleries[0].ID)
+
+	resp := app.get(app.newClient(), path)
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, `src="`+path+`/images/red.png"`)
+	assertContains(t, resp, `src="`+path+`/images/deep%20blue.png"`)
+
+	want, err := os.ReadFile("testdata/images/blue.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = app.get(app.newClient(), path+"/images/deep%20blue.png")
+	assertStatus(t, resp, http.StatusOK)
+	if resp.contentType != "image/png" || resp.body != string(want) {
+		t.Errorf("got a %q image of %d bytes, want the %d bytes of blue.png",
+			resp.contentType, len(resp.body), len(want))
+	}
+
+	assertStatus(t, app.get(app.newClient(), path+"/images/missing.png"), http.StatusNotFound)
+
+	images, err := app.images.ByGalleryID(ctx, galleries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a file gone from the disk is an error, the page gives the request ID
+	err = os.Remove(images[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = app.get(app.newClient(), path+"/images/"+url.PathEscape(images[0].Filename))
+	assertStatus(t, resp, http.StatusInternalServerError)
+	assertContains(t, resp, "Something went wrong. If the problem persists, contact support with the request ID ")
+
+	// deleting the gallery deletes the files too
+	resp = app.post(app.client, "/signin", url.Values{
+		"email":    {"owner@example.com"},
+		"password": {"secret"},
+	})
+	assertRedirect(t, resp, "/users/me")
+	assertRedirect(t, app.post(app.client, path+"/delete", nil), "/galleries")
+
+	for _, image := range images {
+		_, err := os.Stat(image.Path)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s still exists after deleting the gallery: %v", image.Path, err)
+		}
+	}
+}
+
+func TestGalleryImageDetails(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	resp := app.post(app.client, "/galleries", url.Values{"title": {"Cats"}})
+	var galleryID int
+	fmt.Sscanf(resp.location, "/galleries/%d/edit", &galleryID)
+	edit := fmt.Sprintf("/galleries/%d/edit", galleryID)
+	path := fmt.Sprintf("/galleries/%d/images", galleryID)
+	red, err := os.ReadFile("testdata/images/red.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.png", "b.png", "c.png"} {
+		_, err := app.images.Create(context.Background(), galleryID, name, strings.NewReader(string(red)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertContains(t, app.get(app.client, edit), `action="`+path+`"`)
+
+	// the form lists the images in their new order
+	resp = app.post(app.client, path, url.Values{
+		"filename": {"c.png", "a.png", "b.png"},
+		"caption":  {"Sunset ", "", "Breakfast"},
+		"alt":      {"A cat against the sunset", "", ""},
+		"cover":    {"a.png"},
+	})
+	assertRedirect(t, resp, edit)
+	images, err := app.images.ByGalleryID(context.Background(), galleryID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 3 || images[0].Filename != "c.png" || images[0].Caption != "Sunset" ||
+		images[0].Alt != "A cat against the sunset" || images[2].Filename != "b.png" {
+		t.Errorf("got %+v, want c.png, a.png then b.png", images)
+	}
+
+	show := app.get(app.newClient(), fmt.Sprintf("/galleries/%d", galleryID))
+	assertContains(t, show, `alt="A cat against the sunset"`)
+	// without an alt text, the caption or the filename
+	assertContains(t, show, `alt="Breakfast"`)
+	assertContains(t, show, `alt="a.png"`)
+	assertContains(t, show, `<figcaption class="pt-1 text-sm text-gray-600">Sunset</figcaption>`)
+	assertContains(t, show, fmt.Sprintf(`<meta property="og:image" content="http://lenslocked.test/galleries/%d/images/a.png" />`, galleryID))
+	assertContains(t, show, `<meta property="og:title" content="Cats" />`)
+	assertContains(t, app.get(app.client, "/galleries"), fmt.Sprintf(`src="/galleries/%d/images/a.png" alt="Cover of Cats"`, galleryID))
+	resp = app.apiRequest(http.MethodGet, fmt.Sprintf("/api/v1/galleries/%d", galleryID), "bob@example.com", nil)
+	assertContains(t, resp, `"cover":"a.png"`)
+
+	// nothing is saved when an image is unknown or a field too long
+	for want, values := range map[string]url.Values{
+		"nothing was saved": {"filename": {"c.png", "d.png"}, "caption": {"Changed", ""}, "alt": {"", ""}},
+		"The caption of c.png can&#39;t be longer than 500 characters.": {
+			"filename": {"c.png"}, "caption": {strings.Repeat("x", 501)}, "alt": {""}},
+	} {
+		resp = app.post(app.client, path, values)
+		assertStatus(t, resp, http.StatusOK)
+		assertContains(t, resp, want)
+	}
+	images, _ = app.images.ByGalleryID(context.Background(), galleryID)
+	if images[0].Caption != "Sunset" {
+		t.Errorf("got caption %q, want the details unchanged", images[0].Caption)
+	}
+	resp = app.post(app.client, path, url.Values{"filename": {"c.png"}, "caption": {"Sunset"}})
+	assertStatus(t, resp, http.StatusBadRequest)
+
+	// deleting the cover leaves the gallery without one
+	resp = app.post(app.client, path, url.Values{
+		"filename": {"c.png"}, "caption": {""}, "alt": {""}, "cover": {""},
+	})
+	assertRedirect(t, resp, edit)
+	gallery, err := app.galleries.ByID(context.Background(), galleryID)
+	if err != nil || gallery.Cover != "" {
+		t.Errorf("got cover %q, %v, want none", gallery.Cover, err)
+	}
+
+	carol := app.signUpAs("carol@example.com", models.RoleUser)
+	assertStatus(t, app.post(carol, path, url.Values{"cover": {"a.png"}}), http.StatusForbidden)
+}
+
+func TestGalleryDescription(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	assertContains(t, app.get(app.client, "/galleries/new"), `<textarea
+    name="description"`)
+
+	description := "Client: **Ana**\n\n- [site](https://ana.example)\n- [click](javascript:alert(1))\n\n" +
+		`<script>alert(1)</script><img src=x onerror=alert(1)>`
+	resp := app.post(app.client, "/galleries", url.Values{"title": {"Cats"}, "description": {description}})
+	var galleryID int
+	fmt.Sscanf(resp.location, "/galleries/%d/edit", &galleryID)
+	edit := fmt.Sprintf("/galleries/%d/edit", galleryID)
+	assertRedirect(t, resp, edit)
+
+	// the Markdown is rendered, the HTML in it is shown as text
+	show := app.get(app.newClient(), fmt.Sprintf("/galleries/%d", galleryID))
+	assertContains(t, show, "<p>Client: <strong>Ana</strong></p>")
+	assertContains(t, show, `<a href="https://ana.example" rel="nofollow noopener noreferrer">site</a>`)
+	assertContains(t, show, "&lt;script&gt;alert(1)&lt;/script&gt;&lt;img src=x onerror=alert(1)&gt;")
+	if strings.Contains(show.body, "<script>alert") || strings.Contains(show.body, `href="javascript`) {
+		t.Errorf("got unsafe markup in\n%s", show.body)
+	}
+	assertContains(t, app.get(app.client, edit), "Client: **Ana**")
+
+	// too long, nothing is saved
+	path := fmt.Sprintf("/galleries/%d", galleryID)
+	resp = app.post(app.client, path, url.Values{"title": {"Cats"}, "description": {strings.Repeat("x", 5001)}})
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, "The description can&#39;t be longer than 5000 characters.")
+	resp = app.post(app.client, path, url.Values{"title": {"Cats"}, "description": {"# Day one"}})
+	assertRedirect(t, resp, edit)
+	assertContains(t, app.get(app.client, path), "<h2>Day one</h2>")
+	resp = app.apiRequest(http.MethodGet, "/api/v1/galleries/"+fmt.Sprint(galleryID), "bob@example.com", nil)
+	assertContains(t, resp, `"description":"# Day one"`)
+
+	// the live preview
+	resp = app.post(app.client, "/galleries/preview", url.Values{"description": {"*Shot* <b>on film</b>"}})
+	assertStatus(t, resp, http.StatusOK)
+	if resp.contentType != "text/html; charset=utf-8" || resp.body != "<p><em>Shot</em> &lt;b&gt;on film&lt;/b&gt;</p>\n" {
+		t.Errorf("got %s %q", resp.contentType, resp.body)
+	}
+	resp = app.post(app.client, "/galleries/preview", url.Values{"description": {strings.Repeat("x", 5001)}})
+	assertStatus(t, resp, http.StatusBadRequest)
+	assertRedirect(t, app.post(app.newClient(), "/galleries/preview", url.Values{"description": {"x"}}), "/signin")
+}
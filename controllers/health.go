@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+
+	// DefaultHealthTimeout bounds how long each readiness check may take
+	DefaultHealthTimeout = 2 * time.Second
+)
+
+// HealthCheck is a named dependency the app needs to serve requests, like the
+// database or the SMTP server. Check must give up once ctx is done.
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// Health serves the liveness and readiness endpoints used by load balancers.
+// These endpoints are meant to be routed outside the CSRF and user middleware
+// so they never touch sessions.
+type Health struct {
+	Checks []HealthCheck
+	// Timeout is applied to each check. Defaults to DefaultHealthTimeout.
+	Timeout time.Duration
+
+	shuttingDown atomic.Bool
+}
+
+type checkResult struct {
+	Status   string `json:"status"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// Healthz reports that the process is up and able to answer requests. It
+// never checks dependencies, otherwise a database outage would get every
+// instance restarted.
+func (h *Health) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{Status: healthOK})
+}
+
+// Readyz runs every check concurrently and reports whether this instance
+// should receive traffic. It fails as soon as ShutDown is called, so load
+// balancers stop routing requests while in-flight ones are drained.
+func (h *Health) Readyz(w http.ResponseWriter, r *http.Request) {
+	if h.shuttingDown.Load() {
+		writeHealth(w, http.StatusServiceUnavailable, healthResponse{
+			Status: "shutting down",
+		})
+		return
+	}
+
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = DefaultHealthTimeout
+	}
+
+	resp := healthResponse{
+		Status: healthOK,
+		Checks: make(map[string]checkResult, len(h.Checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, hc := range h.Checks {
+		wg.Add(1)
+		go func(hc HealthCheck) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := hc.Check(ctx)
+			result := checkResult{
+				Status:   healthOK,
+				Duration: time.Since(start).String(),
+			}
+			if err != nil {
+				result.Status = healthFail
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Checks[hc.Name] = result
+			if err != nil {
+				resp.Status = healthFail
+			}
+		}(hc)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if resp.Status != healthOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, resp)
+}
+
+// ShutDown makes Readyz fail from now on.
+func (h *Health) ShutDown() {
+	h.shuttingDown.Store(true)
+}
+
+func writeHealth(w http.ResponseWriter, status int, resp healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	// a cached health response is a wrong health response
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
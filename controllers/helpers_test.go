@@ -0,0 +1,342 @@
+package controllers_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/controllers"
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/models/memory"
+	"github.com/rafaelmdurante/lenslocked/seed"
+	"github.com/rafaelmdurante/lenslocked/templates"
+	"github.com/rafaelmdurante/lenslocked/views"
+)
+
+// testApp runs the controllers behind the routes of main.go, backed by the
+// in-memory services. CSRF protection is left out as it is not what these
+// tests are about, the forms are only parsed where it would parse them.
+type testApp struct {
+	t      *testing.T
+	server *httptest.Server
+	client *http.Client
+
+	users     *memory.UserService
+	sessions  *memory.SessionService
+	resets    *memory.PasswordResetService
+	galleries *memory.GalleryService
+	images    *memory.ImageService
+	emails    *memory.EmailService
+	// impersonations is the audit trail of the admin area
+	impersonations *memory.ImpersonationService
+	audit          *memory.AuditService
+	tokens         *memory.APITokenService
+	webhooks       *memory.WebhookService
+	uploads        *memory.UploadService
+	archives       models.ArchiveFiles
+	transactor     *memory.Transactor
+	seeder         *seed.Seeder
+	// apiTokens are the tokens of apiRequest, by email
+	apiTokens map[string]string
+}
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+
+	store := memory.NewStore()
+	app := &testApp{
+		t:         t,
+		users:     &memory.UserService{Store: store},
+		sessions:  &memory.SessionService{Store: store},
+		resets:    &memory.PasswordResetService{Store: store},
+		galleries: &memory.GalleryService{Store: store},
+		images: &memory.ImageService{
+			Store: store,
+			Files: models.ImageFiles{Dir: t.TempDir()},
+		},
+		emails:         &memory.EmailService{},
+		impersonations: &memory.ImpersonationService{Store: store},
+		audit:          &memory.AuditService{Store: store},
+		tokens:         &memory.APITokenService{Store: store},
+		webhooks:       &memory.WebhookService{Store: store},
+		uploads: &memory.UploadService{
+			Store: store,
+			Files: models.UploadFiles{Dir: t.TempDir()},
+		},
+		archives: models.ArchiveFiles{Dir: t.TempDir()},
+	}
+	transactor := &memory.Transactor{Store: store}
+	app.transactor = transactor
+	app.seeder = &seed.Seeder{
+		Users:       app.users,
+		Galleries:   app.galleries,
+		Images:      app.images,
+		Transactor:  transactor,
+		Concurrency: 1,
+	}
+
+	tpl := func(names ...string) views.Template {
+		names = append(names, "tailwind.gohtml")
+		return views.Must(views.ParseFS(templates.FS, names...))
+	}
+
+	umw := controllers.UserMiddleware{SessionService: app.sessions}
+	users := controllers.Users{
+		UserService:          app.users,
+		SessionService:       app.sessions,
+		PasswordResetService: app.resets,
+		EmailService:         app.emails,
+		GalleryService:       app.galleries,
+		ImageService:         app.images,
+		ImpersonationService: app.impersonations,
+		AuditService:         app.audit,
+		Transactor:           transactor,
+		BaseURL:              "http://lenslocked.test",
+	}
+	users.Templates.New = tpl("signup.gohtml")
+	users.Templates.SignIn = tpl("signin.gohtml")
+	users.Templates.ForgotPassword = tpl("forgot-pw.gohtml")
+	users.Templates.CheckYourEmail = tpl("check-your-email.gohtml")
+	users.Templates.ResetPassword = tpl("reset-pw.gohtml")
+	users.Templates.DeleteAccount = tpl("delete-account.gohtml")
+	users.Templates.Activity = tpl("activity.gohtml")
+
+	tokens := controllers.Tokens{
+		APITokenService: app.tokens,
+		AuditService:    app.audit,
+	}
+	tokens.Templates.Index = tpl("tokens.gohtml")
+
+	hooks := controllers.Webhooks{
+		WebhookService: app.webhooks,
+		AuditService:   app.audit,
+	}
+	hooks.Templates.Index = tpl("webhooks.gohtml")
+	hooks.Templates.Show = tpl("webhook.gohtml")
+
+	galleries := controllers.Galleries{
+		GalleryService: app.galleries,
+		ImageService:   app.images,
+		AuditService:   app.audit,
+		WebhookService: app.webhooks,
+		ArchiveService: app.archives,
+		UploadService:  app.uploads,
+		Transactor:     transactor,
+		BaseURL:        "http://lenslocked.test",
+		Quota:          2 << 20,
+	}
+	galleries.Templates.New = tpl("galleries/new.gohtml", "galleries/description.gohtml")
+	galleries.Templates.Edit = tpl("galleries/edit.gohtml", "galleries/description.gohtml")
+	galleries.Templates.Index = tpl("galleries/index.gohtml")
+	galleries.Templates.Show = tpl("galleries/show.gohtml")
+
+	admin := controllers.Admin{
+		UserService:          app.users,
+		SessionService:       app.sessions,
+		GalleryService:       app.galleries,
+		ImageService:         app.images,
+		ImpersonationService: app.impersonations,
+		AuditService:         app.audit,
+		WebhookService:       app.webhooks,
+		Transactor:           transactor,
+	}
+	admin.Templates.Users = tpl("admin/users.gohtml", "admin/nav.gohtml")
+	admin.Templates.Galleries = tpl("admin/galleries.gohtml", "admin/nav.gohtml")
+	admin.Templates.Impersonations = tpl("admin/impersonations.gohtml", "admin/nav.gohtml")
+	admin.Templates.Audit = tpl("admin/audit.gohtml", "admin/nav.gohtml")
+
+	api := controllers.API{
+		APITokenService: app.tokens,
+		GalleryService:  app.galleries,
+		ImageService:    app.images,
+		AuditService:    app.audit,
+		WebhookService:  app.webhooks,
+		UploadService:   app.uploads,
+		Uploads:         controllers.UploadLimits{MaxSize: 1 << 20, Expiry: time.Hour, Quota: 2 << 20},
+		Transactor:      transactor,
+	}
+
+	site := controllers.Site{
+		Users:          users,
+		Tokens:         tokens,
+		Webhooks:       hooks,
+		Galleries:      galleries,
+		Admin:          admin,
+		API:            api,
+		Health:         &controllers.Health{},
+		UserMiddleware: umw,
+		Home:           tpl("home.gohtml"),
+		Contact:        tpl("contact.gohtml"),
+		FAQ:            tpl("faq.gohtml"),
+		Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		CSRF:           parseForm,
+		ImportLimit:    1 << 20,
+	}
+	root := app.checkContract(controllers.Routes(site))
+
+	app.server = httptest.NewServer(root)
+	t.Cleanup(app.server.Close)
+	app.client = app.newClient()
+
+	return app
+}
+
+// parseForm stands in for the CSRF middleware, which reads the token of the
+// forms posted, so the body is read where it would be.
+func parseForm(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			_ = r.PostFormValue("gorilla.csrf.Token")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkContract fails the test when an API response doesn't match the
+// OpenAPI document, which makes every API test a contract test as well.
+func (app *testApp) checkContract(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, controllers.APIPrefix+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := httptest.NewRecorder()
+		next.ServeHTTP(rec, r)
+
+		err := controllers.APISpec().ValidateResponse(r.Method, r.URL.Path,
+			rec.Code, rec.Header(), rec.Body.Bytes())
+		if err != nil {
+			app.t.Errorf("%s %s answered %d, which doesn't match the OpenAPI document: %v",
+				r.Method, r.URL.Path, rec.Code, err)
+		}
+
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		_, _ = w.Write(rec.Body.Bytes())
+	})
+}
+
+// newClient returns a client with its own cookie jar, acting as a separate
+// browser. Redirects are not followed so tests can check them.
+func (app *testApp) newClient() *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// response is a request outcome with the body already read.
+type response struct {
+	status      int
+	location    string
+	contentType string
+	header      http.Header
+	body        string
+}
+
+func (app *testApp) get(client *http.Client, path string) response {
+	app.t.Helper()
+
+	resp, err := client.Get(app.server.URL + path)
+	if err != nil {
+		app.t.Fatalf("GET %s: %v", path, err)
+	}
+	return app.read(resp)
+}
+
+func (app *testApp) post(client *http.Client, path string, values url.Values) response {
+	app.t.Helper()
+
+	resp, err := client.PostForm(app.server.URL+path, values)
+	if err != nil {
+		app.t.Fatalf("POST %s: %v", path, err)
+	}
+	return app.read(resp)
+}
+
+func (app *testApp) read(resp *http.Response) response {
+	app.t.Helper()
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+
+	return response{
+		status:      resp.StatusCode,
+		location:    resp.Header.Get("Location"),
+		contentType: resp.Header.Get("Content-Type"),
+		header:      resp.Header,
+		body:        string(b),
+	}
+}
+
+// signUp creates an account through the signup form and leaves client signed
+// in.
+func (app *testApp) signUp(client *http.Client, email, password string) {
+	app.t.Helper()
+
+	resp := app.post(client, "/signup", url.Values{
+		"email":    {email},
+		"password": {password},
+	})
+	if resp.status != http.StatusFound || resp.location != "/users/me" {
+		app.t.Fatalf("sign up %s: got %d to %q, want 302 to /users/me",
+			email, resp.status, resp.location)
+	}
+}
+
+// seed loads a fixture file, the same format `lenslocked seed load` uses.
+func (app *testApp) seed(path string) {
+	app.t.Helper()
+
+	fixture, err := seed.Load(path)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	_, err = app.seeder.Seed(context.Background(), fixture)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+}
+
+func assertRedirect(t *testing.T, resp response, location string) {
+	t.Helper()
+
+	if resp.status != http.StatusFound || resp.location != location {
+		t.Fatalf("got %d to %q, want 302 to %q", resp.status, resp.location, location)
+	}
+}
+
+func assertStatus(t *testing.T, resp response, status int) {
+	t.Helper()
+
+	if resp.status != status {
+		t.Fatalf("got status %d, want %d\n%s", resp.status, status, resp.body)
+	}
+}
+
+func assertContains(t *testing.T, resp response, substr string) {
+	t.Helper()
+
+	if !strings.Contains(resp.body, substr) {
+		t.Fatalf("body does not contain %q:\n%s", substr, resp.body)
+	}
+}
@@ -0,0 +1,270 @@
+package controllers
+
+import (
+	stdctx "context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/context"
+	"github.com/rafaelmdurante/lenslocked/errors"
+	"github.com/rafaelmdurante/lenslocked/importer"
+	"github.com/rafaelmdurante/lenslocked/metrics"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// importReport is the outcome of an import as the edit page shows it.
+type importReport struct {
+	Imported int
+	Total    int
+	Failed   []importFailure
+}
+
+type importFailure struct {
+	Name    string
+	Message string
+}
+
+// importMessage tells the user why a file wasn't imported.
+func importMessage(err error) string {
+	switch {
+	case errors.Is(err, models.ErrNotImage):
+		return "Not a JPEG, PNG, GIF or WebP image."
+	case errors.Is(err, importer.ErrFileTooLarge):
+		return fmt.Sprintf("Larger than %d MB.", importer.DefaultLimits.MaxFileSize>>20)
+	case errors.Is(err, importer.ErrUnsafePath):
+		return "The path points outside of the archive."
+	case errors.Is(err, importer.ErrNotRegular):
+		return "Not a regular file."
+	case errors.Is(err, importer.ErrDuplicate):
+		return "Another file of the archive has the same name."
+	default:
+		return "The file is damaged."
+	}
+}
+
+// importSlack is the room left in the body of an import for the rest of the
+// form, besides the archive.
+const importSlack = 1 << 20
+
+// importReadTimeout is how long a signed-in user has to send an archive, the
+// largest take much longer than the other requests.
+const importReadTimeout = time.Hour
+
+// LimitImports turns down the imports with a body larger than maxSize, the
+// largest archive, and some slack, and those of users who can't edit the
+// gallery, then gives the others more time to arrive. It has to come before
+// the CSRF middleware, which parses the form, and so reads the whole archive
+// to disk, before any handler runs.
+func (g Galleries) LimitImports(maxSize int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, _ := path.Match("/galleries/*/import", r.URL.Path); !ok || r.Method != http.MethodPost {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.ContentLength > maxSize+importSlack {
+				http.Error(w, fmt.Sprintf("The archive can't be larger than %d MB.", maxSize>>20),
+					http.StatusRequestEntityTooLarge)
+				return
+			}
+			// the route would turn them down too, but only once the archive
+			// is read
+			if context.User(r.Context()) == nil {
+				http.Redirect(w, r, "/signin", http.StatusFound)
+				return
+			}
+			_, err := g.galleryWithID(w, r, path.Base(path.Dir(r.URL.Path)), userCanEdit)
+			if err != nil {
+				return
+			}
+
+			// the length isn't always known up front
+			r.Body = http.MaxBytesReader(w, r.Body, maxSize+importSlack)
+			_ = http.NewResponseController(w).SetReadDeadline(time.Now().Add(importReadTimeout))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// importStreamType is the media type the script of the edit page asks for,
+// to follow an import file by file instead of waiting for the page.
+const importStreamType = "application/x-ndjson"
+
+// importEvent is a line of the progress of an import: one after each file,
+// then a last one, Finished, with the outcome.
+type importEvent struct {
+	File     string `json:"file,omitempty"`
+	Done     int    `json:"done"`
+	Total    int    `json:"total"`
+	Imported int    `json:"imported"`
+	Finished bool   `json:"finished,omitempty"`
+	// Error is why the file, or the whole import when Finished, failed
+	Error string `json:"error,omitempty"`
+}
+
+// importStream sends the progress of an import as JSON lines, flushed as
+// they are written.
+type importStream struct {
+	enc      *json.Encoder
+	rc       *http.ResponseController
+	imported int
+}
+
+// newImportStream returns the stream of the import of r, or nil when the
+// client wants the edit page.
+func newImportStream(w http.ResponseWriter, r *http.Request) *importStream {
+	if r.Header.Get("Accept") != importStreamType {
+		return nil
+	}
+	w.Header().Set("Content-Type", importStreamType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	return &importStream{enc: json.NewEncoder(w), rc: http.NewResponseController(w)}
+}
+
+func (s *importStream) send(event importEvent) {
+	_ = s.enc.Encode(event)
+	_ = s.rc.Flush()
+}
+
+// progress is the Progress of the importer.
+func (s *importStream) progress(done, total int, file importer.File) {
+	event := importEvent{File: file.Name, Done: done, Total: total}
+	if file.Err != nil {
+		event.Error = importMessage(file.Err)
+	} else {
+		s.imported++
+	}
+	event.Imported = s.imported
+	s.send(event)
+}
+
+// finish sends the outcome of the import.
+func (s *importStream) finish(r *http.Request, report *importReport, err error) {
+	event := importEvent{Finished: true}
+	if report != nil {
+		event.Done, event.Total, event.Imported = report.Total, report.Total, report.Imported
+	}
+	if err != nil {
+		var publicErr interface{ Public() string }
+		if errors.As(err, &publicErr) {
+			event.Error = publicErr.Public()
+		} else {
+			context.Logger(r.Context()).Error("importing archive", "err", err)
+			event.Error = withRequestID(r, "Something went wrong.")
+		}
+	}
+	s.send(event)
+}
+
+// Import adds the images of the ZIP archive of the form to the gallery, and
+// shows the edit page again with how it went, file by file. The script of
+// the page follows the import as it goes instead, see importStream.
+func (g Galleries) Import(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userCanEdit)
+	if err != nil {
+		return
+	}
+	// large archives take longer to import than the write timeout allows
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	stream := newImportStream(w, r)
+	data, err := g.importArchive(r, gallery, stream)
+	if stream != nil {
+		stream.finish(r, data, err)
+		return
+	}
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
+	}
+	g.renderEdit(w, r, gallery, data, errs...)
+}
+
+// importArchive imports the archive of the form of r, and returns the report
+// to show, if any files were imported, and the error of the whole import.
+func (g Galleries) importArchive(r *http.Request, gallery *models.Gallery, stream *importStream) (*importReport, error) {
+	// the CSRF check already parsed the form, keeping the large files on disk
+	file, header, err := r.FormFile("archive")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, errors.Public(err,
+			fmt.Sprintf("The archive can't be larger than %d MB.", (tooLarge.Limit-importSlack)>>20))
+	}
+	if err != nil {
+		return nil, errors.Public(err, "Choose a ZIP archive to import.")
+	}
+	defer file.Close()
+	if header.Size > importer.DefaultLimits.MaxTotalSize {
+		return nil, errors.Public(importer.ErrTooLarge,
+			fmt.Sprintf("The archive can't be larger than %d MB.", importer.DefaultLimits.MaxTotalSize>>20))
+	}
+
+	im := importer.Importer{Images: g.ImageService, Room: func(ctx stdctx.Context, filenames []string) (int64, error) {
+		images, err := g.ImageService.ByGalleryID(ctx, gallery.ID)
+		if err != nil {
+			return 0, err
+		}
+		// the images being replaced make room for the new ones
+		replaced := map[string]bool{}
+		for _, filename := range filenames {
+			replaced[filename] = true
+		}
+		var replacing int64
+		for _, image := range images {
+			if replaced[image.Filename] {
+				replacing += image.Size
+			}
+		}
+		return storageRoom(ctx, g.UploadService, g.Quota, gallery.UserID, replacing)
+	}}
+	if stream != nil {
+		im.Progress = stream.progress
+	}
+	// the room is checked in the transaction that creates the images, like
+	// for the uploads, so imports at once can't all fit in the same room
+	var report *importer.Report
+	err = g.Transactor.InTx(r.Context(), func(ctx stdctx.Context) error {
+		if stream != nil {
+			// a retry starts over
+			stream.imported = 0
+		}
+		var err error
+		report, err = im.Zip(ctx, gallery.ID, file, header.Size)
+		return err
+	})
+	// an error leaves none of the images
+	if err != nil {
+		report = &importer.Report{}
+	}
+	for _, f := range report.Files {
+		if f.Err == nil {
+			metrics.UploadedBytes.Add(float64(f.Image.Size))
+			notify(r, g.WebhookService, gallery.UserID, models.WebhookImageUploaded,
+				webhookImage{GalleryID: gallery.ID, apiImage: newAPIImage(f.Image)})
+		}
+	}
+	switch {
+	case errors.Is(err, importer.ErrNotZip):
+		err = errors.Public(err, "The file is not a ZIP archive.")
+	case errors.Is(err, importer.ErrTooManyFiles):
+		err = errors.Public(err, fmt.Sprintf("The archive can't have more than %d files.",
+			importer.DefaultLimits.MaxFiles))
+	case errors.Is(err, importer.ErrNoRoom):
+		err = errors.Public(err, "The images of the archive don't fit in your storage quota.")
+	case errors.Is(err, importer.ErrTooLarge):
+		err = errors.Public(err, fmt.Sprintf("The images of the archive can't take more than %d MB altogether.",
+			importer.DefaultLimits.MaxTotalSize>>20))
+	}
+
+	var data *importReport
+	if len(report.Files) > 0 {
+		data = &importReport{Imported: report.Imported(), Total: len(report.Files)}
+		for _, f := range report.Failed() {
+			data.Failed = append(data.Failed, importFailure{Name: f.Name, Message: importMessage(f.Err)})
+		}
+	}
+	return data, err
+}
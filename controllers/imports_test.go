@@ -0,0 +1,396 @@
+package controllers_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	appctx "github.com/rafaelmdurante/lenslocked/context"
+	"github.com/rafaelmdurante/lenslocked/controllers"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// postFile posts a multipart form with the file in field.
+func (app *testApp) postFile(client *http.Client, path, field, filename string, contents []byte) response {
+	app.t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if field != "" {
+		w, err := mw.CreateFormFile(field, filename)
+		if err != nil {
+			app.t.Fatal(err)
+		}
+		_, _ = w.Write(contents)
+	}
+	err := mw.Close()
+	if err != nil {
+		app.t.Fatal(err)
+	}
+
+	resp, err := client.Post(app.server.URL+path, mw.FormDataContentType(), &body)
+	if err != nil {
+		app.t.Fatalf("POST %s: %v", path, err)
+	}
+	return app.read(resp)
+}
+
+// testArchive zips the files, by name.
+func testArchive(t *testing.T, files map[string][]byte, order ...string) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, name := range order {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write(files[name])
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestGalleryImport(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	hook := app.createWebhook(app.client, "https://lab.example.com/hooks", models.WebhookImageUploaded)
+	resp := app.post(app.client, "/galleries", url.Values{"title": {"Cats"}})
+	var galleryID int
+	fmt.Sscanf(resp.location, "/galleries/%d/edit", &galleryID)
+	path := fmt.Sprintf("/galleries/%d/import", galleryID)
+
+	assertContains(t, app.get(app.client, fmt.Sprintf("/galleries/%d/edit", galleryID)), `action="`+path+`"`)
+
+	red, err := os.ReadFile("testdata/images/red.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blue, err := os.ReadFile("testdata/images/blue.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := testArchive(t, map[string][]byte{
+		"trip/red.png":   red,
+		"trip/blue.png":  blue,
+		"trip/notes.txt": []byte("day one"),
+		"../../evil.png": red,
+		"trip/.DS_Store": []byte("junk"),
+		"other/blue.png": blue,
+	}, "trip/red.png", "trip/blue.png", "trip/notes.txt", "../../evil.png", "trip/.DS_Store", "other/blue.png")
+
+	resp = app.postFile(app.client, path, "archive", "trip.zip", archive)
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, "Imported 2 of 5 files.")
+	assertContains(t, resp, "trip/notes.txt</span>: Not a JPEG, PNG, GIF or WebP image.")
+	assertContains(t, resp, "../../evil.png</span>: The path points outside of the archive.")
+	assertContains(t, resp, "other/blue.png</span>: Another file of the archive has the same name.")
+
+	images, err := app.images.ByGalleryID(context.Background(), galleryID)
+	if err != nil || len(images) != 2 {
+		t.Fatalf("got images %+v, %v, want red and blue", images, err)
+	}
+	if n := len(app.deliveries(hook)); n != 2 {
+		t.Errorf("got %d deliveries, want one per image", n)
+	}
+
+	assertContains(t, app.postFile(app.client, path, "archive", "red.zip", red), "The file is not a ZIP archive.")
+	assertContains(t, app.postFile(app.client, path, "", "", nil), "Choose a ZIP archive to import.")
+
+	carol := app.signUpAs("carol@example.com", models.RoleUser)
+	assertStatus(t, app.postFile(carol, path, "archive", "trip.zip", archive), http.StatusForbidden)
+}
+
+func TestGalleryImportTooLarge(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	resp := app.post(app.client, "/galleries", url.Values{"title": {"Cats"}})
+	var galleryID int
+	fmt.Sscanf(resp.location, "/galleries/%d/edit", &galleryID)
+	path := fmt.Sprintf("/galleries/%d/import", galleryID)
+
+	// the test app takes archives of up to 1 MB, and 1 MB for the rest
+	archive := bytes.Repeat([]byte("a"), 3<<20)
+	resp = app.postFile(app.client, path, "archive", "big.zip", archive)
+	assertStatus(t, resp, http.StatusRequestEntityTooLarge)
+	assertContains(t, resp, "The archive can't be larger than 1 MB.")
+
+	// without a length, the body is cut short as it is read
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("archive", "big.zip")
+	_, _ = fw.Write(archive)
+	_ = mw.Close()
+	req, err := http.NewRequest(http.MethodPost, app.server.URL+path, io.MultiReader(&body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	httpResp, err := app.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = app.read(httpResp)
+	assertContains(t, resp, "The archive can&#39;t be larger than 1 MB.")
+}
+
+func TestGalleryImportQuota(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	resp := app.post(app.client, "/galleries", url.Values{"title": {"Cats"}})
+	var galleryID int
+	fmt.Sscanf(resp.location, "/galleries/%d/edit", &galleryID)
+	path := fmt.Sprintf("/galleries/%d/import", galleryID)
+
+	red, err := os.ReadFile("testdata/images/red.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the test app has a quota of 2 MB, zeros compress well past it
+	archive := testArchive(t, map[string][]byte{
+		"red.png":   red,
+		"large.png": make([]byte, 2<<20),
+	}, "red.png", "large.png")
+
+	resp = app.postFile(app.client, path, "archive", "trip.zip", archive)
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, "The images of the archive don&#39;t fit in your storage quota.")
+	images, err := app.images.ByGalleryID(context.Background(), galleryID)
+	if err != nil || len(images) != 0 {
+		t.Errorf("got images %+v, %v, want none", images, err)
+	}
+}
+
+func TestGalleryImportProgress(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	resp := app.post(app.client, "/galleries", url.Values{"title": {"Cats"}})
+	var galleryID int
+	fmt.Sscanf(resp.location, "/galleries/%d/edit", &galleryID)
+	path := fmt.Sprintf("/galleries/%d/import", galleryID)
+
+	red, err := os.ReadFile("testdata/images/red.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the script of the edit page asks for the progress, line by line
+	post := func(archive []byte) []map[string]any {
+		t.Helper()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("archive", "trip.zip")
+		_, _ = fw.Write(archive)
+		_ = mw.Close()
+		req, err := http.NewRequest(http.MethodPost, app.server.URL+path, &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Accept", "application/x-ndjson")
+		httpResp, err := app.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := app.read(httpResp)
+		assertStatus(t, resp, http.StatusOK)
+		if resp.contentType != "application/x-ndjson" {
+			t.Errorf("got content type %q", resp.contentType)
+		}
+		var events []map[string]any
+		dec := json.NewDecoder(strings.NewReader(resp.body))
+		for dec.More() {
+			var event map[string]any
+			if err := dec.Decode(&event); err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, event)
+		}
+		return events
+	}
+
+	events := post(testArchive(t, map[string][]byte{
+		"red.png":   red,
+		"notes.txt": []byte("day one"),
+	}, "red.png", "notes.txt"))
+	want := []string{
+		`{"done":1,"file":"red.png","imported":1,"total":2}`,
+		`{"done":2,"error":"Not a JPEG, PNG, GIF or WebP image.","file":"notes.txt","imported":1,"total":2}`,
+		`{"done":2,"finished":true,"imported":1,"total":2}`,
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %v, want %d events", events, len(want))
+	}
+	for i, event := range events {
+		b, _ := json.Marshal(event)
+		if string(b) != want[i] {
+			t.Errorf("got %s, want %s", b, want[i])
+		}
+	}
+
+	// the errors of the whole import come last
+	events = post(red)
+	if len(events) != 1 || events[0]["finished"] != true || events[0]["error"] != "The file is not a ZIP archive." {
+		t.Errorf("got %v, want the error", events)
+	}
+}
+
+// unread fails the test when the body is read.
+type unread struct{ t *testing.T }
+
+func (u unread) Read([]byte) (int, error) {
+	u.t.Error("the body was read")
+	return 0, io.EOF
+}
+
+func TestLimitImportsOwner(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+	bob, err := app.users.Create(ctx, "bob@example.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol, err := app.users.Create(ctx, "carol@example.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gallery, err := app.galleries.Create(ctx, "Cats", bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := controllers.Galleries{GalleryService: app.galleries}
+	tests := []struct {
+		name   string
+		user   *models.User
+		path   string
+		status int
+	}{
+		{"Signed out", nil, fmt.Sprintf("/galleries/%d/import", gallery.ID), http.StatusFound},
+		{"Someone else's gallery", carol, fmt.Sprintf("/galleries/%d/import", gallery.ID), http.StatusForbidden},
+		{"Unknown gallery", bob, "/galleries/999/import", http.StatusNotFound},
+		{"Owner", bob, fmt.Sprintf("/galleries/%d/import", gallery.ID), http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the archive is only read once the user can import it
+			handler := g.LimitImports(1 << 20)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			r := httptest.NewRequest(http.MethodPost, tt.path, unread{t})
+			if tt.user != nil {
+				r = r.WithContext(appctx.WithUser(r.Context(), tt.user))
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+// noise returns a PNG of about size bytes, random pixels don't compress.
+func noise(t *testing.T, size int) []byte {
+	t.Helper()
+
+	side := int(math.Sqrt(float64(size / 4)))
+	img := image.NewNRGBA(image.Rect(0, 0, side, side))
+	_, _ = rand.Read(img.Pix)
+	var b bytes.Buffer
+	err := png.Encode(&b, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestGalleryImportQuotaConcurrent(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	resp := app.post(app.client, "/galleries", url.Values{"title": {"Cats"}})
+	var galleryID int
+	fmt.Sscanf(resp.location, "/galleries/%d/edit", &galleryID)
+
+	g := controllers.Galleries{
+		GalleryService: app.galleries,
+		ImageService:   app.images,
+		AuditService:   app.audit,
+		WebhookService: app.webhooks,
+		UploadService:  slowUploads{app.uploads},
+		Transactor:     app.transactor,
+		Quota:          2 << 20,
+	}
+	r := chi.NewRouter()
+	r.Use(controllers.UserMiddleware{SessionService: app.sessions}.SetUser)
+	r.Post("/galleries/{id}/import", g.Import)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	// two archives that fit on their own, only one of them fits along with
+	// the other
+	errs := make(chan string, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		// the names differ, so the second doesn't replace the first
+		filename := fmt.Sprintf("noise%d.png", i)
+		archive := testArchive(t, map[string][]byte{filename: noise(t, 1200<<10)}, filename)
+		go func(i int, archive []byte) {
+			defer wg.Done()
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			fw, _ := mw.CreateFormFile("archive", fmt.Sprintf("%d.zip", i))
+			_, _ = fw.Write(archive)
+			_ = mw.Close()
+			req, _ := http.NewRequest(http.MethodPost,
+				fmt.Sprintf("%s/galleries/%d/import", server.URL, galleryID), &body)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			req.Header.Set("Accept", "application/x-ndjson")
+			// the session cookie of the app is sent, cookies don't mind ports
+			resp, err := app.client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			var last struct{ Error string }
+			dec := json.NewDecoder(resp.Body)
+			for dec.More() {
+				_ = dec.Decode(&last)
+			}
+			errs <- last.Error
+		}(i, archive)
+	}
+	wg.Wait()
+	close(errs)
+
+	var got []string
+	for err := range errs {
+		got = append(got, err)
+	}
+	slices.Sort(got)
+	if len(got) != 2 || got[0] != "" || got[1] != "The images of the archive don't fit in your storage quota." {
+		t.Errorf("got errors %q, want one import over the quota", got)
+	}
+}
@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rafaelmdurante/lenslocked/logging"
+	"github.com/rafaelmdurante/lenslocked/metrics"
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/tracing"
+)
+
+// Site is every controller of the app, along with what Routes needs to put
+// them behind their URLs. main.go and the tests only differ in the services
+// they fill it with.
+type Site struct {
+	Users          Users
+	Tokens         Tokens
+	Webhooks       Webhooks
+	Galleries      Galleries
+	Admin          Admin
+	API            API
+	Health         *Health
+	UserMiddleware UserMiddleware
+
+	// the templates of the static pages
+	Home    Template
+	Contact Template
+	FAQ     Template
+
+	Logger *slog.Logger
+	// CSRF protects the forms of the website. It parses them, so it comes
+	// after the body of the imports is limited.
+	CSRF func(http.Handler) http.Handler
+	// ImportLimit is how large an archive Galleries.Import takes.
+	ImportLimit int64
+	// ValidateAPI checks the API requests against the OpenAPI document.
+	ValidateAPI bool
+	// Metrics serves /metrics next to the app, unless it is nil.
+	Metrics http.Handler
+}
+
+// Routes returns the handler of the whole app: the website, the JSON API and
+// the health endpoints.
+func Routes(s Site) http.Handler {
+	umw := s.UserMiddleware
+	users, tokens, hooks := s.Users, s.Tokens, s.Webhooks
+	galleries, admin, api := s.Galleries, s.Admin, s.API
+
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	// the user is looked up first so the request logger can include it
+	r.Use(umw.SetUser)
+	r.Use(logging.Middleware(s.Logger))
+	r.Use(galleries.LimitImports(s.ImportLimit))
+	r.Use(s.CSRF)
+
+	r.Get("/", StaticHandler(s.Home))
+	r.Get("/contact", StaticHandler(s.Contact))
+	r.Get("/faq", FAQ(s.FAQ))
+
+	r.Get("/signup", users.New)
+	r.Post("/signup", users.Create)
+	r.Get("/signin", users.SignIn)
+	r.Post("/signin", users.ProcessSignIn)
+	// using POST instead of DELETE because it is quite annoying to create links
+	// and forms that performe the verb without the use of JavaScript
+	r.Post("/signout", users.ProcessSignOut)
+
+	// this creates sort of a namespace for the routes
+	r.Route("/users/me", func(r chi.Router) {
+		r.Use(umw.RequireUser)
+		r.Get("/", users.CurrentUser)
+		r.Get("/delete", users.DeleteAccount)
+		r.Post("/delete", users.ProcessDeleteAccount)
+		r.Get("/activity", users.Activity)
+		r.Get("/tokens", tokens.Index)
+		r.Post("/tokens", tokens.Create)
+		r.Post("/tokens/{id}/revoke", tokens.Revoke)
+		r.Get("/webhooks", hooks.Index)
+		r.Post("/webhooks", hooks.Create)
+		r.Get("/webhooks/{id}", hooks.Show)
+		r.Post("/webhooks/{id}/delete", hooks.Delete)
+		r.Post("/webhooks/{id}/deliveries/{deliveryID}/redeliver", hooks.Redeliver)
+	})
+
+	r.Get("/forgot-pw", users.ForgotPassword)
+	r.Post("/forgot-pw", users.ProcessForgotPassword)
+
+	r.Get("/reset-pw", users.ResetPassword)
+	r.Post("/reset-pw", users.ProcessResetPassword)
+
+	// galleries
+	r.Route("/galleries", func(r chi.Router) {
+		// routes that do not require login
+		r.Get("/{id}", galleries.Show)
+		r.Get("/{id}/images/{filename}", galleries.Image)
+		r.Get("/{id}/download", galleries.Download)
+		// all subroutes in this group require login
+		r.Group(func(r chi.Router) {
+			r.Use(umw.RequireUser)
+			r.Get("/", galleries.Index)
+			r.Post("/", galleries.Create)
+			r.Get("/new", galleries.New)
+			r.Post("/preview", galleries.Preview)
+			r.Get("/{id}/edit", galleries.Edit)
+			r.Post("/{id}", galleries.Update)
+			r.Post("/{id}/delete", galleries.Delete)
+			r.Post("/{id}/import", galleries.Import)
+			r.Post("/{id}/downloads", galleries.SetDownloads)
+			r.Post("/{id}/images", galleries.UpdateImages)
+		})
+	})
+
+	// admin area, moderators can only moderate the galleries
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(umw.RequireRole(models.RoleModerator))
+		r.Get("/", admin.Index)
+		r.Get("/galleries", admin.Galleries)
+		r.Post("/galleries/{id}/hide", admin.HideGallery)
+		r.Post("/galleries/{id}/unhide", admin.UnhideGallery)
+		r.Post("/galleries/{id}/delete", admin.DeleteGallery)
+		r.Group(func(r chi.Router) {
+			r.Use(umw.RequireRole(models.RoleAdmin))
+			r.Get("/users", admin.Users)
+			r.Post("/users/{id}/disable", admin.DisableUser)
+			r.Post("/users/{id}/enable", admin.EnableUser)
+			r.Post("/users/{id}/role", admin.SetRole)
+			r.Post("/users/{id}/impersonate", admin.Impersonate)
+			r.Get("/impersonations", admin.Impersonations)
+			r.Get("/audit", admin.Audit)
+		})
+	})
+	// the impersonated user is usually not staff, so this lives outside /admin
+	r.With(umw.RequireUser).Post("/impersonation/stop", admin.StopImpersonating)
+
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Page not found", http.StatusNotFound)
+	})
+
+	// the API authenticates every request on its own instead of with the
+	// session cookie, so it is mounted next to the website, outside of CSRF
+	apiRouter := chi.NewRouter()
+	apiRouter.Use(middleware.RequestID)
+	apiRouter.Use(api.SetUser)
+	apiRouter.Use(logging.Middleware(s.Logger))
+	apiRouter.Use(api.RequireUser)
+	if s.ValidateAPI {
+		apiRouter.Use(api.ValidateRequests)
+	}
+	apiRouter.NotFound(api.NotFound)
+	apiRouter.MethodNotAllowed(api.MethodNotAllowed)
+	// tokens are limited to their scopes
+	api.Routes(apiRouter)
+
+	// health endpoints are hit every few seconds by load balancers, so they
+	// live on a root router that skips logging, CSRF and session lookups
+	root := chi.NewRouter()
+	root.Use(tracing.Middleware)
+	root.Use(metrics.Middleware)
+	root.Get("/healthz", s.Health.Healthz)
+	root.Get("/readyz", s.Health.Readyz)
+	if s.Metrics != nil {
+		root.Handle("/metrics", s.Metrics)
+	}
+	root.Get("/api/openapi.json", api.OpenAPI)
+	root.Get("/api/docs", api.Docs)
+	root.Mount(APIPrefix, apiRouter)
+	root.Mount("/", r)
+
+	return root
+}
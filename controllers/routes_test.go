@@ -0,0 +1,44 @@
+package controllers_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+func TestRoutes(t *testing.T) {
+	app := newTestApp(t)
+	visitor := app.newClient()
+	user := app.signUpAs("bob@example.com", models.RoleUser)
+	moderator := app.signUpAs("mod@example.com", models.RoleModerator)
+	admin := app.signUpAs("admin@example.com", models.RoleAdmin)
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		path   string
+		status int
+	}{
+		{"Home", visitor, "/", http.StatusOK},
+		{"Contact", visitor, "/contact", http.StatusOK},
+		{"FAQ", visitor, "/faq", http.StatusOK},
+		{"Health", visitor, "/healthz", http.StatusOK},
+		{"Readiness", visitor, "/readyz", http.StatusOK},
+		{"API docs", visitor, "/api/docs", http.StatusOK},
+		{"Unknown page", visitor, "/nope", http.StatusNotFound},
+		{"Account signed out", visitor, "/users/me/", http.StatusFound},
+		{"Galleries signed out", visitor, "/galleries/", http.StatusFound},
+		{"Galleries", user, "/galleries/", http.StatusOK},
+		{"Admin signed out", visitor, "/admin/", http.StatusFound},
+		{"Admin as a user", user, "/admin/", http.StatusForbidden},
+		{"Admin as a moderator", moderator, "/admin/galleries", http.StatusOK},
+		{"Users as a moderator", moderator, "/admin/users", http.StatusForbidden},
+		{"Users as an admin", admin, "/admin/users", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertStatus(t, app.get(tt.client, tt.path), tt.status)
+		})
+	}
+}
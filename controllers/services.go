@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// The controllers depend on these interfaces rather than on the services of
+// the models package, so they can be tested against the in-memory services of
+// the models/memory package. Both implementations satisfy them.
+
+type UserService interface {
+	Create(ctx context.Context, email, password string) (*models.User, error)
+	Authenticate(ctx context.Context, email, password string) (*models.User, error)
+	UpdatePassword(ctx context.Context, userID int, password string) error
+	Delete(ctx context.Context, id int) error
+	ByID(ctx context.Context, id int) (*models.User, error)
+	ByEmail(ctx context.Context, email string) (*models.User, error)
+	Search(ctx context.Context, query string, limit, offset int) ([]models.User, error)
+	Disable(ctx context.Context, id int) error
+	Enable(ctx context.Context, id int) error
+	SetRole(ctx context.Context, id int, role models.Role) error
+}
+
+type SessionService interface {
+	Create(ctx context.Context, userID int) (*models.Session, error)
+	User(ctx context.Context, token string) (*models.User, error)
+	Delete(ctx context.Context, token string) error
+	DeleteByUserID(ctx context.Context, userID int) error
+	Impersonate(ctx context.Context, token string, userID int) error
+	StopImpersonating(ctx context.Context, token string) error
+}
+
+type PasswordResetService interface {
+	Create(ctx context.Context, email string) (*models.PasswordReset, error)
+	Consume(ctx context.Context, token string) (*models.User, error)
+}
+
+type EmailService interface {
+	ForgotPassword(ctx context.Context, to, resetURL string) error
+}
+
+type GalleryService interface {
+	Create(ctx context.Context, title string, userID int) (*models.Gallery, error)
+	ByID(ctx context.Context, id int) (*models.Gallery, error)
+	ByUserID(ctx context.Context, userID int) ([]models.Gallery, error)
+	Update(ctx context.Context, gallery *models.Gallery) error
+	Delete(ctx context.Context, id int) error
+	Search(ctx context.Context, query string, limit, offset int) ([]models.Gallery, error)
+	SetHidden(ctx context.Context, id int, hidden bool) error
+	SetDownloads(ctx context.Context, id int, enabled bool) error
+	SetCover(ctx context.Context, id int, filename string) error
+}
+
+type ImageService interface {
+	Create(ctx context.Context, galleryID int, filename string, contents io.Reader) (*models.Image, error)
+	ByGalleryID(ctx context.Context, galleryID int) ([]models.Image, error)
+	ByFilename(ctx context.Context, galleryID int, filename string) (*models.Image, error)
+	UpdateDetails(ctx context.Context, galleryID int, details []models.ImageDetails) error
+	Delete(ctx context.Context, galleryID int, filename string) error
+	DeleteFiles(ctx context.Context, galleryID int) error
+}
+
+type APITokenService interface {
+	Create(ctx context.Context, userID int, name string, scopes []models.Scope, expiresAt *time.Time) (*models.APIToken, error)
+	ByUserID(ctx context.Context, userID int) ([]models.APIToken, error)
+	User(ctx context.Context, token string) (*models.User, *models.APIToken, error)
+	Revoke(ctx context.Context, userID, id int) error
+}
+
+type WebhookService interface {
+	Create(ctx context.Context, userID int, url string, events []models.WebhookEvent) (*models.Webhook, error)
+	ByUserID(ctx context.Context, userID int) ([]models.Webhook, error)
+	ByID(ctx context.Context, userID, id int) (*models.Webhook, error)
+	Delete(ctx context.Context, userID, id int) error
+	Enqueue(ctx context.Context, userID int, event models.WebhookEvent, payload []byte) (int, error)
+	Deliveries(ctx context.Context, webhookID, limit int) ([]models.WebhookDelivery, error)
+	Redeliver(ctx context.Context, webhookID int, id int64) (*models.WebhookDelivery, error)
+}
+
+type UploadService interface {
+	Create(ctx context.Context, userID, galleryID int, filename string, length int64, expiresAt time.Time) (*models.Upload, error)
+	ByID(ctx context.Context, userID int, id string) (*models.Upload, error)
+	Append(ctx context.Context, upload *models.Upload, chunk io.Reader, verify func() error, expiresAt time.Time) error
+	Open(upload *models.Upload) (io.ReadCloser, error)
+	Complete(ctx context.Context, upload *models.Upload) error
+	Delete(ctx context.Context, userID int, id string) error
+	Usage(ctx context.Context, userID int) (int64, error)
+}
+
+// ArchiveService caches the ZIP archives of the galleries. There is only
+// models.ArchiveFiles, the tests point it at a temporary directory.
+type ArchiveService interface {
+	Open(galleryID int, key string) (*os.File, error)
+	Build(ctx context.Context, galleryID int, key string, images []models.Image) (*os.File, error)
+}
+
+type ImpersonationService interface {
+	Start(ctx context.Context, admin, user *models.User, reason string) (*models.Impersonation, error)
+	End(ctx context.Context, adminID int) error
+	List(ctx context.Context, limit, offset int) ([]models.Impersonation, error)
+}
+
+type AuditService interface {
+	Record(ctx context.Context, event models.AuditEvent) error
+	List(ctx context.Context, filter models.AuditFilter, limit, offset int) ([]models.AuditEvent, error)
+}
+
+// Transactor runs fn as a single unit of work: the service calls made with the
+// ctx passed to fn either all take effect or none do. fn may be run more than
+// once, so it must not have side effects outside the services.
+type Transactor interface {
+	InTx(ctx context.Context, fn func(ctx context.Context) error) error
+}
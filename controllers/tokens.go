@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rafaelmdurante/lenslocked/context"
+	"github.com/rafaelmdurante/lenslocked/errors"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// tokenExpiries are the lifetimes offered for new tokens, in days. 0 never
+// expires.
+var tokenExpiries = []int{30, 90, 365, 0}
+
+// Tokens lets users manage their personal API tokens at /users/me/tokens.
+type Tokens struct {
+	Templates struct {
+		Index Template
+	}
+	APITokenService APITokenService
+	AuditService    AuditService
+}
+
+type tokensData struct {
+	Tokens []tokenView
+	// Created is the token just created, the only time it is shown
+	Created string
+	// the form, kept when it has errors
+	Name     string
+	Scopes   []scopeView
+	Expiry   int
+	Expiries []int
+}
+
+type tokenView struct {
+	ID         int
+	Name       string
+	Scopes     []models.Scope
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	Expired    bool
+}
+
+type scopeView struct {
+	Scope       models.Scope
+	Description string
+	Checked     bool
+}
+
+// render shows the tokens of the user along with the form to create one.
+func (t Tokens) render(w http.ResponseWriter, r *http.Request, data tokensData, errs ...error) {
+	user := context.User(r.Context())
+	tokens, err := t.APITokenService.ByUserID(r.Context(), user.ID)
+	if err != nil {
+		serverError(w, r, err, "querying api tokens")
+		return
+	}
+
+	now := time.Now()
+	for _, token := range tokens {
+		data.Tokens = append(data.Tokens, tokenView{
+			ID:         token.ID,
+			Name:       token.Name,
+			Scopes:     token.Scopes,
+			CreatedAt:  token.CreatedAt,
+			ExpiresAt:  token.ExpiresAt,
+			LastUsedAt: token.LastUsedAt,
+			Expired:    token.Expired(now),
+		})
+	}
+	data.Expiries = tokenExpiries
+	if data.Scopes == nil {
+		for _, scope := range models.Scopes {
+			data.Scopes = append(data.Scopes, scopeView{
+				Scope:       scope,
+				Description: scope.Description(),
+				Checked:     scope == models.ScopeReadGalleries,
+			})
+		}
+	}
+	t.Templates.Index.Execute(w, r, data, errs...)
+}
+
+func (t Tokens) Index(w http.ResponseWriter, r *http.Request) {
+	t.render(w, r, tokensData{Expiry: 90})
+}
+
+// Create generates a token and shows it, once. It isn't a redirect, as the
+// token can't be looked up again.
+func (t Tokens) Create(w http.ResponseWriter, r *http.Request) {
+	var data tokensData
+	data.Name = strings.TrimSpace(r.FormValue("name"))
+	data.Expiry, _ = strconv.Atoi(r.FormValue("expiry"))
+	selected := r.Form["scope"]
+	for _, scope := range models.Scopes {
+		data.Scopes = append(data.Scopes, scopeView{
+			Scope:       scope,
+			Description: scope.Description(),
+			Checked:     slices.Contains(selected, string(scope)),
+		})
+	}
+
+	user := context.User(r.Context())
+	if user.Impersonator != nil {
+		// a token would let the admin act as the user after they stop
+		t.render(w, r, data, errors.Public(fmt.Errorf("create api token: impersonating"),
+			"Tokens can't be created while impersonating someone."))
+		return
+	}
+	if data.Name == "" {
+		t.render(w, r, data, errors.Public(fmt.Errorf("create api token: no name"),
+			"Give the token a name to remember what it is for."))
+		return
+	}
+	scopes, err := models.ParseScopes(selected)
+	if err != nil {
+		t.render(w, r, data, errors.Public(err, "One of the scopes is unknown."))
+		return
+	}
+	if len(scopes) == 0 {
+		t.render(w, r, data, errors.Public(fmt.Errorf("create api token: no scopes"),
+			"Pick at least one scope."))
+		return
+	}
+	if !slices.Contains(tokenExpiries, data.Expiry) {
+		t.render(w, r, data, errors.Public(fmt.Errorf("create api token: expiry %d", data.Expiry),
+			"Pick when the token expires."))
+		return
+	}
+
+	var expiresAt *time.Time
+	if data.Expiry != 0 {
+		at := time.Now().AddDate(0, 0, data.Expiry)
+		expiresAt = &at
+	}
+	token, err := t.APITokenService.Create(r.Context(), user.ID, data.Name, scopes, expiresAt)
+	if err != nil {
+		serverError(w, r, err, "creating api token")
+		return
+	}
+	record(r, t.AuditService, models.AuditEvent{
+		Type: models.EventAPITokenCreated, UserID: user.ID, Email: user.Email,
+	})
+
+	t.render(w, r, tokensData{Created: token.Token, Expiry: 90})
+}
+
+func (t Tokens) Revoke(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	err = t.APITokenService.Revoke(r.Context(), user.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		serverError(w, r, err, "revoking api token", "token_id", id)
+		return
+	}
+	record(r, t.AuditService, models.AuditEvent{
+		Type: models.EventAPITokenRevoked, UserID: user.ID, Email: user.Email,
+	})
+
+	http.Redirect(w, r, "/users/me/tokens", http.StatusFound)
+}
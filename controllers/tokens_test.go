@@ -0,0 +1,193 @@
+package controllers_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+var newTokenRe = regexp.MustCompile(`id="new-token">([^<]+)<`)
+
+// createToken creates a token through the form and returns it.
+func (app *testApp) createToken(client *http.Client, name string, scopes ...models.Scope) string {
+	app.t.Helper()
+
+	form := url.Values{"name": {name}, "expiry": {"30"}}
+	for _, scope := range scopes {
+		form.Add("scope", string(scope))
+	}
+	resp := app.post(client, "/users/me/tokens", form)
+	assertStatus(app.t, resp, http.StatusOK)
+	m := newTokenRe.FindStringSubmatch(resp.body)
+	if m == nil {
+		app.t.Fatalf("no token shown:\n%s", resp.body)
+	}
+
+	return m[1]
+}
+
+// bearer is the header to authenticate API requests with token.
+func bearer(token string) []string {
+	return []string{"Authorization", "Bearer " + token}
+}
+
+func TestTokens(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+
+	assertRedirect(t, app.get(app.newClient(), "/users/me/tokens"), "/signin")
+	resp := app.get(app.client, "/users/me/tokens")
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, "No tokens yet.")
+
+	resp = app.post(app.client, "/users/me/tokens", url.Values{
+		"scope": {"read:galleries"}, "expiry": {"30"},
+	})
+	assertContains(t, resp, "Give the token a name")
+	resp = app.post(app.client, "/users/me/tokens", url.Values{
+		"name": {"Lightroom"}, "expiry": {"30"},
+	})
+	assertContains(t, resp, "Pick at least one scope.")
+	assertContains(t, resp, `value="Lightroom"`)
+	resp = app.post(app.client, "/users/me/tokens", url.Values{
+		"name": {"Lightroom"}, "scope": {"delete:everything"}, "expiry": {"30"},
+	})
+	assertContains(t, resp, "One of the scopes is unknown.")
+
+	token := app.createToken(app.client, "Lightroom", models.ScopeReadGalleries, models.ScopeUpload)
+	resp = app.get(app.client, "/users/me/tokens")
+	assertContains(t, resp, "Lightroom")
+	assertContains(t, resp, "upload")
+	if newTokenRe.MatchString(resp.body) {
+		t.Error("the token is shown again")
+	}
+
+	bob, err := app.users.ByEmail(context.Background(), "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := app.tokens.ByUserID(context.Background(), bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].ExpiresAt == nil ||
+		tokens[0].ExpiresAt.Before(time.Now().AddDate(0, 0, 29)) {
+		t.Fatalf("got %+v, want a token expiring in 30 days", tokens)
+	}
+
+	// carol can't revoke bob's token
+	carol := app.signUpAs("carol@example.com", models.RoleUser)
+	path := fmt.Sprintf("/users/me/tokens/%d/revoke", tokens[0].ID)
+	assertStatus(t, app.post(carol, path, nil), http.StatusNotFound)
+
+	assertStatus(t, app.apiRequest(http.MethodGet, "/api/v1/galleries", "", nil, bearer(token)...),
+		http.StatusOK)
+	assertRedirect(t, app.post(app.client, path, nil), "/users/me/tokens")
+	assertAPIError(t, app.apiRequest(http.MethodGet, "/api/v1/galleries", "", nil, bearer(token)...),
+		http.StatusUnauthorized, "unauthorized")
+
+	events := app.events(models.AuditFilter{Email: "bob@example.com"})
+	if got := eventTypes(events); got != "sign_up,api_token_created,api_token_revoked" {
+		t.Errorf("got events %s", got)
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	reader := app.createToken(app.client, "Reader", models.ScopeReadGalleries)
+	uploader := app.createToken(app.client, "Uploader", models.ScopeUpload)
+	writer := app.createToken(app.client, "Writer", models.ScopeWriteGalleries)
+
+	resp := app.apiRequest(http.MethodPost, "/api/v1/galleries", "",
+		map[string]string{"title": "Cats"}, bearer(reader)...)
+	assertAPIError(t, resp, http.StatusForbidden, "insufficient_scope")
+	if got := resp.header.Get("WWW-Authenticate"); got == "" {
+		t.Error("403 without a WWW-Authenticate header naming the scope")
+	}
+
+	resp = app.apiRequest(http.MethodPost, "/api/v1/galleries", "",
+		map[string]string{"title": "Cats"}, bearer(writer)...)
+	assertStatus(t, resp, http.StatusCreated)
+	var g apiGallery
+	decode(t, resp, &g)
+	path := fmt.Sprintf("/api/v1/galleries/%d", g.ID)
+
+	assertAPIError(t, app.apiRequest(http.MethodGet, path, "", nil, bearer(writer)...),
+		http.StatusForbidden, "insufficient_scope")
+	assertStatus(t, app.apiRequest(http.MethodGet, path, "", nil, bearer(reader)...),
+		http.StatusOK)
+
+	red, err := os.ReadFile("testdata/images/red.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAPIError(t, app.apiRequest(http.MethodPut, path+"/images/red.png", "",
+		bytes.NewReader(red), bearer(writer)...), http.StatusForbidden, "insufficient_scope")
+	assertStatus(t, app.apiRequest(http.MethodPut, path+"/images/red.png", "",
+		bytes.NewReader(red), bearer(uploader)...), http.StatusCreated)
+	assertAPIError(t, app.apiRequest(http.MethodDelete, path+"/images/red.png", "", nil,
+		bearer(uploader)...), http.StatusForbidden, "insufficient_scope")
+
+	assertStatus(t, app.apiRequest(http.MethodDelete, path, "", nil, bearer(writer)...),
+		http.StatusNoContent)
+
+	assertAPIError(t, app.apiRequest(http.MethodGet, "/api/v1/galleries", "", nil,
+		bearer("llt_made-up")...), http.StatusUnauthorized, "unauthorized")
+}
+
+func TestTokenExpiry(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	token := app.createToken(app.client, "Short", models.ScopeReadGalleries)
+
+	app.tokens.Now = func() time.Time { return time.Now().AddDate(0, 0, 31) }
+	assertAPIError(t, app.apiRequest(http.MethodGet, "/api/v1/galleries", "", nil, bearer(token)...),
+		http.StatusUnauthorized, "unauthorized")
+
+	// the page tells the expired tokens apart
+	bob, err := app.users.ByEmail(context.Background(), "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	_, err = app.tokens.Create(context.Background(), bob.ID, "Gone",
+		[]models.Scope{models.ScopeReadGalleries}, &past)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertContains(t, app.get(app.client, "/users/me/tokens"), "Expired")
+}
+
+func TestTokensImpersonating(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApp(t)
+	admin := app.signUpAs("admin@example.com", models.RoleAdmin)
+	app.signUpAs("bob@example.com", models.RoleUser)
+	bob, err := app.users.ByEmail(ctx, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.post(admin, fmt.Sprintf("/admin/users/%d/impersonate", bob.ID),
+		url.Values{"reason": {"ticket #42"}})
+
+	resp := app.post(admin, "/users/me/tokens", url.Values{
+		"name": {"Backdoor"}, "scope": {"read:galleries"}, "expiry": {"0"},
+	})
+	assertContains(t, resp, "while impersonating")
+	tokens, err := app.tokens.ByUserID(ctx, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Errorf("got %d tokens created for bob by the admin", len(tokens))
+	}
+}
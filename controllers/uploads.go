@@ -0,0 +1,402 @@
+package controllers
+
+import (
+	"bytes"
+	stdctx "context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rafaelmdurante/lenslocked/context"
+	"github.com/rafaelmdurante/lenslocked/errors"
+	"github.com/rafaelmdurante/lenslocked/metrics"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// The resumable uploads follow the tus protocol, https://tus.io/protocols/resumable-upload,
+// with its creation, checksum, expiration and termination extensions. A
+// client creates an upload of a known length, sends its bytes in as many
+// PATCH requests as it likes and, when one fails, asks with HEAD where to
+// carry on from. Once every byte is in, the file goes through the same
+// checks as any other image.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,checksum,expiration,termination"
+	// tusChunkType is the content type of the PATCH bodies
+	tusChunkType = "application/offset+octet-stream"
+	// tusChecksumAlgorithms are the ones Upload-Checksum can name
+	tusChecksumAlgorithms = "sha1,sha256"
+
+	// StatusChecksumMismatch is what tus answers when a chunk doesn't match
+	// its Upload-Checksum.
+	StatusChecksumMismatch = 460
+)
+
+// UploadLimits bounds the resumable uploads. The zero values of MaxSize and
+// Expiry fall back to the defaults, a zero Quota doesn't limit anything.
+type UploadLimits struct {
+	// MaxSize is the largest file a single upload can be, in bytes
+	MaxSize int64
+	// Expiry is how long an upload is kept after its last chunk
+	Expiry time.Duration
+	// Quota is how many bytes the images and the unfinished uploads of a
+	// user can take up
+	Quota int64
+}
+
+func (l UploadLimits) maxSize() int64 {
+	if l.MaxSize <= 0 {
+		return 256 << 20
+	}
+	return l.MaxSize
+}
+
+func (l UploadLimits) expiresAt() time.Time {
+	expiry := l.Expiry
+	if expiry <= 0 {
+		expiry = 24 * time.Hour
+	}
+	return time.Now().Add(expiry)
+}
+
+var (
+	errAPIQuota = newAPIError(http.StatusRequestEntityTooLarge, "quota_exceeded",
+		"The file doesn't fit in your storage quota.")
+	errAPIUploadNotFound = newAPIError(http.StatusNotFound, "not_found", "Upload not found.")
+)
+
+// room returns how many more bytes the user can store, not counting the
+// ones of replacing, or -1 when there is no quota.
+func (a API) room(r *http.Request, replacing int64) (int64, error) {
+	return storageRoom(r.Context(), a.UploadService, a.Uploads.Quota, context.User(r.Context()).ID, replacing)
+}
+
+// storageRoom returns how many more bytes the user can store with quota, not
+// counting the ones of replacing, or -1 when the quota is zero.
+func storageRoom(ctx stdctx.Context, uploads UploadService, quota int64, userID int, replacing int64) (int64, error) {
+	if quota <= 0 {
+		return -1, nil
+	}
+	usage, err := uploads.Usage(ctx, userID)
+	if err != nil {
+		return 0, fmt.Errorf("query storage usage: %w", err)
+	}
+
+	return max(quota-usage+replacing, 0), nil
+}
+
+// tusResumable answers with a 412 the requests made with another version of
+// the protocol, or without saying which.
+func tusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeError(w, r, newAPIError(http.StatusPreconditionFailed, "unsupported_version",
+			"Only version %s of the tus protocol is supported.", tusVersion), "")
+		return false
+	}
+	return true
+}
+
+// UploadOptions tells tus clients what the server supports.
+func (a API) UploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(a.Uploads.maxSize(), 10))
+	w.Header().Set("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadMetadata parses the Upload-Metadata header, comma separated keys
+// each followed by a space and its base64 value, which can be left out.
+func uploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("the value of %s is not base64", key)
+		}
+		metadata[key] = string(b)
+	}
+	return metadata, nil
+}
+
+// CreateUpload starts a resumable upload to the gallery. The quota is
+// checked against the whole length, so an upload that can't fit is turned
+// down before any byte is sent.
+func (a API) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	gallery, err := a.gallery(r, (*models.User).CanEditGallery)
+	if err != nil {
+		writeError(w, r, err, "querying gallery")
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 1 {
+		writeError(w, r, newAPIError(http.StatusBadRequest, "invalid_header",
+			"The Upload-Length header must be a positive number."), "")
+		return
+	}
+	if length > a.Uploads.maxSize() {
+		writeError(w, r, newAPIError(http.StatusRequestEntityTooLarge, "too_large",
+			"Uploads can't be larger than %d bytes.", a.Uploads.maxSize()), "")
+		return
+	}
+
+	metadata, err := uploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, r, newAPIError(http.StatusBadRequest, "invalid_header",
+			"The Upload-Metadata header is not valid: %v.", err), "")
+		return
+	}
+	// tus-js-client sends filename, Uppy name
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	err = checkImageFilename(filename)
+	if err != nil {
+		writeError(w, r, err, "")
+		return
+	}
+
+	// the usage is checked in the transaction that adds to it, otherwise
+	// uploads started at once would all fit in the same room
+	var upload *models.Upload
+	err = a.Transactor.InTx(r.Context(), func(ctx stdctx.Context) error {
+		room, err := a.room(r.WithContext(ctx), 0)
+		if err != nil {
+			return err
+		}
+		if room >= 0 && length > room {
+			return errAPIQuota
+		}
+
+		user := context.User(ctx)
+		upload, err = a.UploadService.Create(ctx, user.ID, gallery.ID, filename, length, a.Uploads.expiresAt())
+		return err
+	})
+	if err != nil {
+		writeError(w, r, err, "creating upload", "gallery_id", gallery.ID)
+		return
+	}
+
+	w.Header().Set("Location", APIPrefix+"/uploads/"+upload.ID)
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// upload looks up the upload of the uploadID URL parameter. Only its owner
+// can see it.
+func (a API) upload(r *http.Request) (*models.Upload, error) {
+	upload, err := a.UploadService.ByID(r.Context(), context.User(r.Context()).ID, chi.URLParam(r, "uploadID"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			return nil, errAPIUploadNotFound
+		}
+		return nil, fmt.Errorf("query upload: %w", err)
+	}
+	return upload, nil
+}
+
+// uploadHeaders sets the headers telling where an upload stands.
+func uploadHeaders(w http.ResponseWriter, upload *models.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// UploadStatus answers with the offset to carry on from.
+func (a API) UploadStatus(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	upload, err := a.upload(r)
+	if err != nil {
+		writeError(w, r, err, "querying upload")
+		return
+	}
+
+	uploadHeaders(w, upload)
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// checksum returns a function checking that what went through the hash
+// matches the Upload-Checksum header, "<algorithm> <base64 digest>", or nil
+// without one.
+func checksum(header string) (hash.Hash, func() error, error) {
+	if header == "" {
+		return nil, nil, nil
+	}
+	algorithm, encoded, _ := strings.Cut(header, " ")
+	want, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, newAPIError(http.StatusBadRequest, "invalid_header",
+			"The digest of the Upload-Checksum header is not base64.")
+	}
+
+	var h hash.Hash
+	switch algorithm {
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	default:
+		return nil, nil, newAPIError(http.StatusBadRequest, "invalid_header",
+			"The checksum algorithm %q is not supported, use one of %s.", algorithm, tusChecksumAlgorithms)
+	}
+
+	return h, func() error {
+		if !bytes.Equal(h.Sum(nil), want) {
+			return newAPIError(StatusChecksumMismatch, "checksum_mismatch",
+				"The chunk doesn't match its checksum, send it again.")
+		}
+		return nil
+	}, nil
+}
+
+// AppendUpload writes a chunk at the offset the client thinks the upload is
+// at. The chunk that completes the upload turns it into an image.
+func (a API) AppendUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != tusChunkType {
+		writeError(w, r, newAPIError(http.StatusUnsupportedMediaType, "unsupported_media_type",
+			"Chunks must be sent as %s.", tusChunkType), "")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, r, newAPIError(http.StatusBadRequest, "invalid_header",
+			"The Upload-Offset header must be a number."), "")
+		return
+	}
+	h, verify, err := checksum(r.Header.Get("Upload-Checksum"))
+	if err != nil {
+		writeError(w, r, err, "")
+		return
+	}
+
+	upload, err := a.upload(r)
+	if err != nil {
+		writeError(w, r, err, "querying upload")
+		return
+	}
+	errConflict := newAPIError(http.StatusConflict, "offset_conflict",
+		"The upload is at offset %d.", upload.Offset)
+	if offset != upload.Offset {
+		writeError(w, r, errConflict, "")
+		return
+	}
+	remaining := upload.Length - upload.Offset
+	if r.ContentLength > remaining {
+		writeError(w, r, newAPIError(http.StatusRequestEntityTooLarge, "too_large",
+			"The chunk is longer than the %d bytes left.", remaining), "")
+		return
+	}
+
+	var chunk io.Reader = http.MaxBytesReader(w, r.Body, remaining)
+	if h != nil {
+		chunk = io.TeeReader(chunk, h)
+	}
+	err = a.UploadService.Append(r.Context(), upload, chunk, verify, a.Uploads.expiresAt())
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.Is(err, models.ErrUploadConflict):
+			err = errConflict
+		case errors.As(err, &tooLarge):
+			err = newAPIError(http.StatusRequestEntityTooLarge, "too_large",
+				"The chunk is longer than the %d bytes left.", tooLarge.Limit)
+		}
+		writeError(w, r, err, "appending to upload", "upload_id", upload.ID)
+		return
+	}
+
+	if upload.Received() && upload.CompletedAt == nil {
+		err = a.completeUpload(r, upload)
+		if err != nil {
+			writeError(w, r, err, "completing upload", "upload_id", upload.ID)
+			return
+		}
+	}
+
+	uploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeUpload adds the received file to its gallery. A file that isn't
+// an image is no use to anyone, so the upload goes away with it.
+func (a API) completeUpload(r *http.Request, upload *models.Upload) error {
+	// the user may have lost access to the gallery since the upload started
+	gallery, err := a.GalleryService.ByID(r.Context(), upload.GalleryID)
+	if err != nil {
+		return fmt.Errorf("query gallery %d: %w", upload.GalleryID, err)
+	}
+	if !context.User(r.Context()).CanEditGallery(gallery) {
+		return newAPIError(http.StatusForbidden, "forbidden",
+			"You are not authorised to change this gallery.")
+	}
+
+	f, err := a.UploadService.Open(upload)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	image, err := a.ImageService.Create(r.Context(), gallery.ID, upload.Filename, f)
+	if err != nil {
+		if errors.Is(err, models.ErrNotImage) {
+			// the image error is the one worth answering with
+			_ = a.UploadService.Delete(r.Context(), upload.UserID, upload.ID)
+		}
+		return err
+	}
+	metrics.UploadedBytes.Add(float64(image.Size))
+
+	err = a.UploadService.Complete(r.Context(), upload)
+	if err != nil {
+		return err
+	}
+	notify(r, a.WebhookService, gallery.UserID, models.WebhookImageUploaded,
+		webhookImage{GalleryID: gallery.ID, apiImage: newAPIImage(image)})
+
+	return nil
+}
+
+// DeleteUpload abandons an upload, freeing its space right away rather than
+// once it expires.
+func (a API) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	err := a.UploadService.Delete(r.Context(), context.User(r.Context()).ID, chi.URLParam(r, "uploadID"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			err = errAPIUploadNotFound
+		}
+		writeError(w, r, err, "deleting upload")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
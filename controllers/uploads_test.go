@@ -0,0 +1,306 @@
+package controllers_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rafaelmdurante/lenslocked/controllers"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// tus is the header every tus request but OPTIONS carries.
+var tus = []string{"Tus-Resumable", "1.0.0"}
+
+// createUpload starts an upload of length bytes to the gallery and returns
+// its path.
+func (app *testApp) createUpload(email string, galleryID int, filename string, length int) string {
+	app.t.Helper()
+
+	resp := app.apiRequest(http.MethodPost, fmt.Sprintf("/api/v1/galleries/%d/uploads", galleryID), email, nil,
+		append(tus, "Upload-Length", fmt.Sprint(length),
+			"Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(filename)))...)
+	assertStatus(app.t, resp, http.StatusCreated)
+	if !strings.HasPrefix(resp.location, "/api/v1/uploads/") {
+		app.t.Fatalf("got location %q, want the upload", resp.location)
+	}
+	return resp.location
+}
+
+// patchUpload sends a chunk at offset.
+func (app *testApp) patchUpload(email, path string, offset int, chunk []byte, header ...string) response {
+	app.t.Helper()
+
+	header = append(header, tus...)
+	header = append(header, "Content-Type", "application/offset+octet-stream",
+		"Upload-Offset", fmt.Sprint(offset))
+	return app.apiRequest(http.MethodPatch, path, email, bytes.NewReader(chunk), header...)
+}
+
+// createAPIGallery creates a gallery through the API and returns its id.
+func (app *testApp) createAPIGallery(email, title string) int {
+	app.t.Helper()
+
+	resp := app.apiRequest(http.MethodPost, "/api/v1/galleries", email, map[string]string{"title": title})
+	assertStatus(app.t, resp, http.StatusCreated)
+	var g apiGallery
+	decode(app.t, resp, &g)
+	return g.ID
+}
+
+func sha1Checksum(b []byte) string {
+	sum := sha1.Sum(b)
+	return "sha1 " + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestResumableUpload(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	hook := app.createWebhook(app.client, "https://lab.example.com/hooks", models.WebhookImageUploaded)
+	galleryID := app.createAPIGallery("bob@example.com", "Cats")
+	red, err := os.ReadFile("testdata/images/red.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := app.apiRequest(http.MethodOptions, "/api/v1/uploads", "bob@example.com", nil)
+	assertStatus(t, resp, http.StatusNoContent)
+	if got := resp.header.Get("Tus-Extension"); !strings.Contains(got, "checksum") {
+		t.Errorf("got Tus-Extension %q", got)
+	}
+	if got := resp.header.Get("Tus-Max-Size"); got != "1048576" {
+		t.Errorf("got Tus-Max-Size %q", got)
+	}
+
+	uploads := fmt.Sprintf("/api/v1/galleries/%d/uploads", galleryID)
+	resp = app.apiRequest(http.MethodPost, uploads, "bob@example.com", nil, "Upload-Length", "10")
+	assertAPIError(t, resp, http.StatusPreconditionFailed, "unsupported_version")
+	if got := resp.header.Get("Tus-Version"); got != "1.0.0" {
+		t.Errorf("got Tus-Version %q", got)
+	}
+	resp = app.apiRequest(http.MethodPost, uploads, "bob@example.com", nil,
+		append(tus, "Upload-Length", fmt.Sprint(2<<20), "Upload-Metadata", "filename cmVkLnBuZw==")...)
+	assertAPIError(t, resp, http.StatusRequestEntityTooLarge, "too_large")
+	resp = app.apiRequest(http.MethodPost, uploads, "bob@example.com", nil,
+		append(tus, "Upload-Length", "10", "Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("../red.png")))...)
+	assertAPIError(t, resp, http.StatusUnprocessableEntity, "invalid_field")
+
+	path := app.createUpload("bob@example.com", galleryID, "red.png", len(red))
+	resp = app.apiRequest(http.MethodHead, path, "bob@example.com", nil, tus...)
+	assertStatus(t, resp, http.StatusOK)
+	if resp.header.Get("Upload-Offset") != "0" || resp.header.Get("Upload-Length") != fmt.Sprint(len(red)) {
+		t.Errorf("got offset %q of %q", resp.header.Get("Upload-Offset"), resp.header.Get("Upload-Length"))
+	}
+	app.signUpAs("carol@example.com", models.RoleUser)
+	assertStatus(t, app.apiRequest(http.MethodHead, path, "carol@example.com", nil, tus...), http.StatusNotFound)
+
+	// a chunk that doesn't match its checksum isn't kept
+	half := len(red) / 2
+	resp = app.patchUpload("bob@example.com", path, 0, red[:half], "Upload-Checksum", sha1Checksum(red[half:]))
+	assertAPIError(t, resp, 460, "checksum_mismatch")
+	resp = app.patchUpload("bob@example.com", path, 0, red[:half], "Upload-Checksum", "md5 AAAA")
+	assertAPIError(t, resp, http.StatusBadRequest, "invalid_header")
+	resp = app.patchUpload("bob@example.com", path, 0, red[:half], "Upload-Checksum", sha1Checksum(red[:half]))
+	assertStatus(t, resp, http.StatusNoContent)
+	if got := resp.header.Get("Upload-Offset"); got != fmt.Sprint(half) {
+		t.Errorf("got offset %q, want %d", got, half)
+	}
+
+	// the client has to carry on from where the upload is
+	resp = app.patchUpload("bob@example.com", path, 0, red[:half])
+	assertAPIError(t, resp, http.StatusConflict, "offset_conflict")
+	resp = app.apiRequest(http.MethodPatch, path, "bob@example.com", bytes.NewReader(red[half:]),
+		append(tus, "Content-Type", "image/png", "Upload-Offset", fmt.Sprint(half))...)
+	assertAPIError(t, resp, http.StatusUnsupportedMediaType, "unsupported_media_type")
+	resp = app.patchUpload("bob@example.com", path, half, append(red[half:], 0))
+	assertAPIError(t, resp, http.StatusRequestEntityTooLarge, "too_large")
+
+	// the last chunk adds the image
+	resp = app.patchUpload("bob@example.com", path, half, red[half:])
+	assertStatus(t, resp, http.StatusNoContent)
+	if got := resp.header.Get("Upload-Offset"); got != fmt.Sprint(len(red)) {
+		t.Errorf("got offset %q, want %d", got, len(red))
+	}
+	resp = app.apiRequest(http.MethodGet, fmt.Sprintf("/api/v1/galleries/%d/images/red.png", galleryID), "bob@example.com", nil)
+	assertStatus(t, resp, http.StatusOK)
+	var image struct {
+		ContentType string `json:"content_type"`
+		Size        int
+	}
+	decode(t, resp, &image)
+	if image.Size != len(red) || image.ContentType != "image/png" {
+		t.Errorf("got image %+v", image)
+	}
+	if deliveries := app.deliveries(hook); len(deliveries) != 1 {
+		t.Errorf("got %d deliveries, want the image.uploaded one", len(deliveries))
+	}
+
+	assertStatus(t, app.apiRequest(http.MethodDelete, path, "carol@example.com", nil, tus...), http.StatusNotFound)
+	assertStatus(t, app.apiRequest(http.MethodDelete, path, "bob@example.com", nil, tus...), http.StatusNoContent)
+	assertStatus(t, app.apiRequest(http.MethodHead, path, "bob@example.com", nil, tus...), http.StatusNotFound)
+}
+
+func TestResumableUploadNotImage(t *testing.T) {
+	app := newTestApp(t)
+	app.signUpAs("bob@example.com", models.RoleUser)
+	galleryID := app.createAPIGallery("bob@example.com", "Cats")
+
+	path := app.createUpload("bob@example.com", galleryID, "notes.png", 5)
+	resp := app.patchUpload("bob@example.com", path, 0, []byte("hello"))
+	assertAPIError(t, resp, http.StatusUnsupportedMediaType, "not_image")
+	// it is of no use to anyone, so it is gone
+	assertStatus(t, app.apiRequest(http.MethodHead, path, "bob@example.com", nil, tus...), http.StatusNotFound)
+	images, err := app.images.ByGalleryID(context.Background(), galleryID)
+	if err != nil || len(images) != 0 {
+		t.Errorf("got images %v, %v, want none", images, err)
+	}
+}
+
+func TestUploadQuota(t *testing.T) {
+	app := newTestApp(t)
+	app.signUpAs("bob@example.com", models.RoleUser)
+	galleryID := app.createAPIGallery("bob@example.com", "Cats")
+	red, err := os.ReadFile("testdata/images/red.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unfinished uploads count for their whole length
+	first := app.createUpload("bob@example.com", galleryID, "a.png", 1<<20)
+	app.createUpload("bob@example.com", galleryID, "b.png", 1<<20)
+	resp := app.apiRequest(http.MethodPost, fmt.Sprintf("/api/v1/galleries/%d/uploads", galleryID), "bob@example.com", nil,
+		append(tus, "Upload-Length", "1", "Upload-Metadata", "filename Yy5wbmc=")...)
+	assertAPIError(t, resp, http.StatusRequestEntityTooLarge, "quota_exceeded")
+	image := fmt.Sprintf("/api/v1/galleries/%d/images/red.png", galleryID)
+	resp = app.apiRequest(http.MethodPut, image, "bob@example.com", bytes.NewReader(red))
+	assertAPIError(t, resp, http.StatusRequestEntityTooLarge, "quota_exceeded")
+
+	// abandoning one makes room
+	assertStatus(t, app.apiRequest(http.MethodDelete, first, "bob@example.com", nil, tus...), http.StatusNoContent)
+	assertStatus(t, app.apiRequest(http.MethodPut, image, "bob@example.com", bytes.NewReader(red)), http.StatusCreated)
+	// and the quota is per user
+	app.signUpAs("carol@example.com", models.RoleUser)
+	app.createUpload("carol@example.com", app.createAPIGallery("carol@example.com", "Birds"), "c.png", 1<<20)
+}
+
+// slowUploads takes its time to sum the usage, so that concurrent uploads
+// all read it before any of them is created, unless something runs them
+// one after the other.
+type slowUploads struct {
+	controllers.UploadService
+}
+
+func (s slowUploads) Usage(ctx context.Context, userID int) (int64, error) {
+	usage, err := s.UploadService.Usage(ctx, userID)
+	time.Sleep(20 * time.Millisecond)
+	return usage, err
+}
+
+func TestUploadQuotaConcurrent(t *testing.T) {
+	app := newTestApp(t)
+	app.signUpAs("bob@example.com", models.RoleUser)
+	const bob = "bob@example.com"
+	galleryID := app.createAPIGallery(bob, "Cats")
+
+	api := controllers.API{
+		APITokenService: app.tokens,
+		GalleryService:  app.galleries,
+		UploadService:   slowUploads{app.uploads},
+		Uploads:         controllers.UploadLimits{MaxSize: 1 << 20, Expiry: time.Hour, Quota: 2 << 20},
+		Transactor:      app.transactor,
+	}
+	r := chi.NewRouter()
+	r.Use(api.SetUser)
+	r.Use(api.RequireUser)
+	api.Routes(r)
+	root := chi.NewRouter()
+	root.Mount(controllers.APIPrefix, r)
+	server := httptest.NewServer(root)
+	t.Cleanup(server.Close)
+
+	// uploads started at once, only two of them fit in the quota
+	statuses := make(chan int, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(statuses); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodPost,
+				fmt.Sprintf("%s/api/v1/galleries/%d/uploads", server.URL, galleryID), nil)
+			req.Header.Set("Authorization", "Bearer "+app.apiToken(bob))
+			req.Header.Set("Tus-Resumable", "1.0.0")
+			req.Header.Set("Upload-Length", fmt.Sprint(1<<20))
+			req.Header.Set("Upload-Metadata",
+				"filename "+base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%d.png", i))))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+	close(statuses)
+
+	got := map[int]int{}
+	for status := range statuses {
+		got[status]++
+	}
+	if got[http.StatusCreated] != 2 || got[http.StatusRequestEntityTooLarge] != 2 {
+		t.Errorf("got statuses %v, want two 201", got)
+	}
+}
+
+func TestUploadExpiry(t *testing.T) {
+	app := newTestApp(t)
+	app.signUpAs("bob@example.com", models.RoleUser)
+	galleryID := app.createAPIGallery("bob@example.com", "Cats")
+
+	path := app.createUpload("bob@example.com", galleryID, "red.png", 10)
+	resp := app.patchUpload("bob@example.com", path, 0, []byte("01234"))
+	assertStatus(t, resp, http.StatusNoContent)
+	expires, err := http.ParseTime(resp.header.Get("Upload-Expires"))
+	if err != nil || time.Until(expires) < 59*time.Minute {
+		t.Errorf("got Upload-Expires %q, %v, want an hour from now", resp.header.Get("Upload-Expires"), err)
+	}
+
+	app.uploads.Now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	assertStatus(t, app.apiRequest(http.MethodHead, path, "bob@example.com", nil, tus...), http.StatusNotFound)
+	// the file of an upload whose row isn't committed yet is kept
+	err = app.uploads.Files.Create("uncommitted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := app.uploads.DeleteExpired(context.Background())
+	if err != nil || n != 1 {
+		t.Errorf("got %d, %v, want the expired upload deleted", n, err)
+	}
+	if _, err := os.Stat(app.uploads.Files.Path("uncommitted")); err != nil {
+		t.Errorf("the recent file was removed: %v", err)
+	}
+	// until it is left over for good
+	old := time.Now().Add(-models.UploadFileGrace - time.Minute)
+	err = os.Chtimes(app.uploads.Files.Path("uncommitted"), old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = app.uploads.DeleteExpired(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(app.uploads.Files.Path("uncommitted")); !os.IsNotExist(err) {
+		t.Errorf("the left over file is still there: %v", err)
+	}
+}
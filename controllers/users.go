@@ -1,17 +1,21 @@
 package controllers
 
 import (
+	stdctx "context"
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/rafaelmdurante/lenslocked/context"
 	"github.com/rafaelmdurante/lenslocked/errors"
+	"github.com/rafaelmdurante/lenslocked/metrics"
 	"github.com/rafaelmdurante/lenslocked/models"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type UserMiddleware struct {
-	SessionService *models.SessionService
+	SessionService SessionService
 }
 
 type Users struct {
@@ -21,11 +25,24 @@ type Users struct {
 		ForgotPassword Template
 		CheckYourEmail Template
 		ResetPassword  Template
+		DeleteAccount  Template
+		Activity       Template
 	}
-	UserService          *models.UserService
-	SessionService       *models.SessionService
-	PasswordResetService *models.PasswordResetService
-	EmailService         *models.EmailService
+	UserService          UserService
+	SessionService       SessionService
+	PasswordResetService PasswordResetService
+	EmailService         EmailService
+	GalleryService       GalleryService
+	ImageService         ImageService
+	ImpersonationService ImpersonationService
+	AuditService         AuditService
+	// Transactor groups the service calls of a flow, so a failure halfway
+	// through doesn't leave things half done
+	Transactor Transactor
+	// BaseURL is the public URL of the app, used to build links in emails
+	BaseURL string
+	// SecureCookies only lets the session cookie go over https
+	SecureCookies bool
 }
 
 func (u Users) New(w http.ResponseWriter, r *http.Request) {
@@ -44,7 +61,24 @@ func (u Users) Create(w http.ResponseWriter, r *http.Request) {
 	data.Email = r.FormValue("email")
 	data.Password = r.FormValue("password")
 
-	user, err := u.UserService.Create(data.Email, data.Password)
+	// the user and their session are created together, otherwise a failure
+	// creating the session leaves an account the user doesn't know exists
+	var user *models.User
+	var session *models.Session
+	err := u.Transactor.InTx(r.Context(), func(ctx stdctx.Context) error {
+		var err error
+		user, err = u.UserService.Create(ctx, data.Email, data.Password)
+		if err != nil {
+			return err
+		}
+
+		session, err = u.SessionService.Create(ctx, user.ID)
+		if err != nil {
+			return fmt.Errorf("create session: %w", err)
+		}
+
+		return nil
+	})
 	if err != nil {
 		if errors.Is(err, models.ErrEmailToken) {
 			err = errors.Public(err, "That email address is already associated with an account.")
@@ -52,16 +86,12 @@ func (u Users) Create(w http.ResponseWriter, r *http.Request) {
 		u.Templates.New.Execute(w, r, data, err)
 		return
 	}
+	metrics.Signups.Inc()
+	record(r, u.AuditService, models.AuditEvent{
+		Type: models.EventSignUp, UserID: user.ID, Email: user.Email,
+	})
 
-	session, err := u.SessionService.Create(user.ID)
-	if err != nil {
-		fmt.Println(err)
-		// TODO: long term, we should show a warning about not being able to sign the user in
-		http.Redirect(w, r, "/signin", http.StatusFound)
-		return
-	}
-
-	setCookie(w, CookieSession, session.Token)
+	setCookie(w, CookieSession, session.Token, u.SecureCookies)
 	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
 
@@ -84,21 +114,37 @@ func (u Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
 	data.Email = r.FormValue("email")
 	data.Password = r.FormValue("password")
 
-	user, err := u.UserService.Authenticate(data.Email, data.Password)
-	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "something went wrong authenticating", http.StatusInternalServerError)
+	user, err := u.UserService.Authenticate(r.Context(), data.Email, data.Password)
+	switch {
+	case errors.Is(err, models.ErrNotFound), errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+		// the same message for both, so it doesn't tell which emails have an
+		// account
+		metrics.FailedLogins.Inc()
+		recordFailedSignIn(r, u.UserService, u.AuditService, data.Email)
+		err = errors.Public(err, "Invalid email or password.")
+		u.Templates.SignIn.Execute(w, r, data, err)
+		return
+	case errors.Is(err, models.ErrDisabled):
+		recordFailedSignIn(r, u.UserService, u.AuditService, data.Email)
+		err = errors.Public(err, "This account has been disabled.")
+		u.Templates.SignIn.Execute(w, r, data, err)
+		return
+	case err != nil:
+		serverError(w, r, err, "authenticating user")
 		return
 	}
 
-	session, err := u.SessionService.Create(user.ID)
+	session, err := u.SessionService.Create(r.Context(), user.ID)
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "Something went wrong creating session", http.StatusInternalServerError)
+		serverError(w, r, err, "creating session")
 		return
 	}
+	metrics.SignIns.Inc()
+	record(r, u.AuditService, models.AuditEvent{
+		Type: models.EventSignIn, UserID: user.ID, Email: user.Email,
+	})
 
-	setCookie(w, CookieSession, session.Token)
+	setCookie(w, CookieSession, session.Token, u.SecureCookies)
 	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
 
@@ -109,14 +155,30 @@ func (u Users) ProcessSignOut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = u.SessionService.Delete(token)
+	err = u.SessionService.Delete(r.Context(), token)
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "something went wrong deleting session", http.StatusInternalServerError)
+		serverError(w, r, err, "deleting session")
 		return
 	}
 
-	deleteCookie(w, CookieSession)
+	// signing out ends an impersonation too, the trail has to say so
+	user := context.User(r.Context())
+	if user != nil && user.Impersonator != nil {
+		err = u.ImpersonationService.End(r.Context(), user.Impersonator.ID)
+		if err != nil {
+			serverError(w, r, err, "ending impersonation")
+			return
+		}
+		// it is the admin's session that ends
+		user = user.Impersonator
+	}
+	if user != nil {
+		record(r, u.AuditService, models.AuditEvent{
+			Type: models.EventSignOut, UserID: user.ID, Email: user.Email,
+		})
+	}
+
+	deleteCookie(w, CookieSession, u.SecureCookies)
 	http.Redirect(w, r, "/signin", http.StatusFound)
 }
 
@@ -127,6 +189,46 @@ func (u Users) CurrentUser(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "current user: %s\n", user.Email)
 }
 
+// Activity lists the audit events of the current user, so they can spot
+// sign ins they don't recognise.
+func (u Users) Activity(w http.ResponseWriter, r *http.Request) {
+	type Event struct {
+		Description string
+		// ByStaff is set when an admin or a moderator did it
+		ByStaff   bool
+		IP        string
+		UserAgent string
+		CreatedAt time.Time
+	}
+
+	var data struct {
+		pagination
+		Events []Event
+	}
+	data.pagination = newPagination(r)
+
+	user := context.User(r.Context())
+	events, err := u.AuditService.List(r.Context(),
+		models.AuditFilter{UserID: user.ID}, adminPageSize, data.offset())
+	if err != nil {
+		serverError(w, r, err, "listing user activity")
+		return
+	}
+	data.links("/users/me/activity", len(events))
+
+	for _, event := range events {
+		data.Events = append(data.Events, Event{
+			Description: event.Type.Description(),
+			ByStaff:     event.ActorID != 0,
+			IP:          event.IP,
+			UserAgent:   event.UserAgent,
+			CreatedAt:   event.CreatedAt,
+		})
+	}
+
+	u.Templates.Activity.Execute(w, r, data)
+}
+
 // ForgotPassword handles the request for forgotten password
 // It prefill the user's email
 func (u Users) ForgotPassword(w http.ResponseWriter, r *http.Request) {
@@ -145,12 +247,11 @@ func (u Users) ProcessForgotPassword(w http.ResponseWriter, r *http.Request) {
 
 	data.Email = r.FormValue("email")
 
-	newPassword, err := u.PasswordResetService.Create(data.Email)
+	newPassword, err := u.PasswordResetService.Create(r.Context(), data.Email)
 	if err != nil {
 		// TODO: handle other cases in the future, for instance, if a user
 		// does not exist with the email address
-		fmt.Println(err)
-		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		serverError(w, r, err, "creating password reset")
 		return
 	}
 
@@ -158,15 +259,18 @@ func (u Users) ProcessForgotPassword(w http.ResponseWriter, r *http.Request) {
 		"token": {newPassword.Token},
 	}
 
-	// TODO: make the url configurable
-	resetURL := "https://www.lenslocked.com/reset-pw?" + vals.Encode()
+	resetURL := u.BaseURL + "/reset-pw?" + vals.Encode()
 
-	err = u.EmailService.ForgotPassword(data.Email, resetURL)
+	err = u.EmailService.ForgotPassword(r.Context(), data.Email, resetURL)
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		serverError(w, r, err, "sending password reset email")
 		return
 	}
+	record(r, u.AuditService, models.AuditEvent{
+		Type:   models.EventPasswordResetRequested,
+		UserID: newPassword.UserID,
+		Email:  data.Email,
+	})
 
 	// don't render the token here! we need them to confirm they have access to
 	// their email to get the token. sharing it here would be a massive security
@@ -188,7 +292,7 @@ func (umw UserMiddleware) SetUser(next http.Handler) http.Handler {
 		}
 
 		// if we have a token, try to lookup the user with that token
-		user, err := umw.SessionService.User(token)
+		user, err := umw.SessionService.User(r.Context(), token)
 		if err != nil {
 			// invalid or expired token, then proceed without setting a user
 			next.ServeHTTP(w, r)
@@ -224,6 +328,26 @@ func (umw UserMiddleware) RequireUser(next http.Handler) http.Handler {
 	})
 }
 
+// RequireRole only lets through users with at least the role min, sending
+// everyone else to sign in or away with a 403. Like RequireUser, it has to come
+// after SetUser.
+func (umw UserMiddleware) RequireRole(min models.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := context.User(r.Context())
+			if user == nil {
+				http.Redirect(w, r, "/signin", http.StatusFound)
+				return
+			}
+			if !user.Role.AtLeast(min) {
+				http.Error(w, "You are not authorised to see this page", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // ResetPassword is a handler to render the form. It parses a token from the
 // URL query parameters. The token is inserted into the form as a hidden value.
 func (u Users) ResetPassword(w http.ResponseWriter, r *http.Request) {
@@ -243,35 +367,106 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 	data.Token = r.FormValue("token")
 	data.Password = r.FormValue("password")
 
-	// attempt to consume the token
-	user, err := u.PasswordResetService.Consume(data.Token)
+	// consuming the token, updating the password and signing the user in
+	// happen in one transaction, otherwise a failure after consuming the
+	// token burns it without changing the password
+	var user *models.User
+	var session *models.Session
+	err := u.Transactor.InTx(r.Context(), func(ctx stdctx.Context) error {
+		// attempt to consume the token
+		var err error
+		user, err = u.PasswordResetService.Consume(ctx, data.Token)
+		if err != nil {
+			// TODO: Distinguis between server errors and invalid token errors
+			return fmt.Errorf("consume password reset token: %w", err)
+		}
+
+		// update the user's password
+		err = u.UserService.UpdatePassword(ctx, user.ID, data.Password)
+		if err != nil {
+			return fmt.Errorf("update password: %w", err)
+		}
+
+		// create a new session
+		session, err = u.SessionService.Create(ctx, user.ID)
+		if err != nil {
+			return fmt.Errorf("create session: %w", err)
+		}
+
+		return nil
+	})
 	if err != nil {
-		fmt.Println(err)
-		// TODO: Distinguis between server errors and invalid token errors
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		serverError(w, r, err, "resetting password")
 		return
 	}
 
-	// update the user's password
-	err = u.UserService.UpdatePassword(user.ID, data.Password)
+	for _, typ := range []models.AuditEventType{models.EventPasswordResetConsumed, models.EventSignIn} {
+		record(r, u.AuditService, models.AuditEvent{
+			Type: typ, UserID: user.ID, Email: user.Email,
+		})
+	}
+
+	// sign the user in
+	setCookie(w, CookieSession, session.Token, u.SecureCookies)
+
+	// redirect them to the /users/me page
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// DeleteAccount renders the form where users confirm the deletion of their
+// account with their password.
+func (u Users) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	u.Templates.DeleteAccount.Execute(w, r, nil)
+}
+
+// ProcessDeleteAccount deletes the galleries of the current user and then the
+// user, whose sessions and password resets go with it.
+func (u Users) ProcessDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	// a session alone is not enough to delete an account, it could be a
+	// browser left signed in
+	_, err := u.UserService.Authenticate(r.Context(), user.Email, r.FormValue("password"))
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			err = errors.Public(err, "The password is incorrect.")
+		}
+		u.Templates.DeleteAccount.Execute(w, r, nil, err)
 		return
 	}
 
-	// create a new session
-	session, err := u.SessionService.Create(user.ID)
+	// all or nothing, a failure halfway would otherwise leave the account
+	// without some of its galleries
+	var galleries []models.Gallery
+	err = u.Transactor.InTx(r.Context(), func(ctx stdctx.Context) error {
+		galleries, err = u.GalleryService.ByUserID(ctx, user.ID)
+		if err != nil {
+			return fmt.Errorf("query galleries: %w", err)
+		}
+		for _, gallery := range galleries {
+			err = u.GalleryService.Delete(ctx, gallery.ID)
+			if err != nil {
+				return fmt.Errorf("delete gallery %d: %w", gallery.ID, err)
+			}
+		}
+
+		return u.UserService.Delete(ctx, user.ID)
+	})
 	if err != nil {
-		fmt.Println(err)
-		http.Redirect(w, r, "/signin", http.StatusFound)
+		serverError(w, r, err, "deleting account", "user_id", user.ID)
 		return
 	}
 
-	// sign the user in
-	setCookie(w, CookieSession, session.Token)
+	// files can't be rolled back, so they go once the account is gone for
+	// good. The account is deleted either way, a failure is only logged
+	for _, gallery := range galleries {
+		err = u.ImageService.DeleteFiles(r.Context(), gallery.ID)
+		if err != nil {
+			context.Logger(r.Context()).Error("deleting gallery images",
+				"gallery_id", gallery.ID, "err", err)
+		}
+	}
 
-	// redirect them to the /users/me page
-	http.Redirect(w, r, "/users/me", http.StatusFound)
+	deleteCookie(w, CookieSession, u.SecureCookies)
+	http.Redirect(w, r, "/", http.StatusFound)
 }
-
@@ -0,0 +1,291 @@
+package controllers_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/controllers"
+)
+
+func TestSignUp(t *testing.T) {
+	app := newTestApp(t)
+
+	app.signUp(app.client, "Bob@Example.com", "secret")
+
+	resp := app.get(app.client, "/users/me")
+	assertStatus(t, resp, http.StatusOK)
+	// emails are stored lower cased
+	assertContains(t, resp, "current user: bob@example.com")
+}
+
+func TestSignUpEmailTaken(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+
+	resp := app.post(app.newClient(), "/signup", url.Values{
+		"email":    {"BOB@example.com"},
+		"password": {"other"},
+	})
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, "That email address is already associated with an account.")
+}
+
+func TestSignIn(t *testing.T) {
+	app := newTestApp(t)
+	_, err := app.users.Create(context.Background(), "bob@example.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		signedIn bool
+	}{
+		{"valid credentials", "bob@example.com", "secret", true},
+		{"email is case insensitive", "BOB@example.com", "secret", true},
+		{"wrong password", "bob@example.com", "wrong", false},
+		{"unknown email", "alice@example.com", "secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := app.newClient()
+			resp := app.post(client, "/signin", url.Values{
+				"email":    {tt.email},
+				"password": {tt.password},
+			})
+
+			if tt.signedIn {
+				assertRedirect(t, resp, "/users/me")
+				assertStatus(t, app.get(client, "/users/me"), http.StatusOK)
+				return
+			}
+
+			// the form again, with an error that doesn't tell which was wrong
+			assertStatus(t, resp, http.StatusOK)
+			assertContains(t, resp, "Invalid email or password.")
+			assertRedirect(t, app.get(client, "/users/me"), "/signin")
+		})
+	}
+}
+
+func TestSignOut(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+
+	resp := app.post(app.client, "/signout", nil)
+	assertRedirect(t, resp, "/signin")
+
+	assertRedirect(t, app.get(app.client, "/users/me"), "/signin")
+}
+
+func TestSignInSecureCookie(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+
+	// TLS ends at a proxy, the request itself is plain http
+	users := controllers.Users{
+		UserService:    app.users,
+		SessionService: app.sessions,
+		AuditService:   app.audit,
+		SecureCookies:  true,
+	}
+	form := url.Values{"email": {"bob@example.com"}, "password": {"secret"}}
+	r := httptest.NewRequest(http.MethodPost, "/signin", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	users.ProcessSignIn(w, r)
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != controllers.CookieSession {
+		t.Fatalf("got cookies %v, want the session cookie", cookies)
+	}
+	if !cookies[0].Secure {
+		t.Error("got a session cookie that isn't Secure")
+	}
+}
+
+func TestSignInReplacesSession(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+
+	// there is a single session per user, signing in elsewhere ends the
+	// first one
+	other := app.newClient()
+	resp := app.post(other, "/signin", url.Values{
+		"email":    {"bob@example.com"},
+		"password": {"secret"},
+	})
+	assertRedirect(t, resp, "/users/me")
+
+	assertRedirect(t, app.get(app.client, "/users/me"), "/signin")
+	assertStatus(t, app.get(other, "/users/me"), http.StatusOK)
+}
+
+func TestPasswordReset(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+
+	client := app.newClient()
+	resp := app.post(client, "/forgot-pw", url.Values{"email": {"bob@example.com"}})
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, "Check your email")
+
+	token := resetToken(t, app)
+
+	resp = app.get(client, "/reset-pw?token="+url.QueryEscape(token))
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, token)
+
+	resp = app.post(client, "/reset-pw", url.Values{
+		"token":    {token},
+		"password": {"new secret"},
+	})
+	assertRedirect(t, resp, "/users/me")
+	assertStatus(t, app.get(client, "/users/me"), http.StatusOK)
+
+	t.Run("token can only be used once", func(t *testing.T) {
+		resp := app.post(app.newClient(), "/reset-pw", url.Values{
+			"token":    {token},
+			"password": {"hijacked"},
+		})
+		if resp.status == http.StatusFound {
+			t.Fatalf("got redirect to %q, want the token to be rejected", resp.location)
+		}
+	})
+
+	t.Run("password is changed", func(t *testing.T) {
+		resp := app.post(app.newClient(), "/signin", url.Values{
+			"email":    {"bob@example.com"},
+			"password": {"secret"},
+		})
+		if resp.status == http.StatusFound {
+			t.Fatal("signed in with the old password")
+		}
+
+		resp = app.post(app.newClient(), "/signin", url.Values{
+			"email":    {"bob@example.com"},
+			"password": {"new secret"},
+		})
+		assertRedirect(t, resp, "/users/me")
+	})
+}
+
+func TestPasswordResetExpired(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+
+	resp := app.post(app.newClient(), "/forgot-pw", url.Values{"email": {"bob@example.com"}})
+	assertStatus(t, resp, http.StatusOK)
+	token := resetToken(t, app)
+
+	app.resets.Now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+
+	resp = app.post(app.newClient(), "/reset-pw", url.Values{
+		"token":    {token},
+		"password": {"new secret"},
+	})
+	if resp.status == http.StatusFound {
+		t.Fatalf("got redirect to %q, want the expired token to be rejected", resp.location)
+	}
+}
+
+func TestPasswordResetUnknownEmail(t *testing.T) {
+	app := newTestApp(t)
+
+	resp := app.post(app.client, "/forgot-pw", url.Values{"email": {"nobody@example.com"}})
+	if resp.status == http.StatusOK {
+		t.Fatal("got 200, want the reset to fail for an unknown email")
+	}
+	if n := len(app.emails.Outbox()); n != 0 {
+		t.Fatalf("sent %d emails, want none", n)
+	}
+}
+
+// resetToken reads the token from the last password reset email.
+func resetToken(t *testing.T, app *testApp) string {
+	t.Helper()
+
+	outbox := app.emails.Outbox()
+	if len(outbox) == 0 {
+		t.Fatal("no email sent")
+	}
+	email := outbox[len(outbox)-1]
+
+	const prefix = "http://lenslocked.test/reset-pw?"
+	i := strings.Index(email.Plaintext, prefix)
+	if i < 0 {
+		t.Fatalf("no reset link in email: %q", email.Plaintext)
+	}
+	query, err := url.ParseQuery(email.Plaintext[i+len(prefix):])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return query.Get("token")
+}
+
+func TestDeleteAccount(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	for _, title := range []string{"Holidays", "Wedding"} {
+		resp := app.post(app.client, "/galleries", url.Values{"title": {title}})
+		if resp.status != http.StatusFound {
+			t.Fatalf("create gallery: got %d, want 302", resp.status)
+		}
+	}
+
+	resp := app.get(app.client, "/users/me/delete")
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, "Delete your account")
+
+	t.Run("wrong password", func(t *testing.T) {
+		resp := app.post(app.client, "/users/me/delete", url.Values{"password": {"wrong"}})
+		assertStatus(t, resp, http.StatusOK)
+		assertContains(t, resp, "The password is incorrect.")
+		assertStatus(t, app.get(app.client, "/users/me"), http.StatusOK)
+	})
+
+	resp = app.post(app.client, "/users/me/delete", url.Values{"password": {"secret"}})
+	assertRedirect(t, resp, "/")
+	assertRedirect(t, app.get(app.client, "/users/me"), "/signin")
+
+	_, err := app.users.Authenticate(context.Background(), "bob@example.com", "secret")
+	if err == nil {
+		t.Fatal("user still exists after deleting the account")
+	}
+	assertStatus(t, app.get(app.client, "/galleries/1"), http.StatusNotFound)
+
+	// the email address can be used again
+	app.signUp(app.newClient(), "bob@example.com", "other")
+}
+
+func TestDisabledUser(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	bob, err := app.users.ByEmail(context.Background(), "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.users.Disable(context.Background(), bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the existing session stops working
+	assertRedirect(t, app.get(app.client, "/users/me"), "/signin")
+
+	resp := app.post(app.newClient(), "/signin", url.Values{
+		"email":    {"bob@example.com"},
+		"password": {"secret"},
+	})
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, "This account has been disabled.")
+}
@@ -0,0 +1,231 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rafaelmdurante/lenslocked/context"
+	"github.com/rafaelmdurante/lenslocked/errors"
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/webhooks"
+)
+
+// webhookDeliveries is how many of the latest deliveries a webhook shows.
+const webhookDeliveries = 50
+
+// notify queues event for the webhooks of the user subscribed to it, with
+// data as the payload. Like record, failing to do so is logged and the
+// request goes on.
+func notify(r *http.Request, hooks WebhookService, userID int, event models.WebhookEvent, data any) {
+	payload, err := json.Marshal(webhooks.Payload{
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err == nil {
+		_, err = hooks.Enqueue(r.Context(), userID, event, payload)
+	}
+	if err != nil {
+		context.Logger(r.Context()).Error("queueing webhook deliveries",
+			"event", event, "user_id", userID, "err", err)
+	}
+}
+
+// webhookImage is the payload of image.uploaded.
+type webhookImage struct {
+	GalleryID int `json:"gallery_id"`
+	apiImage
+}
+
+// Webhooks lets users manage their webhooks at /users/me/webhooks.
+type Webhooks struct {
+	Templates struct {
+		Index Template
+		Show  Template
+	}
+	WebhookService WebhookService
+	AuditService   AuditService
+}
+
+type webhookEventView struct {
+	Event       models.WebhookEvent
+	Description string
+	Checked     bool
+}
+
+func webhookEventViews(checked []string) []webhookEventView {
+	var views []webhookEventView
+	for _, event := range models.WebhookEvents {
+		views = append(views, webhookEventView{
+			Event:       event,
+			Description: event.Description(),
+			Checked:     slices.Contains(checked, string(event)),
+		})
+	}
+	return views
+}
+
+type webhooksData struct {
+	Webhooks []models.Webhook
+	// the form, kept when it has errors
+	URL    string
+	Events []webhookEventView
+}
+
+func (wh Webhooks) render(w http.ResponseWriter, r *http.Request, data webhooksData, errs ...error) {
+	user := context.User(r.Context())
+	hooks, err := wh.WebhookService.ByUserID(r.Context(), user.ID)
+	if err != nil {
+		serverError(w, r, err, "querying webhooks")
+		return
+	}
+	data.Webhooks = hooks
+	wh.Templates.Index.Execute(w, r, data, errs...)
+}
+
+func (wh Webhooks) Index(w http.ResponseWriter, r *http.Request) {
+	wh.render(w, r, webhooksData{Events: webhookEventViews(nil)})
+}
+
+// webhookURL checks the URL of an endpoint, which must be absolute.
+func webhookURL(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User != nil {
+		return "", errors.Public(fmt.Errorf("create webhook: invalid url %q", raw),
+			"The URL must start with https:// or http://, without a username or password.")
+	}
+	return u.String(), nil
+}
+
+func (wh Webhooks) Create(w http.ResponseWriter, r *http.Request) {
+	data := webhooksData{
+		URL:    strings.TrimSpace(r.FormValue("url")),
+		Events: webhookEventViews(r.Form["event"]),
+	}
+
+	user := context.User(r.Context())
+	if user.Impersonator != nil {
+		// like tokens, the admin would keep getting the user's events
+		wh.render(w, r, data, errors.Public(fmt.Errorf("create webhook: impersonating"),
+			"Webhooks can't be added while impersonating someone."))
+		return
+	}
+	endpoint, err := webhookURL(data.URL)
+	if err != nil {
+		wh.render(w, r, data, err)
+		return
+	}
+	events, err := models.ParseWebhookEvents(r.Form["event"])
+	if err != nil {
+		wh.render(w, r, data, errors.Public(err, "One of the events is unknown."))
+		return
+	}
+	if len(events) == 0 {
+		wh.render(w, r, data, errors.Public(fmt.Errorf("create webhook: no events"),
+			"Pick at least one event."))
+		return
+	}
+
+	webhook, err := wh.WebhookService.Create(r.Context(), user.ID, endpoint, events)
+	if err != nil {
+		serverError(w, r, err, "creating webhook")
+		return
+	}
+	record(r, wh.AuditService, models.AuditEvent{
+		Type: models.EventWebhookCreated, UserID: user.ID, Email: user.Email,
+	})
+
+	http.Redirect(w, r, fmt.Sprintf("/users/me/webhooks/%d", webhook.ID), http.StatusFound)
+}
+
+// webhook looks up the webhook of the id URL parameter, among the user's.
+// On error the response is already written.
+func (wh Webhooks) webhook(w http.ResponseWriter, r *http.Request) (*models.Webhook, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return nil, err
+	}
+
+	webhook, err := wh.WebhookService.ByID(r.Context(), context.User(r.Context()).ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return nil, err
+		}
+		serverError(w, r, err, "querying webhook", "webhook_id", id)
+		return nil, err
+	}
+
+	return webhook, nil
+}
+
+// Show shows a webhook, its secret and the log of its latest deliveries.
+func (wh Webhooks) Show(w http.ResponseWriter, r *http.Request) {
+	webhook, err := wh.webhook(w, r)
+	if err != nil {
+		return
+	}
+
+	deliveries, err := wh.WebhookService.Deliveries(r.Context(), webhook.ID, webhookDeliveries)
+	if err != nil {
+		serverError(w, r, err, "querying webhook deliveries", "webhook_id", webhook.ID)
+		return
+	}
+
+	wh.Templates.Show.Execute(w, r, struct {
+		Webhook    *models.Webhook
+		Deliveries []models.WebhookDelivery
+	}{webhook, deliveries})
+}
+
+func (wh Webhooks) Delete(w http.ResponseWriter, r *http.Request) {
+	webhook, err := wh.webhook(w, r)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	err = wh.WebhookService.Delete(r.Context(), user.ID, webhook.ID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		serverError(w, r, err, "deleting webhook", "webhook_id", webhook.ID)
+		return
+	}
+	record(r, wh.AuditService, models.AuditEvent{
+		Type: models.EventWebhookDeleted, UserID: user.ID, Email: user.Email,
+	})
+
+	http.Redirect(w, r, "/users/me/webhooks", http.StatusFound)
+}
+
+// Redeliver queues a delivery again, as a new one sent as soon as possible.
+func (wh Webhooks) Redeliver(w http.ResponseWriter, r *http.Request) {
+	webhook, err := wh.webhook(w, r)
+	if err != nil {
+		return
+	}
+	id, err := strconv.ParseInt(chi.URLParam(r, "deliveryID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+
+	_, err = wh.WebhookService.Redeliver(r.Context(), webhook.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Delivery not found", http.StatusNotFound)
+			return
+		}
+		serverError(w, r, err, "redelivering webhook delivery", "delivery_id", id)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/users/me/webhooks/%d", webhook.ID), http.StatusFound)
+}
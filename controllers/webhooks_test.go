@@ -0,0 +1,269 @@
+package controllers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/webhooks"
+)
+
+var webhookPathRe = regexp.MustCompile(`^/users/me/webhooks/(\d+)$`)
+
+// createWebhook adds a webhook through the form and returns its id.
+func (app *testApp) createWebhook(client *http.Client, endpoint string, events ...models.WebhookEvent) int {
+	app.t.Helper()
+
+	form := url.Values{"url": {endpoint}}
+	for _, event := range events {
+		form.Add("event", string(event))
+	}
+	resp := app.post(client, "/users/me/webhooks", form)
+	m := webhookPathRe.FindStringSubmatch(resp.location)
+	if resp.status != http.StatusFound || m == nil {
+		app.t.Fatalf("got %d to %q, want a redirect to the webhook\n%s", resp.status, resp.location, resp.body)
+	}
+
+	var id int
+	fmt.Sscan(m[1], &id)
+	return id
+}
+
+// deliveries returns the deliveries of the webhook, the latest first.
+func (app *testApp) deliveries(webhookID int) []models.WebhookDelivery {
+	app.t.Helper()
+
+	deliveries, err := app.webhooks.Deliveries(context.Background(), webhookID, 100)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	return deliveries
+}
+
+func TestWebhooks(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+
+	assertRedirect(t, app.get(app.newClient(), "/users/me/webhooks"), "/signin")
+	resp := app.get(app.client, "/users/me/webhooks")
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, "No webhooks yet.")
+	assertContains(t, resp, "image.uploaded")
+
+	resp = app.post(app.client, "/users/me/webhooks", url.Values{
+		"url": {"ftp://lab.example.com"}, "event": {"gallery.created"},
+	})
+	assertContains(t, resp, "The URL must start with https://")
+	resp = app.post(app.client, "/users/me/webhooks", url.Values{
+		"url": {"https://lab.example.com/hooks"},
+	})
+	assertContains(t, resp, "Pick at least one event.")
+	assertContains(t, resp, `value="https://lab.example.com/hooks"`)
+	resp = app.post(app.client, "/users/me/webhooks", url.Values{
+		"url": {"https://lab.example.com/hooks"}, "event": {"user.deleted"},
+	})
+	assertContains(t, resp, "One of the events is unknown.")
+
+	id := app.createWebhook(app.client, "https://lab.example.com/hooks", models.WebhookImageUploaded)
+	path := fmt.Sprintf("/users/me/webhooks/%d", id)
+	resp = app.get(app.client, path)
+	assertStatus(t, resp, http.StatusOK)
+	assertContains(t, resp, models.WebhookSecretPrefix)
+	assertContains(t, resp, "Nothing was sent yet.")
+	assertContains(t, app.get(app.client, "/users/me/webhooks"), "https://lab.example.com/hooks")
+
+	// carol can't see nor delete bob's webhook
+	carol := app.signUpAs("carol@example.com", models.RoleUser)
+	assertStatus(t, app.get(carol, path), http.StatusNotFound)
+	assertStatus(t, app.post(carol, path+"/delete", nil), http.StatusNotFound)
+
+	assertRedirect(t, app.post(app.client, path+"/delete", nil), "/users/me/webhooks")
+	assertStatus(t, app.get(app.client, path), http.StatusNotFound)
+
+	events := app.events(models.AuditFilter{Email: "bob@example.com"})
+	if got := eventTypes(events); got != "sign_up,webhook_created,webhook_deleted" {
+		t.Errorf("got events %s", got)
+	}
+}
+
+func TestWebhooksImpersonating(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApp(t)
+	admin := app.signUpAs("admin@example.com", models.RoleAdmin)
+	app.signUpAs("bob@example.com", models.RoleUser)
+	bob, err := app.users.ByEmail(ctx, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.post(admin, fmt.Sprintf("/admin/users/%d/impersonate", bob.ID),
+		url.Values{"reason": {"ticket #42"}})
+
+	resp := app.post(admin, "/users/me/webhooks", url.Values{
+		"url": {"https://evil.example.com"}, "event": {"image.uploaded"},
+	})
+	assertContains(t, resp, "while impersonating")
+	hooks, err := app.webhooks.ByUserID(ctx, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 0 {
+		t.Errorf("got %d webhooks added for bob by the admin", len(hooks))
+	}
+}
+
+func TestWebhookEvents(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	all := app.createWebhook(app.client, "https://lab.example.com/all", models.WebhookEvents...)
+	uploads := app.createWebhook(app.client, "https://lab.example.com/uploads", models.WebhookImageUploaded)
+
+	// on the website
+	resp := app.post(app.client, "/galleries", url.Values{"title": {"Cats"}})
+	assertStatus(t, resp, http.StatusFound)
+	var galleryID int
+	fmt.Sscanf(resp.location, "/galleries/%d/edit", &galleryID)
+	app.post(app.client, fmt.Sprintf("/galleries/%d/delete", galleryID), nil)
+
+	// and through the API
+	resp = app.apiRequest(http.MethodPost, "/api/v1/galleries", "bob@example.com",
+		map[string]string{"title": "Dogs"})
+	assertStatus(t, resp, http.StatusCreated)
+	var g apiGallery
+	decode(t, resp, &g)
+	red, err := os.ReadFile("testdata/images/red.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStatus(t, app.apiRequest(http.MethodPut, fmt.Sprintf("/api/v1/galleries/%d/images/red.png", g.ID),
+		"bob@example.com", bytes.NewReader(red)), http.StatusCreated)
+
+	var got []models.WebhookEvent
+	for _, d := range app.deliveries(all) {
+		got = append(got, d.Event)
+	}
+	want := []models.WebhookEvent{
+		models.WebhookImageUploaded, models.WebhookGalleryCreated,
+		models.WebhookGalleryDeleted, models.WebhookGalleryCreated,
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got events %v, want %v", got, want)
+	}
+
+	deliveries := app.deliveries(uploads)
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries for the uploads webhook, want 1", len(deliveries))
+	}
+	var payload struct {
+		Event string
+		Data  struct {
+			GalleryID int    `json:"gallery_id"`
+			Filename  string `json:"filename"`
+		}
+	}
+	err = json.Unmarshal([]byte(deliveries[0].Payload), &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != "image.uploaded" || payload.Data.GalleryID != g.ID || payload.Data.Filename != "red.png" {
+		t.Errorf("got payload %s", deliveries[0].Payload)
+	}
+
+	// carol's galleries don't concern bob's webhooks
+	carol := app.signUpAs("carol@example.com", models.RoleUser)
+	app.post(carol, "/galleries", url.Values{"title": {"Birds"}})
+	if n := len(app.deliveries(all)); n != 4 {
+		t.Errorf("got %d deliveries, want carol's gallery left out", n)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		status = http.StatusInternalServerError
+		bodies [][]byte
+		sigs   []string
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, b)
+		sigs = append(sigs, r.Header.Get(webhooks.SignatureHeader))
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(receiver.Close)
+
+	app := newTestApp(t)
+	app.signUp(app.client, "bob@example.com", "secret")
+	id := app.createWebhook(app.client, receiver.URL, models.WebhookGalleryCreated)
+	hook, err := app.webhooks.ByID(context.Background(), webhookOwner(t, app), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := &webhooks.Dispatcher{
+		Queue:        app.webhooks,
+		AllowPrivate: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	app.post(app.client, "/galleries", url.Values{"title": {"Cats"}})
+	n, err := dispatcher.DeliverDue(context.Background())
+	if err != nil || n != 1 {
+		t.Fatalf("got %d deliveries, %v, want 1", n, err)
+	}
+	if len(bodies) != 1 {
+		t.Fatalf("the receiver got %d requests, want 1", len(bodies))
+	}
+	err = webhooks.Verify(hook.Secret, sigs[0], bodies[0], 5*time.Minute, time.Now())
+	if err != nil {
+		t.Errorf("the signature doesn't verify: %v", err)
+	}
+
+	// the failure shows in the log, and redelivering sends it again
+	path := fmt.Sprintf("/users/me/webhooks/%d", id)
+	resp := app.get(app.client, path)
+	assertContains(t, resp, "Pending")
+	assertContains(t, resp, "the endpoint answered 500")
+
+	failed := app.deliveries(id)[0]
+	mu.Lock()
+	status = http.StatusNoContent
+	mu.Unlock()
+	assertRedirect(t, app.post(app.client, fmt.Sprintf("%s/deliveries/%d/redeliver", path, failed.ID), nil), path)
+	n, err = dispatcher.DeliverDue(context.Background())
+	if err != nil || n != 1 {
+		t.Fatalf("got %d deliveries, %v, want the redelivery", n, err)
+	}
+	if len(bodies) != 2 || !bytes.Equal(bodies[0], bodies[1]) {
+		t.Errorf("got bodies %q, want the same payload twice", bodies)
+	}
+	assertContains(t, app.get(app.client, path), "Delivered")
+
+	// a delivery can only be redelivered through its own webhook
+	other := app.createWebhook(app.client, receiver.URL, models.WebhookGalleryDeleted)
+	assertStatus(t, app.post(app.client, fmt.Sprintf("/users/me/webhooks/%d/deliveries/%d/redeliver", other, failed.ID), nil),
+		http.StatusNotFound)
+}
+
+// webhookOwner returns the id of bob, who owns the webhooks of the tests.
+func webhookOwner(t *testing.T, app *testApp) int {
+	t.Helper()
+
+	bob, err := app.users.ByEmail(context.Background(), "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bob.ID
+}
@@ -0,0 +1,18 @@
+package errors
+
+import (
+	"context"
+	"errors"
+)
+
+// Canceled reports whether err comes from a canceled context, which for a
+// request means the client went away before the response was ready.
+func Canceled(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
+
+// Timeout reports whether err comes from a context whose deadline expired,
+// like a query that took longer than the configured timeout.
+func Timeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
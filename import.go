@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rafaelmdurante/lenslocked/cli"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// runImport runs `lenslocked import`, with the same configuration as the
+// server so the images end up in its storage directory.
+func runImport(args []string) error {
+	im := cli.Import{
+		Out: os.Stdout,
+		Err: os.Stderr,
+	}
+	cfg, args, err := commandConfig("lenslocked import", cli.ImportUsage, args, im.Flags)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db, err := models.Open(cfg.PSQL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = checkSchema(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	im.Users = &models.UserService{
+		DB:           db,
+		QueryTimeout: cfg.PSQL.QueryTimeout,
+	}
+	im.Galleries = &models.GalleryService{
+		DB:           db,
+		QueryTimeout: cfg.PSQL.QueryTimeout,
+	}
+	im.Images = &models.ImageService{
+		DB:           db,
+		Files:        models.ImageFiles{Dir: cfg.Storage.Dir},
+		QueryTimeout: cfg.PSQL.QueryTimeout,
+	}
+
+	return im.Run(ctx, args)
+}
@@ -0,0 +1,337 @@
+// Package importer adds many images to a gallery at once, from a ZIP archive
+// or from a directory.
+//
+// Archives come from users, so they are treated as hostile:
+//
+//   - entry names are never used as paths, only their base name becomes the
+//     filename of the image, and names that would climb out of the archive
+//     (zip-slip) are refused outright so the user knows
+//   - the number of entries and the size of each, and of them all, are
+//     bounded before anything is extracted. archive/zip fails the entries
+//     that inflate past their declared size, so a zip bomb can't get past
+//     the limits by lying about it
+//   - every file still goes through the image checks of the models package,
+//     anything but a JPEG, PNG, GIF or WebP image is turned down
+//
+// Entries are streamed one at a time, nothing is extracted to disk besides
+// the images themselves. Hidden files and directories, like the __MACOSX
+// ones of the archives made on a Mac, are skipped.
+package importer
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+var (
+	// ErrNotZip is returned for archives archive/zip can't read.
+	ErrNotZip = errors.New("importer: not a ZIP archive")
+	// ErrTooManyFiles and ErrTooLarge are returned for the archives and
+	// directories over the limits, before any image is created.
+	ErrTooManyFiles = errors.New("importer: too many files")
+	ErrTooLarge     = errors.New("importer: files too large altogether")
+	// ErrNoRoom is returned for the imports larger than the Room left, before
+	// any image is created.
+	ErrNoRoom = errors.New("importer: not enough room")
+
+	// The errors of a single file, which doesn't stop the others.
+	ErrFileTooLarge = errors.New("importer: file too large")
+	ErrUnsafePath   = errors.New("importer: unsafe path")
+	ErrNotRegular   = errors.New("importer: not a regular file")
+	ErrDuplicate    = errors.New("importer: duplicate filename")
+)
+
+// Limits bound an import. The zero fields fall back to DefaultLimits.
+type Limits struct {
+	// MaxFiles is how many entries an archive, or files a directory, can have
+	MaxFiles int
+	// MaxFileSize is the largest a single image can be, in bytes
+	MaxFileSize int64
+	// MaxTotalSize is the largest all the images can be together, in bytes
+	MaxTotalSize int64
+}
+
+// DefaultLimits keep an import within what a request can handle.
+var DefaultLimits = Limits{
+	MaxFiles:     1000,
+	MaxFileSize:  32 << 20,
+	MaxTotalSize: 1 << 30,
+}
+
+func (l Limits) orDefault() Limits {
+	if l.MaxFiles <= 0 {
+		l.MaxFiles = DefaultLimits.MaxFiles
+	}
+	if l.MaxFileSize <= 0 {
+		l.MaxFileSize = DefaultLimits.MaxFileSize
+	}
+	if l.MaxTotalSize <= 0 {
+		l.MaxTotalSize = DefaultLimits.MaxTotalSize
+	}
+	return l
+}
+
+type ImageService interface {
+	Create(ctx context.Context, galleryID int, filename string, contents io.Reader) (*models.Image, error)
+}
+
+// File is what became of one file of the import.
+type File struct {
+	// Name is the path of the file in the archive or the directory
+	Name string
+	// Image is the image created from it, unless Err says why not
+	Image *models.Image
+	Err   error
+}
+
+// Report lists the files of an import, in the order they were imported.
+type Report struct {
+	Files []File
+}
+
+// Imported returns how many images were created.
+func (r *Report) Imported() int {
+	n := 0
+	for _, f := range r.Files {
+		if f.Err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Failed returns the files that were not imported.
+func (r *Report) Failed() []File {
+	var failed []File
+	for _, f := range r.Files {
+		if f.Err != nil {
+			failed = append(failed, f)
+		}
+	}
+	return failed
+}
+
+// Importer creates the images of the files. Images replace those with the
+// same filename, like uploading them one by one would.
+type Importer struct {
+	Images ImageService
+	Limits Limits
+	// Progress, when set, is called after each file with how many are done
+	// out of how many
+	Progress func(done, total int, file File)
+	// Room, when set, returns how many bytes the images of filenames can take
+	// up altogether, the images they replace included, or -1 for no limit
+	Room func(ctx context.Context, filenames []string) (int64, error)
+}
+
+// entry is a file to import, checked but not read yet.
+type entry struct {
+	name     string
+	filename string
+	open     func() (io.ReadCloser, error)
+	err      error
+}
+
+// collector checks the files as they are found, and keeps track of the
+// limits.
+type collector struct {
+	limits    Limits
+	entries   []entry
+	filenames map[string]bool
+	total     int64
+}
+
+// hidden reports whether a path has a hidden file or directory in it.
+func hidden(name string) bool {
+	for _, elem := range strings.Split(name, "/") {
+		if strings.HasPrefix(elem, ".") || elem == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
+
+// add checks a file. Only the problems of the whole import are returned,
+// those of the file are kept for the report.
+func (c *collector) add(name string, size int64, regular bool, open func() (io.ReadCloser, error)) error {
+	if len(c.entries) >= c.limits.MaxFiles {
+		return fmt.Errorf("%w: more than %d", ErrTooManyFiles, c.limits.MaxFiles)
+	}
+
+	e := entry{name: name, filename: path.Base(name), open: open}
+	switch {
+	case !regular:
+		e.err = ErrNotRegular
+	case size > c.limits.MaxFileSize:
+		e.err = ErrFileTooLarge
+	case c.filenames[e.filename]:
+		e.err = ErrDuplicate
+	default:
+		c.filenames[e.filename] = true
+		c.total += size
+		if c.total > c.limits.MaxTotalSize {
+			return fmt.Errorf("%w: more than %d bytes", ErrTooLarge, c.limits.MaxTotalSize)
+		}
+	}
+	c.entries = append(c.entries, e)
+
+	return nil
+}
+
+// Zip imports the images of the ZIP archive of r, size bytes long.
+func (im *Importer) Zip(ctx context.Context, galleryID int, r io.ReaderAt, size int64) (*Report, error) {
+	zr, err := zip.NewReader(r, size)
+	// the archives with unsafe names are still read, those entries get
+	// ErrUnsafePath below
+	if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+		return &Report{}, fmt.Errorf("%w: %v", ErrNotZip, err)
+	}
+
+	c := collector{limits: im.Limits.orDefault(), filenames: map[string]bool{}}
+	if len(zr.File) > c.limits.MaxFiles {
+		return &Report{}, fmt.Errorf("%w: more than %d", ErrTooManyFiles, c.limits.MaxFiles)
+	}
+	for _, f := range zr.File {
+		name := strings.TrimSuffix(f.Name, "/")
+		if !fs.ValidPath(name) || strings.Contains(name, `\`) {
+			c.entries = append(c.entries, entry{name: f.Name, err: ErrUnsafePath})
+			continue
+		}
+		if f.FileInfo().IsDir() || hidden(name) {
+			continue
+		}
+
+		size := int64(min(f.UncompressedSize64, 1<<62))
+		err := c.add(name, size, f.Mode().IsRegular(), f.Open)
+		if err != nil {
+			return &Report{}, err
+		}
+	}
+
+	return im.run(ctx, galleryID, &c)
+}
+
+// Dir imports the images of dir and its subdirectories. Symbolic links are
+// not followed.
+func (im *Importer) Dir(ctx context.Context, galleryID int, dir string) (*Report, error) {
+	fsys := os.DirFS(dir)
+	c := collector{limits: im.Limits.orDefault(), filenames: map[string]bool{}}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		if hidden(name) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return c.add(name, info.Size(), d.Type().IsRegular(), func() (io.ReadCloser, error) {
+			return fsys.Open(name)
+		})
+	})
+	if err != nil {
+		return &Report{}, fmt.Errorf("import %s: %w", dir, err)
+	}
+
+	return im.run(ctx, galleryID, &c)
+}
+
+// run creates the images of the files collected. The errors that aren't about
+// one file, like the database being down, stop the import and are returned
+// along with the report so far.
+func (im *Importer) run(ctx context.Context, galleryID int, c *collector) (*Report, error) {
+	if im.Room != nil {
+		filenames := make([]string, 0, len(c.filenames))
+		for _, e := range c.entries {
+			if e.err == nil {
+				filenames = append(filenames, e.filename)
+			}
+		}
+		room, err := im.Room(ctx, filenames)
+		if err != nil {
+			return &Report{}, fmt.Errorf("import: %w", err)
+		}
+		if room >= 0 && c.total > room {
+			return &Report{}, fmt.Errorf("%w: %d bytes for %d left", ErrNoRoom, c.total, room)
+		}
+	}
+
+	entries := c.entries
+	report := &Report{Files: make([]File, 0, len(entries))}
+	for i, e := range entries {
+		file := File{Name: e.name, Err: e.err}
+		if file.Err == nil {
+			file.Image, file.Err = im.create(ctx, galleryID, e, c.limits.MaxFileSize)
+			if file.Err != nil && !fileError(file.Err) {
+				return report, fmt.Errorf("import %s: %w", e.name, file.Err)
+			}
+		}
+
+		report.Files = append(report.Files, file)
+		if im.Progress != nil {
+			im.Progress(i+1, len(entries), file)
+		}
+	}
+
+	return report, nil
+}
+
+func (im *Importer) create(ctx context.Context, galleryID int, e entry, maxSize int64) (*models.Image, error) {
+	rc, err := e.open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return im.Images.Create(ctx, galleryID, e.filename, &limitedReader{r: rc, n: maxSize})
+}
+
+// fileError reports whether err only concerns the file being imported.
+func fileError(err error) bool {
+	return errors.Is(err, models.ErrNotImage) || errors.Is(err, ErrFileTooLarge) ||
+		errors.Is(err, zip.ErrFormat) || errors.Is(err, zip.ErrChecksum) ||
+		errors.Is(err, zip.ErrAlgorithm) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// limitedReader fails with ErrFileTooLarge rather than stopping quietly
+// like io.LimitReader, which would leave a truncated image.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.n < 0 {
+		return 0, ErrFileTooLarge
+	}
+	if int64(len(p)) > lr.n+1 {
+		p = p[:lr.n+1]
+	}
+	n, err := lr.r.Read(p)
+	lr.n -= int64(n)
+	if lr.n < 0 {
+		return n, ErrFileTooLarge
+	}
+	return n, err
+}
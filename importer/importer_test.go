@@ -0,0 +1,272 @@
+package importer_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/importer"
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/models/memory"
+)
+
+func pngImage(t *testing.T) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 2, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// zipArchive returns an archive of the files, in order.
+func zipArchive(t *testing.T, files ...[2]string) *bytes.Reader {
+	t.Helper()
+
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, f := range files {
+		w, err := zw.Create(f[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(f[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(b.Bytes())
+}
+
+func newImporter(t *testing.T) (*importer.Importer, *memory.ImageService, int) {
+	t.Helper()
+
+	store := memory.NewStore()
+	user, err := (&memory.UserService{Store: store}).Create(context.Background(), "bob@example.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gallery, err := (&memory.GalleryService{Store: store}).Create(context.Background(), "Cats", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := &memory.ImageService{Store: store, Files: models.ImageFiles{Dir: t.TempDir()}}
+
+	return &importer.Importer{Images: images}, images, gallery.ID
+}
+
+func TestZip(t *testing.T) {
+	im, images, galleryID := newImporter(t)
+	img := string(pngImage(t))
+	archive := zipArchive(t,
+		[2]string{"holiday/", ""},
+		[2]string{"holiday/cat.png", img},
+		[2]string{"holiday/notes.txt", "not an image"},
+		[2]string{"../../etc/evil.png", img},
+		[2]string{"__MACOSX/holiday/._cat.png", "resource fork"},
+		[2]string{".DS_Store", "junk"},
+		[2]string{"other/cat.png", img},
+		[2]string{"dog.png", img},
+	)
+
+	var progress []int
+	im.Progress = func(done, total int, file importer.File) {
+		progress = append(progress, done, total)
+	}
+	report, err := im.Zip(context.Background(), galleryID, archive, archive.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		name string
+		err  error
+	}{
+		{"holiday/cat.png", nil},
+		{"holiday/notes.txt", models.ErrNotImage},
+		{"../../etc/evil.png", importer.ErrUnsafePath},
+		{"other/cat.png", importer.ErrDuplicate},
+		{"dog.png", nil},
+	}
+	if len(report.Files) != len(want) {
+		t.Fatalf("got %d files, want %d: %+v", len(report.Files), len(want), report.Files)
+	}
+	for i, w := range want {
+		f := report.Files[i]
+		if f.Name != w.name || !errors.Is(f.Err, w.err) || (w.err == nil) != (f.Image != nil) {
+			t.Errorf("file %d: got %s, %v, want %s, %v", i, f.Name, f.Err, w.name, w.err)
+		}
+	}
+	if report.Imported() != 2 || len(report.Failed()) != 3 {
+		t.Errorf("got %d imported and %d failed", report.Imported(), len(report.Failed()))
+	}
+	if len(progress) != 10 || progress[8] != 5 || progress[9] != 5 {
+		t.Errorf("got progress %v", progress)
+	}
+
+	got, err := images.ByGalleryID(context.Background(), galleryID)
+	if err != nil || len(got) != 2 || got[0].Filename != "cat.png" || got[1].Filename != "dog.png" {
+		t.Errorf("got images %+v, %v", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(got[0].Path), "..", "..", "etc")); err == nil {
+		t.Error("the archive escaped the gallery directory")
+	}
+}
+
+func TestZipLimits(t *testing.T) {
+	img := string(pngImage(t))
+	tests := []struct {
+		name   string
+		limits importer.Limits
+		files  [][2]string
+		err    error
+		// fileErr is the error of the first file when the import goes on
+		fileErr error
+	}{
+		{"Too many files", importer.Limits{MaxFiles: 2},
+			[][2]string{{"a.png", img}, {"b.png", img}, {"c.png", img}}, importer.ErrTooManyFiles, nil},
+		{"Too large altogether", importer.Limits{MaxTotalSize: int64(len(img)) + 1},
+			[][2]string{{"a.png", img}, {"b.png", img}}, importer.ErrTooLarge, nil},
+		{"File too large", importer.Limits{MaxFileSize: 10},
+			[][2]string{{"a.png", img}}, nil, importer.ErrFileTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im, images, galleryID := newImporter(t)
+			im.Limits = tt.limits
+			archive := zipArchive(t, tt.files...)
+
+			report, err := im.Zip(context.Background(), galleryID, archive, archive.Size())
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if tt.fileErr != nil && !errors.Is(report.Files[0].Err, tt.fileErr) {
+				t.Errorf("got %v, want %v", report.Files[0].Err, tt.fileErr)
+			}
+			// nothing gets in
+			got, _ := images.ByGalleryID(context.Background(), galleryID)
+			if len(got) != 0 {
+				t.Errorf("got %d images", len(got))
+			}
+		})
+	}
+}
+
+func TestZipRoom(t *testing.T) {
+	img := string(pngImage(t))
+	tests := []struct {
+		name string
+		room int64
+		err  error
+	}{
+		{"No limit", -1, nil},
+		{"Enough room", int64(2 * len(img)), nil},
+		{"Not enough room", int64(2*len(img)) - 1, importer.ErrNoRoom},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im, images, galleryID := newImporter(t)
+			var filenames []string
+			im.Room = func(ctx context.Context, names []string) (int64, error) {
+				filenames = names
+				return tt.room, nil
+			}
+			archive := zipArchive(t, [2]string{"a.png", img}, [2]string{"notes/b.png", img},
+				[2]string{"other/b.png", img})
+
+			_, err := im.Zip(context.Background(), galleryID, archive, archive.Size())
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			// the duplicate isn't imported, it doesn't count
+			if len(filenames) != 2 || filenames[0] != "a.png" || filenames[1] != "b.png" {
+				t.Errorf("got filenames %q", filenames)
+			}
+			got, _ := images.ByGalleryID(context.Background(), galleryID)
+			if want := map[bool]int{true: 2, false: 0}[tt.err == nil]; len(got) != want {
+				t.Errorf("got %d images, want %d", len(got), want)
+			}
+		})
+	}
+}
+
+func TestZipNotAnArchive(t *testing.T) {
+	im, _, galleryID := newImporter(t)
+	r := bytes.NewReader(pngImage(t))
+	_, err := im.Zip(context.Background(), galleryID, r, r.Size())
+	if !errors.Is(err, importer.ErrNotZip) {
+		t.Errorf("got %v, want ErrNotZip", err)
+	}
+}
+
+func TestDir(t *testing.T) {
+	im, images, galleryID := newImporter(t)
+	dir := t.TempDir()
+	img := pngImage(t)
+	for name, contents := range map[string][]byte{
+		"a.png":           img,
+		"sub/b.png":       img,
+		"sub/readme.md":   []byte("# photos"),
+		".git/config":     []byte("[core]"),
+		"sub/.hidden.png": img,
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, contents, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Symlink("/etc/passwd", filepath.Join(dir, "passwd.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := im.Dir(context.Background(), galleryID, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// in lexical order
+	want := []struct {
+		name string
+		err  error
+	}{
+		{"a.png", nil},
+		{"passwd.png", importer.ErrNotRegular},
+		{"sub/b.png", nil},
+		{"sub/readme.md", models.ErrNotImage},
+	}
+	if len(report.Files) != len(want) {
+		t.Fatalf("got %d files, want %d: %+v", len(report.Files), len(want), report.Files)
+	}
+	for i, w := range want {
+		f := report.Files[i]
+		if f.Name != w.name || !errors.Is(f.Err, w.err) {
+			t.Errorf("file %d: got %s, %v, want %s, %v", i, f.Name, f.Err, w.name, w.err)
+		}
+	}
+	got, err := images.ByGalleryID(context.Background(), galleryID)
+	if err != nil || len(got) != 2 {
+		t.Errorf("got images %+v, %v", got, err)
+	}
+
+	_, err = im.Dir(context.Background(), galleryID, filepath.Join(dir, "missing"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want ErrNotExist", err)
+	}
+}
@@ -0,0 +1,86 @@
+// Package logging sets up the structured logger used across the app and the
+// middleware that gives every request its own logger.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rafaelmdurante/lenslocked/context"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// New returns a logger writing to w in the given format, text or json, and
+// discarding anything below level: debug, info, warn or error.
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, fmt.Errorf("logging: %w", err)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case FormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("logging: unknown format %q", format)
+	}
+}
+
+// Middleware stores a logger enriched with the request ID and, when signed
+// in, the user ID in the request context, then logs the outcome of the
+// request. It needs chi's RequestID middleware and the UserMiddleware's SetUser
+// to run before it.
+func Middleware(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := middleware.GetReqID(r.Context())
+			// users are shown the request ID on error pages, it helps support
+			// to find the matching logs
+			w.Header().Set(middleware.RequestIDHeader, id)
+
+			l := logger.With("request_id", id)
+			if user := context.User(r.Context()); user != nil {
+				l = l.With("user_id", user.ID)
+			}
+			r = r.WithContext(context.WithLogger(r.Context(), l))
+
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			next.ServeHTTP(ww, r)
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			level := slog.LevelInfo
+			if status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+
+			// the route is added here, now that the router has matched it
+			context.Logger(r.Context()).Log(r.Context(), level, "request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", status,
+				"bytes", ww.BytesWritten(),
+				"duration", time.Since(start),
+				"remote_addr", r.RemoteAddr,
+			)
+		})
+	}
+}
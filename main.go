@@ -1,66 +1,85 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
-	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
 	"github.com/gorilla/csrf"
-	"github.com/joho/godotenv"
+	"github.com/rafaelmdurante/lenslocked/config"
 	"github.com/rafaelmdurante/lenslocked/controllers"
+	"github.com/rafaelmdurante/lenslocked/importer"
+	"github.com/rafaelmdurante/lenslocked/logging"
+	"github.com/rafaelmdurante/lenslocked/metrics"
 	"github.com/rafaelmdurante/lenslocked/migrations"
 	"github.com/rafaelmdurante/lenslocked/models"
 	"github.com/rafaelmdurante/lenslocked/templates"
+	"github.com/rafaelmdurante/lenslocked/tracing"
 	"github.com/rafaelmdurante/lenslocked/views"
+	"github.com/rafaelmdurante/lenslocked/webhooks"
 )
 
-type config struct {
-	PSQL models.PostgresConfig
-	SMTP models.SMTPConfig
-	CSRF struct {
-		Key    string
-		Secure bool
-	}
-	Server struct {
-		Address string
+func main() {
+	// without a subcommand the binary runs the server, as it always did
+	if len(os.Args) > 1 {
+		commands := map[string]func(args []string) error{
+			"admin":   runAdmin,
+			"import":  runImport,
+			"migrate": runMigrate,
+			"seed":    runSeed,
+		}
+		if command, ok := commands[os.Args[1]]; ok {
+			err := command(os.Args[2:])
+			if err != nil {
+				if !errors.Is(err, flag.ErrHelp) {
+					fmt.Fprintln(os.Stderr, err)
+				}
+				os.Exit(1)
+			}
+			return
+		}
 	}
-}
 
-func loadEnvConfig() (config, error) {
-	var cfg config
-
-	err := godotenv.Load()
+	flags := flag.NewFlagSet("lenslocked", flag.ExitOnError)
+	loadConfig := config.Flags(flags)
+	printConfig := flags.Bool("print-config", false,
+		"print the resolved configuration, with secrets masked, and exit")
+	noMigrate := flags.Bool("no-migrate", false,
+		"don't run the migrations on startup, for deploys running `lenslocked migrate up` as a separate step")
+	// ExitOnError means Parse exits by itself on invalid flags or -h
+	_ = flags.Parse(os.Args[1:])
+
+	cfg, err := loadConfig()
+	if *printConfig {
+		// print even an invalid config, it helps to find out what is wrong
+		config.Print(os.Stdout, cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	if err != nil {
-		return cfg, err
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
-	// TODO: PSQL
-	cfg.PSQL = models.DefaultPostgresConfig()
-
-	// TODO: STMP
-	cfg.SMTP.Host = os.Getenv("SMTP_HOST")
-	cfg.SMTP.Username = os.Getenv("SMTP_USERNAME")
-	cfg.SMTP.Password = os.Getenv("SMTP_PASSWORD")
-	cfg.SMTP.Port, err = strconv.Atoi(os.Getenv("SMTP_PORT"))
+	logger, err := logging.New(os.Stderr, cfg.Log.Format, cfg.Log.Level)
 	if err != nil {
-		return cfg, err
+		panic(err)
 	}
+	// code without a request-scoped logger falls back to the default one
+	slog.SetDefault(logger)
 
-	// TODO: CSRF
-	cfg.CSRF.Key = "A4roiqjosijdfoi145ADSdfoqiwer"
-	cfg.CSRF.Secure = false
-
-	// TODO: Server
-	cfg.Server.Address = ":3000"
-
-	return cfg, nil
-}
-
-func main() {
-	cfg, err := loadEnvConfig()
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
 	if err != nil {
 		panic(err)
 	}
@@ -72,29 +91,70 @@ func main() {
 		panic(err)
 	}
 
-	// ensure connection will be closed when main function finishes
+	// ensure connection will be closed if main returns before serve, which
+	// closes it itself once the requests are drained
 	defer db.Close()
 
-	// run the migrations
-	err = models.MigrateFS(db, migrations.FS, ".")
+	err = metrics.RegisterDB(db, cfg.PSQL.Database)
 	if err != nil {
 		panic(err)
 	}
 
+	// run the migrations. Instances starting at once take turns through an
+	// advisory lock, the first one migrates and the others find nothing to do
+	if !*noMigrate {
+		err = models.MigrateFS(db, migrations.FS, ".")
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	// set up services
 	userService := models.UserService{
-		DB: db,
+		DB:           db,
+		QueryTimeout: cfg.PSQL.QueryTimeout,
 	}
 	sessionService := models.SessionService{
-		DB: db,
+		DB:           db,
+		QueryTimeout: cfg.PSQL.QueryTimeout,
 	}
 	pwResetService := models.PasswordResetService{
-		DB: db,
+		DB:           db,
+		QueryTimeout: cfg.PSQL.QueryTimeout,
 	}
 	emailService := models.NewEmailService(cfg.SMTP)
 	galleryService := models.GalleryService{
-		DB: db,
+		DB:           db,
+		QueryTimeout: cfg.PSQL.QueryTimeout,
+	}
+	imageService := models.ImageService{
+		DB:           db,
+		Files:        models.ImageFiles{Dir: cfg.Storage.Dir},
+		QueryTimeout: cfg.PSQL.QueryTimeout,
+	}
+	impersonationService := models.ImpersonationService{
+		DB:           db,
+		QueryTimeout: cfg.PSQL.QueryTimeout,
+	}
+	auditService := models.AuditService{
+		DB:           db,
+		QueryTimeout: cfg.PSQL.QueryTimeout,
+	}
+	apiTokenService := models.APITokenService{
+		DB:           db,
+		QueryTimeout: cfg.PSQL.QueryTimeout,
 	}
+	webhookService := models.WebhookService{
+		DB:           db,
+		QueryTimeout: cfg.PSQL.QueryTimeout,
+	}
+	uploadService := models.UploadService{
+		DB:           db,
+		Files:        models.UploadFiles{Dir: filepath.Join(cfg.Storage.Dir, "uploads")},
+		QueryTimeout: cfg.PSQL.QueryTimeout,
+	}
+	archiveFiles := models.ArchiveFiles{Dir: filepath.Join(cfg.Storage.Dir, "archives")}
+	transactor := models.Transactor{DB: db}
 
 	// set up middleware
 	// middleware to set the user from token
@@ -102,20 +162,26 @@ func main() {
 		SessionService: &sessionService,
 	}
 
-	// random 32-byte key
+	// the 32-byte key is enforced by config validation
 	csrfMiddleware := csrf.Protect(
 		[]byte(cfg.CSRF.Key),
-		// 'false' because it is not https yet, fix before deploy to prod
-		csrf.Secure(cfg.CSRF.Secure), // secure is false
+		// config validation requires it to be true in production
+		csrf.Secure(cfg.CSRF.Secure),
 		csrf.Path("/")) // force csrf token to always use path `/` so works for all paths
 
-
 	// set up controllers
 	users := controllers.Users{
 		UserService:          &userService,
 		SessionService:       &sessionService,
 		PasswordResetService: &pwResetService,
 		EmailService:         emailService,
+		GalleryService:       &galleryService,
+		ImageService:         &imageService,
+		ImpersonationService: &impersonationService,
+		AuditService:         &auditService,
+		Transactor:           &transactor,
+		BaseURL:              cfg.App.BaseURL,
+		SecureCookies:        cfg.CSRF.Secure || cfg.TLS.Enabled(),
 	}
 	users.Templates.New = views.Must(views.ParseFS(templates.FS,
 		"signup.gohtml", "tailwind.gohtml"))
@@ -127,82 +193,211 @@ func main() {
 		"check-your-email.gohtml", "tailwind.gohtml"))
 	users.Templates.ResetPassword = views.Must(views.ParseFS(templates.FS,
 		"reset-pw.gohtml", "tailwind.gohtml"))
+	users.Templates.DeleteAccount = views.Must(views.ParseFS(templates.FS,
+		"delete-account.gohtml", "tailwind.gohtml"))
+	users.Templates.Activity = views.Must(views.ParseFS(templates.FS,
+		"activity.gohtml", "tailwind.gohtml"))
+
+	// personal API tokens, at /users/me/tokens
+	tokens := controllers.Tokens{
+		APITokenService: &apiTokenService,
+		AuditService:    &auditService,
+	}
+	tokens.Templates.Index = views.Must(views.ParseFS(templates.FS,
+		"tokens.gohtml", "tailwind.gohtml"))
+
+	// webhooks, at /users/me/webhooks
+	hooks := controllers.Webhooks{
+		WebhookService: &webhookService,
+		AuditService:   &auditService,
+	}
+	hooks.Templates.Index = views.Must(views.ParseFS(templates.FS,
+		"webhooks.gohtml", "tailwind.gohtml"))
+	hooks.Templates.Show = views.Must(views.ParseFS(templates.FS,
+		"webhook.gohtml", "tailwind.gohtml"))
 
 	// galleries controllers
 	galleries := controllers.Galleries{
 		GalleryService: &galleryService,
+		ImageService:   &imageService,
+		AuditService:   &auditService,
+		WebhookService: &webhookService,
+		ArchiveService: archiveFiles,
+		UploadService:  &uploadService,
+		Transactor:     &transactor,
+		BaseURL:        cfg.App.BaseURL,
+		Quota:          cfg.Uploads.Quota,
 	}
 	galleries.Templates.New = views.Must(views.ParseFS(templates.FS,
-		"galleries/new.gohtml", "tailwind.gohtml"))
+		"galleries/new.gohtml", "galleries/description.gohtml", "tailwind.gohtml"))
 	galleries.Templates.Edit = views.Must(views.ParseFS(templates.FS,
-		"galleries/edit.gohtml", "tailwind.gohtml"))
+		"galleries/edit.gohtml", "galleries/description.gohtml", "tailwind.gohtml"))
 	galleries.Templates.Index = views.Must(views.ParseFS(templates.FS,
 		"galleries/index.gohtml", "tailwind.gohtml"))
 	galleries.Templates.Show = views.Must(views.ParseFS(templates.FS,
 		"galleries/show.gohtml", "tailwind.gohtml"))
 
-	// set up router and routes
-	r := chi.NewRouter()
-
-	r.Use(csrfMiddleware)
-	r.Use(middleware.Logger)
-	r.Use(umw.SetUser)
-
-	// config routes
-	r.Get("/", controllers.StaticHandler(views.Must(views.ParseFS(
-		templates.FS,
-		"home.gohtml", "tailwind.gohtml"))))
-
-	r.Get("/contact", controllers.StaticHandler(views.Must(views.ParseFS(
-		templates.FS,
-		"contact.gohtml", "tailwind.gohtml"))))
-
-	r.Get("/faq", controllers.FAQ(views.Must(views.ParseFS(
-		templates.FS,
-		"faq.gohtml", "tailwind.gohtml"))))
-
-	r.Get("/signup", users.New)
-	r.Post("/signup", users.Create)
-	r.Get("/signin", users.SignIn)
-	r.Post("/signin", users.ProcessSignIn)
-	// using POST instead of DELETE because it is quite annoying to create links
-	// and forms that performe the verb without the use of JavaScript
-	r.Post("/signout", users.ProcessSignOut)
-
-	// this creates sort of a namespace for the routes
-	r.Route("/users/me", func(r chi.Router) {
-		r.Use(umw.RequireUser)
-		r.Get("/", users.CurrentUser)
-	})
+	// admin area controllers
+	admin := controllers.Admin{
+		UserService:          &userService,
+		SessionService:       &sessionService,
+		GalleryService:       &galleryService,
+		ImageService:         &imageService,
+		ImpersonationService: &impersonationService,
+		AuditService:         &auditService,
+		WebhookService:       &webhookService,
+		Transactor:           &transactor,
+	}
+	admin.Templates.Users = views.Must(views.ParseFS(templates.FS,
+		"admin/users.gohtml", "admin/nav.gohtml", "tailwind.gohtml"))
+	admin.Templates.Galleries = views.Must(views.ParseFS(templates.FS,
+		"admin/galleries.gohtml", "admin/nav.gohtml", "tailwind.gohtml"))
+	admin.Templates.Impersonations = views.Must(views.ParseFS(templates.FS,
+		"admin/impersonations.gohtml", "admin/nav.gohtml", "tailwind.gohtml"))
+	admin.Templates.Audit = views.Must(views.ParseFS(templates.FS,
+		"admin/audit.gohtml", "admin/nav.gohtml", "tailwind.gohtml"))
+
+	// JSON API controllers
+	api := controllers.API{
+		APITokenService: &apiTokenService,
+		GalleryService:  &galleryService,
+		ImageService:    &imageService,
+		AuditService:    &auditService,
+		WebhookService:  &webhookService,
+		UploadService:   &uploadService,
+		Uploads:         controllers.UploadLimits(cfg.Uploads),
+		Transactor:      &transactor,
+	}
 
-	r.Get("/forgot-pw", users.ForgotPassword)
-	r.Post("/forgot-pw", users.ProcessForgotPassword)
-
-	r.Get("/reset-pw", users.ResetPassword)
-	r.Post("/reset-pw", users.ProcessResetPassword)
-
-	// galleries
-	r.Route("/galleries", func(r chi.Router) {
-		// routes that do not require login
-		r.Get("/{id}", galleries.Show)
-		// all subroutes in this group require login
-		r.Group(func(r chi.Router) {
-			r.Use(umw.RequireUser)
-			r.Get("/", galleries.Index)
-			r.Post("/", galleries.Create)
-			r.Get("/new", galleries.New)
-			r.Get("/{id}/edit", galleries.Edit)
-			r.Post("/{id}", galleries.Update)
+	health := &controllers.Health{
+		Checks: []controllers.HealthCheck{
+			{Name: "database", Check: db.PingContext},
+			{Name: "migrations", Check: func(ctx context.Context) error {
+				current, latest, err := models.MigrationVersions(ctx, db, migrations.FS)
+				if err != nil {
+					return err
+				}
+				if current != latest {
+					return fmt.Errorf("database is at version %d, latest is %d",
+						current, latest)
+				}
+				return nil
+			}},
+			{Name: "storage", Check: checkStorage(cfg.Storage.Dir)},
+		},
+	}
+	// without a host the email service is not configured, so it is not a
+	// dependency worth failing readiness for
+	if cfg.SMTP.Host != "" {
+		health.Checks = append(health.Checks, controllers.HealthCheck{
+			Name: "smtp", Check: emailService.Ping,
 		})
-	})
+	}
 
-	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w, "Page not found", http.StatusNotFound)
+	site := controllers.Site{
+		Users:          users,
+		Tokens:         tokens,
+		Webhooks:       hooks,
+		Galleries:      galleries,
+		Admin:          admin,
+		API:            api,
+		Health:         health,
+		UserMiddleware: umw,
+		Home: views.Must(views.ParseFS(templates.FS,
+			"home.gohtml", "tailwind.gohtml")),
+		Contact: views.Must(views.ParseFS(templates.FS,
+			"contact.gohtml", "tailwind.gohtml")),
+		FAQ: views.Must(views.ParseFS(templates.FS,
+			"faq.gohtml", "tailwind.gohtml")),
+		Logger:      logger,
+		CSRF:        csrfMiddleware,
+		ImportLimit: importer.DefaultLimits.MaxTotalSize,
+		ValidateAPI: cfg.API.Validate,
+	}
+	// a dedicated metrics listener takes precedence, it is not exposed with
+	// the rest of the app
+	if cfg.Metrics.Address == "" && cfg.Metrics.Token != "" {
+		site.Metrics = metrics.Handler(cfg.Metrics.Token)
+	}
+	root := controllers.Routes(site)
+
+	// SIGTERM is what modd and most process managers send to stop the server
+	ctx, stop := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ws := newWorkers()
+	dispatcher := &webhooks.Dispatcher{
+		Queue:        &webhookService,
+		AllowPrivate: cfg.Webhooks.AllowPrivate,
+		Logger:       logger,
+	}
+	ws.Go(dispatcher.Run)
+	ws.Every(time.Hour, logger, "deleting expired uploads", func(ctx context.Context) error {
+		n, err := uploadService.DeleteExpired(ctx)
+		if n > 0 {
+			logger.Info("deleted expired uploads", "count", n)
+		}
+		return err
+	})
+	// the archives are only there for resumed downloads, a day is plenty
+	ws.Every(time.Hour, logger, "pruning gallery archives", func(ctx context.Context) error {
+		n, err := archiveFiles.Prune(time.Now().Add(-24 * time.Hour))
+		if n > 0 {
+			logger.Info("pruned gallery archives", "count", n)
+		}
+		return err
 	})
+	listeners, err := newListeners(cfg, root)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if cfg.Metrics.Address != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler(cfg.Metrics.Token))
+		srv := &http.Server{
+			Addr:              cfg.Metrics.Address,
+			Handler:           mux,
+			ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		}
+		listeners = append(listeners, listener{srv: srv, start: srv.ListenAndServe})
+	}
+
+	logger.Info("starting server", "address", cfg.Server.Address,
+		"tls", cfg.TLS.Mode, "env", cfg.App.Env)
+	err = serve(ctx, stop, cfg, listeners, ws, db, health.ShutDown)
+
+	// flush the spans of the last requests, the exporter may be unreachable
+	// so it gets a deadline of its own
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = errors.Join(err, shutdownTracing(flushCtx))
 
-	fmt.Printf("starting server on %s...\n", cfg.Server.Address)
-	err = http.ListenAndServe(cfg.Server.Address, r)
 	if err != nil {
-		panic(err)
+		logger.Error("server stopped", "err", err)
+		os.Exit(1)
+	}
+}
+
+// checkStorage verifies that images can be written to dir, creating it if
+// needed.
+func checkStorage(dir string) func(ctx context.Context) error {
+	return func(ctx context.Context) (err error) {
+		_, span := tracing.Start(ctx, "storage.check")
+		defer func() { tracing.End(span, err) }()
+
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("storage: %w", err)
+		}
+
+		f, err := os.CreateTemp(dir, ".readyz-*")
+		if err != nil {
+			return fmt.Errorf("storage: %w", err)
+		}
+		f.Close()
+
+		return os.Remove(f.Name())
 	}
 }
@@ -0,0 +1,378 @@
+// Package markdown renders the Markdown written by users, like the
+// descriptions of the galleries, to HTML that is safe to put in a page.
+//
+// Only a subset of Markdown is supported:
+//
+//   - paragraphs, with a hard line break where a line ends with two spaces
+//     or a backslash
+//   - ATX headings, one level below the heading of the page: # is a <h2>
+//   - bullet and numbered lists, one level deep
+//   - block quotes, fenced code blocks and thematic breaks
+//   - emphasis, strong emphasis, code spans, links, autolinks and bare
+//     http(s) URLs
+//
+// HTML in the source isn't markup, it is shown as text. Whatever the
+// renderer produces still goes through Sanitize before it is returned, so a
+// bug in the renderer can't become a cross-site scripting hole: only the
+// elements above survive, and links only to http, https and mailto URLs or
+// to pages of the site.
+package markdown
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+// Render renders the Markdown source to sanitized HTML.
+func Render(src string) template.HTML {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	src = strings.ReplaceAll(src, "\r", "\n")
+
+	var b strings.Builder
+	renderBlocks(&b, strings.Split(src, "\n"), 0)
+	return template.HTML(Sanitize(b.String()))
+}
+
+var (
+	headingRe = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	quoteRe   = regexp.MustCompile(`^ {0,3}> ?(.*)$`)
+	fenceRe   = regexp.MustCompile("^ {0,3}(```+|~~~+)")
+	bulletRe  = regexp.MustCompile(`^ {0,3}[-*+][ \t]+(.*)$`)
+	numberRe  = regexp.MustCompile(`^ {0,3}(\d{1,9})[.)][ \t]+(.*)$`)
+)
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// isRule reports whether the line is a thematic break: three or more of the
+// same -, * or _, maybe spaced out.
+func isRule(line string) bool {
+	line = strings.TrimLeft(line, " ")
+	if line == "" || !strings.ContainsRune("-*_", rune(line[0])) {
+		return false
+	}
+	n := 0
+	for _, c := range line {
+		switch c {
+		case rune(line[0]):
+			n++
+		case ' ', '\t':
+		default:
+			return false
+		}
+	}
+	return n >= 3
+}
+
+// listItem returns the text of the list item starting on the line, and
+// whether it is numbered. start is the number of a numbered one.
+func listItem(line string) (text string, numbered bool, start string, ok bool) {
+	if m := bulletRe.FindStringSubmatch(line); m != nil {
+		return m[1], false, "", true
+	}
+	if m := numberRe.FindStringSubmatch(line); m != nil {
+		return m[2], true, strings.TrimLeft(m[1], "0"), true
+	}
+	return "", false, "", false
+}
+
+// startsBlock reports whether the line starts a block other than a
+// paragraph, ending the paragraph before it. Like in CommonMark, only a list
+// numbered from 1 can do so, or a line of a paragraph starting with a year
+// would start a list.
+func startsBlock(line string) bool {
+	if _, numbered, start, ok := listItem(line); ok {
+		return !numbered || start == "1"
+	}
+	return fenceRe.MatchString(line) || isRule(line) || headingRe.MatchString(line) ||
+		quoteRe.MatchString(line)
+}
+
+// maxQuoteDepth is how deep block quotes nest, deeper > are text. Each
+// level goes over the lines again.
+const maxQuoteDepth = 8
+
+// renderBlocks renders the lines, depth block quotes deep.
+func renderBlocks(b *strings.Builder, lines []string, depth int) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+
+		case fenceRe.MatchString(line):
+			fence := fenceRe.FindStringSubmatch(line)[1]
+			i++
+			var code []string
+			for i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence) {
+				code = append(code, lines[i])
+				i++
+			}
+			i++ // the closing fence, when there is one
+			b.WriteString("<pre><code>")
+			for _, line := range code {
+				b.WriteString(html.EscapeString(line) + "\n")
+			}
+			b.WriteString("</code></pre>\n")
+
+		case isRule(line):
+			b.WriteString("<hr>\n")
+			i++
+
+		case headingRe.MatchString(line):
+			m := headingRe.FindStringSubmatch(line)
+			level := min(len(m[1])+1, 6)
+			fmt.Fprintf(b, "<h%d>", level)
+			renderInline(b, m[2], false)
+			fmt.Fprintf(b, "</h%d>\n", level)
+			i++
+
+		case depth < maxQuoteDepth && quoteRe.MatchString(line):
+			var quote []string
+			for ; i < len(lines) && !isBlank(lines[i]); i++ {
+				m := quoteRe.FindStringSubmatch(lines[i])
+				if m == nil {
+					// a lazy continuation of the quoted paragraph
+					quote = append(quote, lines[i])
+					continue
+				}
+				quote = append(quote, m[1])
+			}
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, quote, depth+1)
+			b.WriteString("</blockquote>\n")
+
+		default:
+			if _, _, _, ok := listItem(line); ok {
+				i = renderList(b, lines, i)
+				continue
+			}
+			para := []string{line}
+			for i++; i < len(lines) && !isBlank(lines[i]) && !startsBlock(lines[i]); i++ {
+				para = append(para, lines[i])
+			}
+			b.WriteString("<p>")
+			renderLines(b, para)
+			b.WriteString("</p>\n")
+		}
+	}
+}
+
+// renderList renders the list starting at lines[i], and returns the index of
+// the line after it.
+func renderList(b *strings.Builder, lines []string, i int) int {
+	_, numbered, start, _ := listItem(lines[i])
+	tag := "ul"
+	if numbered {
+		tag = "ol"
+	}
+	if numbered && start != "1" && start != "" {
+		fmt.Fprintf(b, "<ol start=\"%s\">\n", start)
+	} else {
+		fmt.Fprintf(b, "<%s>\n", tag)
+	}
+
+	for i < len(lines) {
+		text, n, _, ok := listItem(lines[i])
+		if !ok || n != numbered {
+			break
+		}
+		item := []string{text}
+		for i++; i < len(lines) && !isBlank(lines[i]) && !startsBlock(lines[i]); i++ {
+			if _, _, _, ok := listItem(lines[i]); ok {
+				break
+			}
+			item = append(item, lines[i])
+		}
+		b.WriteString("<li>")
+		renderLines(b, item)
+		b.WriteString("</li>\n")
+
+		// a blank line between two items doesn't end the list
+		if i+1 < len(lines) && isBlank(lines[i]) {
+			if _, n, _, ok := listItem(lines[i+1]); ok && n == numbered {
+				i++
+			}
+		}
+	}
+
+	fmt.Fprintf(b, "</%s>\n", tag)
+	return i
+}
+
+// renderLines renders the lines of a paragraph or of a list item.
+func renderLines(b *strings.Builder, lines []string) {
+	for i, line := range lines {
+		line = strings.TrimLeft(line, " \t")
+		if i == len(lines)-1 {
+			renderInline(b, strings.TrimRight(line, " \t"), false)
+			break
+		}
+		hard := strings.HasSuffix(line, "  ") || strings.HasSuffix(line, `\`)
+		renderInline(b, strings.TrimRight(strings.TrimSuffix(line, `\`), " \t"), false)
+		if hard {
+			b.WriteString("<br>")
+		}
+		b.WriteString("\n")
+	}
+}
+
+// renderInline renders the emphasis, code spans and links of s. Links can't
+// be nested, inLink is set while rendering the text of one.
+func renderInline(b *strings.Builder, s string, inLink bool) {
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(punctuation, s[i+1]) >= 0:
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '`':
+			n := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+			fence := s[i : i+n]
+			if end := strings.Index(s[i+n:], fence); end >= 0 {
+				code := s[i+n : i+n+end]
+				if len(code) > 1 && code[0] == ' ' && code[len(code)-1] == ' ' {
+					code = code[1 : len(code)-1]
+				}
+				b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += 2*n + end
+				continue
+			}
+			b.WriteString(fence)
+			i += n
+			continue
+
+		case c == '[' && !inLink:
+			if text, dest, n, ok := parseLink(s[i:]); ok {
+				if href, ok := safeURL(dest); ok {
+					b.WriteString(`<a href="` + html.EscapeString(href) + `">`)
+					renderInline(b, text, true)
+					b.WriteString("</a>")
+					i += n
+					continue
+				}
+			}
+
+		case c == '<' && !inLink:
+			if end := strings.IndexByte(s[i:], '>'); end > 0 {
+				dest := s[i+1 : i+end]
+				if href, ok := safeURL(dest); ok && isAbsolute(dest) {
+					b.WriteString(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(dest) + "</a>")
+					i += end + 1
+					continue
+				}
+			}
+
+		case c == 'h' && !inLink && (i == 0 || !isAlnum(s[i-1])) &&
+			(strings.HasPrefix(s[i:], "http://") || strings.HasPrefix(s[i:], "https://")):
+			end := strings.IndexAny(s[i:], " \t<")
+			if end < 0 {
+				end = len(s) - i
+			}
+			// the punctuation ending a sentence isn't part of the URL
+			dest := strings.TrimRight(s[i:i+end], ".,:;!?'\")")
+			if href, ok := safeURL(dest); ok && len(dest) > len("https://") {
+				b.WriteString(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(dest) + "</a>")
+				i += len(dest)
+				continue
+			}
+
+		case c == '*' || c == '_':
+			n := 1
+			if i+1 < len(s) && s[i+1] == c {
+				n = 2
+			}
+			if end, ok := closeEmphasis(s, i, n); ok {
+				tag := "em"
+				if n == 2 {
+					tag = "strong"
+				}
+				b.WriteString("<" + tag + ">")
+				renderInline(b, s[i+n:end], inLink)
+				b.WriteString("</" + tag + ">")
+				i = end + n
+				continue
+			}
+			b.WriteString(s[i : i+n])
+			i += n
+			continue
+		}
+
+		b.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+}
+
+const punctuation = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+func isAlnum(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// closeEmphasis finds the delimiter closing the run of n * or _ at s[i], and
+// returns its index. The text in between can't start or end with a space, and
+// _ doesn't work within words, for the snake_case names.
+func closeEmphasis(s string, i, n int) (int, bool) {
+	c := s[i]
+	open := i + n
+	if open >= len(s) || s[open] == ' ' || c == '_' && i > 0 && isAlnum(s[i-1]) {
+		return 0, false
+	}
+	for j := open + 1; j+n <= len(s); j++ {
+		if s[j] != c || s[j-1] == ' ' || s[j-1] == '\\' {
+			continue
+		}
+		// a single delimiter doesn't close on half of a double one
+		if n == 1 && (j+1 < len(s) && s[j+1] == c || s[j-1] == c) {
+			j++
+			continue
+		}
+		if n == 2 && s[j+1] != c {
+			continue
+		}
+		if c == '_' && j+n < len(s) && isAlnum(s[j+n]) {
+			continue
+		}
+		return j, true
+	}
+	return 0, false
+}
+
+// parseLink parses the [text](destination) link at the start of s, and
+// returns how long it is. A title after the destination is left out.
+func parseLink(s string) (text, dest string, n int, ok bool) {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth > 0 {
+				continue
+			}
+			if !strings.HasPrefix(s[i+1:], "(") {
+				return "", "", 0, false
+			}
+			end := strings.IndexByte(s[i+2:], ')')
+			if end < 0 {
+				return "", "", 0, false
+			}
+			fields := strings.Fields(s[i+2 : i+2+end])
+			if len(fields) == 0 {
+				return "", "", 0, false
+			}
+			dest = strings.TrimSuffix(strings.TrimPrefix(fields[0], "<"), ">")
+			return s[1:i], dest, i + 3 + end, true
+		}
+	}
+	return "", "", 0, false
+}
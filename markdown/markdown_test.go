@@ -0,0 +1,95 @@
+package markdown_test
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/markdown"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"Paragraphs", "Client: *Ana*\nShot on **film**\r\n\r\nSecond", "<p>Client: <em>Ana</em>\nShot on <strong>film</strong></p>\n<p>Second</p>\n"},
+		{"Hard break", "Line one  \nLine two\\\nthree", "<p>Line one<br>\nLine two<br>\nthree</p>\n"},
+		{"Headings", "# Day one\n### Notes ###\n#hashtag", "<h2>Day one</h2>\n<h4>Notes</h4>\n<p>#hashtag</p>\n"},
+		{"Lists", "- one\n- two\n  more\n\n- three\n\n1. first\n2. second\n\nThen\n\n3) third", "<ul>\n<li>one</li>\n<li>two\nmore</li>\n<li>three</li>\n</ul>\n<ol>\n<li>first</li>\n<li>second</li>\n</ol>\n<p>Then</p>\n<ol start=\"3\">\n<li>third</li>\n</ol>\n"},
+		{"Year in a paragraph", "Shot in\n2024. A good year", "<p>Shot in\n2024. A good year</p>\n"},
+		{"Quote", "> Lovely\nlight\n\nafter", "<blockquote>\n<p>Lovely\nlight</p>\n</blockquote>\n<p>after</p>\n"},
+		{"Code", "Use `<b>` tags\n\n```\n<script>x</script>\n```", "<p>Use <code>&lt;b&gt;</code> tags</p>\n<pre><code>&lt;script&gt;x&lt;/script&gt;\n</code></pre>\n"},
+		{"Rule", "a\n\n* * *\n\nb", "<p>a</p>\n<hr>\n<p>b</p>\n"},
+		{"Snake case", "my_file_name and _this_", "<p>my_file_name and <em>this</em></p>\n"},
+		{"Escapes", `\*not em\* 2 * 3`, "<p>*not em* 2 * 3</p>\n"},
+		{"Link", "[Ana's *site*](https://ana.example/a?b=1&c=2)", `<p><a href="https://ana.example/a?b=1&amp;c=2" rel="nofollow noopener noreferrer">Ana&#39;s <em>site</em></a></p>` + "\n"},
+		{"Relative link", "[more](/galleries/2)", `<p><a href="/galleries/2" rel="nofollow noopener noreferrer">more</a></p>` + "\n"},
+		{"Protocol-relative link", "[more](//evil.example)", "<p>[more](//evil.example)</p>\n"},
+		{"Autolinks", "<mailto:ana@example.com> or https://ana.example.", `<p><a href="mailto:ana@example.com" rel="nofollow noopener noreferrer">mailto:ana@example.com</a> or <a href="https://ana.example" rel="nofollow noopener noreferrer">https://ana.example</a>.</p>` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(markdown.Render(tt.src))
+			if got != tt.want {
+				t.Errorf("got\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+var unsafeTagRe = regexp.MustCompile(`<(script|img|iframe)|<[^>]*(\son\w+=|href="(javascript|data):)`)
+
+func TestRenderXSS(t *testing.T) {
+	tests := []string{
+		`<script>alert(1)</script>`,
+		`<img src=x onerror=alert(1)>`,
+		`[click](javascript:alert(1))`,
+		`[click](JaVaScRiPt:alert(1))`,
+		`[click]( javascript:alert(1))`,
+		`[click](data:text/html;base64,PHNjcmlwdD4=)`,
+		`<javascript:alert(1)>`,
+		`[x](https://a.example" onmouseover="alert(1))`,
+		"```\n</code></pre><script>alert(1)</script>\n```",
+		"`<iframe src=//evil.example>`",
+	}
+	for _, src := range tests {
+		// shown as text, the source is harmless
+		got := strings.ToLower(string(markdown.Render(src)))
+		if tag := unsafeTagRe.FindString(got); tag != "" {
+			t.Errorf("%s: got %q, with %s", src, got, tag)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{"Allowed", `<p class="x">Hi <strong>there</strong><br/></p>`, "<p>Hi <strong>there</strong><br></p>"},
+		{"Text of others", `<div><span style="color:red">red</span></div>`, "red"},
+		{"Dropped", `a<script>alert("<p>")</script><style>p{}</style><svg><p>b</p></svg>c`, "ac"},
+		{"Event handlers", `<a href="/x" onclick="alert(1)">x</a>`, `<a href="/x" rel="nofollow noopener noreferrer">x</a>`},
+		{"Unsafe URLs", `<a href="java&#x09;script:alert(1)">x</a><a href=" vbscript:x">y</a>`,
+			`<a rel="nofollow noopener noreferrer">x</a><a rel="nofollow noopener noreferrer">y</a>`},
+		{"Start", `<ol start="3" reversed><li>x</li></ol><ol start="-1"></ol>`, `<ol start="3"><li>x</li></ol><ol></ol>`},
+		{"Unclosed", `<blockquote><p><em>x`, "<blockquote><p><em>x</em></p></blockquote>"},
+		{"Stray end tags", `</p></blockquote>x<p>y</em></p>`, "x<p>y</p>"},
+		{"Nested links", `<a href="/a">a<a href="/b">b</a></a>`, `<a href="/a" rel="nofollow noopener noreferrer">ab</a>`},
+		{"Off-site without a scheme", `<a href="//evil.example/x">x</a><a href="/\evil.example">y</a>`,
+			`<a rel="nofollow noopener noreferrer">x</a><a rel="nofollow noopener noreferrer">y</a>`},
+		{"Comments", `a<!-- <script> -->b`, "ab"},
+		{"Text", `1 &lt; 2 &amp; "3"`, "1 &lt; 2 &amp; &#34;3&#34;"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := markdown.Sanitize(tt.html)
+			if got != tt.want {
+				t.Errorf("got\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package markdown
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// The elements Sanitize keeps, those the renderer writes. Their attributes
+// are dropped, but for the href of links and the start of numbered lists.
+var allowedTags = map[string]bool{
+	"a": true, "blockquote": true, "br": true, "code": true, "em": true,
+	"h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "hr": true,
+	"li": true, "ol": true, "p": true, "pre": true, "strong": true, "ul": true,
+}
+
+// The elements Sanitize drops along with everything in them: their contents
+// aren't text meant to be read.
+var droppedTags = map[string]bool{
+	"script": true, "style": true, "template": true, "iframe": true, "object": true,
+	"embed": true, "noscript": true, "noembed": true, "noframes": true, "textarea": true,
+	"title": true, "xmp": true, "plaintext": true, "svg": true, "math": true, "select": true,
+}
+
+// Sanitize keeps only the elements of the Markdown subset in the HTML s, and
+// the text of the others. Links only keep an http, https or mailto URL, or a
+// URL on the site, and don't pass on the referrer or any ranking. Every
+// element is closed, so that s can't change the page around it.
+func Sanitize(s string) string {
+	var b strings.Builder
+	var open []string
+	// how deep the tokenizer is in the dropped elements
+	dropped := 0
+
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		tok := z.Token()
+		void := tok.Data == "br" || tok.Data == "hr"
+
+		switch tt {
+		case html.TextToken:
+			if dropped == 0 {
+				b.WriteString(html.EscapeString(tok.Data))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if droppedTags[tok.Data] {
+				if tt == html.StartTagToken {
+					dropped++
+				}
+				continue
+			}
+			if dropped > 0 || !allowedTags[tok.Data] {
+				continue
+			}
+			// a link in a link is not valid HTML, browsers close the first
+			if tok.Data == "a" && slices.Contains(open, "a") {
+				continue
+			}
+			b.WriteString(startTag(tok))
+			if !void {
+				open = append(open, tok.Data)
+			}
+		case html.EndTagToken:
+			if droppedTags[tok.Data] {
+				dropped = max(dropped-1, 0)
+				continue
+			}
+			if dropped > 0 {
+				continue
+			}
+			// closing an element closes those left open in it
+			if i := slices.Index(open, tok.Data); i >= 0 && !slices.Contains(open[i+1:], tok.Data) {
+				for len(open) > i {
+					b.WriteString("</" + open[len(open)-1] + ">")
+					open = open[:len(open)-1]
+				}
+			}
+		}
+	}
+
+	for len(open) > 0 {
+		b.WriteString("</" + open[len(open)-1] + ">")
+		open = open[:len(open)-1]
+	}
+	return b.String()
+}
+
+func startTag(tok html.Token) string {
+	var b strings.Builder
+	b.WriteString("<" + tok.Data)
+	for _, attr := range tok.Attr {
+		switch {
+		case tok.Data == "a" && attr.Key == "href":
+			if href, ok := safeURL(attr.Val); ok {
+				b.WriteString(` href="` + html.EscapeString(href) + `"`)
+			}
+		case tok.Data == "ol" && attr.Key == "start" && len(attr.Val) <= 9 &&
+			attr.Val != "" && strings.Trim(attr.Val, "0123456789") == "":
+			b.WriteString(` start="` + attr.Val + `"`)
+		}
+	}
+	if tok.Data == "a" {
+		b.WriteString(` rel="nofollow noopener noreferrer"`)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// safeURL returns the URL a link can point to, and whether it can point to
+// raw at all: only http, https and mailto URLs, and URLs on the site, can.
+// A protocol-relative //host URL leaves the site, it needs a scheme.
+func safeURL(raw string) (string, bool) {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil || raw == "" {
+		return "", false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+		return u.String(), true
+	case "":
+		// browsers read a backslash as a slash, /\host is //host too
+		if u.Host != "" || strings.HasPrefix(strings.ReplaceAll(raw, `\`, "/"), "//") {
+			return "", false
+		}
+		return u.String(), true
+	}
+	return "", false
+}
+
+// isAbsolute reports whether raw is a URL with a scheme, which autolinks
+// need: <b> is an HTML tag shown as text, not a link to the page b.
+func isAbsolute(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme != "" && !strings.ContainsAny(raw, " \t")
+}
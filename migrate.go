@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rafaelmdurante/lenslocked/cli"
+	"github.com/rafaelmdurante/lenslocked/migrations"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// runMigrate runs `lenslocked migrate` with the migrations embedded in the
+// binary, against the database from the config.
+func runMigrate(args []string) error {
+	cfg, args, err := commandConfig("lenslocked migrate", cli.MigrateUsage, args)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Open doesn't connect, create works without a database
+	db, err := models.Open(cfg.PSQL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrate := cli.Migrate{
+		DB:  db,
+		FS:  migrations.FS,
+		Dir: "migrations",
+		Out: os.Stdout,
+		Err: os.Stderr,
+	}
+
+	return migrate.Run(ctx, args)
+}
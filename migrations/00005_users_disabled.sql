@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- disabled users cannot sign in, NULL means the account is active
+ALTER TABLE users ADD COLUMN disabled_at TIMESTAMPTZ;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN disabled_at;
+-- +goose StatementEnd
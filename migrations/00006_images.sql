@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the files themselves live on disk under storage.dir, one directory per
+-- gallery, these rows keep track of them
+CREATE TABLE images (
+    id SERIAL PRIMARY KEY,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (gallery_id, filename)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE images;
+-- +goose StatementEnd
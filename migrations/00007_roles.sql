@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+-- moderators can hide and delete any gallery, admins can also manage users
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user'
+    CHECK (role IN ('user', 'moderator', 'admin'));
+-- hidden galleries are only visible to their owner and to moderators
+ALTER TABLE galleries ADD COLUMN hidden_at TIMESTAMPTZ;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries DROP COLUMN hidden_at;
+ALTER TABLE users DROP COLUMN role;
+-- +goose StatementEnd
@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+-- an admin impersonating someone keeps their own session, which then acts as
+-- the impersonated user
+ALTER TABLE sessions ADD COLUMN impersonated_user_id INT
+    REFERENCES users (id) ON DELETE SET NULL;
+
+-- the audit trail of impersonations. The emails are copied so the trail
+-- still says who was involved once the accounts are deleted
+CREATE TABLE impersonations (
+    id SERIAL PRIMARY KEY,
+    admin_id INT REFERENCES users (id) ON DELETE SET NULL,
+    admin_email TEXT NOT NULL,
+    user_id INT REFERENCES users (id) ON DELETE SET NULL,
+    user_email TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ended_at TIMESTAMPTZ
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE impersonations;
+ALTER TABLE sessions DROP COLUMN impersonated_user_id;
+-- +goose StatementEnd
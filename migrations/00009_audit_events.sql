@@ -0,0 +1,41 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the security audit log. user_id and actor_id have no foreign keys: the
+-- events of a deleted account are kept as they were, with the email it had
+CREATE TABLE audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    type TEXT NOT NULL,
+    -- the user the event is about, NULL for a sign in to an unknown email
+    user_id INT,
+    email TEXT NOT NULL DEFAULT '',
+    -- who did it when not the user: an admin, a moderator or an impersonator
+    actor_id INT,
+    gallery_id INT,
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    request_id TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX audit_events_user_id_idx ON audit_events (user_id, id);
+CREATE INDEX audit_events_created_at_idx ON audit_events (created_at);
+
+-- the log is append-only, even for the app's own database user
+CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_no_update_delete
+    BEFORE UPDATE OR DELETE ON audit_events
+    FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+CREATE TRIGGER audit_events_no_truncate
+    BEFORE TRUNCATE ON audit_events
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE audit_events;
+DROP FUNCTION audit_events_append_only();
+-- +goose StatementEnd
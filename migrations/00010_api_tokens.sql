@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+-- personal access tokens for the JSON API. Like sessions, only the hash of the
+-- token is stored. scopes is space separated, e.g. 'read:galleries upload'
+CREATE TABLE api_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    scopes TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    -- NULL for tokens that never expire
+    expires_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ
+);
+CREATE INDEX api_tokens_user_id_idx ON api_tokens (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE api_tokens;
+-- +goose StatementEnd
@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+-- resumable uploads of the API. The bytes received so far are in a file named
+-- after the id under storage.dir/uploads, the image is created once they are
+-- all there. id is random, it is in the URL the client resumes with
+CREATE TABLE uploads (
+    id TEXT PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    length BIGINT NOT NULL,
+    received BIGINT NOT NULL DEFAULT 0,
+    -- set while a chunk is being written, so two can't be at once
+    locked_until TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ NOT NULL,
+    completed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (received >= 0 AND received <= length)
+);
+CREATE INDEX uploads_user_id_idx ON uploads (user_id);
+CREATE INDEX uploads_expires_at_idx ON uploads (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE uploads;
+-- +goose StatementEnd
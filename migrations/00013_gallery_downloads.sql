@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the owner of a gallery can turn off the "download all" archive of it
+ALTER TABLE galleries
+    ADD COLUMN downloads_disabled BOOLEAN NOT NULL DEFAULT false;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+    DROP COLUMN downloads_disabled;
+-- +goose StatementEnd
@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the owner of a gallery orders its images, captions them and describes them
+-- for screen readers. The images already there keep the order they were
+-- added in
+ALTER TABLE images
+    ADD COLUMN position INT NOT NULL DEFAULT 0,
+    ADD COLUMN caption TEXT NOT NULL DEFAULT '',
+    ADD COLUMN alt TEXT NOT NULL DEFAULT '';
+UPDATE images
+SET position = numbered.position
+FROM (
+    SELECT id, row_number() OVER (PARTITION BY gallery_id ORDER BY id) AS position
+    FROM images
+) AS numbered
+WHERE images.id = numbered.id;
+
+-- the image standing for the gallery in lists and link previews
+ALTER TABLE galleries
+    ADD COLUMN cover_image_id INT REFERENCES images (id) ON DELETE SET NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+    DROP COLUMN cover_image_id;
+ALTER TABLE images
+    DROP COLUMN position,
+    DROP COLUMN caption,
+    DROP COLUMN alt;
+-- +goose StatementEnd
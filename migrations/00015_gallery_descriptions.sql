@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Markdown, rendered and sanitized when the gallery is shown
+ALTER TABLE galleries
+    ADD COLUMN description TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+    DROP COLUMN description;
+-- +goose StatementEnd
@@ -0,0 +1,239 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/rand"
+)
+
+// APITokenPrefix starts every API token, so people and secret scanners can
+// tell them apart from other credentials.
+const APITokenPrefix = "llt_"
+
+// Scope is what an API token is allowed to do.
+type Scope string
+
+const (
+	ScopeReadGalleries  Scope = "read:galleries"
+	ScopeWriteGalleries Scope = "write:galleries"
+	ScopeUpload         Scope = "upload"
+)
+
+// Scopes lists every scope, in the order to offer them.
+var Scopes = []Scope{ScopeReadGalleries, ScopeWriteGalleries, ScopeUpload}
+
+var scopeDescriptions = map[Scope]string{
+	ScopeReadGalleries:  "List and read your galleries and their images",
+	ScopeWriteGalleries: "Create, rename and delete galleries and images",
+	ScopeUpload:         "Upload images to your galleries",
+}
+
+// Description is how the scope is shown to people.
+func (s Scope) Description() string {
+	return scopeDescriptions[s]
+}
+
+// ParseScopes returns the scopes named in names, without duplicates, or an
+// error naming the first unknown one.
+func ParseScopes(names []string) ([]Scope, error) {
+	var scopes []Scope
+	for _, name := range names {
+		scope := Scope(name)
+		if !slices.Contains(Scopes, scope) {
+			return nil, fmt.Errorf("unknown scope %q", name)
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return scopes, nil
+}
+
+// APIToken is a personal access token, the credentials of a user for the
+// JSON API limited to some scopes.
+type APIToken struct {
+	ID     int
+	UserID int
+	Name   string
+	Scopes []Scope
+	// Token is only set when the token is created, only its hash is stored
+	Token     string
+	TokenHash string
+	CreatedAt time.Time
+	// ExpiresAt is nil for tokens that never expire, LastUsedAt for the ones
+	// never used
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+}
+
+// HasScope reports whether the token allows scope.
+func (t *APIToken) HasScope(scope Scope) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// Expired reports whether the token can no longer be used at now.
+func (t *APIToken) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+func joinScopes(scopes []Scope) string {
+	names := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		names = append(names, string(scope))
+	}
+	return strings.Join(names, " ")
+}
+
+func splitScopes(s string) []Scope {
+	var scopes []Scope
+	for _, name := range strings.Fields(s) {
+		scopes = append(scopes, Scope(name))
+	}
+	return scopes
+}
+
+type APITokenService struct {
+	DB DBTX
+	// BytesPerToken works like SessionService.BytesPerToken.
+	BytesPerToken int
+	// QueryTimeout bounds the queries of each call. Defaults to
+	// DefaultQueryTimeout.
+	QueryTimeout time.Duration
+}
+
+// Create generates a token for the user. It is returned in the Token field,
+// the only time it is known: only its hash is stored. A nil expiresAt makes a
+// token that never expires.
+func (ts *APITokenService) Create(ctx context.Context, userID int, name string, scopes []Scope, expiresAt *time.Time) (*APIToken, error) {
+	ctx, cancel := withTimeout(ctx, ts.QueryTimeout)
+	defer cancel()
+
+	bytesPerToken := ts.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create api token: %w", err)
+	}
+
+	t := APIToken{
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		Token:     APITokenPrefix + token,
+		ExpiresAt: expiresAt,
+	}
+	t.TokenHash = ts.hash(t.Token)
+
+	row := conn(ctx, ts.DB).QueryRowContext(ctx, `
+		INSERT INTO api_tokens (user_id, name, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at;`,
+		t.UserID, t.Name, t.TokenHash, joinScopes(t.Scopes), t.ExpiresAt)
+	err = row.Scan(&t.ID, &t.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create api token: %w", err)
+	}
+
+	return &t, nil
+}
+
+// ByUserID returns the tokens of a user, the latest first, expired ones
+// included.
+func (ts *APITokenService) ByUserID(ctx context.Context, userID int) ([]APIToken, error) {
+	ctx, cancel := withTimeout(ctx, ts.QueryTimeout)
+	defer cancel()
+
+	rows, err := conn(ctx, ts.DB).QueryContext(ctx, `
+		SELECT id, name, token_hash, scopes, created_at, expires_at, last_used_at
+		FROM api_tokens
+		WHERE user_id = $1
+		ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query api tokens by user: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		t := APIToken{UserID: userID}
+		var scopes string
+		err := rows.Scan(&t.ID, &t.Name, &t.TokenHash, &scopes, &t.CreatedAt,
+			&t.ExpiresAt, &t.LastUsedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query api tokens by user: %w", err)
+		}
+		t.Scopes = splitScopes(scopes)
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query api tokens by user: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// User returns the user a token belongs to, along with the token, and records
+// that it was used. Unknown and expired tokens, and the tokens of disabled
+// users, are ErrNotFound.
+func (ts *APITokenService) User(ctx context.Context, token string) (*User, *APIToken, error) {
+	ctx, cancel := withTimeout(ctx, ts.QueryTimeout)
+	defer cancel()
+
+	t := APIToken{TokenHash: ts.hash(token)}
+	var user User
+	var scopes string
+
+	row := conn(ctx, ts.DB).QueryRowContext(ctx, `
+		UPDATE api_tokens t
+		SET last_used_at = now()
+		FROM users u
+		WHERE t.token_hash = $1
+			AND (t.expires_at IS NULL OR t.expires_at > now())
+			AND u.id = t.user_id
+			AND u.disabled_at IS NULL
+		RETURNING t.id, t.name, t.scopes, t.created_at, t.expires_at,
+			t.last_used_at, u.id, u.email, u.password_hash, u.role;`, t.TokenHash)
+	err := row.Scan(&t.ID, &t.Name, &scopes, &t.CreatedAt, &t.ExpiresAt,
+		&t.LastUsedAt, &user.ID, &user.Email, &user.PasswordHash, &user.Role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("api token user: %w", err)
+	}
+	t.UserID = user.ID
+	t.Scopes = splitScopes(scopes)
+
+	return &user, &t, nil
+}
+
+// Revoke deletes a token of the user. Tokens of other users are not found.
+func (ts *APITokenService) Revoke(ctx context.Context, userID, id int) error {
+	ctx, cancel := withTimeout(ctx, ts.QueryTimeout)
+	defer cancel()
+
+	res, err := conn(ctx, ts.DB).ExecContext(ctx, `
+		DELETE FROM api_tokens
+		WHERE id = $1 AND user_id = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("revoke api token: %w", err)
+	}
+
+	return notFoundIfNone(res, "revoke api token")
+}
+
+func (ts *APITokenService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,101 @@
+package models_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := models.ParseScopes([]string{"upload", "read:galleries", "upload"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scopes) != 2 || scopes[0] != models.ScopeUpload || scopes[1] != models.ScopeReadGalleries {
+		t.Errorf("got %v, want upload and read:galleries once each", scopes)
+	}
+
+	_, err = models.ParseScopes([]string{"read:galleries", "admin"})
+	if err == nil || !strings.Contains(err.Error(), `"admin"`) {
+		t.Errorf("got error %v, want the unknown scope named", err)
+	}
+}
+
+func TestAPITokenService(t *testing.T) {
+	tx := testDB.Tx(t)
+	ctx := context.Background()
+	ts := models.APITokenService{DB: tx}
+	us := models.UserService{DB: tx}
+
+	bob := createUser(t, tx, "bob@example.com", "secret")
+	carol := createUser(t, tx, "carol@example.com", "secret")
+
+	token, err := ts.Create(ctx, bob.ID, "Lightroom",
+		[]models.Scope{models.ScopeReadGalleries, models.ScopeUpload}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token.Token, models.APITokenPrefix) {
+		t.Errorf("got token %q, want the %s prefix", token.Token, models.APITokenPrefix)
+	}
+	// only the hash is stored
+	if n := count(t, tx, "api_tokens", "token_hash = $1", token.Token); n != 0 {
+		t.Error("the token is stored in the clear")
+	}
+
+	user, got, err := ts.User(ctx, token.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != bob.ID || got.Name != "Lightroom" || !got.HasScope(models.ScopeUpload) ||
+		got.HasScope(models.ScopeWriteGalleries) || got.LastUsedAt == nil {
+		t.Errorf("got %+v for %+v", *got, *user)
+	}
+	_, _, err = ts.User(ctx, "llt_nope")
+	if err != models.ErrNotFound {
+		t.Errorf("unknown token: got %v, want ErrNotFound", err)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	expired, err := ts.Create(ctx, bob.ID, "Old", []models.Scope{models.ScopeReadGalleries}, &past)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ts.User(ctx, expired.Token)
+	if err != models.ErrNotFound {
+		t.Errorf("expired token: got %v, want ErrNotFound", err)
+	}
+
+	tokens, err := ts.ByUserID(ctx, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0].Name != "Old" || tokens[1].Name != "Lightroom" {
+		t.Errorf("got %+v, want both tokens, the latest first", tokens)
+	}
+
+	// tokens of disabled users stop working
+	err = us.Disable(ctx, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ts.User(ctx, token.Token)
+	if err != models.ErrNotFound {
+		t.Errorf("disabled user: got %v, want ErrNotFound", err)
+	}
+
+	err = ts.Revoke(ctx, carol.ID, token.ID)
+	if err != models.ErrNotFound {
+		t.Errorf("revoking someone else's token: got %v, want ErrNotFound", err)
+	}
+	err = ts.Revoke(ctx, bob.ID, token.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, tx, "api_tokens", "id = $1", token.ID); n != 0 {
+		t.Error("the revoked token is still there")
+	}
+}
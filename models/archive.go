@@ -0,0 +1,189 @@
+package models
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ArchiveKey identifies the ZIP archive of the images: it changes whenever an
+// image is added, removed or replaced. It looks at the files themselves, as
+// replacing an image keeps its row.
+func ArchiveKey(images []Image) (string, error) {
+	h := sha256.New()
+	for _, image := range images {
+		stat, err := os.Stat(image.Path)
+		if err != nil {
+			return "", fmt.Errorf("archive key: %w", err)
+		}
+		fmt.Fprintf(h, "%d %q %d %d\n", image.ID, image.Filename, stat.Size(),
+			stat.ModTime().UnixNano())
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+// WriteArchive writes a ZIP archive of the images to w, one entry per image
+// named after it. The images are stored rather than deflated, they are
+// compressed already. The same images always give the same bytes, which is
+// what lets a download streamed by one request be resumed from the archive
+// ArchiveFiles builds in another.
+func WriteArchive(ctx context.Context, w io.Writer, images []Image) error {
+	zw := zip.NewWriter(w)
+	for _, image := range images {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("write archive: %w", err)
+		}
+		err := writeArchiveEntry(zw, image)
+		if err != nil {
+			return fmt.Errorf("write archive: %w", err)
+		}
+	}
+
+	err := zw.Close()
+	if err != nil {
+		return fmt.Errorf("write archive: %w", err)
+	}
+	return nil
+}
+
+func writeArchiveEntry(zw *zip.Writer, image Image) error {
+	f, err := os.Open(image.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     image.Filename,
+		Method:   zip.Store,
+		Modified: image.CreatedAt.UTC().Truncate(time.Second),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// ArchiveFiles caches the ZIP archives of the galleries under Dir, for the
+// downloads resumed with a Range request, which need the whole archive to
+// seek in. An archive is named after its gallery and ArchiveKey, so a changed
+// gallery gets a new one.
+type ArchiveFiles struct {
+	Dir string
+}
+
+// Path returns where the archive of a gallery is cached.
+func (f ArchiveFiles) Path(galleryID int, key string) string {
+	return filepath.Join(f.Dir, fmt.Sprintf("gallery-%d-%s.zip", galleryID, key))
+}
+
+// Open opens the cached archive of a gallery. The error wraps fs.ErrNotExist
+// when there is none for key.
+func (f ArchiveFiles) Open(galleryID int, key string) (*os.File, error) {
+	file, err := os.Open(f.Path(galleryID, key))
+	if err != nil {
+		return nil, fmt.Errorf("open archive: %w", err)
+	}
+	// Prune goes by the modification time, using an archive keeps it
+	now := time.Now()
+	_ = os.Chtimes(file.Name(), now, now)
+
+	return file, nil
+}
+
+// Build writes the archive of the images of a gallery to the cache and opens
+// it, in place of the older archives of the gallery. It is written under a
+// temporary name and renamed once complete, so Open never returns half of
+// one, and two requests building it at once both end up with a whole one.
+func (f ArchiveFiles) Build(ctx context.Context, galleryID int, key string, images []Image) (file *os.File, err error) {
+	ctx, span := tracing.Start(ctx, "storage.archive",
+		attribute.Int("gallery.id", galleryID))
+	defer func() { tracing.End(span, err) }()
+
+	err = os.MkdirAll(f.Dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("build archive: %w", err)
+	}
+	tmp, err := os.CreateTemp(f.Dir, ".archive-*")
+	if err != nil {
+		return nil, fmt.Errorf("build archive: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	err = WriteArchive(ctx, tmp, images)
+	if err != nil {
+		return nil, fmt.Errorf("build archive: %w", err)
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return nil, fmt.Errorf("build archive: %w", err)
+	}
+	path := f.Path(galleryID, key)
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return nil, fmt.Errorf("build archive: %w", err)
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("build archive: %w", err)
+	}
+
+	// the downloads still reading an older one keep their open file
+	old, _ := filepath.Glob(filepath.Join(f.Dir, fmt.Sprintf("gallery-%d-*.zip", galleryID)))
+	for _, name := range old {
+		if name != path {
+			os.Remove(name)
+		}
+	}
+
+	return tmp, nil
+}
+
+// Prune deletes the archives not used since before, and those of
+// interrupted builds, and returns how many it deleted.
+func (f ArchiveFiles) Prune(before time.Time) (int, error) {
+	entries, err := os.ReadDir(f.Dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("prune archives: %w", err)
+	}
+
+	n := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.Type().IsRegular() || !info.ModTime().Before(before) {
+			continue
+		}
+		if !strings.HasSuffix(entry.Name(), ".zip") && !strings.HasPrefix(entry.Name(), ".archive-") {
+			continue
+		}
+		err = os.Remove(filepath.Join(f.Dir, entry.Name()))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return n, fmt.Errorf("prune archives: %w", err)
+		}
+		n++
+	}
+
+	return n, nil
+}
@@ -0,0 +1,154 @@
+package models_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// archiveImages saves the images to a gallery and returns them as the
+// ImageService would.
+func archiveImages(t *testing.T, files models.ImageFiles, names ...string) []models.Image {
+	t.Helper()
+
+	var images []models.Image
+	for i, name := range names {
+		contents := pngImage(t, i+1, i+1)
+		_, size, err := files.Save(context.Background(), 1, name, bytes.NewReader(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, models.Image{ID: i + 1, GalleryID: 1, Filename: name, Size: size,
+			CreatedAt: time.Now(), Path: files.Path(1, name)})
+	}
+	return images
+}
+
+func TestWriteArchive(t *testing.T) {
+	files := models.ImageFiles{Dir: t.TempDir()}
+	images := archiveImages(t, files, "cat.png", "dog.png")
+
+	var first, second bytes.Buffer
+	for _, b := range []*bytes.Buffer{&first, &second} {
+		err := models.WriteArchive(context.Background(), b, images)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("the same images gave different archives")
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(first.Bytes()), int64(first.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Name != "cat.png" || zr.File[1].Name != "dog.png" {
+		t.Fatalf("got entries %v", zr.File)
+	}
+	rc, err := zr.File[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	got, _ := io.ReadAll(rc)
+	want, _ := os.ReadFile(images[1].Path)
+	if !bytes.Equal(got, want) {
+		t.Error("the entry differs from the image")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = models.WriteArchive(ctx, io.Discard, images)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestArchiveKey(t *testing.T) {
+	files := models.ImageFiles{Dir: t.TempDir()}
+	images := archiveImages(t, files, "cat.png", "dog.png")
+
+	key, err := models.ArchiveKey(images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := models.ArchiveKey(images); again != key {
+		t.Errorf("got keys %s and %s for the same images", key, again)
+	}
+	if fewer, _ := models.ArchiveKey(images[:1]); fewer == key {
+		t.Error("removing an image kept the key")
+	}
+
+	// replacing an image keeps its row
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(images[0].Path, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced, _ := models.ArchiveKey(images); replaced == key {
+		t.Error("replacing an image kept the key")
+	}
+
+	os.Remove(images[1].Path)
+	_, err = models.ArchiveKey(images)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want ErrNotExist", err)
+	}
+}
+
+func TestArchiveFiles(t *testing.T) {
+	images := archiveImages(t, models.ImageFiles{Dir: t.TempDir()}, "cat.png")
+	archives := models.ArchiveFiles{Dir: filepath.Join(t.TempDir(), "archives")}
+
+	_, err := archives.Open(1, "old")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("got %v, want ErrNotExist", err)
+	}
+	for _, key := range []string{"old", "new"} {
+		f, err := archives.Build(context.Background(), 1, key, images)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(f)
+		f.Close()
+		var want bytes.Buffer
+		_ = models.WriteArchive(context.Background(), &want, images)
+		if !bytes.Equal(got, want.Bytes()) {
+			t.Errorf("%s: the cached archive differs from the streamed one", key)
+		}
+	}
+
+	// the new archive replaced the old one
+	_, err = archives.Open(1, "old")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want the old archive gone", err)
+	}
+	f, err := archives.Open(1, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	n, err := archives.Prune(time.Now().Add(-time.Hour))
+	if err != nil || n != 0 {
+		t.Errorf("got %d, %v, want the archive in use kept", n, err)
+	}
+	n, err = archives.Prune(time.Now().Add(time.Hour))
+	if err != nil || n != 1 {
+		t.Errorf("got %d, %v, want the archive pruned", n, err)
+	}
+	n, err = models.ArchiveFiles{Dir: filepath.Join(t.TempDir(), "missing")}.Prune(time.Now())
+	if err != nil || n != 0 {
+		t.Errorf("got %d, %v, want nothing to prune", n, err)
+	}
+}
@@ -0,0 +1,216 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuditEventType is what happened in an AuditEvent.
+type AuditEventType string
+
+const (
+	EventSignUp       AuditEventType = "sign_up"
+	EventSignIn       AuditEventType = "sign_in"
+	EventSignInFailed AuditEventType = "sign_in_failed"
+	EventSignOut      AuditEventType = "sign_out"
+	// EventPasswordResetRequested is recorded when a reset link is sent,
+	// EventPasswordResetConsumed when it is used to change the password
+	EventPasswordResetRequested AuditEventType = "password_reset_requested"
+	EventPasswordResetConsumed  AuditEventType = "password_reset_consumed"
+	// EventSessionsRevoked is recorded when all the sessions of a user are
+	// deleted, e.g. when an admin disables the account
+	EventSessionsRevoked AuditEventType = "sessions_revoked"
+	// EventUserEnabled and EventRoleChanged are recorded when an admin
+	// enables the account again or changes its role
+	EventUserEnabled    AuditEventType = "user_enabled"
+	EventRoleChanged    AuditEventType = "role_changed"
+	EventGalleryCreated AuditEventType = "gallery_created"
+	EventGalleryUpdated AuditEventType = "gallery_updated"
+	EventGalleryDeleted AuditEventType = "gallery_deleted"
+	// EventGalleryHidden and EventGalleryUnhidden are recorded when a
+	// moderator hides a gallery from the public or shows it again
+	EventGalleryHidden   AuditEventType = "gallery_hidden"
+	EventGalleryUnhidden AuditEventType = "gallery_unhidden"
+	EventAPITokenCreated AuditEventType = "api_token_created"
+	EventAPITokenRevoked AuditEventType = "api_token_revoked"
+	EventWebhookCreated  AuditEventType = "webhook_created"
+	EventWebhookDeleted  AuditEventType = "webhook_deleted"
+	// there is no event for email changes, the app has no way to change the
+	// email of an account yet
+)
+
+// AuditEventTypes lists every type, in the order to offer them in filters.
+var AuditEventTypes = []AuditEventType{
+	EventSignUp,
+	EventSignIn,
+	EventSignInFailed,
+	EventSignOut,
+	EventPasswordResetRequested,
+	EventPasswordResetConsumed,
+	EventSessionsRevoked,
+	EventUserEnabled,
+	EventRoleChanged,
+	EventGalleryCreated,
+	EventGalleryUpdated,
+	EventGalleryDeleted,
+	EventGalleryHidden,
+	EventGalleryUnhidden,
+	EventAPITokenCreated,
+	EventAPITokenRevoked,
+	EventWebhookCreated,
+	EventWebhookDeleted,
+}
+
+var auditEventDescriptions = map[AuditEventType]string{
+	EventSignUp:                 "Signed up",
+	EventSignIn:                 "Signed in",
+	EventSignInFailed:           "Failed to sign in",
+	EventSignOut:                "Signed out",
+	EventPasswordResetRequested: "Requested a password reset",
+	EventPasswordResetConsumed:  "Reset the password",
+	EventSessionsRevoked:        "Signed out everywhere",
+	EventGalleryCreated:         "Created a gallery",
+	EventGalleryUpdated:         "Updated a gallery",
+	EventUserEnabled:            "Enabled the account",
+	EventRoleChanged:            "Changed the role",
+	EventGalleryDeleted:         "Deleted a gallery",
+	EventGalleryHidden:          "Hid a gallery",
+	EventGalleryUnhidden:        "Unhid a gallery",
+	EventAPITokenCreated:        "Created an API token",
+	EventAPITokenRevoked:        "Revoked an API token",
+	EventWebhookCreated:         "Added a webhook",
+	EventWebhookDeleted:         "Deleted a webhook",
+}
+
+// Description is how the event is shown to people, e.g. "Signed in".
+func (t AuditEventType) Description() string {
+	if d, ok := auditEventDescriptions[t]; ok {
+		return d
+	}
+	return string(t)
+}
+
+// AuditEvent is an entry of the security audit log. The ids are 0 when they
+// don't apply, they are kept once the user or gallery is deleted.
+type AuditEvent struct {
+	ID   int64
+	Type AuditEventType
+	// UserID is who the event is about, Email their email at the time, or
+	// the one tried for a failed sign in
+	UserID int
+	Email  string
+	// ActorID is who did it when it wasn't the user: an admin, a moderator
+	// or an admin impersonating the user
+	ActorID   int
+	GalleryID int
+	// IP, UserAgent and RequestID say where the event came from. They are
+	// empty for the command line
+	IP        string
+	UserAgent string
+	RequestID string
+	CreatedAt time.Time
+}
+
+// AuditFilter narrows down AuditService.List. Zero fields match everything.
+type AuditFilter struct {
+	UserID int
+	// Email matches the events whose email contains it, ignoring case
+	Email string
+	Type  AuditEventType
+	IP    string
+	// Since is inclusive, Until exclusive
+	Since time.Time
+	Until time.Time
+}
+
+type AuditService struct {
+	DB DBTX
+	// QueryTimeout bounds the queries of each call. Defaults to
+	// DefaultQueryTimeout.
+	QueryTimeout time.Duration
+}
+
+// Record appends the event to the log. Its ID and CreatedAt are ignored.
+func (service *AuditService) Record(ctx context.Context, event AuditEvent) error {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	_, err := conn(ctx, service.DB).ExecContext(ctx, `
+		INSERT INTO audit_events (type, user_id, email, actor_id, gallery_id,
+			ip, user_agent, request_id)
+		VALUES ($1, NULLIF($2, 0), $3, NULLIF($4, 0), NULLIF($5, 0), $6, $7, $8);`,
+		event.Type, event.UserID, event.Email, event.ActorID, event.GalleryID,
+		event.IP, event.UserAgent, event.RequestID)
+	if err != nil {
+		return fmt.Errorf("record audit event: %w", err)
+	}
+
+	return nil
+}
+
+// List returns up to limit events matching the filter, the latest first,
+// skipping the first offset.
+func (service *AuditService) List(ctx context.Context, filter AuditFilter, limit, offset int) ([]AuditEvent, error) {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	var where []string
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if filter.UserID != 0 {
+		add("user_id = $%d", filter.UserID)
+	}
+	if filter.Email != "" {
+		add("strpos(lower(email), $%d) > 0", strings.ToLower(filter.Email))
+	}
+	if filter.Type != "" {
+		add("type = $%d", filter.Type)
+	}
+	if filter.IP != "" {
+		add("ip = $%d", filter.IP)
+	}
+	if !filter.Since.IsZero() {
+		add("created_at >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		add("created_at < $%d", filter.Until)
+	}
+
+	query := `
+		SELECT id, type, COALESCE(user_id, 0), email, COALESCE(actor_id, 0),
+			COALESCE(gallery_id, 0), ip, user_agent, request_id, created_at
+		FROM audit_events`
+	if len(where) > 0 {
+		query += "\n\t\tWHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, limit, offset)
+	query += fmt.Sprintf("\n\t\tORDER BY id DESC\n\t\tLIMIT $%d OFFSET $%d;",
+		len(args)-1, len(args))
+
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list audit events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var e AuditEvent
+		err := rows.Scan(&e.ID, &e.Type, &e.UserID, &e.Email, &e.ActorID,
+			&e.GalleryID, &e.IP, &e.UserAgent, &e.RequestID, &e.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("list audit events: %w", err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list audit events: %w", err)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,107 @@
+package models_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+func TestAuditServiceList(t *testing.T) {
+	ctx := context.Background()
+	tx := testDB.Tx(t)
+	as := models.AuditService{DB: tx}
+	bob := createUser(t, tx, "bob@example.com", "secret")
+
+	for _, event := range []models.AuditEvent{
+		{Type: models.EventSignInFailed, Email: "bob@example.com", IP: "10.0.0.1"},
+		{Type: models.EventSignIn, UserID: bob.ID, Email: "bob@example.com", IP: "10.0.0.1",
+			UserAgent: "curl", RequestID: "req-1"},
+		{Type: models.EventGalleryCreated, UserID: bob.ID, GalleryID: 7, ActorID: bob.ID + 1},
+		{Type: models.EventSignInFailed, Email: "alice@example.com", IP: "10.0.0.2"},
+	} {
+		err := as.Record(ctx, event)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter models.AuditFilter
+		want   string
+	}{
+		{name: "all", want: "sign_in_failed,gallery_created,sign_in,sign_in_failed"},
+		{name: "user", filter: models.AuditFilter{UserID: bob.ID}, want: "gallery_created,sign_in"},
+		{name: "email", filter: models.AuditFilter{Email: "BOB@"}, want: "sign_in,sign_in_failed"},
+		{name: "type", filter: models.AuditFilter{Type: models.EventSignInFailed}, want: "sign_in_failed,sign_in_failed"},
+		{name: "ip", filter: models.AuditFilter{IP: "10.0.0.2"}, want: "sign_in_failed"},
+		{name: "since", filter: models.AuditFilter{Since: time.Now().Add(time.Hour)}},
+		{name: "until", filter: models.AuditFilter{Until: time.Now().Add(-time.Hour)}},
+		{
+			name:   "combined",
+			filter: models.AuditFilter{Email: "bob", Type: models.EventSignIn, Since: time.Now().Add(-time.Hour)},
+			want:   "sign_in",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := as.List(ctx, tt.filter, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var types []string
+			for _, event := range events {
+				types = append(types, string(event.Type))
+			}
+			if got := strings.Join(types, ","); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	events, err := as.List(ctx, models.AuditFilter{Type: models.EventGalleryCreated}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].GalleryID != 7 || events[0].ActorID != bob.ID+1 {
+		t.Errorf("got %+v, want the gallery and actor ids back", events)
+	}
+}
+
+func TestAuditEventsAppendOnly(t *testing.T) {
+	ctx := context.Background()
+	tx := testDB.Tx(t)
+	as := models.AuditService{DB: tx}
+	us := models.UserService{DB: tx}
+	bob := createUser(t, tx, "bob@example.com", "secret")
+
+	err := as.Record(ctx, models.AuditEvent{Type: models.EventSignIn, UserID: bob.ID, Email: bob.Email})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the events outlive the account
+	err = us.Delete(ctx, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, tx, "audit_events", "user_id = $1", bob.ID); n != 1 {
+		t.Errorf("got %d events left for the deleted user, want 1", n)
+	}
+
+	_, err = tx.Exec("SAVEPOINT tamper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Exec("DELETE FROM audit_events")
+	if err == nil || !strings.Contains(err.Error(), "append-only") {
+		t.Errorf("delete: got error %v, want the log to be append-only", err)
+	}
+	_, err = tx.Exec("ROLLBACK TO SAVEPOINT tamper")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,9 +1,15 @@
 package models
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"strconv"
 
 	"github.com/go-mail/mail/v2"
+	"github.com/rafaelmdurante/lenslocked/metrics"
+	"github.com/rafaelmdurante/lenslocked/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -32,7 +38,7 @@ type SMTPConfig struct {
 	Host     string
 	Port     int
 	Username string
-	Password string
+	Password string `secret:"true"`
 }
 
 func NewEmailService(config SMTPConfig) *EmailService {
@@ -42,7 +48,24 @@ func NewEmailService(config SMTPConfig) *EmailService {
 	}
 }
 
-func (es *EmailService) Send(email Email) error {
+// Ping checks that the SMTP server accepts connections, without sending
+// anything.
+func (es *EmailService) Ping(ctx context.Context) error {
+	addr := net.JoinHostPort(es.dialer.Host, strconv.Itoa(es.dialer.Port))
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("ping smtp: %w", err)
+	}
+
+	return conn.Close()
+}
+
+func (es *EmailService) Send(ctx context.Context, email Email) error {
+	_, span := tracing.Start(ctx, "smtp.send",
+		attribute.String("email.subject", email.Subject))
+
 	msg := mail.NewMessage()
 
 	msg.SetHeader("To", email.To)
@@ -60,6 +83,8 @@ func (es *EmailService) Send(email Email) error {
 	}
 
 	err := es.dialer.DialAndSend(msg)
+	metrics.EmailsSent.WithLabelValues(metrics.Result(err)).Inc()
+	tracing.End(span, err)
 	if err != nil {
 		return fmt.Errorf("failed to send email: %w", err)
 	}
@@ -82,7 +107,7 @@ func (es *EmailService) setFrom(msg *mail.Message, email Email) {
     msg.SetHeader("From", from)
 }
 
-func (es *EmailService) ForgotPassword(to, resetURL string) error {
+func (es *EmailService) ForgotPassword(ctx context.Context, to, resetURL string) error {
     email := Email{
         Subject: "Reset your password",
         To: to,
@@ -90,7 +115,7 @@ func (es *EmailService) ForgotPassword(to, resetURL string) error {
         HTML: `<p>To reset your password, please visit the following link: <a href="` + resetURL + `">` + resetURL,
     }
 
-    err := es.Send(email)
+    err := es.Send(ctx, email)
     if err != nil {
         return fmt.Errorf("forgot password email: %w", err)
     }
@@ -6,4 +6,6 @@ import "errors"
 var (
 	ErrEmailToken = errors.New("models: email address is already in use")
 	ErrNotFound   = errors.New("models: resource could not be found")
+	ErrDisabled   = errors.New("models: account is disabled")
+	ErrNotImage   = errors.New("models: file is not a supported image")
 )
@@ -1,28 +1,46 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 )
 
 type Gallery struct {
 	ID     int
 	UserID int
 	Title  string
+	// Description is the Markdown the owner wrote about the gallery
+	Description string
+	// HiddenAt is set once a moderator hides the gallery
+	HiddenAt *time.Time
+	// DownloadsDisabled is set when the owner turned off downloading the
+	// gallery as a ZIP archive
+	DownloadsDisabled bool
+	// Cover is the filename of the image the owner chose to stand for the
+	// gallery, if any
+	Cover string
 }
 
 type GalleryService struct {
-	DB *sql.DB
+	DB DBTX
+	// QueryTimeout bounds the queries of each call. Defaults to
+	// DefaultQueryTimeout.
+	QueryTimeout time.Duration
 }
 
-func (service *GalleryService) Create(title string, userID int) (*Gallery, error) {
+func (service *GalleryService) Create(ctx context.Context, title string, userID int) (*Gallery, error) {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
 	gallery := Gallery{
 		Title: title,
 		UserID: userID,
 	}
 
-	row := service.DB.QueryRow(`
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
 		INSERT INTO galleries (title, user_id)
 		values ($1, $2) RETURNING id;`,
 		gallery.Title, gallery.UserID)
@@ -35,17 +53,22 @@ func (service *GalleryService) Create(title string, userID int) (*Gallery, error
 	return &gallery, nil
 }
 
-func (service *GalleryService) ByID(id int) (*Gallery, error) {
+func (service *GalleryService) ByID(ctx context.Context, id int) (*Gallery, error) {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
 	gallery := Gallery{
 		ID: id,
 	}
 
-	row := service.DB.QueryRow(`
-		SELECT title, user_id
-		FROM galleries
-		WHERE id = $1`, gallery.ID)
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		SELECT g.title, g.description, g.user_id, g.hidden_at, g.downloads_disabled, COALESCE(i.filename, '')
+		FROM galleries g
+		LEFT JOIN images i ON i.id = g.cover_image_id
+		WHERE g.id = $1`, gallery.ID)
 
-	err := row.Scan(&gallery.Title, &gallery.UserID)
+	err := row.Scan(&gallery.Title, &gallery.Description, &gallery.UserID, &gallery.HiddenAt, &gallery.DownloadsDisabled,
+		&gallery.Cover)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNotFound
@@ -56,38 +79,47 @@ func (service *GalleryService) ByID(id int) (*Gallery, error) {
 	return &gallery, nil
 }
 
-func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
-	rows, err := service.DB.Query(`
-		SELECT id, title
-		FROM galleries
-		WHERE user_id = $1`, userID)
+func (service *GalleryService) ByUserID(ctx context.Context, userID int) ([]Gallery, error) {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+		SELECT g.id, g.title, g.description, g.hidden_at, g.downloads_disabled, COALESCE(i.filename, '')
+		FROM galleries g
+		LEFT JOIN images i ON i.id = g.cover_image_id
+		WHERE g.user_id = $1`, userID)
 	if err != nil {
 		return nil, fmt.Errorf("query galleries by user: %w", err)
 	}
+	defer rows.Close()
 
 	var galleries []Gallery
 	for rows.Next() {
 		var gallery = Gallery{ UserID: userID }
 
-		err := rows.Scan(&gallery.ID, &gallery.Title)
+		err := rows.Scan(&gallery.ID, &gallery.Title, &gallery.Description, &gallery.HiddenAt, &gallery.DownloadsDisabled,
+			&gallery.Cover)
 		if err != nil {
 			return nil, fmt.Errorf("query galleries by user: %w", err)
 		}
 
 		galleries = append(galleries, gallery)
 	}
-	if rows.Err() != nil {
+	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("query galleries by user: %w", err)
 	}
 
 	return galleries, nil
 }
 
-func (service *GalleryService) Update(gallery *Gallery) error {
-	_, err := service.DB.Exec(`
+func (service *GalleryService) Update(ctx context.Context, gallery *Gallery) error {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	_, err := conn(ctx, service.DB).ExecContext(ctx, `
 		UPDATE galleries
-		SET title = $2
-		WHERE id = $1;`, gallery.ID, gallery.Title)
+		SET title = $2, description = $3
+		WHERE id = $1;`, gallery.ID, gallery.Title, gallery.Description)
 	if err != nil {
 		return fmt.Errorf("update gallery: %w", err)
 	}
@@ -95,8 +127,11 @@ func (service *GalleryService) Update(gallery *Gallery) error {
 	return nil
 }
 
-func (service *GalleryService) Delete(id int) error {
-	_, err :=service.DB.Exec(`
+func (service *GalleryService) Delete(ctx context.Context, id int) error {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	_, err := conn(ctx, service.DB).ExecContext(ctx, `
 		DELETE FROM galleries
 		WHERE id = $1;`, id)
 	if err != nil {
@@ -105,3 +140,119 @@ func (service *GalleryService) Delete(id int) error {
 
 	return nil
 }
+
+// Transfer gives the gallery to another user.
+func (service *GalleryService) Transfer(ctx context.Context, id, toUserID int) error {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	res, err := conn(ctx, service.DB).ExecContext(ctx, `
+		UPDATE galleries
+		SET user_id = $2
+		WHERE id = $1;`, id, toUserID)
+	if err != nil {
+		return fmt.Errorf("transfer gallery: %w", err)
+	}
+
+	return notFoundIfNone(res, "transfer gallery")
+}
+
+// Search returns up to limit galleries whose title contains query, in any
+// case, ordered by id and skipping the first offset. Hidden galleries are
+// included.
+func (service *GalleryService) Search(ctx context.Context, query string, limit, offset int) ([]Gallery, error) {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+		SELECT g.id, g.user_id, g.title, g.description, g.hidden_at, g.downloads_disabled, COALESCE(i.filename, '')
+		FROM galleries g
+		LEFT JOIN images i ON i.id = g.cover_image_id
+		WHERE strpos(lower(g.title), lower($1)) > 0
+		ORDER BY g.id
+		LIMIT $2 OFFSET $3;`, query, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("search galleries: %w", err)
+	}
+	defer rows.Close()
+
+	var galleries []Gallery
+	for rows.Next() {
+		var gallery Gallery
+		err := rows.Scan(&gallery.ID, &gallery.UserID, &gallery.Title, &gallery.Description, &gallery.HiddenAt,
+			&gallery.DownloadsDisabled, &gallery.Cover)
+		if err != nil {
+			return nil, fmt.Errorf("search galleries: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("search galleries: %w", err)
+	}
+
+	return galleries, nil
+}
+
+// SetHidden hides the gallery from everyone but its owner and the
+// moderators, or shows it again. Hiding a hidden gallery keeps the original
+// HiddenAt.
+func (service *GalleryService) SetHidden(ctx context.Context, id int, hidden bool) error {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	res, err := conn(ctx, service.DB).ExecContext(ctx, `
+		UPDATE galleries
+		SET hidden_at = CASE WHEN $2 THEN COALESCE(hidden_at, now()) END
+		WHERE id = $1;`, id, hidden)
+	if err != nil {
+		return fmt.Errorf("set gallery hidden: %w", err)
+	}
+
+	return notFoundIfNone(res, "set gallery hidden")
+}
+
+// SetDownloads lets whoever can see the gallery download it as a ZIP
+// archive, or only those who can edit it.
+func (service *GalleryService) SetDownloads(ctx context.Context, id int, enabled bool) error {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	res, err := conn(ctx, service.DB).ExecContext(ctx, `
+		UPDATE galleries
+		SET downloads_disabled = NOT $2
+		WHERE id = $1;`, id, enabled)
+	if err != nil {
+		return fmt.Errorf("set gallery downloads: %w", err)
+	}
+
+	return notFoundIfNone(res, "set gallery downloads")
+}
+
+// SetCover makes the image with filename the cover of the gallery, or leaves
+// the gallery without one when filename is empty. Deleting the image leaves
+// the gallery without a cover too.
+func (service *GalleryService) SetCover(ctx context.Context, id int, filename string) error {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	var res sql.Result
+	var err error
+	if filename == "" {
+		res, err = conn(ctx, service.DB).ExecContext(ctx, `
+			UPDATE galleries
+			SET cover_image_id = NULL
+			WHERE id = $1;`, id)
+	} else {
+		res, err = conn(ctx, service.DB).ExecContext(ctx, `
+			UPDATE galleries
+			SET cover_image_id = images.id
+			FROM images
+			WHERE galleries.id = $1 AND images.gallery_id = $1 AND images.filename = $2;`,
+			id, filename)
+	}
+	if err != nil {
+		return fmt.Errorf("set gallery cover: %w", err)
+	}
+
+	return notFoundIfNone(res, "set gallery cover")
+}
@@ -0,0 +1,318 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+func TestGalleryServiceCreate(t *testing.T) {
+	tests := []struct {
+		name    string
+		title   string
+		unknown bool
+		wantFK  bool
+	}{
+		{name: "new gallery", title: "Holidays"},
+		{name: "empty title", title: ""},
+		{name: "unknown user", title: "Holidays", unknown: true, wantFK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := testDB.Tx(t)
+			gs := models.GalleryService{DB: tx}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+
+			userID := bob.ID
+			if tt.unknown {
+				userID = bob.ID + 1000
+			}
+			gallery, err := gs.Create(context.Background(), tt.title, userID)
+
+			if tt.wantFK {
+				var pgErr *pgconn.PgError
+				if !errors.As(err, &pgErr) || pgErr.Code != pgerrcode.ForeignKeyViolation {
+					t.Fatalf("got error %v, want a foreign key violation", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := models.Gallery{ID: gallery.ID, UserID: bob.ID, Title: tt.title}
+			if *gallery != want {
+				t.Errorf("got %+v, want %+v", *gallery, want)
+			}
+			if n := count(t, tx, "galleries", "id = $1 AND user_id = $2 AND title = $3", gallery.ID, bob.ID, tt.title); n != 1 {
+				t.Errorf("gallery %d is not stored", gallery.ID)
+			}
+		})
+	}
+}
+
+func TestGalleryServiceByID(t *testing.T) {
+	tests := []struct {
+		name    string
+		unknown bool
+		wantErr error
+	}{
+		{name: "existing gallery"},
+		{name: "unknown gallery", unknown: true, wantErr: models.ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tx := testDB.Tx(t)
+			gs := models.GalleryService{DB: tx}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+			created, err := gs.Create(ctx, "Holidays", bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id := created.ID
+			if tt.unknown {
+				id = created.ID + 1000
+			}
+			gallery, err := gs.ByID(ctx, id)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && *gallery != *created {
+				t.Errorf("got %+v, want %+v", *gallery, *created)
+			}
+		})
+	}
+}
+
+func TestGalleryServiceByUserID(t *testing.T) {
+	tests := []struct {
+		name   string
+		titles []string
+	}{
+		{name: "no galleries"},
+		{name: "one gallery", titles: []string{"Holidays"}},
+		{name: "several galleries", titles: []string{"Holidays", "Wedding", "Pets"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tx := testDB.Tx(t)
+			gs := models.GalleryService{DB: tx}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+			alice := createUser(t, tx, "alice@example.com", "secret")
+
+			// alice's galleries must never show up in bob's
+			_, err := gs.Create(ctx, "Alice's", alice.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []models.Gallery
+			for _, title := range tt.titles {
+				gallery, err := gs.Create(ctx, title, bob.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, *gallery)
+			}
+
+			got, err := gs.ByUserID(ctx, bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the query has no ORDER BY
+			sort.Slice(got, func(i, j int) bool { return got[i].ID < got[j].ID })
+			if len(got) != len(want) {
+				t.Fatalf("got %d galleries, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("gallery %d: got %+v, want %+v", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGalleryServiceUpdate(t *testing.T) {
+	tests := []struct {
+		name        string
+		title       string
+		description string
+	}{
+		{name: "new title", title: "Summer holidays"},
+		{name: "empty title", title: ""},
+		{name: "description", title: "Holidays", description: "Shot on **film**"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tx := testDB.Tx(t)
+			gs := models.GalleryService{DB: tx}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+			gallery, err := gs.Create(ctx, "Holidays", bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := gs.Create(ctx, "Wedding", bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gallery.Title = tt.title
+			gallery.Description = tt.description
+			err = gs.Update(ctx, gallery)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := gs.ByID(ctx, gallery.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Title != tt.title || got.Description != tt.description {
+				t.Errorf("got %q, %q, want %q, %q", got.Title, got.Description, tt.title, tt.description)
+			}
+			got, err = gs.ByID(ctx, other.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Title != "Wedding" {
+				t.Errorf("other gallery got title %q", got.Title)
+			}
+		})
+	}
+}
+
+func TestGalleryServiceDelete(t *testing.T) {
+	tests := []struct {
+		name     string
+		unknown  bool
+		wantRows int
+	}{
+		{name: "existing gallery", wantRows: 0},
+		// deleting a gallery that doesn't exist is not an error
+		{name: "unknown gallery", unknown: true, wantRows: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tx := testDB.Tx(t)
+			gs := models.GalleryService{DB: tx}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+			gallery, err := gs.Create(ctx, "Holidays", bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id := gallery.ID
+			if tt.unknown {
+				id = gallery.ID + 1000
+			}
+			err = gs.Delete(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := count(t, tx, "galleries", "user_id = $1", bob.ID); n != tt.wantRows {
+				t.Errorf("got %d galleries, want %d", n, tt.wantRows)
+			}
+		})
+	}
+}
+
+func TestGalleryServiceTransfer(t *testing.T) {
+	tests := []struct {
+		name           string
+		unknownGallery bool
+		unknownUser    bool
+		wantErr        error
+		wantFK         bool
+	}{
+		{name: "to another user"},
+		{name: "unknown gallery", unknownGallery: true, wantErr: models.ErrNotFound},
+		{name: "unknown user", unknownUser: true, wantFK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tx := testDB.Tx(t)
+			gs := models.GalleryService{DB: tx}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+			alice := createUser(t, tx, "alice@example.com", "secret")
+			gallery, err := gs.Create(ctx, "Holidays", bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id, toUserID := gallery.ID, alice.ID
+			if tt.unknownGallery {
+				id += 1000
+			}
+			if tt.unknownUser {
+				toUserID += 1000
+			}
+			err = gs.Transfer(ctx, id, toUserID)
+
+			if tt.wantFK {
+				var pgErr *pgconn.PgError
+				if !errors.As(err, &pgErr) || pgErr.Code != pgerrcode.ForeignKeyViolation {
+					t.Fatalf("got error %v, want a foreign key violation", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			wantOwner := alice.ID
+			if tt.wantErr != nil {
+				wantOwner = bob.ID
+			}
+			got, err := gs.ByID(ctx, gallery.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.UserID != wantOwner {
+				t.Errorf("got owner %d, want %d", got.UserID, wantOwner)
+			}
+		})
+	}
+}
+
+func TestGalleryServiceSetDownloads(t *testing.T) {
+	ctx := context.Background()
+	tx := testDB.Tx(t)
+	gs := models.GalleryService{DB: tx}
+	bob := createUser(t, tx, "bob@example.com", "secret")
+	gallery, err := gs.Create(ctx, "Holidays", bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gallery.DownloadsDisabled {
+		t.Fatal("got downloads disabled, want them on by default")
+	}
+
+	for _, enabled := range []bool{false, true} {
+		err = gs.SetDownloads(ctx, gallery.ID, enabled)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := gs.ByID(ctx, gallery.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.DownloadsDisabled == enabled {
+			t.Errorf("got downloads disabled %t after setting enabled %t", got.DownloadsDisabled, enabled)
+		}
+	}
+
+	err = gs.SetDownloads(ctx, gallery.ID+1000, false)
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,330 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type Image struct {
+	ID          int
+	GalleryID   int
+	Filename    string
+	ContentType string
+	Size        int64
+	CreatedAt   time.Time
+	// Path is where the file is stored on disk
+	Path string
+	// Position orders the images of a gallery, new images go last
+	Position int
+	Caption  string
+	// Alt describes the image to those who can't see it
+	Alt string
+}
+
+// ImageDetails are what the owner of a gallery says about one of its images.
+type ImageDetails struct {
+	Filename string
+	Position int
+	Caption  string
+	Alt      string
+}
+
+// imageTypes are the content types, as detected by http.DetectContentType,
+// accepted for images. Browsers display all of them.
+var imageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// ImageFiles stores the image files on disk, in a directory per gallery under
+// Dir. It knows nothing about the database, the ImageService keeps track of
+// the files in the images table.
+type ImageFiles struct {
+	Dir string
+}
+
+// Path returns where the image of a gallery is stored.
+func (f ImageFiles) Path(galleryID int, filename string) string {
+	return filepath.Join(f.galleryDir(galleryID), filename)
+}
+
+func (f ImageFiles) galleryDir(galleryID int) string {
+	return filepath.Join(f.Dir, fmt.Sprintf("gallery-%d", galleryID))
+}
+
+// Save writes contents to the gallery directory, replacing the file with the
+// same name if there is one. Contents that aren't a JPEG, PNG, GIF or WebP
+// image are rejected with ErrNotImage. The file is written under a temporary
+// name and renamed once complete, so readers never see half of it.
+func (f ImageFiles) Save(ctx context.Context, galleryID int, filename string, contents io.Reader) (contentType string, size int64, err error) {
+	_, span := tracing.Start(ctx, "storage.save",
+		attribute.Int("gallery.id", galleryID))
+	defer func() { tracing.End(span, err) }()
+
+	// the temporary files start with a dot, so such names are not allowed
+	if filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") {
+		return "", 0, fmt.Errorf("save image: invalid filename %q", filename)
+	}
+
+	// DetectContentType looks at most at the first 512 bytes
+	head := make([]byte, 512)
+	n, err := io.ReadFull(contents, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", 0, fmt.Errorf("save image: %w", err)
+	}
+	head = head[:n]
+
+	contentType = http.DetectContentType(head)
+	if !imageTypes[contentType] {
+		return "", 0, ErrNotImage
+	}
+
+	dir := f.galleryDir(galleryID)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", 0, fmt.Errorf("save image: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return "", 0, fmt.Errorf("save image: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	size, err = io.Copy(tmp, io.MultiReader(bytes.NewReader(head), contents))
+	if err != nil {
+		return "", 0, fmt.Errorf("save image: %w", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return "", 0, fmt.Errorf("save image: %w", err)
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return "", 0, fmt.Errorf("save image: %w", err)
+	}
+	err = os.Rename(tmp.Name(), f.Path(galleryID, filename))
+	if err != nil {
+		return "", 0, fmt.Errorf("save image: %w", err)
+	}
+	span.SetAttributes(attribute.Int64("image.size", size))
+
+	return contentType, size, nil
+}
+
+// Remove deletes the file of an image. A file that is already gone is not an
+// error.
+func (f ImageFiles) Remove(ctx context.Context, galleryID int, filename string) (err error) {
+	_, span := tracing.Start(ctx, "storage.remove",
+		attribute.Int("gallery.id", galleryID))
+	defer func() { tracing.End(span, err) }()
+
+	if filename != filepath.Base(filename) {
+		return fmt.Errorf("remove image: invalid filename %q", filename)
+	}
+	err = os.Remove(f.Path(galleryID, filename))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove image: %w", err)
+	}
+
+	return nil
+}
+
+// RemoveGallery deletes the directory of a gallery with every file in it. A
+// gallery without images has no directory, which is not an error.
+func (f ImageFiles) RemoveGallery(ctx context.Context, galleryID int) (err error) {
+	_, span := tracing.Start(ctx, "storage.remove",
+		attribute.Int("gallery.id", galleryID))
+	defer func() { tracing.End(span, err) }()
+
+	err = os.RemoveAll(f.galleryDir(galleryID))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove gallery images: %w", err)
+	}
+
+	return nil
+}
+
+type ImageService struct {
+	DB    DBTX
+	Files ImageFiles
+	// QueryTimeout bounds the queries of each call. Defaults to
+	// DefaultQueryTimeout.
+	QueryTimeout time.Duration
+}
+
+// Create stores an image in a gallery. An image with the same filename is
+// replaced, so creating the same image twice leaves a single one.
+func (service *ImageService) Create(ctx context.Context, galleryID int, filename string, contents io.Reader) (*Image, error) {
+	contentType, size, err := service.Files.Save(ctx, galleryID, filename, contents)
+	if err != nil {
+		return nil, fmt.Errorf("create image: %w", err)
+	}
+
+	// the file is written before the row, so the query timeout only starts
+	// now. Should the insert fail, the file stays behind until an image with
+	// the same name replaces it or the gallery is deleted
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	image := Image{
+		GalleryID:   galleryID,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        size,
+		Path:        service.Files.Path(galleryID, filename),
+	}
+
+	// a replaced image keeps its place, caption and alt text
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		INSERT INTO images (gallery_id, filename, content_type, size, position)
+		VALUES ($1, $2, $3, $4,
+			(SELECT COALESCE(MAX(position), 0) + 1 FROM images WHERE gallery_id = $1))
+		ON CONFLICT (gallery_id, filename) DO UPDATE
+		SET content_type = EXCLUDED.content_type, size = EXCLUDED.size
+		RETURNING id, created_at, position, caption, alt;`,
+		galleryID, filename, contentType, size)
+
+	err = row.Scan(&image.ID, &image.CreatedAt, &image.Position, &image.Caption, &image.Alt)
+	if err != nil {
+		return nil, fmt.Errorf("create image: %w", err)
+	}
+
+	return &image, nil
+}
+
+// ByGalleryID returns the images of a gallery by position.
+func (service *ImageService) ByGalleryID(ctx context.Context, galleryID int) ([]Image, error) {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+		SELECT id, filename, content_type, size, created_at, position, caption, alt
+		FROM images
+		WHERE gallery_id = $1
+		ORDER BY position, id`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query images by gallery: %w", err)
+	}
+	defer rows.Close()
+
+	var images []Image
+	for rows.Next() {
+		image := Image{GalleryID: galleryID}
+
+		err := rows.Scan(&image.ID, &image.Filename, &image.ContentType,
+			&image.Size, &image.CreatedAt, &image.Position, &image.Caption, &image.Alt)
+		if err != nil {
+			return nil, fmt.Errorf("query images by gallery: %w", err)
+		}
+		image.Path = service.Files.Path(galleryID, image.Filename)
+
+		images = append(images, image)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query images by gallery: %w", err)
+	}
+
+	return images, nil
+}
+
+func (service *ImageService) ByFilename(ctx context.Context, galleryID int, filename string) (*Image, error) {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	image := Image{
+		GalleryID: galleryID,
+		Filename:  filename,
+		Path:      service.Files.Path(galleryID, filename),
+	}
+
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		SELECT id, content_type, size, created_at, position, caption, alt
+		FROM images
+		WHERE gallery_id = $1 AND filename = $2`, galleryID, filename)
+
+	err := row.Scan(&image.ID, &image.ContentType, &image.Size, &image.CreatedAt,
+		&image.Position, &image.Caption, &image.Alt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query image by filename: %w", err)
+	}
+
+	return &image, nil
+}
+
+// UpdateDetails sets the position, caption and alt text of images of a
+// gallery. An unknown filename is ErrNotFound, run it in a transaction for
+// none of the images to change then.
+func (service *ImageService) UpdateDetails(ctx context.Context, galleryID int, details []ImageDetails) error {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	for _, d := range details {
+		res, err := conn(ctx, service.DB).ExecContext(ctx, `
+			UPDATE images
+			SET position = $3, caption = $4, alt = $5
+			WHERE gallery_id = $1 AND filename = $2;`,
+			galleryID, d.Filename, d.Position, d.Caption, d.Alt)
+		if err != nil {
+			return fmt.Errorf("update image details: %w", err)
+		}
+		err = notFoundIfNone(res, "update image details")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes an image from a gallery, then its file. Should removing the
+// file fail, it stays behind like it does when Create fails, rather than
+// leaving a row without its file.
+func (service *ImageService) Delete(ctx context.Context, galleryID int, filename string) error {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	res, err := conn(ctx, service.DB).ExecContext(ctx, `
+		DELETE FROM images
+		WHERE gallery_id = $1 AND filename = $2;`, galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("delete image: %w", err)
+	}
+	err = notFoundIfNone(res, "delete image")
+	if err != nil {
+		return err
+	}
+
+	return service.Files.Remove(ctx, galleryID, filename)
+}
+
+// DeleteFiles removes the files of a gallery from disk. The rows go away with
+// the gallery, through ON DELETE CASCADE, so this is called once the gallery
+// is deleted. Calling it earlier, or from a transaction that is then rolled
+// back, would leave the images without their files.
+func (service *ImageService) DeleteFiles(ctx context.Context, galleryID int) error {
+	return service.Files.RemoveGallery(ctx, galleryID)
+}
@@ -0,0 +1,296 @@
+package models_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// pngImage returns the bytes of a w by h PNG image.
+func pngImage(t *testing.T, w, h int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestImageFilesSave(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		contents []byte
+		wantErr  bool
+	}{
+		{name: "png", filename: "cat.png", contents: pngImage(t, 4, 4)},
+		{name: "spaces", filename: "my cat.png", contents: pngImage(t, 4, 4)},
+		{name: "text", filename: "cat.png", contents: []byte("not an image"), wantErr: true},
+		{name: "html", filename: "cat.png", contents: []byte("<html><script></script></html>"), wantErr: true},
+		{name: "empty", filename: "cat.png", contents: nil, wantErr: true},
+		{name: "path", filename: "../cat.png", contents: pngImage(t, 4, 4), wantErr: true},
+		{name: "hidden", filename: ".cat.png", contents: pngImage(t, 4, 4), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := models.ImageFiles{Dir: t.TempDir()}
+
+			contentType, size, err := files.Save(context.Background(), 1, tt.filename,
+				bytes.NewReader(tt.contents))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				entries, _ := os.ReadDir(filepath.Join(files.Dir, "gallery-1"))
+				if len(entries) > 0 {
+					t.Errorf("files left behind: %v", entries)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if contentType != "image/png" || size != int64(len(tt.contents)) {
+				t.Errorf("got %s of %d bytes, want image/png of %d", contentType, size, len(tt.contents))
+			}
+			stored, err := os.ReadFile(files.Path(1, tt.filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(stored, tt.contents) {
+				t.Error("stored file differs from the contents")
+			}
+		})
+	}
+}
+
+func TestImageFilesSaveNotImage(t *testing.T) {
+	files := models.ImageFiles{Dir: t.TempDir()}
+
+	_, _, err := files.Save(context.Background(), 1, "notes.png", strings.NewReader("hello"))
+	if !errors.Is(err, models.ErrNotImage) {
+		t.Fatalf("got %v, want ErrNotImage", err)
+	}
+}
+
+func TestImageServiceCreate(t *testing.T) {
+	tx := testDB.Tx(t)
+	ctx := context.Background()
+	is := models.ImageService{DB: tx, Files: models.ImageFiles{Dir: t.TempDir()}}
+	gs := models.GalleryService{DB: tx}
+
+	bob := createUser(t, tx, "bob@example.com", "secret")
+	gallery, err := gs.Create(ctx, "Cats", bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := is.Create(ctx, gallery.ID, "cat.png", bytes.NewReader(pngImage(t, 4, 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same filename replaces the image, keeping its row
+	bigger := pngImage(t, 64, 64)
+	second, err := is.Create(ctx, gallery.ID, "cat.png", bytes.NewReader(bigger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != first.ID || second.Size != int64(len(bigger)) {
+		t.Errorf("got %+v, want image %d replaced with %d bytes", *second, first.ID, len(bigger))
+	}
+	if n := count(t, tx, "images", "gallery_id = $1", gallery.ID); n != 1 {
+		t.Errorf("got %d images, want 1", n)
+	}
+
+	got, err := is.ByFilename(ctx, gallery.ID, "cat.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ContentType != "image/png" || got.Path != is.Files.Path(gallery.ID, "cat.png") {
+		t.Errorf("got %+v", *got)
+	}
+
+	_, err = is.ByFilename(ctx, gallery.ID, "dog.png")
+	if err != models.ErrNotFound {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+}
+
+func TestImageServiceByGalleryID(t *testing.T) {
+	tx := testDB.Tx(t)
+	ctx := context.Background()
+	is := models.ImageService{DB: tx, Files: models.ImageFiles{Dir: t.TempDir()}}
+	gs := models.GalleryService{DB: tx}
+
+	bob := createUser(t, tx, "bob@example.com", "secret")
+	cats, err := gs.Create(ctx, "Cats", bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dogs, err := gs.Create(ctx, "Dogs", bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"b.png", "a.png"} {
+		_, err := is.Create(ctx, cats.ID, name, bytes.NewReader(pngImage(t, 4, 4)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	images, err := is.ByGalleryID(ctx, cats.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[0].Filename != "b.png" || images[1].Filename != "a.png" {
+		t.Errorf("got %+v, want b.png then a.png, in the order they were added", images)
+	}
+
+	images, err = is.ByGalleryID(ctx, dogs.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 0 {
+		t.Errorf("got %d images for an empty gallery", len(images))
+	}
+
+	// the rows go with the gallery, the files with DeleteFiles
+	err = gs.Delete(ctx, cats.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, tx, "images", "gallery_id = $1", cats.ID); n != 0 {
+		t.Errorf("got %d images left after deleting the gallery", n)
+	}
+	err = is.DeleteFiles(ctx, cats.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(is.Files.Path(cats.ID, "a.png"))
+	if !os.IsNotExist(err) {
+		t.Errorf("file still exists: %v", err)
+	}
+}
+
+func TestImageServiceDelete(t *testing.T) {
+	tx := testDB.Tx(t)
+	ctx := context.Background()
+	is := models.ImageService{DB: tx, Files: models.ImageFiles{Dir: t.TempDir()}}
+	gs := models.GalleryService{DB: tx}
+
+	bob := createUser(t, tx, "bob@example.com", "secret")
+	gallery, err := gs.Create(ctx, "Cats", bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.png", "b.png"} {
+		_, err := is.Create(ctx, gallery.ID, name, bytes.NewReader(pngImage(t, 4, 4)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = is.Delete(ctx, gallery.ID, "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := is.ByGalleryID(ctx, gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Filename != "b.png" {
+		t.Errorf("got %+v, want only b.png left", images)
+	}
+	_, err = os.Stat(is.Files.Path(gallery.ID, "a.png"))
+	if !os.IsNotExist(err) {
+		t.Errorf("file still exists: %v", err)
+	}
+
+	err = is.Delete(ctx, gallery.ID, "a.png")
+	if err != models.ErrNotFound {
+		t.Errorf("deleting twice: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestImageServiceUpdateDetails(t *testing.T) {
+	tx := testDB.Tx(t)
+	ctx := context.Background()
+	is := models.ImageService{DB: tx, Files: models.ImageFiles{Dir: t.TempDir()}}
+	gs := models.GalleryService{DB: tx}
+
+	bob := createUser(t, tx, "bob@example.com", "secret")
+	gallery, err := gs.Create(ctx, "Cats", bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"a.png", "b.png"} {
+		image, err := is.Create(ctx, gallery.ID, name, bytes.NewReader(pngImage(t, 4, 4)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if image.Position != i+1 {
+			t.Errorf("%s: got position %d, want %d", name, image.Position, i+1)
+		}
+	}
+
+	err = is.UpdateDetails(ctx, gallery.ID, []models.ImageDetails{
+		{Filename: "b.png", Position: 1, Caption: "Bob's cat", Alt: "A grey cat asleep"},
+		{Filename: "a.png", Position: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// replacing an image keeps its details
+	_, err = is.Create(ctx, gallery.ID, "b.png", bytes.NewReader(pngImage(t, 8, 8)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := is.ByGalleryID(ctx, gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[0].Filename != "b.png" || images[0].Caption != "Bob's cat" ||
+		images[0].Alt != "A grey cat asleep" || images[1].Filename != "a.png" {
+		t.Errorf("got %+v, want b.png with its details then a.png", images)
+	}
+
+	err = is.UpdateDetails(ctx, gallery.ID, []models.ImageDetails{{Filename: "c.png", Position: 3}})
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+
+	// the cover goes with its image
+	err = gs.SetCover(ctx, gallery.ID, "c.png")
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+	err = gs.SetCover(ctx, gallery.ID, "b.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gs.ByID(ctx, gallery.ID)
+	if err != nil || got.Cover != "b.png" {
+		t.Errorf("got cover %q, %v, want b.png", got.Cover, err)
+	}
+	err = is.Delete(ctx, gallery.ID, "b.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = gs.ByID(ctx, gallery.ID)
+	if err != nil || got.Cover != "" {
+		t.Errorf("got cover %q, %v, want none", got.Cover, err)
+	}
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Impersonation is an entry of the audit trail kept when admins act as other
+// users.
+type Impersonation struct {
+	ID int
+	// AdminID and UserID are 0 once the account is deleted, the emails stay
+	AdminID    int
+	AdminEmail string
+	UserID     int
+	UserEmail  string
+	// Reason is why the admin needed to impersonate the user, e.g. a support
+	// ticket
+	Reason    string
+	StartedAt time.Time
+	// EndedAt is nil while the impersonation goes on
+	EndedAt *time.Time
+}
+
+type ImpersonationService struct {
+	DB DBTX
+	// QueryTimeout bounds the queries of each call. Defaults to
+	// DefaultQueryTimeout.
+	QueryTimeout time.Duration
+}
+
+// Start records that admin started impersonating user.
+func (service *ImpersonationService) Start(ctx context.Context, admin, user *User, reason string) (*Impersonation, error) {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	impersonation := Impersonation{
+		AdminID:    admin.ID,
+		AdminEmail: admin.Email,
+		UserID:     user.ID,
+		UserEmail:  user.Email,
+		Reason:     reason,
+	}
+
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		INSERT INTO impersonations (admin_id, admin_email, user_id, user_email, reason)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, started_at;`,
+		admin.ID, admin.Email, user.ID, user.Email, reason)
+
+	err := row.Scan(&impersonation.ID, &impersonation.StartedAt)
+	if err != nil {
+		return nil, fmt.Errorf("start impersonation: %w", err)
+	}
+
+	return &impersonation, nil
+}
+
+// End records that the admin stopped impersonating whoever they were.
+func (service *ImpersonationService) End(ctx context.Context, adminID int) error {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	_, err := conn(ctx, service.DB).ExecContext(ctx, `
+		UPDATE impersonations
+		SET ended_at = now()
+		WHERE admin_id = $1 AND ended_at IS NULL;`, adminID)
+	if err != nil {
+		return fmt.Errorf("end impersonation: %w", err)
+	}
+
+	return nil
+}
+
+// List returns up to limit impersonations, the latest first, skipping the
+// first offset.
+func (service *ImpersonationService) List(ctx context.Context, limit, offset int) ([]Impersonation, error) {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+		SELECT id, COALESCE(admin_id, 0), admin_email, COALESCE(user_id, 0),
+			user_email, reason, started_at, ended_at
+		FROM impersonations
+		ORDER BY started_at DESC, id DESC
+		LIMIT $1 OFFSET $2;`, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("list impersonations: %w", err)
+	}
+	defer rows.Close()
+
+	var impersonations []Impersonation
+	for rows.Next() {
+		var i Impersonation
+		err := rows.Scan(&i.ID, &i.AdminID, &i.AdminEmail, &i.UserID,
+			&i.UserEmail, &i.Reason, &i.StartedAt, &i.EndedAt)
+		if err != nil {
+			return nil, fmt.Errorf("list impersonations: %w", err)
+		}
+		impersonations = append(impersonations, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list impersonations: %w", err)
+	}
+
+	return impersonations, nil
+}
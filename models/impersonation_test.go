@@ -0,0 +1,220 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+func TestUserServiceSetRole(t *testing.T) {
+	ctx := context.Background()
+	tx := testDB.Tx(t)
+	us := models.UserService{DB: tx}
+	bob := createUser(t, tx, "bob@example.com", "secret")
+
+	if bob.Role != models.RoleUser {
+		t.Errorf("new user has role %q, want %q", bob.Role, models.RoleUser)
+	}
+
+	err := us.SetRole(ctx, bob.ID, models.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := us.ByEmail(ctx, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Role != models.RoleAdmin {
+		t.Errorf("got role %q, want %q", got.Role, models.RoleAdmin)
+	}
+
+	err = us.SetRole(ctx, bob.ID+1000, models.RoleAdmin)
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("unknown user: got error %v, want %v", err, models.ErrNotFound)
+	}
+}
+
+func TestUserServiceSearch(t *testing.T) {
+	tx := testDB.Tx(t)
+	us := models.UserService{DB: tx}
+	for _, email := range []string{"ann@example.com", "bob@example.com", "bobby@test.com", "50%@example.com"} {
+		createUser(t, tx, email, "secret")
+	}
+
+	tests := []struct {
+		query      string
+		wantEmails []string
+	}{
+		{query: "BOB", wantEmails: []string{"bob@example.com", "bobby@test.com"}},
+		{query: "test.com", wantEmails: []string{"bobby@test.com"}},
+		// no LIKE wildcards
+		{query: "%", wantEmails: []string{"50%@example.com"}},
+		{query: "carol"},
+	}
+	for _, tt := range tests {
+		users, err := us.Search(context.Background(), tt.query, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var emails []string
+		for _, user := range users {
+			emails = append(emails, user.Email)
+		}
+		if strings.Join(emails, ",") != strings.Join(tt.wantEmails, ",") {
+			t.Errorf("search %q: got %v, want %v", tt.query, emails, tt.wantEmails)
+		}
+	}
+}
+
+func TestGalleryServiceSetHidden(t *testing.T) {
+	ctx := context.Background()
+	tx := testDB.Tx(t)
+	gs := models.GalleryService{DB: tx}
+	bob := createUser(t, tx, "bob@example.com", "secret")
+	gallery, err := gs.Create(ctx, "Cats", bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = gs.SetHidden(ctx, gallery.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hidden, err := gs.ByID(ctx, gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hidden.HiddenAt == nil {
+		t.Fatal("gallery is not hidden")
+	}
+
+	// hiding again keeps the first time
+	err = gs.SetHidden(ctx, gallery.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := gs.ByID(ctx, gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.HiddenAt == nil || !again.HiddenAt.Equal(*hidden.HiddenAt) {
+		t.Errorf("got hidden at %v, want %v", again.HiddenAt, hidden.HiddenAt)
+	}
+
+	err = gs.SetHidden(ctx, gallery.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shown, err := gs.ByID(ctx, gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shown.HiddenAt != nil {
+		t.Errorf("gallery still hidden at %v", shown.HiddenAt)
+	}
+
+	err = gs.SetHidden(ctx, gallery.ID+1000, true)
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("unknown gallery: got error %v, want %v", err, models.ErrNotFound)
+	}
+}
+
+func TestSessionServiceImpersonate(t *testing.T) {
+	ctx := context.Background()
+	tx := testDB.Tx(t)
+	ss := models.SessionService{DB: tx}
+	us := models.UserService{DB: tx}
+	admin := createUser(t, tx, "admin@example.com", "secret")
+	bob := createUser(t, tx, "bob@example.com", "secret")
+	session, err := ss.Create(ctx, admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ss.Impersonate(ctx, session.Token, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := ss.User(ctx, session.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != bob.ID || user.Impersonator == nil || user.Impersonator.ID != admin.ID {
+		t.Fatalf("got %+v, want bob impersonated by the admin", user)
+	}
+
+	// the admin may look at a disabled account
+	err = us.Disable(ctx, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ss.User(ctx, session.Token)
+	if err != nil {
+		t.Errorf("impersonating a disabled user: %v", err)
+	}
+
+	err = ss.StopImpersonating(ctx, session.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = ss.User(ctx, session.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != admin.ID || user.Impersonator != nil {
+		t.Errorf("got %+v, want the admin back", user)
+	}
+
+	err = ss.Impersonate(ctx, "unknown", bob.ID)
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("unknown session: got error %v, want %v", err, models.ErrNotFound)
+	}
+}
+
+func TestImpersonationService(t *testing.T) {
+	ctx := context.Background()
+	tx := testDB.Tx(t)
+	is := models.ImpersonationService{DB: tx}
+	us := models.UserService{DB: tx}
+	admin := createUser(t, tx, "admin@example.com", "secret")
+	bob := createUser(t, tx, "bob@example.com", "secret")
+	alice := createUser(t, tx, "alice@example.com", "secret")
+
+	_, err := is.Start(ctx, admin, bob, "ticket #1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = is.End(ctx, admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = is.Start(ctx, admin, alice, "ticket #2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trail, err := is.List(ctx, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trail) != 2 || trail[0].UserEmail != "alice@example.com" || trail[0].EndedAt != nil ||
+		trail[1].UserEmail != "bob@example.com" || trail[1].EndedAt == nil {
+		t.Fatalf("got %+v, want alice's ongoing then bob's ended", trail)
+	}
+
+	// the trail outlives the accounts
+	err = us.Delete(ctx, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trail, err = is.List(ctx, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trail) != 2 || trail[1].UserID != 0 || trail[1].UserEmail != "bob@example.com" {
+		t.Errorf("got %+v, want bob's entry kept without its id", trail[1])
+	}
+}
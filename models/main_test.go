@@ -0,0 +1,44 @@
+package models_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/models/pgtest"
+)
+
+var testDB *pgtest.DB
+
+func TestMain(m *testing.M) {
+	os.Exit(pgtest.Main(m, &testDB))
+}
+
+// createUser inserts a user the tests can hang sessions, resets and galleries
+// from.
+func createUser(t *testing.T, tx *sql.Tx, email, password string) *models.User {
+	t.Helper()
+
+	us := models.UserService{DB: tx}
+	user, err := us.Create(context.Background(), email, password)
+	if err != nil {
+		t.Fatalf("create user %s: %v", email, err)
+	}
+
+	return user
+}
+
+// count returns the number of rows in table matching the where clause.
+func count(t *testing.T, tx *sql.Tx, table, where string, args ...any) int {
+	t.Helper()
+
+	var n int
+	err := tx.QueryRow("SELECT count(*) FROM "+table+" WHERE "+where, args...).Scan(&n)
+	if err != nil {
+		t.Fatalf("count %s: %v", table, err)
+	}
+
+	return n
+}
@@ -0,0 +1,133 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/rand"
+)
+
+type APITokenService struct {
+	Store *Store
+	// BytesPerToken works like models.APITokenService.BytesPerToken.
+	BytesPerToken int
+	// Now returns the current time and can be replaced to test expiration.
+	// Defaults to time.Now.
+	Now func() time.Time
+}
+
+func (ts *APITokenService) now() time.Time {
+	if ts.Now == nil {
+		return time.Now()
+	}
+	return ts.Now()
+}
+
+func (ts *APITokenService) Create(ctx context.Context, userID int, name string, scopes []models.Scope, expiresAt *time.Time) (*models.APIToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("create api token: %w", err)
+	}
+
+	bytesPerToken := ts.BytesPerToken
+	if bytesPerToken < models.MinBytesPerToken {
+		bytesPerToken = models.MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create api token: %w", err)
+	}
+
+	ts.Store.mu.Lock()
+	defer ts.Store.mu.Unlock()
+
+	if _, ok := ts.Store.users[userID]; !ok {
+		return nil, fmt.Errorf("create api token: %w",
+			foreignKeyViolation("api_tokens_user_id_fkey"))
+	}
+
+	t := models.APIToken{
+		ID:        ts.Store.nextID("api_tokens"),
+		UserID:    userID,
+		Name:      name,
+		Scopes:    slices.Clone(scopes),
+		Token:     models.APITokenPrefix + token,
+		CreatedAt: ts.now(),
+		ExpiresAt: expiresAt,
+	}
+	t.TokenHash = hash(t.Token)
+
+	stored := t
+	stored.Token = ""
+	ts.Store.apiTokens[t.ID] = stored
+
+	return &t, nil
+}
+
+func (ts *APITokenService) ByUserID(ctx context.Context, userID int) ([]models.APIToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("query api tokens by user: %w", err)
+	}
+
+	ts.Store.mu.Lock()
+	defer ts.Store.mu.Unlock()
+
+	var tokens []models.APIToken
+	for _, t := range ts.Store.apiTokens {
+		if t.UserID == userID {
+			tokens = append(tokens, t)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].ID > tokens[j].ID
+	})
+
+	return tokens, nil
+}
+
+func (ts *APITokenService) User(ctx context.Context, token string) (*models.User, *models.APIToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, fmt.Errorf("api token user: %w", err)
+	}
+	tokenHash := hash(token)
+	now := ts.now()
+
+	ts.Store.mu.Lock()
+	defer ts.Store.mu.Unlock()
+
+	for id, t := range ts.Store.apiTokens {
+		if t.TokenHash != tokenHash || t.Expired(now) {
+			continue
+		}
+		user := ts.Store.users[t.UserID]
+		if user.DisabledAt != nil {
+			break
+		}
+		t.LastUsedAt = &now
+		ts.Store.apiTokens[id] = t
+
+		return &user, &t, nil
+	}
+
+	return nil, nil, models.ErrNotFound
+}
+
+func (ts *APITokenService) Revoke(ctx context.Context, userID, id int) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("revoke api token: %w", err)
+	}
+
+	ts.Store.mu.Lock()
+	defer ts.Store.mu.Unlock()
+
+	t, ok := ts.Store.apiTokens[id]
+	if !ok || t.UserID != userID {
+		return models.ErrNotFound
+	}
+	delete(ts.Store.apiTokens, id)
+
+	return nil
+}
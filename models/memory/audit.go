@@ -0,0 +1,56 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+type AuditService struct {
+	Store *Store
+}
+
+func (as *AuditService) Record(ctx context.Context, event models.AuditEvent) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("record audit event: %w", err)
+	}
+
+	as.Store.mu.Lock()
+	defer as.Store.mu.Unlock()
+
+	event.ID = int64(as.Store.nextID("audit_events"))
+	event.CreatedAt = time.Now()
+	as.Store.auditEvents = append(as.Store.auditEvents, event)
+
+	return nil
+}
+
+// List returns the latest first, like the Postgres version ordering by id.
+func (as *AuditService) List(ctx context.Context, filter models.AuditFilter, limit, offset int) ([]models.AuditEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("list audit events: %w", err)
+	}
+
+	as.Store.mu.Lock()
+	defer as.Store.mu.Unlock()
+
+	var events []models.AuditEvent
+	for i := len(as.Store.auditEvents) - 1; i >= 0; i-- {
+		e := as.Store.auditEvents[i]
+		switch {
+		case filter.UserID != 0 && e.UserID != filter.UserID,
+			filter.Email != "" && !strings.Contains(strings.ToLower(e.Email), strings.ToLower(filter.Email)),
+			filter.Type != "" && e.Type != filter.Type,
+			filter.IP != "" && e.IP != filter.IP,
+			!filter.Since.IsZero() && e.CreatedAt.Before(filter.Since),
+			!filter.Until.IsZero() && !e.CreatedAt.Before(filter.Until):
+			continue
+		}
+		events = append(events, e)
+	}
+
+	return page(events, limit, offset), nil
+}
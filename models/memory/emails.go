@@ -0,0 +1,54 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// EmailService keeps the emails it is asked to send in an outbox instead of
+// sending them, so tests can read password reset links.
+type EmailService struct {
+	mu     sync.Mutex
+	outbox []models.Email
+}
+
+func (es *EmailService) Send(ctx context.Context, email models.Email) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if email.From == "" {
+		email.From = models.DefaultSender
+	}
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.outbox = append(es.outbox, email)
+
+	return nil
+}
+
+func (es *EmailService) ForgotPassword(ctx context.Context, to, resetURL string) error {
+	email := models.Email{
+		Subject:   "Reset your password",
+		To:        to,
+		Plaintext: "To reset your password, please visit the following link: " + resetURL,
+	}
+
+	err := es.Send(ctx, email)
+	if err != nil {
+		return fmt.Errorf("forgot password email: %w", err)
+	}
+
+	return nil
+}
+
+// Outbox returns a copy of every email sent so far.
+func (es *EmailService) Outbox() []models.Email {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	return append([]models.Email(nil), es.outbox...)
+}
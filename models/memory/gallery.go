@@ -0,0 +1,229 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+type GalleryService struct {
+	Store *Store
+}
+
+func (gs *GalleryService) Create(ctx context.Context, title string, userID int) (*models.Gallery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("create gallery: %w", err)
+	}
+
+	gs.Store.mu.Lock()
+	defer gs.Store.mu.Unlock()
+
+	if _, ok := gs.Store.users[userID]; !ok {
+		return nil, fmt.Errorf("create gallery: %w",
+			foreignKeyViolation("galleries_user_id_fkey"))
+	}
+
+	gallery := models.Gallery{
+		ID:     gs.Store.nextID("galleries"),
+		UserID: userID,
+		Title:  title,
+	}
+	gs.Store.galleries[gallery.ID] = gallery
+
+	return &gallery, nil
+}
+
+func (gs *GalleryService) ByID(ctx context.Context, id int) (*models.Gallery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("query gallery by id: %w", err)
+	}
+
+	gs.Store.mu.Lock()
+	defer gs.Store.mu.Unlock()
+
+	gallery, ok := gs.Store.galleries[id]
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+
+	return &gallery, nil
+}
+
+// ByUserID returns the galleries ordered by id, the order Postgres returns
+// them in practice.
+func (gs *GalleryService) ByUserID(ctx context.Context, userID int) ([]models.Gallery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("query galleries by user: %w", err)
+	}
+
+	gs.Store.mu.Lock()
+	defer gs.Store.mu.Unlock()
+
+	var galleries []models.Gallery
+	for _, g := range gs.Store.galleries {
+		if g.UserID == userID {
+			galleries = append(galleries, g)
+		}
+	}
+	sort.Slice(galleries, func(i, j int) bool {
+		return galleries[i].ID < galleries[j].ID
+	})
+
+	return galleries, nil
+}
+
+func (gs *GalleryService) Update(ctx context.Context, gallery *models.Gallery) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("update gallery: %w", err)
+	}
+
+	gs.Store.mu.Lock()
+	defer gs.Store.mu.Unlock()
+
+	stored, ok := gs.Store.galleries[gallery.ID]
+	if !ok {
+		return nil
+	}
+	stored.Title = gallery.Title
+	stored.Description = gallery.Description
+	gs.Store.galleries[gallery.ID] = stored
+
+	return nil
+}
+
+func (gs *GalleryService) Delete(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("delete gallery by id: %w", err)
+	}
+
+	gs.Store.mu.Lock()
+	defer gs.Store.mu.Unlock()
+
+	delete(gs.Store.galleries, id)
+	// images.gallery_id and uploads.gallery_id have ON DELETE CASCADE
+	for iid, image := range gs.Store.images {
+		if image.GalleryID == id {
+			delete(gs.Store.images, iid)
+		}
+	}
+	for uid, u := range gs.Store.uploads {
+		if u.GalleryID == id {
+			delete(gs.Store.uploads, uid)
+		}
+	}
+
+	return nil
+}
+
+func (gs *GalleryService) Transfer(ctx context.Context, id, toUserID int) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("transfer gallery: %w", err)
+	}
+
+	gs.Store.mu.Lock()
+	defer gs.Store.mu.Unlock()
+
+	gallery, ok := gs.Store.galleries[id]
+	if !ok {
+		return models.ErrNotFound
+	}
+	if _, ok := gs.Store.users[toUserID]; !ok {
+		return fmt.Errorf("transfer gallery: %w",
+			foreignKeyViolation("galleries_user_id_fkey"))
+	}
+	gallery.UserID = toUserID
+	gs.Store.galleries[id] = gallery
+
+	return nil
+}
+
+func (gs *GalleryService) Search(ctx context.Context, query string, limit, offset int) ([]models.Gallery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("search galleries: %w", err)
+	}
+	query = strings.ToLower(query)
+
+	gs.Store.mu.Lock()
+	defer gs.Store.mu.Unlock()
+
+	var galleries []models.Gallery
+	for _, g := range gs.Store.galleries {
+		if strings.Contains(strings.ToLower(g.Title), query) {
+			galleries = append(galleries, g)
+		}
+	}
+	sort.Slice(galleries, func(i, j int) bool {
+		return galleries[i].ID < galleries[j].ID
+	})
+
+	return page(galleries, limit, offset), nil
+}
+
+func (gs *GalleryService) SetHidden(ctx context.Context, id int, hidden bool) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("set gallery hidden: %w", err)
+	}
+
+	gs.Store.mu.Lock()
+	defer gs.Store.mu.Unlock()
+
+	gallery, ok := gs.Store.galleries[id]
+	if !ok {
+		return models.ErrNotFound
+	}
+	switch {
+	case !hidden:
+		gallery.HiddenAt = nil
+	case gallery.HiddenAt == nil:
+		now := time.Now()
+		gallery.HiddenAt = &now
+	}
+	gs.Store.galleries[id] = gallery
+
+	return nil
+}
+
+func (gs *GalleryService) SetDownloads(ctx context.Context, id int, enabled bool) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("set gallery downloads: %w", err)
+	}
+
+	gs.Store.mu.Lock()
+	defer gs.Store.mu.Unlock()
+
+	gallery, ok := gs.Store.galleries[id]
+	if !ok {
+		return models.ErrNotFound
+	}
+	gallery.DownloadsDisabled = !enabled
+	gs.Store.galleries[id] = gallery
+
+	return nil
+}
+
+func (gs *GalleryService) SetCover(ctx context.Context, id int, filename string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("set gallery cover: %w", err)
+	}
+
+	gs.Store.mu.Lock()
+	defer gs.Store.mu.Unlock()
+
+	gallery, ok := gs.Store.galleries[id]
+	if !ok {
+		return models.ErrNotFound
+	}
+	if filename != "" {
+		if _, ok := gs.Store.imageByFilename(id, filename); !ok {
+			return models.ErrNotFound
+		}
+	}
+	gallery.Cover = filename
+	gs.Store.galleries[id] = gallery
+
+	return nil
+}
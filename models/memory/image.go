@@ -0,0 +1,167 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// ImageService keeps the rows in memory but writes the files to disk with
+// models.ImageFiles, like the Postgres service does. Tests point Files.Dir at
+// a temporary directory.
+type ImageService struct {
+	Store *Store
+	Files models.ImageFiles
+}
+
+func (is *ImageService) Create(ctx context.Context, galleryID int, filename string, contents io.Reader) (*models.Image, error) {
+	contentType, size, err := is.Files.Save(ctx, galleryID, filename, contents)
+	if err != nil {
+		return nil, fmt.Errorf("create image: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("create image: %w", err)
+	}
+
+	is.Store.mu.Lock()
+	defer is.Store.mu.Unlock()
+
+	if _, ok := is.Store.galleries[galleryID]; !ok {
+		return nil, fmt.Errorf("create image: %w",
+			foreignKeyViolation("images_gallery_id_fkey"))
+	}
+
+	image := models.Image{
+		GalleryID:   galleryID,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        size,
+		Path:        is.Files.Path(galleryID, filename),
+	}
+	// ON CONFLICT (gallery_id, filename) keeps the id, created_at and the
+	// details, new images go last
+	if existing, ok := is.Store.imageByFilename(galleryID, filename); ok {
+		image.ID = existing.ID
+		image.CreatedAt = existing.CreatedAt
+		image.Position = existing.Position
+		image.Caption = existing.Caption
+		image.Alt = existing.Alt
+	} else {
+		image.ID = is.Store.nextID("images")
+		image.CreatedAt = time.Now()
+		for _, other := range is.Store.images {
+			if other.GalleryID == galleryID {
+				image.Position = max(image.Position, other.Position)
+			}
+		}
+		image.Position++
+	}
+	is.Store.images[image.ID] = image
+
+	return &image, nil
+}
+
+func (is *ImageService) ByGalleryID(ctx context.Context, galleryID int) ([]models.Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("query images by gallery: %w", err)
+	}
+
+	is.Store.mu.Lock()
+	defer is.Store.mu.Unlock()
+
+	var images []models.Image
+	for _, image := range is.Store.images {
+		if image.GalleryID == galleryID {
+			images = append(images, image)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Position != images[j].Position {
+			return images[i].Position < images[j].Position
+		}
+		return images[i].ID < images[j].ID
+	})
+
+	return images, nil
+}
+
+func (is *ImageService) ByFilename(ctx context.Context, galleryID int, filename string) (*models.Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("query image by filename: %w", err)
+	}
+
+	is.Store.mu.Lock()
+	defer is.Store.mu.Unlock()
+
+	image, ok := is.Store.imageByFilename(galleryID, filename)
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+
+	return &image, nil
+}
+
+func (is *ImageService) UpdateDetails(ctx context.Context, galleryID int, details []models.ImageDetails) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("update image details: %w", err)
+	}
+
+	is.Store.mu.Lock()
+	defer is.Store.mu.Unlock()
+
+	for _, d := range details {
+		image, ok := is.Store.imageByFilename(galleryID, d.Filename)
+		if !ok {
+			return models.ErrNotFound
+		}
+		image.Position = d.Position
+		image.Caption = d.Caption
+		image.Alt = d.Alt
+		is.Store.images[image.ID] = image
+	}
+
+	return nil
+}
+
+func (is *ImageService) Delete(ctx context.Context, galleryID int, filename string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("delete image: %w", err)
+	}
+
+	is.Store.mu.Lock()
+	image, ok := is.Store.imageByFilename(galleryID, filename)
+	if ok {
+		delete(is.Store.images, image.ID)
+		// ON DELETE SET NULL of galleries.cover_image_id
+		if gallery := is.Store.galleries[galleryID]; gallery.Cover == filename {
+			gallery.Cover = ""
+			is.Store.galleries[galleryID] = gallery
+		}
+	}
+	is.Store.mu.Unlock()
+	if !ok {
+		return models.ErrNotFound
+	}
+
+	return is.Files.Remove(ctx, galleryID, filename)
+}
+
+func (is *ImageService) DeleteFiles(ctx context.Context, galleryID int) error {
+	return is.Files.RemoveGallery(ctx, galleryID)
+}
+
+// imageByFilename looks up an image by its unique key. The caller must hold
+// the lock.
+func (s *Store) imageByFilename(galleryID int, filename string) (models.Image, bool) {
+	for _, image := range s.images {
+		if image.GalleryID == galleryID && image.Filename == filename {
+			return image, true
+		}
+	}
+
+	return models.Image{}, false
+}
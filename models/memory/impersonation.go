@@ -0,0 +1,69 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+type ImpersonationService struct {
+	Store *Store
+}
+
+func (is *ImpersonationService) Start(ctx context.Context, admin, user *models.User, reason string) (*models.Impersonation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("start impersonation: %w", err)
+	}
+
+	is.Store.mu.Lock()
+	defer is.Store.mu.Unlock()
+
+	impersonation := models.Impersonation{
+		ID:         is.Store.nextID("impersonations"),
+		AdminID:    admin.ID,
+		AdminEmail: admin.Email,
+		UserID:     user.ID,
+		UserEmail:  user.Email,
+		Reason:     reason,
+		StartedAt:  time.Now(),
+	}
+	is.Store.impersonations = append(is.Store.impersonations, impersonation)
+
+	return &impersonation, nil
+}
+
+func (is *ImpersonationService) End(ctx context.Context, adminID int) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("end impersonation: %w", err)
+	}
+
+	is.Store.mu.Lock()
+	defer is.Store.mu.Unlock()
+
+	now := time.Now()
+	for i, impersonation := range is.Store.impersonations {
+		if impersonation.AdminID == adminID && impersonation.EndedAt == nil {
+			is.Store.impersonations[i].EndedAt = &now
+		}
+	}
+
+	return nil
+}
+
+// List returns the latest first, the ids break ties like in Postgres.
+func (is *ImpersonationService) List(ctx context.Context, limit, offset int) ([]models.Impersonation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("list impersonations: %w", err)
+	}
+
+	is.Store.mu.Lock()
+	defer is.Store.mu.Unlock()
+
+	impersonations := slices.Clone(is.Store.impersonations)
+	slices.Reverse(impersonations)
+
+	return page(impersonations, limit, offset), nil
+}
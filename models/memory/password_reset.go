@@ -0,0 +1,111 @@
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/rand"
+)
+
+type PasswordResetService struct {
+	Store *Store
+	// BytesPerToken and Duration work like the fields of
+	// models.PasswordResetService.
+	BytesPerToken int
+	Duration      time.Duration
+	// Now returns the current time and can be replaced to test expiration.
+	// Defaults to time.Now.
+	Now func() time.Time
+}
+
+func (prs *PasswordResetService) now() time.Time {
+	if prs.Now == nil {
+		return time.Now()
+	}
+	return prs.Now()
+}
+
+func (prs *PasswordResetService) Create(ctx context.Context, email string) (*models.PasswordReset, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+	email = strings.ToLower(email)
+
+	bytesPerToken := prs.BytesPerToken
+	if bytesPerToken == 0 {
+		bytesPerToken = models.MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	duration := prs.Duration
+	if duration == 0 {
+		duration = models.DefaultResetDuration
+	}
+
+	prs.Store.mu.Lock()
+	defer prs.Store.mu.Unlock()
+
+	userID := 0
+	for _, u := range prs.Store.users {
+		if u.Email == email {
+			userID = u.ID
+		}
+	}
+	if userID == 0 {
+		return nil, fmt.Errorf("create: %w", sql.ErrNoRows)
+	}
+
+	pwReset := models.PasswordReset{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: hash(token),
+		ExpiresAt: prs.now().Add(duration),
+	}
+
+	// password_resets.user_id is unique, a new reset replaces the old one
+	for id, r := range prs.Store.resets {
+		if r.UserID == userID {
+			pwReset.ID = id
+		}
+	}
+	if pwReset.ID == 0 {
+		pwReset.ID = prs.Store.nextID("password_resets")
+	}
+
+	stored := pwReset
+	stored.Token = ""
+	prs.Store.resets[pwReset.ID] = stored
+
+	return &pwReset, nil
+}
+
+func (prs *PasswordResetService) Consume(ctx context.Context, token string) (*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("consume get token: %w", err)
+	}
+	tokenHash := hash(token)
+
+	prs.Store.mu.Lock()
+	defer prs.Store.mu.Unlock()
+
+	for id, r := range prs.Store.resets {
+		if r.TokenHash != tokenHash {
+			continue
+		}
+		if prs.now().After(r.ExpiresAt) {
+			return nil, fmt.Errorf("token expired: %v", token)
+		}
+		delete(prs.Store.resets, id)
+		user := prs.Store.users[r.UserID]
+		return &user, nil
+	}
+
+	return nil, fmt.Errorf("consume get token: %w", sql.ErrNoRows)
+}
@@ -0,0 +1,169 @@
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/rand"
+)
+
+type SessionService struct {
+	Store *Store
+	// BytesPerToken works like models.SessionService.BytesPerToken.
+	BytesPerToken int
+}
+
+// Create replaces the user's session, as sessions.user_id is unique and the
+// Postgres implementation upserts it.
+func (ss *SessionService) Create(ctx context.Context, userID int) (*models.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("error creating session token: %w", err)
+	}
+
+	bytesPerToken := ss.BytesPerToken
+	if bytesPerToken < models.MinBytesPerToken {
+		bytesPerToken = models.MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("error creating session token: %w", err)
+	}
+
+	ss.Store.mu.Lock()
+	defer ss.Store.mu.Unlock()
+
+	if _, ok := ss.Store.users[userID]; !ok {
+		return nil, fmt.Errorf("error creating session token: %w",
+			foreignKeyViolation("sessions_user_id_fkey"))
+	}
+
+	session := models.Session{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: hash(token),
+	}
+
+	// ON CONFLICT (user_id) DO UPDATE keeps the id of the existing row
+	for id, s := range ss.Store.sessions {
+		if s.UserID == userID {
+			session.ID = id
+		}
+	}
+	if session.ID == 0 {
+		session.ID = ss.Store.nextID("sessions")
+	}
+
+	stored := session
+	stored.Token = ""
+	ss.Store.sessions[session.ID] = stored
+
+	return &session, nil
+}
+
+func (ss *SessionService) User(ctx context.Context, token string) (*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("user: error getting user %w", err)
+	}
+	tokenHash := hash(token)
+
+	ss.Store.mu.Lock()
+	defer ss.Store.mu.Unlock()
+
+	for _, s := range ss.Store.sessions {
+		if s.TokenHash == tokenHash {
+			user := ss.Store.users[s.UserID]
+			if user.DisabledAt != nil {
+				break
+			}
+			if s.ImpersonatedUserID != 0 {
+				admin := user
+				user = ss.Store.users[s.ImpersonatedUserID]
+				user.DisabledAt = nil
+				user.Impersonator = &admin
+			}
+			return &user, nil
+		}
+	}
+
+	return nil, fmt.Errorf("user: error getting user %w", sql.ErrNoRows)
+}
+
+func (ss *SessionService) Impersonate(ctx context.Context, token string, userID int) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("impersonate: %w", err)
+	}
+	tokenHash := hash(token)
+
+	ss.Store.mu.Lock()
+	defer ss.Store.mu.Unlock()
+
+	if _, ok := ss.Store.users[userID]; !ok {
+		return fmt.Errorf("impersonate: %w",
+			foreignKeyViolation("sessions_impersonated_user_id_fkey"))
+	}
+	for id, s := range ss.Store.sessions {
+		if s.TokenHash == tokenHash {
+			s.ImpersonatedUserID = userID
+			ss.Store.sessions[id] = s
+			return nil
+		}
+	}
+
+	return models.ErrNotFound
+}
+
+func (ss *SessionService) StopImpersonating(ctx context.Context, token string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("stop impersonating: %w", err)
+	}
+	tokenHash := hash(token)
+
+	ss.Store.mu.Lock()
+	defer ss.Store.mu.Unlock()
+
+	for id, s := range ss.Store.sessions {
+		if s.TokenHash == tokenHash {
+			s.ImpersonatedUserID = 0
+			ss.Store.sessions[id] = s
+		}
+	}
+
+	return nil
+}
+
+func (ss *SessionService) Delete(ctx context.Context, token string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("error deleting a session token: %w", err)
+	}
+	tokenHash := hash(token)
+
+	ss.Store.mu.Lock()
+	defer ss.Store.mu.Unlock()
+
+	for id, s := range ss.Store.sessions {
+		if s.TokenHash == tokenHash {
+			delete(ss.Store.sessions, id)
+		}
+	}
+
+	return nil
+}
+
+func (ss *SessionService) DeleteByUserID(ctx context.Context, userID int) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("delete sessions of user: %w", err)
+	}
+
+	ss.Store.mu.Lock()
+	defer ss.Store.mu.Unlock()
+
+	for id, s := range ss.Store.sessions {
+		if s.UserID == userID {
+			delete(ss.Store.sessions, id)
+		}
+	}
+
+	return nil
+}
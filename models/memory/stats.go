@@ -0,0 +1,41 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+type StatsService struct {
+	Store *Store
+}
+
+func (ss *StatsService) Stats(ctx context.Context) (*models.Stats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("stats: %w", err)
+	}
+
+	ss.Store.mu.Lock()
+	defer ss.Store.mu.Unlock()
+
+	stats := models.Stats{
+		Users:     len(ss.Store.users),
+		Sessions:  len(ss.Store.sessions),
+		Galleries: len(ss.Store.galleries),
+	}
+	for _, user := range ss.Store.users {
+		if user.DisabledAt != nil {
+			stats.DisabledUsers++
+		}
+	}
+	now := time.Now()
+	for _, reset := range ss.Store.resets {
+		if reset.ExpiresAt.After(now) {
+			stats.PendingResets++
+		}
+	}
+
+	return &stats, nil
+}
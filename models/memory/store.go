@@ -0,0 +1,169 @@
+// Package memory implements the model services in memory, for tests that
+// shouldn't need a database. The services mirror how their Postgres
+// counterparts in the models package behave, including the errors they return
+// and the constraints of the tables: unique emails, one session and password
+// reset per user, foreign keys and ON DELETE CASCADE.
+package memory
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"sync"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// Store keeps every table in memory. Services sharing a Store see the same
+// data, the same way services sharing a *sql.DB do.
+type Store struct {
+	mu sync.Mutex
+	// tx runs the transactions one at a time, the way serializable ones
+	// appear to run
+	tx sync.Mutex
+
+	users     map[int]models.User
+	sessions  map[int]models.Session
+	resets    map[int]models.PasswordReset
+	galleries map[int]models.Gallery
+	images    map[int]models.Image
+	apiTokens map[int]models.APIToken
+	webhooks  map[int]models.Webhook
+	// webhookDeliveries is keyed by the BIGSERIAL ids, which fit an int here
+	webhookDeliveries map[int]models.WebhookDelivery
+	// uploads is keyed by the random ids of the uploads
+	uploads map[string]upload
+	// impersonations is append-only, like the audit trail it mirrors
+	impersonations []models.Impersonation
+	// auditEvents has no foreign keys, deleting users leaves it alone
+	auditEvents []models.AuditEvent
+
+	// serials mimic the SERIAL primary keys, one sequence per table
+	serials map[string]int
+}
+
+func NewStore() *Store {
+	return &Store{
+		users:     map[int]models.User{},
+		sessions:  map[int]models.Session{},
+		resets:    map[int]models.PasswordReset{},
+		galleries: map[int]models.Gallery{},
+		images:    map[int]models.Image{},
+		apiTokens: map[int]models.APIToken{},
+		webhooks:  map[int]models.Webhook{},
+
+		webhookDeliveries: map[int]models.WebhookDelivery{},
+		uploads:           map[string]upload{},
+
+		serials: map[string]int{},
+	}
+}
+
+// nextID returns the next value of the table's sequence. Like Postgres, ids
+// are never reused, even after a failed insert or a delete.
+func (s *Store) nextID(table string) int {
+	s.serials[table]++
+	return s.serials[table]
+}
+
+// deleteUser removes a user and cascades to the tables that reference it.
+// The caller must hold the lock.
+func (s *Store) deleteUser(id int) error {
+	if _, ok := s.users[id]; !ok {
+		return models.ErrNotFound
+	}
+
+	// galleries.user_id has no ON DELETE CASCADE
+	for _, g := range s.galleries {
+		if g.UserID == id {
+			return foreignKeyViolation("galleries_user_id_fkey")
+		}
+	}
+
+	for sid, session := range s.sessions {
+		if session.UserID == id {
+			delete(s.sessions, sid)
+		}
+	}
+	for rid, reset := range s.resets {
+		if reset.UserID == id {
+			delete(s.resets, rid)
+		}
+	}
+	for tid, t := range s.apiTokens {
+		if t.UserID == id {
+			delete(s.apiTokens, tid)
+		}
+	}
+	for wid, w := range s.webhooks {
+		if w.UserID == id {
+			s.deleteWebhook(wid)
+		}
+	}
+	for uid, u := range s.uploads {
+		if u.UserID == id {
+			delete(s.uploads, uid)
+		}
+	}
+	// sessions.impersonated_user_id and the impersonations have ON DELETE
+	// SET NULL
+	for sid, session := range s.sessions {
+		if session.ImpersonatedUserID == id {
+			session.ImpersonatedUserID = 0
+			s.sessions[sid] = session
+		}
+	}
+	for i := range s.impersonations {
+		if s.impersonations[i].AdminID == id {
+			s.impersonations[i].AdminID = 0
+		}
+		if s.impersonations[i].UserID == id {
+			s.impersonations[i].UserID = 0
+		}
+	}
+	delete(s.users, id)
+
+	return nil
+}
+
+// foreignKeyViolation returns the same error the pgx driver does, so callers
+// checking for it work with both implementations.
+func foreignKeyViolation(constraint string) error {
+	return &pgconn.PgError{
+		Severity:       "ERROR",
+		Code:           pgerrcode.ForeignKeyViolation,
+		Message:        "violates foreign key constraint",
+		ConstraintName: constraint,
+	}
+}
+
+// checkViolation returns the error the pgx driver does when a CHECK
+// constraint fails.
+func checkViolation(constraint string) error {
+	return &pgconn.PgError{
+		Severity:       "ERROR",
+		Code:           pgerrcode.CheckViolation,
+		Message:        "violates check constraint",
+		ConstraintName: constraint,
+	}
+}
+
+// page returns the items a LIMIT and OFFSET would.
+func page[T any](items []T, limit, offset int) []T {
+	if offset >= len(items) {
+		return nil
+	}
+	items = items[offset:]
+	if limit < len(items) {
+		items = items[:limit]
+	}
+
+	return items
+}
+
+// hash matches the hashing of tokens done by the models services.
+func hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,78 @@
+package memory
+
+import (
+	"context"
+	"maps"
+	"slices"
+)
+
+type txKey struct{}
+
+// Transactor mirrors models.Transactor. Transactions run one at a time, and
+// when fn fails the store is put back the way it was, like a rollback, but
+// calls made outside fn in the meantime are neither isolated from it nor
+// kept. That is fine for tests, which don't run transactions concurrently
+// with other writes.
+type Transactor struct {
+	Store *Store
+}
+
+func (t *Transactor) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if ctx.Value(txKey{}) != nil {
+		return fn(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	t.Store.tx.Lock()
+	defer t.Store.tx.Unlock()
+
+	snapshot := t.Store.snapshot()
+	err := fn(context.WithValue(ctx, txKey{}, true))
+	if err != nil {
+		t.Store.restore(snapshot)
+	}
+
+	return err
+}
+
+// snapshot copies every table, but not the serials as sequences are not
+// rolled back either.
+func (s *Store) snapshot() *Store {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &Store{
+		users:     maps.Clone(s.users),
+		sessions:  maps.Clone(s.sessions),
+		resets:    maps.Clone(s.resets),
+		galleries: maps.Clone(s.galleries),
+		images:    maps.Clone(s.images),
+		apiTokens: maps.Clone(s.apiTokens),
+		webhooks:  maps.Clone(s.webhooks),
+
+		webhookDeliveries: maps.Clone(s.webhookDeliveries),
+		uploads:           maps.Clone(s.uploads),
+
+		impersonations: slices.Clone(s.impersonations),
+		auditEvents:    slices.Clone(s.auditEvents),
+	}
+}
+
+func (s *Store) restore(snapshot *Store) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users = snapshot.users
+	s.sessions = snapshot.sessions
+	s.resets = snapshot.resets
+	s.galleries = snapshot.galleries
+	s.images = snapshot.images
+	s.apiTokens = snapshot.apiTokens
+	s.webhooks = snapshot.webhooks
+	s.webhookDeliveries = snapshot.webhookDeliveries
+	s.uploads = snapshot.uploads
+	s.impersonations = snapshot.impersonations
+	s.auditEvents = snapshot.auditEvents
+}
@@ -0,0 +1,244 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// upload is a row of the uploads table, with the lock Append takes.
+type upload struct {
+	models.Upload
+	lockedUntil time.Time
+}
+
+// UploadService keeps the rows in memory but writes the files to disk with
+// models.UploadFiles, like ImageService does.
+type UploadService struct {
+	Store *Store
+	Files models.UploadFiles
+	// Now returns the current time and can be replaced to test the expiry.
+	// Defaults to time.Now.
+	Now func() time.Time
+}
+
+func (us *UploadService) now() time.Time {
+	if us.Now == nil {
+		return time.Now()
+	}
+	return us.Now()
+}
+
+func (us *UploadService) Create(ctx context.Context, userID, galleryID int, filename string, length int64, expiresAt time.Time) (*models.Upload, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+	id, err := models.NewUploadID()
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+
+	us.Store.mu.Lock()
+	if _, ok := us.Store.users[userID]; !ok {
+		us.Store.mu.Unlock()
+		return nil, fmt.Errorf("create upload: %w",
+			foreignKeyViolation("uploads_user_id_fkey"))
+	}
+	if _, ok := us.Store.galleries[galleryID]; !ok {
+		us.Store.mu.Unlock()
+		return nil, fmt.Errorf("create upload: %w",
+			foreignKeyViolation("uploads_gallery_id_fkey"))
+	}
+	u := models.Upload{
+		ID:        id,
+		UserID:    userID,
+		GalleryID: galleryID,
+		Filename:  filename,
+		Length:    length,
+		ExpiresAt: expiresAt,
+		CreatedAt: us.now(),
+	}
+	us.Store.uploads[id] = upload{Upload: u}
+	us.Store.mu.Unlock()
+
+	err = us.Files.Create(id)
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+
+	return &u, nil
+}
+
+func (us *UploadService) ByID(ctx context.Context, userID int, id string) (*models.Upload, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("query upload by id: %w", err)
+	}
+
+	us.Store.mu.Lock()
+	defer us.Store.mu.Unlock()
+
+	u, ok := us.Store.uploads[id]
+	if !ok || u.UserID != userID || !u.ExpiresAt.After(us.now()) {
+		return nil, models.ErrNotFound
+	}
+
+	return &u.Upload, nil
+}
+
+func (us *UploadService) Append(ctx context.Context, u *models.Upload, chunk io.Reader, verify func() error, expiresAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("lock upload: %w", err)
+	}
+
+	us.Store.mu.Lock()
+	row, ok := us.Store.uploads[u.ID]
+	now := us.now()
+	if !ok || row.Offset != u.Offset || row.lockedUntil.After(now) {
+		us.Store.mu.Unlock()
+		return models.ErrUploadConflict
+	}
+	row.lockedUntil = now.Add(models.UploadLease)
+	us.Store.uploads[u.ID] = row
+	us.Store.mu.Unlock()
+
+	n, writeErr := us.Files.Write(u.ID, u.Offset, chunk)
+	if writeErr == nil && verify != nil {
+		writeErr = verify()
+	}
+	if writeErr != nil && (verify != nil || n == 0) {
+		n = 0
+		_ = us.Files.Truncate(u.ID, u.Offset)
+	}
+
+	us.Store.mu.Lock()
+	row, ok = us.Store.uploads[u.ID]
+	if ok {
+		row.Offset += n
+		row.ExpiresAt = expiresAt
+		row.lockedUntil = time.Time{}
+		us.Store.uploads[u.ID] = row
+	}
+	us.Store.mu.Unlock()
+	u.Offset += n
+	u.ExpiresAt = expiresAt
+
+	if writeErr != nil {
+		return fmt.Errorf("append to upload: %w", writeErr)
+	}
+	return nil
+}
+
+func (us *UploadService) Open(u *models.Upload) (io.ReadCloser, error) {
+	f, err := os.Open(us.Files.Path(u.ID))
+	if err != nil {
+		return nil, fmt.Errorf("open upload: %w", err)
+	}
+	return f, nil
+}
+
+func (us *UploadService) Complete(ctx context.Context, u *models.Upload) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("complete upload: %w", err)
+	}
+
+	us.Store.mu.Lock()
+	row, ok := us.Store.uploads[u.ID]
+	if !ok {
+		us.Store.mu.Unlock()
+		return models.ErrNotFound
+	}
+	now := us.now()
+	row.CompletedAt = &now
+	us.Store.uploads[u.ID] = row
+	us.Store.mu.Unlock()
+	u.CompletedAt = &now
+
+	return us.Files.Remove(u.ID)
+}
+
+func (us *UploadService) Delete(ctx context.Context, userID int, id string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("delete upload: %w", err)
+	}
+
+	us.Store.mu.Lock()
+	u, ok := us.Store.uploads[id]
+	if ok && u.UserID == userID {
+		delete(us.Store.uploads, id)
+	}
+	us.Store.mu.Unlock()
+	if !ok || u.UserID != userID {
+		return models.ErrNotFound
+	}
+
+	return us.Files.Remove(id)
+}
+
+func (us *UploadService) DeleteExpired(ctx context.Context) (int, error) {
+	// the files are on disk, their times are not the ones of Now
+	files, err := us.Files.IDs(time.Now().Add(-models.UploadFileGrace))
+	if err != nil {
+		return 0, fmt.Errorf("delete expired uploads: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("delete expired uploads: %w", err)
+	}
+
+	us.Store.mu.Lock()
+	now := us.now()
+	var expired []string
+	for id, u := range us.Store.uploads {
+		if !u.ExpiresAt.After(now) {
+			delete(us.Store.uploads, id)
+			expired = append(expired, id)
+		}
+	}
+	live := map[string]bool{}
+	for _, id := range files {
+		if _, ok := us.Store.uploads[id]; ok {
+			live[id] = true
+		}
+	}
+	us.Store.mu.Unlock()
+
+	var errs []error
+	for _, id := range append(expired, files...) {
+		if !live[id] {
+			errs = append(errs, us.Files.Remove(id))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return 0, fmt.Errorf("delete expired uploads: %w", err)
+	}
+
+	return len(expired), nil
+}
+
+func (us *UploadService) Usage(ctx context.Context, userID int) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("query storage usage: %w", err)
+	}
+
+	us.Store.mu.Lock()
+	defer us.Store.mu.Unlock()
+
+	var usage int64
+	for _, image := range us.Store.images {
+		if g, ok := us.Store.galleries[image.GalleryID]; ok && g.UserID == userID {
+			usage += image.Size
+		}
+	}
+	now := us.now()
+	for _, u := range us.Store.uploads {
+		if u.UserID == userID && u.CompletedAt == nil && u.ExpiresAt.After(now) {
+			usage += u.Length
+		}
+	}
+
+	return usage, nil
+}
@@ -0,0 +1,250 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type UserService struct {
+	Store *Store
+	// Cost is the bcrypt cost used to hash passwords. Defaults to
+	// bcrypt.MinCost, which keeps tests fast.
+	Cost int
+}
+
+func (us *UserService) Create(ctx context.Context, email, password string) (*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+	email = strings.ToLower(email)
+
+	cost := us.Cost
+	if cost == 0 {
+		cost = bcrypt.MinCost
+	}
+	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+
+	us.Store.mu.Lock()
+	defer us.Store.mu.Unlock()
+
+	for _, u := range us.Store.users {
+		if u.Email == email {
+			return nil, models.ErrEmailToken
+		}
+	}
+
+	user := models.User{
+		ID:           us.Store.nextID("users"),
+		Email:        email,
+		PasswordHash: string(hashedBytes),
+		Role:         models.RoleUser,
+	}
+	us.Store.users[user.ID] = user
+
+	return &user, nil
+}
+
+func (us *UserService) Authenticate(ctx context.Context, email, password string) (*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("authenticate: %w", err)
+	}
+	email = strings.ToLower(email)
+
+	us.Store.mu.Lock()
+	var user *models.User
+	for _, u := range us.Store.users {
+		if u.Email == email {
+			u := u
+			user = &u
+			break
+		}
+	}
+	us.Store.mu.Unlock()
+
+	if user == nil {
+		return nil, models.ErrNotFound
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	if err != nil {
+		return nil, fmt.Errorf("authenticate: %w", err)
+	}
+	if user.DisabledAt != nil {
+		return nil, models.ErrDisabled
+	}
+
+	return user, nil
+}
+
+// UpdatePassword is a no-op for unknown users, like an UPDATE matching no
+// rows.
+func (us *UserService) UpdatePassword(ctx context.Context, userID int, password string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+
+	cost := us.Cost
+	if cost == 0 {
+		cost = bcrypt.MinCost
+	}
+	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+
+	us.Store.mu.Lock()
+	defer us.Store.mu.Unlock()
+
+	user, ok := us.Store.users[userID]
+	if !ok {
+		return nil
+	}
+	user.PasswordHash = string(hashedBytes)
+	us.Store.users[userID] = user
+
+	return nil
+}
+
+func (us *UserService) Delete(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("delete user: %w", err)
+	}
+
+	us.Store.mu.Lock()
+	defer us.Store.mu.Unlock()
+
+	err := us.Store.deleteUser(id)
+	if err != nil && err != models.ErrNotFound {
+		return fmt.Errorf("delete user: %w", err)
+	}
+
+	return err
+}
+
+func (us *UserService) ByID(ctx context.Context, id int) (*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("query user by id: %w", err)
+	}
+
+	us.Store.mu.Lock()
+	defer us.Store.mu.Unlock()
+
+	user, ok := us.Store.users[id]
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+
+	return &user, nil
+}
+
+func (us *UserService) ByEmail(ctx context.Context, email string) (*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("query user by email: %w", err)
+	}
+	email = strings.ToLower(email)
+
+	us.Store.mu.Lock()
+	defer us.Store.mu.Unlock()
+
+	for _, user := range us.Store.users {
+		if user.Email == email {
+			return &user, nil
+		}
+	}
+
+	return nil, models.ErrNotFound
+}
+
+func (us *UserService) List(ctx context.Context, limit, offset int) ([]models.User, error) {
+	return us.Search(ctx, "", limit, offset)
+}
+
+func (us *UserService) Search(ctx context.Context, query string, limit, offset int) ([]models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	query = strings.ToLower(query)
+
+	us.Store.mu.Lock()
+	defer us.Store.mu.Unlock()
+
+	var users []models.User
+	for _, user := range us.Store.users {
+		if strings.Contains(user.Email, query) {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	return page(users, limit, offset), nil
+}
+
+func (us *UserService) Disable(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("disable user: %w", err)
+	}
+
+	us.Store.mu.Lock()
+	defer us.Store.mu.Unlock()
+
+	user, ok := us.Store.users[id]
+	if !ok {
+		return models.ErrNotFound
+	}
+	if user.DisabledAt == nil {
+		now := time.Now()
+		user.DisabledAt = &now
+		us.Store.users[id] = user
+	}
+
+	return nil
+}
+
+func (us *UserService) Enable(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("enable user: %w", err)
+	}
+
+	us.Store.mu.Lock()
+	defer us.Store.mu.Unlock()
+
+	user, ok := us.Store.users[id]
+	if !ok {
+		return models.ErrNotFound
+	}
+	user.DisabledAt = nil
+	us.Store.users[id] = user
+
+	return nil
+}
+
+func (us *UserService) SetRole(ctx context.Context, id int, role models.Role) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("set user role: %w", err)
+	}
+
+	us.Store.mu.Lock()
+	defer us.Store.mu.Unlock()
+
+	user, ok := us.Store.users[id]
+	if !ok {
+		return models.ErrNotFound
+	}
+	// the CHECK constraint of users.role
+	if _, err := models.ParseRole(string(role)); err != nil {
+		return fmt.Errorf("set user role: %w", checkViolation("users_role_check"))
+	}
+	user.Role = role
+	us.Store.users[id] = user
+
+	return nil
+}
@@ -0,0 +1,290 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/rand"
+)
+
+type WebhookService struct {
+	Store *Store
+	// Now returns the current time and can be replaced to test the retries.
+	// Defaults to time.Now.
+	Now func() time.Time
+}
+
+func (ws *WebhookService) now() time.Time {
+	if ws.Now == nil {
+		return time.Now()
+	}
+	return ws.Now()
+}
+
+// deleteWebhook removes a webhook and cascades to its deliveries. The caller
+// must hold the lock.
+func (s *Store) deleteWebhook(id int) {
+	for did, d := range s.webhookDeliveries {
+		if d.WebhookID == id {
+			delete(s.webhookDeliveries, did)
+		}
+	}
+	delete(s.webhooks, id)
+}
+
+func (ws *WebhookService) Create(ctx context.Context, userID int, url string, events []models.WebhookEvent) (*models.Webhook, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("create webhook: %w", err)
+	}
+
+	secret, err := rand.String(models.MinBytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create webhook: %w", err)
+	}
+
+	ws.Store.mu.Lock()
+	defer ws.Store.mu.Unlock()
+
+	if _, ok := ws.Store.users[userID]; !ok {
+		return nil, fmt.Errorf("create webhook: %w",
+			foreignKeyViolation("webhooks_user_id_fkey"))
+	}
+
+	w := models.Webhook{
+		ID:        ws.Store.nextID("webhooks"),
+		UserID:    userID,
+		URL:       url,
+		Secret:    models.WebhookSecretPrefix + secret,
+		Events:    slices.Clone(events),
+		CreatedAt: ws.now(),
+	}
+	ws.Store.webhooks[w.ID] = w
+
+	return &w, nil
+}
+
+func (ws *WebhookService) ByUserID(ctx context.Context, userID int) ([]models.Webhook, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("query webhooks by user: %w", err)
+	}
+
+	ws.Store.mu.Lock()
+	defer ws.Store.mu.Unlock()
+
+	var webhooks []models.Webhook
+	for _, w := range ws.Store.webhooks {
+		if w.UserID == userID {
+			webhooks = append(webhooks, w)
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].ID > webhooks[j].ID
+	})
+
+	return webhooks, nil
+}
+
+func (ws *WebhookService) ByID(ctx context.Context, userID, id int) (*models.Webhook, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("query webhook by id: %w", err)
+	}
+
+	ws.Store.mu.Lock()
+	defer ws.Store.mu.Unlock()
+
+	w, ok := ws.Store.webhooks[id]
+	if !ok || w.UserID != userID {
+		return nil, models.ErrNotFound
+	}
+
+	return &w, nil
+}
+
+func (ws *WebhookService) Delete(ctx context.Context, userID, id int) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("delete webhook: %w", err)
+	}
+
+	ws.Store.mu.Lock()
+	defer ws.Store.mu.Unlock()
+
+	w, ok := ws.Store.webhooks[id]
+	if !ok || w.UserID != userID {
+		return models.ErrNotFound
+	}
+	ws.Store.deleteWebhook(id)
+
+	return nil
+}
+
+func (ws *WebhookService) Enqueue(ctx context.Context, userID int, event models.WebhookEvent, payload []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, fmt.Errorf("enqueue webhook deliveries: %w", err)
+	}
+	now := ws.now()
+
+	ws.Store.mu.Lock()
+	defer ws.Store.mu.Unlock()
+
+	// in id order, like the rows of the INSERT ... SELECT
+	ids := make([]int, 0, len(ws.Store.webhooks))
+	for id := range ws.Store.webhooks {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	n := 0
+	for _, id := range ids {
+		w := ws.Store.webhooks[id]
+		if w.UserID != userID || !w.Subscribed(event) {
+			continue
+		}
+		d := models.WebhookDelivery{
+			ID:            int64(ws.Store.nextID("webhook_deliveries")),
+			WebhookID:     w.ID,
+			Event:         event,
+			Payload:       string(payload),
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+		}
+		ws.Store.webhookDeliveries[int(d.ID)] = d
+		n++
+	}
+
+	return n, nil
+}
+
+func (ws *WebhookService) Deliveries(ctx context.Context, webhookID, limit int) ([]models.WebhookDelivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("query webhook deliveries: %w", err)
+	}
+
+	ws.Store.mu.Lock()
+	defer ws.Store.mu.Unlock()
+
+	var deliveries []models.WebhookDelivery
+	for _, d := range ws.Store.webhookDeliveries {
+		if d.WebhookID == webhookID {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].ID > deliveries[j].ID
+	})
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+
+	return deliveries, nil
+}
+
+func (ws *WebhookService) Redeliver(ctx context.Context, webhookID int, id int64) (*models.WebhookDelivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("redeliver webhook delivery: %w", err)
+	}
+	now := ws.now()
+
+	ws.Store.mu.Lock()
+	defer ws.Store.mu.Unlock()
+
+	original, ok := ws.Store.webhookDeliveries[int(id)]
+	if !ok || original.WebhookID != webhookID {
+		return nil, models.ErrNotFound
+	}
+	d := models.WebhookDelivery{
+		ID:            int64(ws.Store.nextID("webhook_deliveries")),
+		WebhookID:     original.WebhookID,
+		Event:         original.Event,
+		Payload:       original.Payload,
+		NextAttemptAt: &now,
+		CreatedAt:     now,
+	}
+	ws.Store.webhookDeliveries[int(d.ID)] = d
+
+	return &d, nil
+}
+
+func (ws *WebhookService) Claim(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookJob, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("claim webhook deliveries: %w", err)
+	}
+	now := ws.now()
+
+	ws.Store.mu.Lock()
+	defer ws.Store.mu.Unlock()
+
+	var due []models.WebhookDelivery
+	for _, d := range ws.Store.webhookDeliveries {
+		if d.NextAttemptAt != nil && !d.NextAttemptAt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextAttemptAt.Equal(*due[j].NextAttemptAt) {
+			return due[i].NextAttemptAt.Before(*due[j].NextAttemptAt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	jobs := make([]models.WebhookJob, 0, len(due))
+	for _, d := range due {
+		d.Attempts++
+		next := now.Add(lease)
+		d.NextAttemptAt = &next
+		ws.Store.webhookDeliveries[int(d.ID)] = d
+
+		w := ws.Store.webhooks[d.WebhookID]
+		jobs = append(jobs, models.WebhookJob{Delivery: d, URL: w.URL, Secret: w.Secret})
+	}
+
+	return jobs, nil
+}
+
+func (ws *WebhookService) Delivered(ctx context.Context, id int64, statusCode int) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("mark webhook delivery delivered: %w", err)
+	}
+	now := ws.now()
+
+	ws.Store.mu.Lock()
+	defer ws.Store.mu.Unlock()
+
+	d, ok := ws.Store.webhookDeliveries[int(id)]
+	if !ok {
+		return models.ErrNotFound
+	}
+	d.StatusCode = statusCode
+	d.Error = ""
+	d.DeliveredAt = &now
+	d.NextAttemptAt = nil
+	ws.Store.webhookDeliveries[int(id)] = d
+
+	return nil
+}
+
+func (ws *WebhookService) Failed(ctx context.Context, id int64, statusCode int, message string, retryAt *time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("mark webhook delivery failed: %w", err)
+	}
+
+	ws.Store.mu.Lock()
+	defer ws.Store.mu.Unlock()
+
+	d, ok := ws.Store.webhookDeliveries[int(id)]
+	if !ok {
+		return models.ErrNotFound
+	}
+	d.StatusCode = statusCode
+	d.Error = message
+	d.NextAttemptAt = retryAt
+	ws.Store.webhookDeliveries[int(id)] = d
+
+	return nil
+}
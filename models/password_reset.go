@@ -1,8 +1,8 @@
 package models
 
 import (
+	"context"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/base64"
 	"fmt"
 	"strings"
@@ -28,7 +28,7 @@ type PasswordReset struct {
 }
 
 type PasswordResetService struct {
-	DB *sql.DB
+	DB DBTX
 	// BytesPerToken is used to determine how many bytes to use when generating
 	// each password reset token. If this value is not set or is less than the
 	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be
@@ -37,14 +37,20 @@ type PasswordResetService struct {
 	// Duration is the amount of time that a PasswordReset is valid for.
 	// Defaults to DefaultResetDuration
 	Duration time.Duration
+	// QueryTimeout bounds the queries of each call. Defaults to
+	// DefaultQueryTimeout.
+	QueryTimeout time.Duration
 }
 
-func (prs *PasswordResetService) Create(email string) (*PasswordReset, error) {
+func (prs *PasswordResetService) Create(ctx context.Context, email string) (*PasswordReset, error) {
+	ctx, cancel := withTimeout(ctx, prs.QueryTimeout)
+	defer cancel()
+
 	// verify we have a valid email address for a user
 	email = strings.ToLower(email)
 
 	var userID int
-	row := prs.DB.QueryRow(`
+	row := conn(ctx, prs.DB).QueryRowContext(ctx, `
 		SELECT id FROM users WHERE email = $1;`, email)
 
 	err := row.Scan(&userID)
@@ -76,7 +82,7 @@ func (prs *PasswordResetService) Create(email string) (*PasswordReset, error) {
 		ExpiresAt: time.Now().Add(duration),
 	}
 
-	row = prs.DB.QueryRow(`
+	row = conn(ctx, prs.DB).QueryRowContext(ctx, `
 		INSERT INTO password_resets (user_id, token_hash, expires_at)
 		VALUES ($1, $2, $3) ON CONFLICT (user_id) DO
 		UPDATE
@@ -93,14 +99,17 @@ func (prs *PasswordResetService) Create(email string) (*PasswordReset, error) {
 
 // We are going to consume a token and return the user associated with it,
 // or return an error if the token wasn't valid for any reason
-func (prs *PasswordResetService) Consume(token string) (*User, error) {
+func (prs *PasswordResetService) Consume(ctx context.Context, token string) (*User, error) {
+	ctx, cancel := withTimeout(ctx, prs.QueryTimeout)
+	defer cancel()
+
 	// validate that the token is valid and hasn't expired
 	tokenHash := prs.hash(token)
 
 	var user User
 	var pwReset PasswordReset
 
-	row := prs.DB.QueryRow(`
+	row := conn(ctx, prs.DB).QueryRowContext(ctx, `
 			SELECT
 				pr.id,
 				pr.expires_at,
@@ -124,7 +133,7 @@ func (prs *PasswordResetService) Consume(token string) (*User, error) {
 		return nil, fmt.Errorf("token expired: %v", token)
 	}
 
-	err = prs.delete(pwReset.ID)
+	err = prs.delete(ctx, pwReset.ID)
 	if err != nil {
 		return nil, fmt.Errorf("consume delete token: %w", err) 
 	}
@@ -138,8 +147,8 @@ func (prs *PasswordResetService) hash(token string) string {
 	return base64.URLEncoding.EncodeToString(tokenHash[:])
 }
 
-func (prs *PasswordResetService) delete(id int) error {
-	_, err := prs.DB.Exec(`DELETE FROM password_resets WHERE id = $1;`, id)
+func (prs *PasswordResetService) delete(ctx context.Context, id int) error {
+	_, err := conn(ctx, prs.DB).ExecContext(ctx, `DELETE FROM password_resets WHERE id = $1;`, id)
 	if err != nil {
 		return fmt.Errorf("delete: %w", err)
 	}
@@ -0,0 +1,156 @@
+package models_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+func TestPasswordResetServiceCreate(t *testing.T) {
+	tests := []struct {
+		name  string
+		email string
+		// existing creates a reset beforehand, which the new one replaces
+		// through ON CONFLICT (user_id)
+		existing bool
+		duration time.Duration
+		wantErr  error
+	}{
+		{name: "first reset", email: "bob@example.com"},
+		{name: "email in other case", email: "BOB@example.com"},
+		{name: "replaces previous reset", email: "bob@example.com", existing: true},
+		{name: "custom duration", email: "bob@example.com", duration: 10 * time.Minute},
+		{name: "unknown email", email: "alice@example.com", wantErr: sql.ErrNoRows},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tx := testDB.Tx(t)
+			prs := models.PasswordResetService{DB: tx, Duration: tt.duration}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+
+			var previous *models.PasswordReset
+			if tt.existing {
+				var err error
+				previous, err = prs.Create(ctx, bob.Email)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			start := time.Now()
+			reset, err := prs.Create(ctx, tt.email)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if reset.UserID != bob.ID {
+				t.Errorf("got user %d, want %d", reset.UserID, bob.ID)
+			}
+			duration := tt.duration
+			if duration == 0 {
+				duration = models.DefaultResetDuration
+			}
+			if reset.ExpiresAt.Before(start.Add(duration)) || reset.ExpiresAt.After(time.Now().Add(duration)) {
+				t.Errorf("got expiry %v, want %v from now", reset.ExpiresAt, duration)
+			}
+			if n := count(t, tx, "password_resets", "user_id = $1", bob.ID); n != 1 {
+				t.Fatalf("got %d resets, want 1", n)
+			}
+			if n := count(t, tx, "password_resets", "id = $1 AND token_hash = $2", reset.ID, reset.TokenHash); n != 1 {
+				t.Errorf("reset %d is not stored with its token hash", reset.ID)
+			}
+
+			if previous == nil {
+				return
+			}
+			if reset.ID != previous.ID {
+				t.Errorf("got reset id %d, want the upsert to keep %d", reset.ID, previous.ID)
+			}
+			_, err = prs.Consume(ctx, previous.Token)
+			if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("previous token: got error %v, want %v", err, sql.ErrNoRows)
+			}
+		})
+	}
+}
+
+func TestPasswordResetServiceConsume(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration time.Duration
+		token    func(reset *models.PasswordReset) string
+		wantErr  bool
+		// wantRows is how many resets are left for the user afterwards
+		wantRows int
+	}{
+		{
+			name:     "valid token",
+			token:    func(pr *models.PasswordReset) string { return pr.Token },
+			wantRows: 0,
+		},
+		{
+			name:     "unknown token",
+			token:    func(*models.PasswordReset) string { return "nope" },
+			wantErr:  true,
+			wantRows: 1,
+		},
+		{
+			name:     "expired token",
+			duration: -time.Minute,
+			token:    func(pr *models.PasswordReset) string { return pr.Token },
+			wantErr:  true,
+			wantRows: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tx := testDB.Tx(t)
+			prs := models.PasswordResetService{DB: tx, Duration: tt.duration}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+			reset, err := prs.Create(ctx, bob.Email)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			user, err := prs.Consume(ctx, tt.token(reset))
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if err == nil && *user != *bob {
+				t.Errorf("got user %+v, want %+v", *user, *bob)
+			}
+			if n := count(t, tx, "password_resets", "user_id = $1", bob.ID); n != tt.wantRows {
+				t.Errorf("got %d resets, want %d", n, tt.wantRows)
+			}
+		})
+	}
+
+	t.Run("token can only be used once", func(t *testing.T) {
+		ctx := context.Background()
+		tx := testDB.Tx(t)
+		prs := models.PasswordResetService{DB: tx}
+		bob := createUser(t, tx, "bob@example.com", "secret")
+		reset, err := prs.Create(ctx, bob.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = prs.Consume(ctx, reset.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = prs.Consume(ctx, reset.Token)
+		if !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("got error %v, want %v", err, sql.ErrNoRows)
+		}
+	})
+}
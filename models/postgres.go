@@ -1,21 +1,30 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io/fs"
+	"os"
+	"time"
 
+	"github.com/XSAM/otelsql"
 	_ "github.com/jackc/pgx/v4/stdlib"
 	"github.com/pressly/goose/v3"
+	"github.com/pressly/goose/v3/lock"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 )
 
 type PostgresConfig struct {
 	Host     string
 	Port     string
 	User     string
-	Password string
+	Password string `secret:"true"`
 	Database string
 	SSLMode  string
+	// QueryTimeout is not part of the connection string, services use it as
+	// the deadline of their queries.
+	QueryTimeout time.Duration `cfg:"query_timeout"`
 }
 
 func (cfg PostgresConfig) String() string {
@@ -32,14 +41,52 @@ func DefaultPostgresConfig() PostgresConfig {
 		Password: "junglebook",
 		Database: "lenslocked",
 		SSLMode:  "disable",
+
+		QueryTimeout: DefaultQueryTimeout,
+	}
+}
+
+// DBTX runs queries. Both *sql.DB and *sql.Tx implement it, so the same
+// service can be used on its own or as part of a transaction.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// notFoundIfNone returns ErrNotFound when the statement didn't touch any row.
+func notFoundIfNone(res sql.Result, op string) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// DefaultQueryTimeout is used by services without a QueryTimeout.
+const DefaultQueryTimeout = 5 * time.Second
+
+// withTimeout bounds ctx by timeout, or DefaultQueryTimeout when it is not
+// set, so a service call can't wait on the database forever even when the
+// request itself has no deadline.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
 	}
+	return context.WithTimeout(ctx, timeout)
 }
 
 // Open will open a SQL connection with the provided Postgres database.
 // Callers of Open need to ensure the connection is eventually closed via the
 // db.Close() method
 func Open(config PostgresConfig) (*sql.DB, error) {
-	db, err := sql.Open("pgx", config.String())
+	// otelsql wraps the driver so every query gets its own span
+	db, err := otelsql.Open("pgx", config.String(),
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL))
 
 	if err != nil {
 		return nil, fmt.Errorf("open: %w", err)
@@ -51,35 +98,71 @@ func Open(config PostgresConfig) (*sql.DB, error) {
 // Migrate runs the migrations, but it requires the .sql files to exist in the
 // computer. That means binaries without embedded sql files will not work.
 func Migrate(db *sql.DB, dir string) error {
-    err := goose.SetDialect("postgres")
-    if err != nil {
-        return fmt.Errorf("migrate: failed to set dialect: %w", err)
-    }
-
-    err = goose.Up(db, dir)
-    if err != nil {
-        return fmt.Errorf("migrate: failed to run migration: %w", err)
-    }
-
-    return nil
+	return MigrateFS(db, os.DirFS(dir), ".")
 }
 
 // MigrateFS embeds migration files into the binary so it works without having
 // the sql files available in the computer.
 func MigrateFS(db *sql.DB, migrationsFS fs.FS, dir string) error {
-    // in case the dir is an empty string, they probably meant the current dir
-    // and goose wants a period for that
-    if dir == "" {
-        dir = "."
-    }
-
-    goose.SetBaseFS(migrationsFS)
-    defer func() {
-        // ensure that we remove the FS on the off chance some other of our app
-        // uses goose for migrations and doesn't want to use our FS.
-        goose.SetBaseFS(nil)
-    }()
-
-    return Migrate(db, dir)
+	// in case the dir is an empty string, they probably meant the current dir
+	// and fs.Sub wants a period for that
+	if dir == "" {
+		dir = "."
+	}
+
+	migrationsFS, err := fs.Sub(migrationsFS, dir)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+
+	provider, err := NewMigrationProvider(db, migrationsFS)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+
+	_, err = provider.Up(context.Background())
+	if err != nil {
+		return fmt.Errorf("migrate: failed to run migration: %w", err)
+	}
+
+	return nil
+}
+
+// NewMigrationProvider returns a goose provider for the migrations in
+// migrationsFS. Every operation changing the schema holds a Postgres advisory
+// lock, so two instances starting at once, or a deploy step running next to
+// the server, take turns instead of racing each other. The provider must not
+// be closed, that would close db.
+func NewMigrationProvider(db *sql.DB, migrationsFS fs.FS) (*goose.Provider, error) {
+	locker, err := lock.NewPostgresSessionLocker()
+	if err != nil {
+		return nil, fmt.Errorf("migration lock: %w", err)
+	}
+
+	return goose.NewProvider(goose.DialectPostgres, db, migrationsFS,
+		goose.WithSessionLocker(locker))
 }
 
+// MigrationVersions returns the version the database is currently at and the
+// latest version available in migrationsFS. They differ when there are
+// migrations left to run. It doesn't wait for the migration lock, which the
+// readiness check can't afford to do.
+func MigrationVersions(ctx context.Context, db *sql.DB, migrationsFS fs.FS) (current, latest int64, err error) {
+	provider, err := goose.NewProvider(goose.DialectPostgres, db, migrationsFS)
+	if err != nil {
+		return 0, 0, fmt.Errorf("migration versions: %w", err)
+	}
+
+	current, err = provider.GetDBVersion(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("migration versions: %w", err)
+	}
+
+	for _, source := range provider.ListSources() {
+		if source.Version > latest {
+			latest = source.Version
+		}
+	}
+
+	return current, latest, nil
+}
@@ -0,0 +1,25 @@
+package models_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/migrations"
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/models/pgtest"
+)
+
+func TestMigrationVersions(t *testing.T) {
+	if testDB == nil {
+		t.Skipf("%s is not set", pgtest.EnvDSN)
+	}
+
+	// the harness migrated the database all the way up
+	current, latest, err := models.MigrationVersions(context.Background(), testDB.DB, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != latest || latest == 0 {
+		t.Errorf("got version %d of %d, want the latest", current, latest)
+	}
+}
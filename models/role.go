@@ -0,0 +1,86 @@
+package models
+
+import "fmt"
+
+// Role is what a user is allowed to do besides managing their own account and
+// galleries. Each role has the permissions of the ones before it.
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// roleRanks orders the roles, a higher rank includes the lower ones.
+var roleRanks = map[Role]int{
+	RoleUser:      0,
+	RoleModerator: 1,
+	RoleAdmin:     2,
+}
+
+// ParseRole returns the role named s, or an error listing the valid roles.
+func ParseRole(s string) (Role, error) {
+	role := Role(s)
+	if _, ok := roleRanks[role]; !ok {
+		return "", fmt.Errorf("unknown role %q, want %s, %s or %s",
+			s, RoleUser, RoleModerator, RoleAdmin)
+	}
+
+	return role, nil
+}
+
+// AtLeast reports whether r includes the permissions of min.
+func (r Role) AtLeast(min Role) bool {
+	rank, ok := roleRanks[r]
+	return ok && rank >= roleRanks[min]
+}
+
+// Permission is something only some roles may do.
+type Permission string
+
+const (
+	// PermissionAdminArea lets staff into /admin
+	PermissionAdminArea Permission = "admin_area"
+	// PermissionModerateGalleries lets staff see, hide and delete any gallery
+	PermissionModerateGalleries Permission = "moderate_galleries"
+	// PermissionManageUsers lets staff search, disable and change the role of
+	// users
+	PermissionManageUsers Permission = "manage_users"
+	// PermissionImpersonate lets staff act as another user
+	PermissionImpersonate Permission = "impersonate"
+)
+
+// permissionRoles is the least role granted each permission.
+var permissionRoles = map[Permission]Role{
+	PermissionAdminArea:         RoleModerator,
+	PermissionModerateGalleries: RoleModerator,
+	PermissionManageUsers:       RoleAdmin,
+	PermissionImpersonate:       RoleAdmin,
+}
+
+// Can reports whether the user has permission p. A nil user, someone who
+// isn't signed in, has no permissions.
+func (u *User) Can(p Permission) bool {
+	role, ok := permissionRoles[p]
+	return u != nil && ok && u.Role.AtLeast(role)
+}
+
+// CanViewGallery reports whether the user may see the gallery. Galleries are
+// public unless a moderator hid them. u may be nil.
+func (u *User) CanViewGallery(gallery *Gallery) bool {
+	return gallery.HiddenAt == nil || u.CanEditGallery(gallery) ||
+		u.Can(PermissionModerateGalleries)
+}
+
+// CanEditGallery reports whether the user may change the gallery, which only
+// its owner can. u may be nil.
+func (u *User) CanEditGallery(gallery *Gallery) bool {
+	return u != nil && gallery.UserID == u.ID
+}
+
+// CanDeleteGallery reports whether the user may delete the gallery, either as
+// its owner or as a moderator. u may be nil.
+func (u *User) CanDeleteGallery(gallery *Gallery) bool {
+	return u.CanEditGallery(gallery) || u.Can(PermissionModerateGalleries)
+}
@@ -0,0 +1,106 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+func TestParseRole(t *testing.T) {
+	for _, s := range []string{"user", "moderator", "admin"} {
+		role, err := models.ParseRole(s)
+		if err != nil || string(role) != s {
+			t.Errorf("ParseRole(%q) = %q, %v", s, role, err)
+		}
+	}
+	for _, s := range []string{"", "Admin", "owner"} {
+		_, err := models.ParseRole(s)
+		if err == nil {
+			t.Errorf("ParseRole(%q): got no error", s)
+		}
+	}
+}
+
+func TestUserCan(t *testing.T) {
+	tests := []struct {
+		role models.Role
+		want map[models.Permission]bool
+	}{
+		{role: models.RoleUser, want: map[models.Permission]bool{}},
+		{role: models.RoleModerator, want: map[models.Permission]bool{
+			models.PermissionAdminArea:         true,
+			models.PermissionModerateGalleries: true,
+		}},
+		{role: models.RoleAdmin, want: map[models.Permission]bool{
+			models.PermissionAdminArea:         true,
+			models.PermissionModerateGalleries: true,
+			models.PermissionManageUsers:       true,
+			models.PermissionImpersonate:       true,
+		}},
+		// a role this version doesn't know grants nothing
+		{role: "superuser", want: map[models.Permission]bool{}},
+	}
+	permissions := []models.Permission{
+		models.PermissionAdminArea,
+		models.PermissionModerateGalleries,
+		models.PermissionManageUsers,
+		models.PermissionImpersonate,
+		"unknown",
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.role), func(t *testing.T) {
+			user := &models.User{Role: tt.role}
+			for _, p := range permissions {
+				if got := user.Can(p); got != tt.want[p] {
+					t.Errorf("Can(%s) = %v, want %v", p, got, tt.want[p])
+				}
+			}
+		})
+	}
+
+	var nobody *models.User
+	if nobody.Can(models.PermissionAdminArea) {
+		t.Error("a nil user has permissions")
+	}
+}
+
+func TestUserCanGallery(t *testing.T) {
+	now := time.Now()
+	owner := &models.User{ID: 1, Role: models.RoleUser}
+	other := &models.User{ID: 2, Role: models.RoleUser}
+	moderator := &models.User{ID: 3, Role: models.RoleModerator}
+	var nobody *models.User
+
+	visible := &models.Gallery{UserID: owner.ID}
+	hidden := &models.Gallery{UserID: owner.ID, HiddenAt: &now}
+
+	tests := []struct {
+		name            string
+		user            *models.User
+		gallery         *models.Gallery
+		view, edit, del bool
+	}{
+		{"owner", owner, visible, true, true, true},
+		{"owner hidden", owner, hidden, true, true, true},
+		{"other", other, visible, true, false, false},
+		{"other hidden", other, hidden, false, false, false},
+		{"moderator", moderator, visible, true, false, true},
+		{"moderator hidden", moderator, hidden, true, false, true},
+		{"nobody", nobody, visible, true, false, false},
+		{"nobody hidden", nobody, hidden, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.user.CanViewGallery(tt.gallery); got != tt.view {
+				t.Errorf("CanViewGallery = %v, want %v", got, tt.view)
+			}
+			if got := tt.user.CanEditGallery(tt.gallery); got != tt.edit {
+				t.Errorf("CanEditGallery = %v, want %v", got, tt.edit)
+			}
+			if got := tt.user.CanDeleteGallery(tt.gallery); got != tt.del {
+				t.Errorf("CanDeleteGallery = %v, want %v", got, tt.del)
+			}
+		})
+	}
+}
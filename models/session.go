@@ -1,10 +1,12 @@
 package models
 
 import (
+	"context"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/base64"
 	"fmt"
+	"time"
+
 	"github.com/rafaelmdurante/lenslocked/rand"
 )
 
@@ -21,21 +23,30 @@ type Session struct {
 	// in our database, and we cannot reverse it into a raw token.
 	Token     string
 	TokenHash string
+	// ImpersonatedUserID is the user an admin acts as through the session, 0
+	// when not impersonating anyone
+	ImpersonatedUserID int
 }
 
 type SessionService struct {
-	DB *sql.DB
+	DB DBTX
 	// BytesPerToken is used to determine how many bytes to use when generating
 	// each session token. If this value is not set or is less than the
 	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be
 	// used instead.
 	BytesPerToken int
+	// QueryTimeout bounds the queries of each call. Defaults to
+	// DefaultQueryTimeout.
+	QueryTimeout time.Duration
 }
 
 // Create will create a new session for the user provided. The session token
 // will be returned as the Token field on the Session type, but only the hashed
 // session token is stored in the database.
-func (ss *SessionService) Create(userID int) (*Session, error) {
+func (ss *SessionService) Create(ctx context.Context, userID int) (*Session, error) {
+	ctx, cancel := withTimeout(ctx, ss.QueryTimeout)
+	defer cancel()
+
 	bytesPerToken := ss.BytesPerToken
 	if bytesPerToken < MinBytesPerToken {
 		bytesPerToken = MinBytesPerToken
@@ -53,12 +64,12 @@ func (ss *SessionService) Create(userID int) (*Session, error) {
 	}
 
 	// this 'on conflict ... do' is a POSTGRES specifically command
-	row := ss.DB.QueryRow(`
+	row := conn(ctx, ss.DB).QueryRowContext(ctx, `
         INSERT INTO sessions (user_id, token_hash)
             VALUES ($1, $2)
         ON CONFLICT (user_id) DO
         UPDATE
-            SET token_hash = $2
+            SET token_hash = $2, impersonated_user_id = NULL
         RETURNING id;`, session.UserID, session.TokenHash)
 	err = row.Scan(&session.ID)
 
@@ -75,42 +86,111 @@ func (ss *SessionService) Create(userID int) (*Session, error) {
 // User will return the user associated with that token. The tradeoff here is
 // that the SessionService needs to know about the 'users' table and how to
 // construct a User struct. It is a bit of intermingling responsibility though.
-func (ss *SessionService) User(token string) (*User, error) {
+//
+// While an admin impersonates someone through the session, the impersonated
+// user is returned, with the admin as its Impersonator.
+func (ss *SessionService) User(ctx context.Context, token string) (*User, error) {
+	ctx, cancel := withTimeout(ctx, ss.QueryTimeout)
+	defer cancel()
+
 	// 1. hash the session token
 	tokenHash := ss.hash(token)
 	var user User
+	var impersonated struct {
+		ID           *int
+		Email        *string
+		PasswordHash *string
+		Role         *Role
+	}
 
-	// 2. query for the session with that hash
-	row := ss.DB.QueryRow(`
+	// 2. query for the session with that hash. Only the owner of the session
+	// has to be enabled, an admin may impersonate a disabled user
+	row := conn(ctx, ss.DB).QueryRowContext(ctx, `
 		SELECT
 			u.id,
 			u.email,
-			u.password_hash
+			u.password_hash,
+			u.role,
+			i.id,
+			i.email,
+			i.password_hash,
+			i.role
 		FROM sessions s
 			JOIN users u ON s.user_id = u.id
-		WHERE s.token_hash = $1`, tokenHash)
+			LEFT JOIN users i ON s.impersonated_user_id = i.id
+		WHERE s.token_hash = $1
+			AND u.disabled_at IS NULL`, tokenHash)
 
 	// 3. assign values to struct
-	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role,
+		&impersonated.ID, &impersonated.Email, &impersonated.PasswordHash,
+		&impersonated.Role)
 	if err != nil {
 		return nil, fmt.Errorf("user: error getting user %w", err)
 	}
 
+	if impersonated.ID != nil {
+		admin := user
+		user = User{
+			ID:           *impersonated.ID,
+			Email:        *impersonated.Email,
+			PasswordHash: *impersonated.PasswordHash,
+			Role:         *impersonated.Role,
+			Impersonator: &admin,
+		}
+	}
+
 	// 4. return the user
 	return &user, nil
 }
 
+// Impersonate makes the session act as another user until
+// StopImpersonating. Signing in again starts a session of the admin's own.
+func (ss *SessionService) Impersonate(ctx context.Context, token string, userID int) error {
+	ctx, cancel := withTimeout(ctx, ss.QueryTimeout)
+	defer cancel()
+
+	res, err := conn(ctx, ss.DB).ExecContext(ctx, `
+		UPDATE sessions
+		SET impersonated_user_id = $2
+		WHERE token_hash = $1;`, ss.hash(token), userID)
+	if err != nil {
+		return fmt.Errorf("impersonate: %w", err)
+	}
+
+	return notFoundIfNone(res, "impersonate")
+}
+
+// StopImpersonating gives the session back to its owner.
+func (ss *SessionService) StopImpersonating(ctx context.Context, token string) error {
+	ctx, cancel := withTimeout(ctx, ss.QueryTimeout)
+	defer cancel()
+
+	_, err := conn(ctx, ss.DB).ExecContext(ctx, `
+		UPDATE sessions
+		SET impersonated_user_id = NULL
+		WHERE token_hash = $1;`, ss.hash(token))
+	if err != nil {
+		return fmt.Errorf("stop impersonating: %w", err)
+	}
+
+	return nil
+}
+
 func (ss *SessionService) hash(token string) string {
 	tokenHash := sha256.Sum256([]byte(token))
 	// base64 encode the data into a string
 	return base64.URLEncoding.EncodeToString(tokenHash[:]) // [:] shorthand to [0:len(tokenHash)]
 }
 
-func (ss *SessionService) Delete(token string) error {
+func (ss *SessionService) Delete(ctx context.Context, token string) error {
+	ctx, cancel := withTimeout(ctx, ss.QueryTimeout)
+	defer cancel()
+
 	tokenHash := ss.hash(token)
 
 	// using Exec instead of QueryRow because we don't care for a return value
-	_, err := ss.DB.Exec(`
+	_, err := conn(ctx, ss.DB).ExecContext(ctx, `
     DELETE FROM sessions
     WHERE token_hash = $1;`, tokenHash)
 
@@ -120,3 +200,18 @@ func (ss *SessionService) Delete(token string) error {
 
 	return nil
 }
+
+// DeleteByUserID signs the user out everywhere.
+func (ss *SessionService) DeleteByUserID(ctx context.Context, userID int) error {
+	ctx, cancel := withTimeout(ctx, ss.QueryTimeout)
+	defer cancel()
+
+	_, err := conn(ctx, ss.DB).ExecContext(ctx, `
+		DELETE FROM sessions
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("delete sessions of user: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package models_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+func TestSessionServiceCreate(t *testing.T) {
+	tests := []struct {
+		name string
+		// existing creates a session for the user beforehand, which the new
+		// one replaces through ON CONFLICT (user_id)
+		existing      bool
+		bytesPerToken int
+		wantTokenLen  int
+	}{
+		{name: "first session", wantTokenLen: 44},
+		{name: "replaces previous session", existing: true, wantTokenLen: 44},
+		{name: "below the minimum token size", bytesPerToken: 8, wantTokenLen: 44},
+		{name: "larger tokens", bytesPerToken: 64, wantTokenLen: 88},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tx := testDB.Tx(t)
+			ss := models.SessionService{DB: tx, BytesPerToken: tt.bytesPerToken}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+
+			var previous *models.Session
+			if tt.existing {
+				var err error
+				previous, err = ss.Create(ctx, bob.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			session, err := ss.Create(ctx, bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(session.Token) != tt.wantTokenLen {
+				t.Errorf("got token of length %d, want %d", len(session.Token), tt.wantTokenLen)
+			}
+			if session.TokenHash == session.Token {
+				t.Error("token hash is the token itself")
+			}
+			if n := count(t, tx, "sessions", "user_id = $1", bob.ID); n != 1 {
+				t.Fatalf("got %d sessions, want 1", n)
+			}
+			if n := count(t, tx, "sessions", "id = $1 AND token_hash = $2", session.ID, session.TokenHash); n != 1 {
+				t.Errorf("session %d is not stored with its token hash", session.ID)
+			}
+
+			if previous == nil {
+				return
+			}
+			if session.ID != previous.ID {
+				t.Errorf("got session id %d, want the upsert to keep %d", session.ID, previous.ID)
+			}
+			_, err = ss.User(ctx, previous.Token)
+			if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("previous token: got error %v, want %v", err, sql.ErrNoRows)
+			}
+		})
+	}
+}
+
+func TestSessionServiceUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   func(session *models.Session) string
+		wantErr error
+	}{
+		{name: "valid token", token: func(s *models.Session) string { return s.Token }},
+		{name: "unknown token", token: func(*models.Session) string { return "nope" }, wantErr: sql.ErrNoRows},
+		{name: "token hash", token: func(s *models.Session) string { return s.TokenHash }, wantErr: sql.ErrNoRows},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tx := testDB.Tx(t)
+			ss := models.SessionService{DB: tx}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+			session, err := ss.Create(ctx, bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			user, err := ss.User(ctx, tt.token(session))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if *user != *bob {
+				t.Errorf("got user %+v, want %+v", *user, *bob)
+			}
+		})
+	}
+}
+
+func TestSessionServiceDelete(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    func(session *models.Session) string
+		wantRows int
+	}{
+		{name: "existing session", token: func(s *models.Session) string { return s.Token }, wantRows: 0},
+		{name: "unknown token", token: func(*models.Session) string { return "nope" }, wantRows: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tx := testDB.Tx(t)
+			ss := models.SessionService{DB: tx}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+			session, err := ss.Create(ctx, bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// deleting a session that doesn't exist is not an error, signing
+			// out twice is fine
+			err = ss.Delete(ctx, tt.token(session))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := count(t, tx, "sessions", "user_id = $1", bob.ID); n != tt.wantRows {
+				t.Errorf("got %d sessions, want %d", n, tt.wantRows)
+			}
+		})
+	}
+}
+
+func TestSessionServiceUserDisabled(t *testing.T) {
+	ctx := context.Background()
+	tx := testDB.Tx(t)
+	ss := models.SessionService{DB: tx}
+	us := models.UserService{DB: tx}
+	bob := createUser(t, tx, "bob@example.com", "secret")
+	session, err := ss.Create(ctx, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = us.Disable(ctx, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ss.User(ctx, session.Token)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("got error %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func TestSessionServiceDeleteByUserID(t *testing.T) {
+	tests := []struct {
+		name string
+		// other deletes alice's sessions instead of bob's
+		other    bool
+		wantRows int
+	}{
+		{name: "user with a session", wantRows: 0},
+		{name: "other user", other: true, wantRows: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tx := testDB.Tx(t)
+			ss := models.SessionService{DB: tx}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+			alice := createUser(t, tx, "alice@example.com", "secret")
+			_, err := ss.Create(ctx, bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id := bob.ID
+			if tt.other {
+				id = alice.ID
+			}
+			err = ss.DeleteByUserID(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := count(t, tx, "sessions", "user_id = $1", bob.ID); n != tt.wantRows {
+				t.Errorf("got %d sessions, want %d", n, tt.wantRows)
+			}
+		})
+	}
+}
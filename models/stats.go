@@ -0,0 +1,45 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Stats are counts over the whole app, for operators.
+type Stats struct {
+	Users         int
+	DisabledUsers int
+	Sessions      int
+	// PendingResets are password resets that haven't expired nor been used
+	PendingResets int
+	Galleries     int
+}
+
+type StatsService struct {
+	DB DBTX
+	// QueryTimeout bounds the queries of each call. Defaults to
+	// DefaultQueryTimeout.
+	QueryTimeout time.Duration
+}
+
+func (ss *StatsService) Stats(ctx context.Context) (*Stats, error) {
+	ctx, cancel := withTimeout(ctx, ss.QueryTimeout)
+	defer cancel()
+
+	var stats Stats
+	err := conn(ctx, ss.DB).QueryRowContext(ctx, `
+		SELECT
+			(SELECT count(*) FROM users),
+			(SELECT count(*) FROM users WHERE disabled_at IS NOT NULL),
+			(SELECT count(*) FROM sessions),
+			(SELECT count(*) FROM password_resets WHERE expires_at > now()),
+			(SELECT count(*) FROM galleries);`,
+	).Scan(&stats.Users, &stats.DisabledUsers, &stats.Sessions,
+		&stats.PendingResets, &stats.Galleries)
+	if err != nil {
+		return nil, fmt.Errorf("stats: %w", err)
+	}
+
+	return &stats, nil
+}
@@ -0,0 +1,62 @@
+package models_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+func TestStatsServiceStats(t *testing.T) {
+	ctx := context.Background()
+	tx := testDB.Tx(t)
+	ss := models.StatsService{DB: tx}
+	bob := createUser(t, tx, "bob@example.com", "secret")
+	alice := createUser(t, tx, "alice@example.com", "secret")
+	carol := createUser(t, tx, "carol@example.com", "secret")
+
+	us := models.UserService{DB: tx}
+	err := us.Disable(ctx, carol.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := models.SessionService{DB: tx}
+	for _, id := range []int{bob.ID, alice.ID} {
+		_, err = sessions.Create(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an expired reset is not pending
+	_, err = (&models.PasswordResetService{DB: tx}).Create(ctx, bob.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&models.PasswordResetService{DB: tx, Duration: -time.Minute}).Create(ctx, alice.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := models.GalleryService{DB: tx}
+	for _, title := range []string{"Holidays", "Wedding", "Pets"} {
+		_, err = gs.Create(ctx, title, bob.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := ss.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := models.Stats{
+		Users:         3,
+		DisabledUsers: 1,
+		Sessions:      2,
+		PendingResets: 1,
+		Galleries:     3,
+	}
+	if *stats != want {
+		t.Errorf("got %+v, want %+v", *stats, want)
+	}
+}
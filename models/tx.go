@@ -0,0 +1,112 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+// DefaultTxRetries is how many times a transaction is retried after a
+// serialization failure when Transactor.MaxRetries is not set.
+const DefaultTxRetries = 3
+
+type txKey struct{}
+
+// Transactor runs several service calls as a single unit of work. Services
+// look for a transaction in the context they are given and use it instead of
+// their own DB, so the calls made with the context passed to fn either all
+// commit or all roll back.
+//
+// Transactions run at the serializable isolation level. Postgres aborts one of
+// two transactions that would step on each other, e.g. two requests consuming
+// the same password reset token, and the aborted one is retried from scratch.
+// That means fn can run more than once and must not do anything that can't be
+// undone by a rollback, like sending emails.
+type Transactor struct {
+	DB *sql.DB
+	// MaxRetries is the number of times fn is run again after a serialization
+	// failure. Defaults to DefaultTxRetries.
+	MaxRetries int
+}
+
+// InTx runs fn in a transaction and commits it if fn returns nil. When ctx
+// already carries a transaction, fn joins it and the outermost InTx decides
+// whether to commit.
+func (t *Transactor) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return fn(ctx)
+	}
+
+	retries := t.MaxRetries
+	if retries <= 0 {
+		retries = DefaultTxRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := t.run(ctx, fn)
+		if err == nil || !retryable(err) || attempt == retries {
+			return err
+		}
+
+		// back off a little so the transaction that won has time to finish,
+		// with jitter so the losers don't collide again
+		backoff := time.Duration(attempt+1)*10*time.Millisecond +
+			time.Duration(rand.Int63n(int64(10*time.Millisecond)))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (t *Transactor) run(ctx context.Context, fn func(ctx context.Context) error) error {
+	tx, err := t.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+
+	err = fn(context.WithValue(ctx, txKey{}, tx))
+	if err != nil {
+		// the error from fn is the one worth reporting, a failed rollback
+		// ends with the connection being discarded anyway
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		// serializable transactions can also fail when committing
+		return fmt.Errorf("commit tx: %w", err)
+	}
+
+	return nil
+}
+
+// retryable reports whether err aborted the transaction only because it ran
+// concurrently with another one, so running it again can succeed.
+func retryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+
+	return pgErr.Code == pgerrcode.SerializationFailure ||
+		pgErr.Code == pgerrcode.DeadlockDetected
+}
+
+// conn returns the transaction carried by ctx, if any, so service calls made
+// within Transactor.InTx are part of it. Otherwise it returns db.
+func conn(ctx context.Context, db DBTX) DBTX {
+	if tx, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return tx
+	}
+
+	return db
+}
@@ -0,0 +1,131 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/models/pgtest"
+)
+
+// The transactor needs a *sql.DB to begin its own transactions, so these tests
+// write to the package database and use unique emails instead of running in
+// a rolled back pgtest transaction.
+
+func TestTransactorInTx(t *testing.T) {
+	if testDB == nil {
+		t.Skipf("%s is not set", pgtest.EnvDSN)
+	}
+
+	serializationFailure := &pgconn.PgError{Code: pgerrcode.SerializationFailure}
+	errBoom := errors.New("boom")
+
+	tests := []struct {
+		name string
+		// errs are returned by fn on each run, after creating the user
+		errs       []error
+		maxRetries int
+		wantErr    error
+		wantRuns   int
+		wantUser   bool
+	}{
+		{name: "commit", errs: []error{nil}, wantRuns: 1, wantUser: true},
+		{name: "rollback", errs: []error{errBoom}, wantErr: errBoom, wantRuns: 1},
+		{
+			name:     "retry serialization failure",
+			errs:     []error{serializationFailure, nil},
+			wantRuns: 2,
+			wantUser: true,
+		},
+		{
+			name:     "retry wrapped serialization failure",
+			errs:     []error{fmt.Errorf("create session: %w", serializationFailure), nil},
+			wantRuns: 2,
+			wantUser: true,
+		},
+		{
+			name:       "give up after max retries",
+			errs:       []error{serializationFailure, serializationFailure, serializationFailure},
+			maxRetries: 2,
+			wantErr:    serializationFailure,
+			wantRuns:   3,
+		},
+		{
+			name:     "other errors are not retried",
+			errs:     []error{errBoom, nil},
+			wantErr:  errBoom,
+			wantRuns: 1,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			transactor := models.Transactor{DB: testDB.DB, MaxRetries: tt.maxRetries}
+			us := models.UserService{DB: testDB.DB}
+			email := fmt.Sprintf("tx-%d@example.com", i)
+			t.Cleanup(func() {
+				user, err := us.Authenticate(ctx, email, "secret")
+				if err == nil {
+					us.Delete(ctx, user.ID)
+				}
+			})
+
+			runs := 0
+			err := transactor.InTx(ctx, func(ctx context.Context) error {
+				runs++
+				_, err := us.Create(ctx, email, "secret")
+				if err != nil {
+					return err
+				}
+				return tt.errs[runs-1]
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if runs != tt.wantRuns {
+				t.Errorf("got %d runs, want %d", runs, tt.wantRuns)
+			}
+
+			_, err = us.Authenticate(ctx, email, "secret")
+			if tt.wantUser != (err == nil) {
+				t.Errorf("user exists: %v, want %v", err == nil, tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestTransactorNested(t *testing.T) {
+	if testDB == nil {
+		t.Skipf("%s is not set", pgtest.EnvDSN)
+	}
+
+	ctx := context.Background()
+	transactor := models.Transactor{DB: testDB.DB}
+	us := models.UserService{DB: testDB.DB}
+	errBoom := errors.New("boom")
+
+	// the inner call joins the outer transaction, so the outer failure rolls
+	// back what the inner one did
+	err := transactor.InTx(ctx, func(ctx context.Context) error {
+		err := transactor.InTx(ctx, func(ctx context.Context) error {
+			_, err := us.Create(ctx, "nested@example.com", "secret")
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return errBoom
+	})
+	if !errors.Is(err, errBoom) {
+		t.Fatalf("got error %v, want %v", err, errBoom)
+	}
+
+	_, err = us.Authenticate(ctx, "nested@example.com", "secret")
+	if err == nil {
+		t.Error("user created by the inner call was committed")
+	}
+}
@@ -0,0 +1,447 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/rand"
+)
+
+// UploadLease is how long a chunk being written keeps other chunks of the
+// same upload out. It only matters when the server dies halfway through one,
+// otherwise the lock is released as soon as the chunk is written. It must be
+// longer than any request can take, see server.read_timeout.
+const UploadLease = 10 * time.Minute
+
+// UploadFileGrace is how long DeleteExpired leaves a file without an upload
+// alone. The upload can be created in a transaction that commits after its
+// file is on disk, and its row can't be seen until then.
+const UploadFileGrace = 10 * time.Minute
+
+// uploadIDBytes is a multiple of 3, so the id has no base64 padding.
+const uploadIDBytes = 24
+
+// ErrUploadConflict is returned when a chunk doesn't start where the upload
+// is, or another chunk is being written.
+var ErrUploadConflict = errors.New("models: upload offset conflict")
+
+// Upload is a resumable upload of an image, sent in chunks. The image is
+// created once all of its Length bytes are received.
+type Upload struct {
+	ID        string
+	UserID    int
+	GalleryID int
+	Filename  string
+	Length    int64
+	// Offset is how many bytes were received so far
+	Offset      int64
+	ExpiresAt   time.Time
+	CompletedAt *time.Time
+	CreatedAt   time.Time
+}
+
+// Received reports whether all the bytes are there.
+func (u *Upload) Received() bool {
+	return u.Offset == u.Length
+}
+
+// UploadFiles stores the bytes of the uploads in progress, a file per upload
+// under Dir.
+type UploadFiles struct {
+	Dir string
+}
+
+// Path returns where the bytes of an upload are stored.
+func (f UploadFiles) Path(id string) string {
+	return filepath.Join(f.Dir, id)
+}
+
+// Create creates the empty file of an upload.
+func (f UploadFiles) Create(id string) error {
+	err := os.MkdirAll(f.Dir, 0755)
+	if err != nil {
+		return fmt.Errorf("create upload file: %w", err)
+	}
+	file, err := os.OpenFile(f.Path(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("create upload file: %w", err)
+	}
+
+	return file.Close()
+}
+
+// Write writes chunk to the file of an upload at offset and returns how many
+// bytes it wrote, along with the error that stopped it, even when some were
+// written: an interrupted chunk keeps what arrived. Whatever was after offset,
+// like the rest of a rejected chunk, is discarded first.
+func (f UploadFiles) Write(id string, offset int64, chunk io.Reader) (int64, error) {
+	file, err := os.OpenFile(f.Path(id), os.O_WRONLY, 0)
+	if err != nil {
+		return 0, fmt.Errorf("write upload file: %w", err)
+	}
+	defer file.Close()
+
+	err = file.Truncate(offset)
+	if err != nil {
+		return 0, fmt.Errorf("write upload file: %w", err)
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, fmt.Errorf("write upload file: %w", err)
+	}
+
+	n, copyErr := io.Copy(file, chunk)
+	// the offset is only moved once the bytes are on disk
+	err = file.Sync()
+	if copyErr != nil {
+		return n, fmt.Errorf("write upload file: %w", copyErr)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("write upload file: %w", err)
+	}
+
+	return n, nil
+}
+
+// Truncate discards the bytes of an upload after offset.
+func (f UploadFiles) Truncate(id string, offset int64) error {
+	err := os.Truncate(f.Path(id), offset)
+	if err != nil {
+		return fmt.Errorf("truncate upload file: %w", err)
+	}
+	return nil
+}
+
+// Remove deletes the file of an upload. A file that is already gone is not
+// an error.
+func (f UploadFiles) Remove(id string) error {
+	err := os.Remove(f.Path(id))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove upload file: %w", err)
+	}
+	return nil
+}
+
+// IDs lists the uploads that have a file last written before before.
+func (f UploadFiles) IDs(before time.Time) ([]string, error) {
+	entries, err := os.ReadDir(f.Dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("list upload files: %w", err)
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("list upload files: %w", err)
+		}
+		if info.ModTime().Before(before) {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
+
+// NewUploadID returns a random id for an upload.
+func NewUploadID() (string, error) {
+	return rand.String(uploadIDBytes)
+}
+
+type UploadService struct {
+	DB    DBTX
+	Files UploadFiles
+	// QueryTimeout bounds the queries of each call. Defaults to
+	// DefaultQueryTimeout.
+	QueryTimeout time.Duration
+}
+
+// Create starts an upload of length bytes, to be added to a gallery as
+// filename.
+func (service *UploadService) Create(ctx context.Context, userID, galleryID int, filename string, length int64, expiresAt time.Time) (*Upload, error) {
+	id, err := NewUploadID()
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	upload := Upload{
+		ID:        id,
+		UserID:    userID,
+		GalleryID: galleryID,
+		Filename:  filename,
+		Length:    length,
+		ExpiresAt: expiresAt,
+	}
+	// the row comes first, so a file without a row is left over, once its
+	// transaction is done, and DeleteExpired can remove it
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		INSERT INTO uploads (id, user_id, gallery_id, filename, length, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at;`,
+		id, userID, galleryID, filename, length, expiresAt)
+	err = row.Scan(&upload.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+
+	err = service.Files.Create(id)
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+
+	return &upload, nil
+}
+
+// ByID returns an upload of the user, unless it expired.
+func (service *UploadService) ByID(ctx context.Context, userID int, id string) (*Upload, error) {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	upload := Upload{ID: id, UserID: userID}
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		SELECT gallery_id, filename, length, received, expires_at, completed_at, created_at
+		FROM uploads
+		WHERE id = $1 AND user_id = $2 AND expires_at > now();`, id, userID)
+	err := row.Scan(&upload.GalleryID, &upload.Filename, &upload.Length, &upload.Offset,
+		&upload.ExpiresAt, &upload.CompletedAt, &upload.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query upload by id: %w", err)
+	}
+
+	return &upload, nil
+}
+
+// Append writes chunk at the offset of the upload, then moves the offset
+// past it and the expiry to expiresAt. With verify, the chunk is only kept
+// when verify, called once it is read, returns no error. Without it, the
+// bytes of an interrupted chunk are kept, along with the error. Another
+// chunk being written, or the offset having moved since the upload was
+// fetched, is an ErrUploadConflict.
+func (service *UploadService) Append(ctx context.Context, upload *Upload, chunk io.Reader, verify func() error, expiresAt time.Time) error {
+	err := service.lock(ctx, upload)
+	if err != nil {
+		return err
+	}
+
+	n, writeErr := service.Files.Write(upload.ID, upload.Offset, chunk)
+	if writeErr == nil && verify != nil {
+		writeErr = verify()
+	}
+	if writeErr != nil && (verify != nil || n == 0) {
+		n = 0
+		// the rest of the file is truncated by the next chunk anyway, this
+		// only gives the disk space back sooner
+		_ = service.Files.Truncate(upload.ID, upload.Offset)
+	}
+
+	// the chunk is done with, whatever the request's fate
+	ctx, cancel := withTimeout(context.WithoutCancel(ctx), service.QueryTimeout)
+	defer cancel()
+
+	_, err = conn(ctx, service.DB).ExecContext(ctx, `
+		UPDATE uploads
+		SET received = received + $2, expires_at = $3, locked_until = NULL
+		WHERE id = $1;`, upload.ID, n, expiresAt)
+	if err != nil {
+		return fmt.Errorf("append to upload: %w", err)
+	}
+	upload.Offset += n
+	upload.ExpiresAt = expiresAt
+
+	if writeErr != nil {
+		return fmt.Errorf("append to upload: %w", writeErr)
+	}
+	return nil
+}
+
+// lock keeps the other chunks of the upload out until Append is done, as
+// long as the offset didn't move.
+func (service *UploadService) lock(ctx context.Context, upload *Upload) error {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	res, err := conn(ctx, service.DB).ExecContext(ctx, `
+		UPDATE uploads
+		SET locked_until = now() + make_interval(secs => $3)
+		WHERE id = $1 AND received = $2
+		AND (locked_until IS NULL OR locked_until < now());`,
+		upload.ID, upload.Offset, UploadLease.Seconds())
+	if err != nil {
+		return fmt.Errorf("lock upload: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("lock upload: %w", err)
+	}
+	if n == 0 {
+		return ErrUploadConflict
+	}
+
+	return nil
+}
+
+// Open opens the bytes received for an upload.
+func (service *UploadService) Open(upload *Upload) (io.ReadCloser, error) {
+	f, err := os.Open(service.Files.Path(upload.ID))
+	if err != nil {
+		return nil, fmt.Errorf("open upload: %w", err)
+	}
+	return f, nil
+}
+
+// Complete marks an upload whose image was created as such and deletes its
+// file. The row stays until it expires, so a client asking where the upload
+// is after losing the last answer hears it is all there.
+func (service *UploadService) Complete(ctx context.Context, upload *Upload) error {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		UPDATE uploads
+		SET completed_at = now()
+		WHERE id = $1
+		RETURNING completed_at;`, upload.ID)
+	err := row.Scan(&upload.CompletedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("complete upload: %w", err)
+	}
+
+	return service.Files.Remove(upload.ID)
+}
+
+// Delete cancels an upload of the user, deleting what was received.
+func (service *UploadService) Delete(ctx context.Context, userID int, id string) error {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	res, err := conn(ctx, service.DB).ExecContext(ctx, `
+		DELETE FROM uploads
+		WHERE id = $1 AND user_id = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("delete upload: %w", err)
+	}
+	err = notFoundIfNone(res, "delete upload")
+	if err != nil {
+		return err
+	}
+
+	return service.Files.Remove(id)
+}
+
+// DeleteExpired deletes the expired uploads along with their files, and the
+// files left without an upload for UploadFileGrace, like the ones of deleted
+// galleries. It returns how many uploads it deleted.
+func (service *UploadService) DeleteExpired(ctx context.Context) (int, error) {
+	// the files are listed first, and the rows of the ones older than the
+	// grace are committed by now
+	files, err := service.Files.IDs(time.Now().Add(-UploadFileGrace))
+	if err != nil {
+		return 0, fmt.Errorf("delete expired uploads: %w", err)
+	}
+
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+		DELETE FROM uploads
+		WHERE expires_at <= now()
+		RETURNING id;`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired uploads: %w", err)
+	}
+	defer rows.Close()
+	var expired []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return 0, fmt.Errorf("delete expired uploads: %w", err)
+		}
+		expired = append(expired, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("delete expired uploads: %w", err)
+	}
+
+	// the files of the uploads still there are kept
+	live := map[string]bool{}
+	if len(files) > 0 {
+		rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+			SELECT id FROM uploads WHERE id = ANY($1);`, files)
+		if err != nil {
+			return 0, fmt.Errorf("delete expired uploads: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return 0, fmt.Errorf("delete expired uploads: %w", err)
+			}
+			live[id] = true
+		}
+		if err := rows.Err(); err != nil {
+			return 0, fmt.Errorf("delete expired uploads: %w", err)
+		}
+	}
+
+	var errs []error
+	for _, id := range append(expired, files...) {
+		if !live[id] {
+			errs = append(errs, service.Files.Remove(id))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return 0, fmt.Errorf("delete expired uploads: %w", err)
+	}
+
+	return len(expired), nil
+}
+
+// Usage returns how many bytes the user stores: the images of their
+// galleries, plus the full length of the uploads in progress, so the quota
+// can't be exceeded by starting many uploads at once.
+func (service *UploadService) Usage(ctx context.Context, userID int) (int64, error) {
+	ctx, cancel := withTimeout(ctx, service.QueryTimeout)
+	defer cancel()
+
+	var usage int64
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		SELECT
+			(SELECT COALESCE(SUM(images.size), 0)
+			FROM images
+			JOIN galleries ON galleries.id = images.gallery_id
+			WHERE galleries.user_id = $1)
+			+
+			(SELECT COALESCE(SUM(length), 0)
+			FROM uploads
+			WHERE user_id = $1 AND completed_at IS NULL AND expires_at > now());`, userID)
+	err := row.Scan(&usage)
+	if err != nil {
+		return 0, fmt.Errorf("query storage usage: %w", err)
+	}
+
+	return usage, nil
+}
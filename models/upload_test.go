@@ -0,0 +1,183 @@
+package models_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+// failingReader returns its bytes, then err.
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	n, err := fr.r.Read(p)
+	if err == io.EOF {
+		return n, fr.err
+	}
+	return n, err
+}
+
+func TestUploadFiles(t *testing.T) {
+	files := models.UploadFiles{Dir: t.TempDir() + "/uploads"}
+	err := files.Create("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := files.Create("abc"); err == nil {
+		t.Error("created the same upload twice")
+	}
+
+	n, err := files.Write("abc", 0, strings.NewReader("hello"))
+	if err != nil || n != 5 {
+		t.Fatalf("got %d, %v, want 5 bytes written", n, err)
+	}
+	// an interrupted chunk keeps what arrived
+	n, err = files.Write("abc", 5, &failingReader{strings.NewReader(" wor"), io.ErrUnexpectedEOF})
+	if !errors.Is(err, io.ErrUnexpectedEOF) || n != 4 {
+		t.Fatalf("got %d, %v, want 4 bytes and the error", n, err)
+	}
+	// writing again at 5 discards them
+	_, err = files.Write("abc", 5, strings.NewReader(" there"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(files.Path("abc"))
+	if err != nil || string(b) != "hello there" {
+		t.Fatalf("got %q, %v, want hello there", b, err)
+	}
+
+	ids, err := files.IDs(time.Now().Add(time.Minute))
+	if err != nil || len(ids) != 1 || ids[0] != "abc" {
+		t.Errorf("got ids %v, %v", ids, err)
+	}
+	// the files written since are left out
+	ids, err = files.IDs(time.Now().Add(-time.Minute))
+	if err != nil || len(ids) != 0 {
+		t.Errorf("got ids %v, %v, want none", ids, err)
+	}
+	err = files.Remove("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := files.Remove("abc"); err != nil {
+		t.Errorf("removing a removed upload: %v", err)
+	}
+}
+
+func TestUploadService(t *testing.T) {
+	tx := testDB.Tx(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	us := models.UploadService{DB: tx, Files: models.UploadFiles{Dir: dir}}
+	is := models.ImageService{DB: tx, Files: models.ImageFiles{Dir: dir}}
+
+	bob := createUser(t, tx, "bob@example.com", "secret")
+	carol := createUser(t, tx, "carol@example.com", "secret")
+	gallery, err := (&models.GalleryService{DB: tx}).Create(ctx, "Wedding", bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = is.Create(ctx, gallery.ID, "cat.png", bytes.NewReader(pngImage(t, 4, 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := us.Usage(ctx, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiresAt := time.Now().Add(time.Hour)
+	upload, err := us.Create(ctx, bob.ID, gallery.ID, "raw.png", 10, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the whole length is counted as soon as the upload starts
+	if got, _ := us.Usage(ctx, bob.ID); got != usage+10 {
+		t.Errorf("got usage %d, want %d", got, usage+10)
+	}
+	if _, err := us.ByID(ctx, carol.ID, upload.ID); err != models.ErrNotFound {
+		t.Errorf("someone else's upload: got %v, want ErrNotFound", err)
+	}
+
+	err = us.Append(ctx, upload, strings.NewReader("01234"), nil, expiresAt)
+	if err != nil || upload.Offset != 5 {
+		t.Fatalf("got offset %d, %v, want 5", upload.Offset, err)
+	}
+	// a copy fetched before the chunk is out of date
+	stale := *upload
+	stale.Offset = 0
+	if err := us.Append(ctx, &stale, strings.NewReader("xx"), nil, expiresAt); err != models.ErrUploadConflict {
+		t.Errorf("got %v, want ErrUploadConflict", err)
+	}
+	// a chunk failing verification isn't kept
+	errChecksum := errors.New("checksum mismatch")
+	err = us.Append(ctx, upload, strings.NewReader("56789"), func() error { return errChecksum }, expiresAt)
+	if !errors.Is(err, errChecksum) || upload.Offset != 5 {
+		t.Fatalf("got offset %d, %v, want 5 and the verify error", upload.Offset, err)
+	}
+	err = us.Append(ctx, upload, strings.NewReader("56789"), func() error { return nil }, expiresAt)
+	if err != nil || !upload.Received() {
+		t.Fatalf("got offset %d, %v, want everything received", upload.Offset, err)
+	}
+
+	got, err := us.ByID(ctx, bob.ID, upload.ID)
+	if err != nil || got.Offset != 10 {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+	f, err := us.Open(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(f)
+	f.Close()
+	if string(b) != "0123456789" {
+		t.Errorf("got bytes %q", b)
+	}
+
+	err = us.Complete(ctx, got)
+	if err != nil || got.CompletedAt == nil {
+		t.Fatalf("got %+v, %v, want it completed", got, err)
+	}
+	if _, err := os.Stat(us.Files.Path(got.ID)); !os.IsNotExist(err) {
+		t.Errorf("the file is still there: %v", err)
+	}
+	if got, _ := us.Usage(ctx, bob.ID); got != usage {
+		t.Errorf("got usage %d, want the completed upload left out", got)
+	}
+
+	// expired uploads are deleted, with their files
+	old, err := us.Create(ctx, bob.ID, gallery.ID, "old.png", 10, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := us.ByID(ctx, bob.ID, old.ID); err != models.ErrNotFound {
+		t.Errorf("expired upload: got %v, want ErrNotFound", err)
+	}
+	n, err := us.DeleteExpired(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("got %d, %v, want the expired upload deleted", n, err)
+	}
+	if _, err := os.Stat(us.Files.Path(old.ID)); !os.IsNotExist(err) {
+		t.Errorf("the file of the expired upload is still there: %v", err)
+	}
+
+	if err := us.Delete(ctx, carol.ID, upload.ID); err != models.ErrNotFound {
+		t.Errorf("deleting someone else's upload: got %v, want ErrNotFound", err)
+	}
+	if err := us.Delete(ctx, bob.ID, upload.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, tx, "uploads", "user_id = $1", bob.ID); n != 0 {
+		t.Errorf("got %d uploads left", n)
+	}
+}
@@ -1,10 +1,12 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
@@ -15,13 +17,23 @@ type User struct {
 	ID           int
 	Email        string
 	PasswordHash string
+	// DisabledAt is set once an admin disables the account, which stops the
+	// user from signing in
+	DisabledAt *time.Time
+	Role       Role
+	// Impersonator is the admin acting as this user. It is only set on the
+	// user of a session, while an admin impersonates them
+	Impersonator *User
 }
 
 type UserService struct {
-	DB *sql.DB
+	DB DBTX
+	// QueryTimeout bounds the queries of each call. Defaults to
+	// DefaultQueryTimeout.
+	QueryTimeout time.Duration
 }
 
-func (s *UserService) Create(email, password string) (*User, error) {
+func (s *UserService) Create(ctx context.Context, email, password string) (*User, error) {
 	email = strings.ToLower(email)
 
 	hashedBytes, err := bcrypt.GenerateFromPassword(
@@ -30,6 +42,10 @@ func (s *UserService) Create(email, password string) (*User, error) {
 		return nil, fmt.Errorf("create user: %w", err)
 	}
 
+	// hashing is slow on purpose, the query timeout only starts now
+	ctx, cancel := withTimeout(ctx, s.QueryTimeout)
+	defer cancel()
+
 	passwordHash := string(hashedBytes)
 
 	user := User{
@@ -37,11 +53,11 @@ func (s *UserService) Create(email, password string) (*User, error) {
 		PasswordHash: passwordHash,
 	}
 
-	row := s.DB.QueryRow(
+	row := conn(ctx, s.DB).QueryRowContext(ctx,
 		`INSERT INTO users (email, password_hash)
-		VALUES ($1, $2) RETURNING id`, email, passwordHash)
+		VALUES ($1, $2) RETURNING id, role`, email, passwordHash)
 
-	err = row.Scan(&user.ID)
+	err = row.Scan(&user.ID, &user.Role)
 	if err != nil {
 		// see if we can use this error as a PgError
 		var pgError *pgconn.PgError
@@ -56,15 +72,21 @@ func (s *UserService) Create(email, password string) (*User, error) {
 	return &user, nil
 }
 
-func (s *UserService) Authenticate(email, password string) (*User, error) {
+func (s *UserService) Authenticate(ctx context.Context, email, password string) (*User, error) {
+	ctx, cancel := withTimeout(ctx, s.QueryTimeout)
+	defer cancel()
+
 	email = strings.ToLower(email)
 	user := User{Email: email}
 
-	err := s.DB.QueryRow(
-		`SELECT id, users.password_hash FROM users WHERE email=$1`,
+	err := conn(ctx, s.DB).QueryRowContext(ctx,
+		`SELECT id, users.password_hash, disabled_at, role FROM users WHERE email=$1`,
 		email,
-	).Scan(&user.ID, &user.PasswordHash)
+	).Scan(&user.ID, &user.PasswordHash, &user.DisabledAt, &user.Role)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
 		return nil, fmt.Errorf("authenticate: %w", err)
 	}
 
@@ -73,18 +95,26 @@ func (s *UserService) Authenticate(email, password string) (*User, error) {
 		return nil, fmt.Errorf("authenticate: %w", err)
 	}
 
+	// only tell someone who knows the password that the account is disabled
+	if user.DisabledAt != nil {
+		return nil, ErrDisabled
+	}
+
 	return &user, nil
 }
 
-func (us *UserService) UpdatePassword(userID int, password string) error {
+func (us *UserService) UpdatePassword(ctx context.Context, userID int, password string) error {
 	hashedBytes, err := bcrypt.GenerateFromPassword(
 		[]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return fmt.Errorf("update password: %w", err)
 	}
 
+	ctx, cancel := withTimeout(ctx, us.QueryTimeout)
+	defer cancel()
+
 	passwordHash := string(hashedBytes)
-	_, err = us.DB.Exec(`
+	_, err = conn(ctx, us.DB).ExecContext(ctx, `
 		UPDATE users
 		SET password_hash = $2
 		WHERE id = $1;`, userID, passwordHash)
@@ -94,3 +124,150 @@ func (us *UserService) UpdatePassword(userID int, password string) error {
 
 	return nil
 }
+
+// Delete removes the user. Their sessions and password resets are removed by
+// the database through ON DELETE CASCADE, while galleries have to be deleted
+// first or the foreign key stops the deletion.
+func (us *UserService) Delete(ctx context.Context, id int) error {
+	ctx, cancel := withTimeout(ctx, us.QueryTimeout)
+	defer cancel()
+
+	res, err := conn(ctx, us.DB).ExecContext(ctx, `
+		DELETE FROM users
+		WHERE id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("delete user: %w", err)
+	}
+
+	return notFoundIfNone(res, "delete user")
+}
+
+// ByID looks up a user by id, returning ErrNotFound if there is none.
+func (us *UserService) ByID(ctx context.Context, id int) (*User, error) {
+	ctx, cancel := withTimeout(ctx, us.QueryTimeout)
+	defer cancel()
+
+	user := User{ID: id}
+	err := conn(ctx, us.DB).QueryRowContext(ctx, `
+		SELECT email, password_hash, disabled_at, role
+		FROM users
+		WHERE id = $1;`, id).Scan(&user.Email, &user.PasswordHash, &user.DisabledAt, &user.Role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query user by id: %w", err)
+	}
+
+	return &user, nil
+}
+
+// ByEmail looks up a user by email, in any case, returning ErrNotFound if
+// there is none.
+func (us *UserService) ByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, cancel := withTimeout(ctx, us.QueryTimeout)
+	defer cancel()
+
+	user := User{Email: strings.ToLower(email)}
+	err := conn(ctx, us.DB).QueryRowContext(ctx, `
+		SELECT id, password_hash, disabled_at, role
+		FROM users
+		WHERE email = $1;`, user.Email).Scan(&user.ID, &user.PasswordHash, &user.DisabledAt, &user.Role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query user by email: %w", err)
+	}
+
+	return &user, nil
+}
+
+// List returns up to limit users ordered by id, skipping the first offset.
+func (us *UserService) List(ctx context.Context, limit, offset int) ([]User, error) {
+	return us.Search(ctx, "", limit, offset)
+}
+
+// Search is List restricted to the users whose email contains query, in any
+// case. An empty query matches everyone.
+func (us *UserService) Search(ctx context.Context, query string, limit, offset int) ([]User, error) {
+	ctx, cancel := withTimeout(ctx, us.QueryTimeout)
+	defer cancel()
+
+	// strpos rather than LIKE, so % and _ in the query have no special meaning
+	rows, err := conn(ctx, us.DB).QueryContext(ctx, `
+		SELECT id, email, password_hash, disabled_at, role
+		FROM users
+		WHERE strpos(email, $1) > 0
+		ORDER BY id
+		LIMIT $2 OFFSET $3;`, strings.ToLower(query), limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		err := rows.Scan(&user.ID, &user.Email, &user.PasswordHash,
+			&user.DisabledAt, &user.Role)
+		if err != nil {
+			return nil, fmt.Errorf("list users: %w", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+
+	return users, nil
+}
+
+// Disable stops the user from signing in and makes their sessions stop
+// working. Disabling a disabled user keeps the original DisabledAt.
+func (us *UserService) Disable(ctx context.Context, id int) error {
+	ctx, cancel := withTimeout(ctx, us.QueryTimeout)
+	defer cancel()
+
+	res, err := conn(ctx, us.DB).ExecContext(ctx, `
+		UPDATE users
+		SET disabled_at = COALESCE(disabled_at, now())
+		WHERE id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("disable user: %w", err)
+	}
+
+	return notFoundIfNone(res, "disable user")
+}
+
+// Enable undoes Disable.
+func (us *UserService) Enable(ctx context.Context, id int) error {
+	ctx, cancel := withTimeout(ctx, us.QueryTimeout)
+	defer cancel()
+
+	res, err := conn(ctx, us.DB).ExecContext(ctx, `
+		UPDATE users
+		SET disabled_at = NULL
+		WHERE id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("enable user: %w", err)
+	}
+
+	return notFoundIfNone(res, "enable user")
+}
+
+// SetRole changes the role of the user.
+func (us *UserService) SetRole(ctx context.Context, id int, role Role) error {
+	ctx, cancel := withTimeout(ctx, us.QueryTimeout)
+	defer cancel()
+
+	res, err := conn(ctx, us.DB).ExecContext(ctx, `
+		UPDATE users
+		SET role = $2
+		WHERE id = $1;`, id, role)
+	if err != nil {
+		return fmt.Errorf("set user role: %w", err)
+	}
+
+	return notFoundIfNone(res, "set user role")
+}
@@ -0,0 +1,349 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/rafaelmdurante/lenslocked/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestUserServiceCreate(t *testing.T) {
+	tests := []struct {
+		name      string
+		existing  string
+		email     string
+		wantEmail string
+		wantErr   error
+	}{
+		{name: "new user", email: "bob@example.com", wantEmail: "bob@example.com"},
+		{name: "email is lower cased", email: "Bob@Example.COM", wantEmail: "bob@example.com"},
+		{name: "email taken", existing: "bob@example.com", email: "bob@example.com", wantErr: models.ErrEmailToken},
+		{name: "email taken in other case", existing: "bob@example.com", email: "BOB@example.com", wantErr: models.ErrEmailToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := testDB.Tx(t)
+			us := models.UserService{DB: tx}
+			if tt.existing != "" {
+				createUser(t, tx, tt.existing, "secret")
+			}
+
+			user, err := us.Create(context.Background(), tt.email, "secret")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if user.ID == 0 {
+				t.Error("got no id")
+			}
+			if user.Email != tt.wantEmail {
+				t.Errorf("got email %q, want %q", user.Email, tt.wantEmail)
+			}
+			err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte("secret"))
+			if err != nil {
+				t.Errorf("password hash does not match: %v", err)
+			}
+			if n := count(t, tx, "users", "id = $1 AND email = $2", user.ID, tt.wantEmail); n != 1 {
+				t.Errorf("got %d rows, want 1", n)
+			}
+		})
+	}
+}
+
+func TestUserServiceAuthenticate(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		wantErr  error
+	}{
+		{name: "valid", email: "bob@example.com", password: "secret"},
+		{name: "email in other case", email: "BOB@example.com", password: "secret"},
+		{name: "wrong password", email: "bob@example.com", password: "wrong",
+			wantErr: bcrypt.ErrMismatchedHashAndPassword},
+		{name: "unknown email", email: "alice@example.com", password: "secret", wantErr: models.ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := testDB.Tx(t)
+			us := models.UserService{DB: tx}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+
+			user, err := us.Authenticate(context.Background(), tt.email, tt.password)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.ID != bob.ID {
+				t.Errorf("got user %d, want %d", user.ID, bob.ID)
+			}
+		})
+	}
+}
+
+func TestUserServiceUpdatePassword(t *testing.T) {
+	tests := []struct {
+		name string
+		// other updates a user that doesn't exist, which is not an error
+		other bool
+	}{
+		{name: "existing user"},
+		{name: "unknown user", other: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tx := testDB.Tx(t)
+			us := models.UserService{DB: tx}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+
+			id := bob.ID
+			if tt.other {
+				id = bob.ID + 1000
+			}
+			err := us.UpdatePassword(ctx, id, "new secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = us.Authenticate(ctx, "bob@example.com", "new secret")
+			if tt.other == (err == nil) {
+				t.Errorf("authenticate with new password: %v", err)
+			}
+			_, err = us.Authenticate(ctx, "bob@example.com", "secret")
+			if tt.other != (err == nil) {
+				t.Errorf("authenticate with old password: %v", err)
+			}
+		})
+	}
+}
+
+func TestUserServiceDelete(t *testing.T) {
+	tests := []struct {
+		name       string
+		unknown    bool
+		hasGallery bool
+		wantErr    error
+		wantFK     bool
+	}{
+		{name: "cascades to sessions and resets"},
+		{name: "unknown user", unknown: true, wantErr: models.ErrNotFound},
+		{name: "user with galleries", hasGallery: true, wantFK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tx := testDB.Tx(t)
+			us := models.UserService{DB: tx}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+
+			ss := models.SessionService{DB: tx}
+			_, err := ss.Create(ctx, bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prs := models.PasswordResetService{DB: tx}
+			_, err = prs.Create(ctx, bob.Email)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.hasGallery {
+				gs := models.GalleryService{DB: tx}
+				_, err = gs.Create(ctx, "Holidays", bob.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			id := bob.ID
+			if tt.unknown {
+				id = bob.ID + 1000
+			}
+			err = us.Delete(ctx, id)
+
+			if tt.wantFK {
+				var pgErr *pgconn.PgError
+				if !errors.As(err, &pgErr) || pgErr.Code != pgerrcode.ForeignKeyViolation {
+					t.Fatalf("got error %v, want a foreign key violation", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			wantRows := 0
+			if tt.unknown {
+				wantRows = 1
+			}
+			for _, table := range []string{"users", "sessions", "password_resets"} {
+				column := "user_id"
+				if table == "users" {
+					column = "id"
+				}
+				if n := count(t, tx, table, column+" = $1", bob.ID); n != wantRows {
+					t.Errorf("%s: got %d rows, want %d", table, n, wantRows)
+				}
+			}
+		})
+	}
+}
+
+func TestUserServiceByIDAndEmail(t *testing.T) {
+	tests := []struct {
+		name    string
+		lookup  func(us *models.UserService, bob *models.User) (*models.User, error)
+		wantErr error
+	}{
+		{
+			name: "by id",
+			lookup: func(us *models.UserService, bob *models.User) (*models.User, error) {
+				return us.ByID(context.Background(), bob.ID)
+			},
+		},
+		{
+			name: "unknown id",
+			lookup: func(us *models.UserService, bob *models.User) (*models.User, error) {
+				return us.ByID(context.Background(), bob.ID+1000)
+			},
+			wantErr: models.ErrNotFound,
+		},
+		{
+			name: "by email in any case",
+			lookup: func(us *models.UserService, bob *models.User) (*models.User, error) {
+				return us.ByEmail(context.Background(), "BOB@example.com")
+			},
+		},
+		{
+			name: "unknown email",
+			lookup: func(us *models.UserService, bob *models.User) (*models.User, error) {
+				return us.ByEmail(context.Background(), "alice@example.com")
+			},
+			wantErr: models.ErrNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := testDB.Tx(t)
+			us := models.UserService{DB: tx}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+
+			user, err := tt.lookup(&us, bob)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && *user != *bob {
+				t.Errorf("got %+v, want %+v", *user, *bob)
+			}
+		})
+	}
+}
+
+func TestUserServiceList(t *testing.T) {
+	tests := []struct {
+		name       string
+		limit      int
+		offset     int
+		wantEmails []string
+	}{
+		{name: "all", limit: 10, wantEmails: []string{"a@example.com", "b@example.com", "c@example.com"}},
+		{name: "limit", limit: 2, wantEmails: []string{"a@example.com", "b@example.com"}},
+		{name: "offset", limit: 10, offset: 1, wantEmails: []string{"b@example.com", "c@example.com"}},
+		{name: "past the end", limit: 10, offset: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := testDB.Tx(t)
+			us := models.UserService{DB: tx}
+			for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+				createUser(t, tx, email, "secret")
+			}
+
+			users, err := us.List(context.Background(), tt.limit, tt.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var emails []string
+			for _, user := range users {
+				emails = append(emails, user.Email)
+			}
+			if strings.Join(emails, ",") != strings.Join(tt.wantEmails, ",") {
+				t.Errorf("got %v, want %v", emails, tt.wantEmails)
+			}
+		})
+	}
+}
+
+func TestUserServiceDisableEnable(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      func(us *models.UserService, ctx context.Context, id int) error
+		unknown bool
+		wantErr error
+		// wantDisabled is whether bob, disabled beforehand, ends up disabled
+		wantDisabled bool
+	}{
+		{name: "disable again", op: (*models.UserService).Disable, wantDisabled: true},
+		{name: "enable", op: (*models.UserService).Enable, wantDisabled: false},
+		{name: "disable unknown", op: (*models.UserService).Disable, unknown: true, wantErr: models.ErrNotFound, wantDisabled: true},
+		{name: "enable unknown", op: (*models.UserService).Enable, unknown: true, wantErr: models.ErrNotFound, wantDisabled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tx := testDB.Tx(t)
+			us := models.UserService{DB: tx}
+			bob := createUser(t, tx, "bob@example.com", "secret")
+
+			err := us.Disable(ctx, bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = us.Authenticate(ctx, "bob@example.com", "secret")
+			if !errors.Is(err, models.ErrDisabled) {
+				t.Fatalf("authenticate disabled user: got error %v, want %v", err, models.ErrDisabled)
+			}
+			disabled, err := us.ByID(ctx, bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id := bob.ID
+			if tt.unknown {
+				id = bob.ID + 1000
+			}
+			err = tt.op(&us, ctx, id)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			user, err := us.ByID(ctx, bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (user.DisabledAt != nil) != tt.wantDisabled {
+				t.Fatalf("got disabled at %v, want disabled: %v", user.DisabledAt, tt.wantDisabled)
+			}
+			if tt.wantDisabled && !user.DisabledAt.Equal(*disabled.DisabledAt) {
+				t.Errorf("disabled at changed from %v to %v", *disabled.DisabledAt, *user.DisabledAt)
+			}
+			_, err = us.Authenticate(ctx, "bob@example.com", "secret")
+			if tt.wantDisabled != errors.Is(err, models.ErrDisabled) {
+				t.Errorf("authenticate: got error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,395 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/rand"
+)
+
+// WebhookSecretPrefix starts every webhook secret, like APITokenPrefix.
+const WebhookSecretPrefix = "whsec_"
+
+// WebhookEvent is what a webhook can be notified of.
+type WebhookEvent string
+
+const (
+	WebhookGalleryCreated WebhookEvent = "gallery.created"
+	WebhookImageUploaded  WebhookEvent = "image.uploaded"
+	WebhookGalleryDeleted WebhookEvent = "gallery.deleted"
+)
+
+// WebhookEvents lists every event, in the order to offer them.
+var WebhookEvents = []WebhookEvent{
+	WebhookGalleryCreated,
+	WebhookImageUploaded,
+	WebhookGalleryDeleted,
+}
+
+var webhookEventDescriptions = map[WebhookEvent]string{
+	WebhookGalleryCreated: "A gallery was created",
+	WebhookImageUploaded:  "An image was uploaded to a gallery",
+	WebhookGalleryDeleted: "A gallery was deleted, by you or a moderator",
+}
+
+// Description is how the event is shown to people.
+func (e WebhookEvent) Description() string {
+	return webhookEventDescriptions[e]
+}
+
+// ParseWebhookEvents works like ParseScopes, for events.
+func ParseWebhookEvents(names []string) ([]WebhookEvent, error) {
+	var events []WebhookEvent
+	for _, name := range names {
+		event := WebhookEvent(name)
+		if !slices.Contains(WebhookEvents, event) {
+			return nil, fmt.Errorf("unknown webhook event %q", name)
+		}
+		if !slices.Contains(events, event) {
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+// Webhook is an endpoint of a user, sent the events it subscribed to.
+type Webhook struct {
+	ID     int
+	UserID int
+	URL    string
+	// Secret signs the payloads, for the endpoint to check they come from us
+	Secret    string
+	Events    []WebhookEvent
+	CreatedAt time.Time
+}
+
+// Subscribed reports whether the webhook is sent event.
+func (w *Webhook) Subscribed(event WebhookEvent) bool {
+	return slices.Contains(w.Events, event)
+}
+
+// WebhookDelivery is an event sent, or to be sent, to a webhook.
+type WebhookDelivery struct {
+	ID        int64
+	WebhookID int
+	Event     WebhookEvent
+	// Payload is the JSON body
+	Payload  string
+	Attempts int
+	// NextAttemptAt is nil once the delivery is done, whether it succeeded
+	// or was given up on
+	NextAttemptAt *time.Time
+	// StatusCode and Error are the outcome of the last attempt. StatusCode is
+	// 0 when there was no response.
+	StatusCode  int
+	Error       string
+	DeliveredAt *time.Time
+	CreatedAt   time.Time
+}
+
+// Pending reports whether the delivery will be attempted (again).
+func (d *WebhookDelivery) Pending() bool {
+	return d.NextAttemptAt != nil
+}
+
+// WebhookJob is a delivery claimed to be attempted, along with where it goes.
+type WebhookJob struct {
+	Delivery WebhookDelivery
+	URL      string
+	Secret   string
+}
+
+func joinWebhookEvents(events []WebhookEvent) string {
+	names := make([]string, 0, len(events))
+	for _, event := range events {
+		names = append(names, string(event))
+	}
+	return strings.Join(names, " ")
+}
+
+func splitWebhookEvents(s string) []WebhookEvent {
+	var events []WebhookEvent
+	for _, name := range strings.Fields(s) {
+		events = append(events, WebhookEvent(name))
+	}
+	return events
+}
+
+// WebhookService stores the webhooks and is the queue of their deliveries.
+type WebhookService struct {
+	DB DBTX
+	// QueryTimeout bounds the queries of each call. Defaults to
+	// DefaultQueryTimeout.
+	QueryTimeout time.Duration
+}
+
+// Create adds a webhook with a new secret.
+func (ws *WebhookService) Create(ctx context.Context, userID int, url string, events []WebhookEvent) (*Webhook, error) {
+	ctx, cancel := withTimeout(ctx, ws.QueryTimeout)
+	defer cancel()
+
+	secret, err := rand.String(MinBytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create webhook: %w", err)
+	}
+
+	w := Webhook{
+		UserID: userID,
+		URL:    url,
+		Secret: WebhookSecretPrefix + secret,
+		Events: events,
+	}
+	row := conn(ctx, ws.DB).QueryRowContext(ctx, `
+		INSERT INTO webhooks (user_id, url, secret, events)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at;`,
+		w.UserID, w.URL, w.Secret, joinWebhookEvents(w.Events))
+	err = row.Scan(&w.ID, &w.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create webhook: %w", err)
+	}
+
+	return &w, nil
+}
+
+// ByUserID returns the webhooks of a user, the latest first.
+func (ws *WebhookService) ByUserID(ctx context.Context, userID int) ([]Webhook, error) {
+	ctx, cancel := withTimeout(ctx, ws.QueryTimeout)
+	defer cancel()
+
+	rows, err := conn(ctx, ws.DB).QueryContext(ctx, `
+		SELECT id, url, secret, events, created_at
+		FROM webhooks
+		WHERE user_id = $1
+		ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query webhooks by user: %w", err)
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		w := Webhook{UserID: userID}
+		var events string
+		err := rows.Scan(&w.ID, &w.URL, &w.Secret, &events, &w.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query webhooks by user: %w", err)
+		}
+		w.Events = splitWebhookEvents(events)
+		webhooks = append(webhooks, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query webhooks by user: %w", err)
+	}
+
+	return webhooks, nil
+}
+
+// ByID returns a webhook of the user. Webhooks of other users are not found.
+func (ws *WebhookService) ByID(ctx context.Context, userID, id int) (*Webhook, error) {
+	ctx, cancel := withTimeout(ctx, ws.QueryTimeout)
+	defer cancel()
+
+	w := Webhook{ID: id, UserID: userID}
+	var events string
+	row := conn(ctx, ws.DB).QueryRowContext(ctx, `
+		SELECT url, secret, events, created_at
+		FROM webhooks
+		WHERE id = $1 AND user_id = $2`, id, userID)
+	err := row.Scan(&w.URL, &w.Secret, &events, &w.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query webhook by id: %w", err)
+	}
+	w.Events = splitWebhookEvents(events)
+
+	return &w, nil
+}
+
+// Delete removes a webhook of the user along with its deliveries.
+func (ws *WebhookService) Delete(ctx context.Context, userID, id int) error {
+	ctx, cancel := withTimeout(ctx, ws.QueryTimeout)
+	defer cancel()
+
+	res, err := conn(ctx, ws.DB).ExecContext(ctx, `
+		DELETE FROM webhooks
+		WHERE id = $1 AND user_id = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("delete webhook: %w", err)
+	}
+
+	return notFoundIfNone(res, "delete webhook")
+}
+
+// Enqueue queues a delivery of the payload to each webhook of the user
+// subscribed to event, and returns how many there are.
+func (ws *WebhookService) Enqueue(ctx context.Context, userID int, event WebhookEvent, payload []byte) (int, error) {
+	ctx, cancel := withTimeout(ctx, ws.QueryTimeout)
+	defer cancel()
+
+	res, err := conn(ctx, ws.DB).ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, next_attempt_at)
+		SELECT id, $2, $3, now()
+		FROM webhooks
+		WHERE user_id = $1
+			AND strpos(' ' || events || ' ', ' ' || $2 || ' ') > 0;`,
+		userID, event, string(payload))
+	if err != nil {
+		return 0, fmt.Errorf("enqueue webhook deliveries: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("enqueue webhook deliveries: %w", err)
+	}
+
+	return int(n), nil
+}
+
+// Deliveries returns the latest deliveries of a webhook, up to limit.
+func (ws *WebhookService) Deliveries(ctx context.Context, webhookID, limit int) ([]WebhookDelivery, error) {
+	ctx, cancel := withTimeout(ctx, ws.QueryTimeout)
+	defer cancel()
+
+	rows, err := conn(ctx, ws.DB).QueryContext(ctx, `
+		SELECT id, event, payload, attempts, next_attempt_at, status_code,
+			error, delivered_at, created_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY id DESC
+		LIMIT $2`, webhookID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("query webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		d := WebhookDelivery{WebhookID: webhookID}
+		err := rows.Scan(&d.ID, &d.Event, &d.Payload, &d.Attempts, &d.NextAttemptAt,
+			&d.StatusCode, &d.Error, &d.DeliveredAt, &d.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query webhook deliveries: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query webhook deliveries: %w", err)
+	}
+
+	return deliveries, nil
+}
+
+// Redeliver queues a copy of a delivery of the webhook, due now. The
+// original stays in the log as it was.
+func (ws *WebhookService) Redeliver(ctx context.Context, webhookID int, id int64) (*WebhookDelivery, error) {
+	ctx, cancel := withTimeout(ctx, ws.QueryTimeout)
+	defer cancel()
+
+	var d WebhookDelivery
+	row := conn(ctx, ws.DB).QueryRowContext(ctx, `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, next_attempt_at)
+		SELECT webhook_id, event, payload, now()
+		FROM webhook_deliveries
+		WHERE id = $1 AND webhook_id = $2
+		RETURNING id, webhook_id, event, payload, next_attempt_at, created_at;`, id, webhookID)
+	err := row.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.NextAttemptAt, &d.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("redeliver webhook delivery: %w", err)
+	}
+
+	return &d, nil
+}
+
+// Claim takes up to limit due deliveries to attempt them, counting the
+// attempt. They are not due again until lease has passed, so other servers
+// don't attempt them too, and a server stopping halfway doesn't lose them:
+// the lease must be longer than an attempt takes.
+func (ws *WebhookService) Claim(ctx context.Context, limit int, lease time.Duration) ([]WebhookJob, error) {
+	ctx, cancel := withTimeout(ctx, ws.QueryTimeout)
+	defer cancel()
+
+	rows, err := conn(ctx, ws.DB).QueryContext(ctx, `
+		WITH due AS (
+			SELECT id
+			FROM webhook_deliveries
+			WHERE next_attempt_at <= now()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE webhook_deliveries d
+		SET attempts = d.attempts + 1,
+			next_attempt_at = now() + $2 * interval '1 millisecond'
+		FROM due, webhooks w
+		WHERE d.id = due.id AND w.id = d.webhook_id
+		RETURNING d.id, d.webhook_id, d.event, d.payload, d.attempts,
+			d.next_attempt_at, d.status_code, d.error, d.created_at,
+			w.url, w.secret;`, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, fmt.Errorf("claim webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []WebhookJob
+	for rows.Next() {
+		var job WebhookJob
+		d := &job.Delivery
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Attempts,
+			&d.NextAttemptAt, &d.StatusCode, &d.Error, &d.CreatedAt,
+			&job.URL, &job.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("claim webhook deliveries: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("claim webhook deliveries: %w", err)
+	}
+
+	return jobs, nil
+}
+
+// Delivered marks a delivery as done, with the status code of the response.
+func (ws *WebhookService) Delivered(ctx context.Context, id int64, statusCode int) error {
+	ctx, cancel := withTimeout(ctx, ws.QueryTimeout)
+	defer cancel()
+
+	res, err := conn(ctx, ws.DB).ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status_code = $2, error = '', delivered_at = now(),
+			next_attempt_at = NULL
+		WHERE id = $1;`, id, statusCode)
+	if err != nil {
+		return fmt.Errorf("mark webhook delivery delivered: %w", err)
+	}
+
+	return notFoundIfNone(res, "mark webhook delivery delivered")
+}
+
+// Failed records why an attempt failed. The delivery is attempted again at
+// retryAt, or given up on when it is nil.
+func (ws *WebhookService) Failed(ctx context.Context, id int64, statusCode int, message string, retryAt *time.Time) error {
+	ctx, cancel := withTimeout(ctx, ws.QueryTimeout)
+	defer cancel()
+
+	res, err := conn(ctx, ws.DB).ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status_code = $2, error = $3, next_attempt_at = $4
+		WHERE id = $1;`, id, statusCode, message, retryAt)
+	if err != nil {
+		return fmt.Errorf("mark webhook delivery failed: %w", err)
+	}
+
+	return notFoundIfNone(res, "mark webhook delivery failed")
+}
@@ -0,0 +1,132 @@
+package models_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+func TestParseWebhookEvents(t *testing.T) {
+	events, err := models.ParseWebhookEvents([]string{"image.uploaded", "gallery.created", "image.uploaded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0] != models.WebhookImageUploaded || events[1] != models.WebhookGalleryCreated {
+		t.Errorf("got %v, want image.uploaded and gallery.created once each", events)
+	}
+
+	_, err = models.ParseWebhookEvents([]string{"gallery.created", "user.deleted"})
+	if err == nil || !strings.Contains(err.Error(), `"user.deleted"`) {
+		t.Errorf("got error %v, want the unknown event named", err)
+	}
+}
+
+func TestWebhookService(t *testing.T) {
+	tx := testDB.Tx(t)
+	ctx := context.Background()
+	ws := models.WebhookService{DB: tx}
+
+	bob := createUser(t, tx, "bob@example.com", "secret")
+	carol := createUser(t, tx, "carol@example.com", "secret")
+
+	lab, err := ws.Create(ctx, bob.ID, "https://lab.example.com/hooks",
+		[]models.WebhookEvent{models.WebhookImageUploaded, models.WebhookGalleryCreated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(lab.Secret, models.WebhookSecretPrefix) {
+		t.Errorf("got secret %q, want the %s prefix", lab.Secret, models.WebhookSecretPrefix)
+	}
+	_, err = ws.Create(ctx, bob.ID, "https://other.example.com",
+		[]models.WebhookEvent{models.WebhookGalleryDeleted})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhooks, err := ws.ByUserID(ctx, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks) != 2 || webhooks[1].ID != lab.ID || !webhooks[1].Subscribed(models.WebhookImageUploaded) {
+		t.Errorf("got %+v, want both webhooks, the latest first", webhooks)
+	}
+	_, err = ws.ByID(ctx, carol.ID, lab.ID)
+	if err != models.ErrNotFound {
+		t.Errorf("someone else's webhook: got %v, want ErrNotFound", err)
+	}
+
+	// only the subscribed webhooks of the user get a delivery
+	n, err := ws.Enqueue(ctx, bob.ID, models.WebhookImageUploaded, []byte(`{"event":"image.uploaded"}`))
+	if err != nil || n != 1 {
+		t.Fatalf("got %d deliveries, %v, want 1", n, err)
+	}
+	n, err = ws.Enqueue(ctx, carol.ID, models.WebhookImageUploaded, []byte(`{}`))
+	if err != nil || n != 0 {
+		t.Fatalf("got %d deliveries for carol, %v, want none", n, err)
+	}
+
+	jobs, err := ws.Claim(ctx, 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].URL != lab.URL || jobs[0].Secret != lab.Secret ||
+		jobs[0].Delivery.Attempts != 1 || jobs[0].Delivery.Payload != `{"event":"image.uploaded"}` {
+		t.Fatalf("got jobs %+v, want the delivery to the lab", jobs)
+	}
+	// a claimed delivery isn't due until its lease is over
+	again, err := ws.Claim(ctx, 10, time.Minute)
+	if err != nil || len(again) != 0 {
+		t.Fatalf("got %+v, %v, want nothing due", again, err)
+	}
+
+	id := jobs[0].Delivery.ID
+	retryAt := time.Now().Add(-time.Second)
+	err = ws.Failed(ctx, id, 503, "status 503", &retryAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err = ws.Claim(ctx, 10, time.Minute)
+	if err != nil || len(jobs) != 1 || jobs[0].Delivery.Attempts != 2 || jobs[0].Delivery.StatusCode != 503 {
+		t.Fatalf("got %+v, %v, want the second attempt", jobs, err)
+	}
+	err = ws.Delivered(ctx, id, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries, err := ws.Deliveries(ctx, lab.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Pending() || deliveries[0].DeliveredAt == nil ||
+		deliveries[0].StatusCode != 200 || deliveries[0].Error != "" {
+		t.Fatalf("got %+v, want one delivered delivery", deliveries)
+	}
+
+	_, err = ws.Redeliver(ctx, webhooks[0].ID, id)
+	if err != models.ErrNotFound {
+		t.Errorf("redelivering the delivery of another webhook: got %v, want ErrNotFound", err)
+	}
+	copied, err := ws.Redeliver(ctx, lab.ID, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.ID == id || !copied.Pending() || copied.Payload != deliveries[0].Payload {
+		t.Errorf("got %+v, want a pending copy", copied)
+	}
+
+	err = ws.Delete(ctx, carol.ID, lab.ID)
+	if err != models.ErrNotFound {
+		t.Errorf("deleting someone else's webhook: got %v, want ErrNotFound", err)
+	}
+	err = ws.Delete(ctx, bob.ID, lab.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, tx, "webhook_deliveries", "webhook_id = $1", lab.ID); n != 0 {
+		t.Errorf("got %d deliveries left, want them deleted with the webhook", n)
+	}
+}
@@ -0,0 +1,24 @@
+package openapi
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+)
+
+//go:embed docs.html
+var docsHTML string
+
+var docsTemplate = template.Must(template.New("docs").Parse(docsHTML))
+
+// Docs serves a page browsing the document at specURL. It is self-contained,
+// nothing is loaded from elsewhere.
+func Docs(title, specURL string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := docsTemplate.Execute(w, struct{ Title, SpecURL string }{title, specURL})
+		if err != nil {
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		}
+	})
+}
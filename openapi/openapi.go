@@ -0,0 +1,190 @@
+// Package openapi describes an HTTP API with an OpenAPI 3 document, generated
+// from Go types rather than written by hand, and checks requests and
+// responses against it.
+//
+// It only implements the parts of the specification the app uses: JSON
+// bodies, path, query and header parameters, and object, array and scalar
+// schemas.
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Version is the version of the specification the documents follow.
+const Version = "3.0.3"
+
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+	// Security applies to the operations that don't set their own
+	Security []SecurityRequirement `json:"security,omitempty"`
+
+	// names are the Go types added with Component
+	names map[reflect.Type]string
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// PathItem holds the operations of a path by lower case method, e.g. "get".
+type PathItem map[string]*Operation
+
+type Operation struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []SecurityRequirement `json:"security,omitempty"`
+}
+
+// Parameter is a path, query or header parameter. Path parameters are always
+// required.
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Description string               `json:"description,omitempty"`
+	Required    bool                 `json:"required,omitempty"`
+	Content     map[string]MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Headers     map[string]Header    `json:"headers,omitempty"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type Header struct {
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas,omitempty"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// SecurityRequirement names a security scheme along with the scopes it needs.
+// Operations are allowed when any of their requirements is met.
+type SecurityRequirement map[string][]string
+
+// JSON is the media type of the JSON bodies.
+const JSON = "application/json"
+
+// New returns an empty document.
+func New(info Info) *Document {
+	return &Document{
+		OpenAPI: Version,
+		Info:    info,
+		Paths:   map[string]*PathItem{},
+		Components: Components{
+			Schemas:         map[string]*Schema{},
+			SecuritySchemes: map[string]SecurityScheme{},
+		},
+	}
+}
+
+// AddOperation adds op at the method and path, a template such as
+// "/galleries/{id}". Adding the same one twice is a programming error.
+func (d *Document) AddOperation(method, path string, op *Operation) {
+	item, ok := d.Paths[path]
+	if !ok {
+		item = &PathItem{}
+		d.Paths[path] = item
+	}
+	method = strings.ToLower(method)
+	if _, ok := (*item)[method]; ok {
+		panic(fmt.Sprintf("openapi: %s %s added twice", method, path))
+	}
+	(*item)[method] = op
+}
+
+// Find returns the operation matching the method and the path of a request,
+// along with its path template and parameters. ok is false when no path
+// matches, or the path has no such method. Like routers do, a literal segment
+// wins over a parameter: "/galleries/new" over "/galleries/{id}".
+func (d *Document) Find(method, path string) (op *Operation, template string, params map[string]string, ok bool) {
+	best := -1
+	for t := range d.Paths {
+		p, matched := matchPath(t, path)
+		if !matched {
+			continue
+		}
+		if best == -1 || len(p) < best || (len(p) == best && t < template) {
+			best, template, params = len(p), t, p
+		}
+	}
+	if best == -1 {
+		return nil, "", nil, false
+	}
+
+	op, ok = (*d.Paths[template])[strings.ToLower(method)]
+	return op, template, params, ok
+}
+
+// matchPath matches a path against a template, segment by segment. A
+// {param} segment matches any non-empty segment.
+func matchPath(template, path string) (map[string]string, bool) {
+	// a trailing slash is a segment of its own, like it is for routers
+	ts := strings.Split(strings.TrimPrefix(template, "/"), "/")
+	ps := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(ts) != len(ps) {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for i, t := range ts {
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			if ps[i] == "" {
+				return nil, false
+			}
+			params[t[1:len(t)-1]] = ps[i]
+			continue
+		}
+		if t != ps[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+// response returns the documented response for status, falling back to the
+// "default" one for server errors only: any other status has to be listed.
+func (op *Operation) response(status int) (*Response, error) {
+	if resp, ok := op.Responses[fmt.Sprint(status)]; ok {
+		return resp, nil
+	}
+	if resp, ok := op.Responses["default"]; ok && status >= http.StatusInternalServerError {
+		return resp, nil
+	}
+
+	return nil, fmt.Errorf("status %d is not documented", status)
+}
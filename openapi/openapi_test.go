@@ -0,0 +1,261 @@
+package openapi_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/openapi"
+)
+
+type owner struct {
+	Name string `json:"name" openapi:"minLength=1,maxLength=20"`
+}
+
+type pet struct {
+	ID         int       `json:"id" openapi:"minimum=1"`
+	Kind       string    `json:"kind" openapi:"enum=cat|dog"`
+	Tags       []string  `json:"tags,omitempty" doc:"what the pet is like"`
+	Owner      *owner    `json:"owner"`
+	BornAt     time.Time `json:"born_at"`
+	Weight     float64   `json:"weight"`
+	Vaccinated bool      `json:"vaccinated"`
+	secret     string
+	Ignored    string `json:"-"`
+}
+
+func newDoc() *openapi.Document {
+	doc := openapi.New(openapi.Info{Title: "pets", Version: "1"})
+	doc.Component("Owner", owner{})
+	doc.Component("Pet", pet{})
+	return doc
+}
+
+func TestSchema(t *testing.T) {
+	doc := newDoc()
+
+	b, err := json.Marshal(doc.Components.Schemas["Pet"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"type":"object","properties":{` +
+		`"born_at":{"type":"string","format":"date-time"},` +
+		`"id":{"type":"integer","format":"int32","minimum":1},` +
+		`"kind":{"type":"string","enum":["cat","dog"]},` +
+		`"owner":{"nullable":true,"allOf":[{"$ref":"#/components/schemas/Owner"}]},` +
+		`"tags":{"type":"array","description":"what the pet is like","items":{"type":"string"}},` +
+		`"vaccinated":{"type":"boolean"},` +
+		`"weight":{"type":"number"}},` +
+		`"required":["id","kind","born_at","weight","vaccinated"],` +
+		`"additionalProperties":false}`
+	if string(b) != want {
+		t.Errorf("got schema\n%s\nwant\n%s", b, want)
+	}
+
+	if ref := doc.Schema([]pet{}).Items.Ref; ref != "#/components/schemas/Pet" {
+		t.Errorf("got items %q, want a reference to Pet", ref)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	doc := newDoc()
+	valid := `{"id": 1, "kind": "cat", "owner": null, "born_at": "2020-01-02T03:04:05Z", "weight": 4.5, "vaccinated": true}`
+
+	tests := []struct {
+		name string
+		json string
+		// problem is part of the error, empty when valid
+		problem string
+	}{
+		{"Valid", valid, ""},
+		{"Owner", strings.Replace(valid, "null", `{"name": "Bob"}`, 1), ""},
+		{"Tags", strings.Replace(valid, `"id": 1`, `"id": 1, "tags": ["fluffy"]`, 1), ""},
+		{"Missing field", strings.Replace(valid, `"id": 1,`, ``, 1), "body: id is required"},
+		{"Unknown field", strings.Replace(valid, `"id": 1`, `"id": 1, "age": 3`, 1), "body: unknown field age"},
+		{"Not an integer", strings.Replace(valid, `"id": 1`, `"id": 1.5`, 1), "body.id: must be an integer"},
+		{"Below minimum", strings.Replace(valid, `"id": 1`, `"id": 0`, 1), "body.id: must be at least 1"},
+		{"Not in enum", strings.Replace(valid, `"cat"`, `"fish"`, 1), "body.kind: must be one of cat, dog"},
+		{"Not a date", strings.Replace(valid, `"2020-01-02T03:04:05Z"`, `"yesterday"`, 1), "body.born_at: must be a date-time"},
+		{"Null", strings.Replace(valid, `4.5`, `null`, 1), "body.weight: must not be null"},
+		{"Wrong type", strings.Replace(valid, `true`, `"yes"`, 1), "body.vaccinated: must be a boolean"},
+		{"Nested", strings.Replace(valid, "null", `{"name": ""}`, 1), "body.owner.name: must be at least 1 characters long"},
+		{"Too long", strings.Replace(valid, "null", `{"name": "Bartholomew the Third!"}`, 1),
+			"body.owner.name: must be at most 20 characters long"},
+		{"Array item", strings.Replace(valid, `"id": 1`, `"id": 1, "tags": [3]`, 1), "body.tags[0]: must be a string"},
+		{"Not an object", `[]`, "body: must be an object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v any
+			err := json.Unmarshal([]byte(tt.json), &v)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = doc.Validate(openapi.Ref("Pet"), v)
+			switch {
+			case tt.problem == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case tt.problem != "" && (err == nil || !strings.Contains(err.Error(), tt.problem)):
+				t.Errorf("got error %v, want %q", err, tt.problem)
+			}
+		})
+	}
+}
+
+func TestFind(t *testing.T) {
+	doc := openapi.New(openapi.Info{Title: "pets", Version: "1"})
+	list := &openapi.Operation{OperationID: "list"}
+	get := &openapi.Operation{OperationID: "get"}
+	search := &openapi.Operation{OperationID: "search"}
+	doc.AddOperation(http.MethodGet, "/pets", list)
+	doc.AddOperation(http.MethodGet, "/pets/{id}", get)
+	doc.AddOperation(http.MethodGet, "/pets/search", search)
+
+	tests := []struct {
+		method, path string
+		op           *openapi.Operation
+		params       map[string]string
+	}{
+		{http.MethodGet, "/pets", list, map[string]string{}},
+		{http.MethodGet, "/pets/7", get, map[string]string{"id": "7"}},
+		{http.MethodGet, "/pets/search", search, map[string]string{}},
+		{http.MethodPost, "/pets", nil, nil},
+		{http.MethodGet, "/pets/7/toys", nil, nil},
+		{http.MethodGet, "/pets//", nil, nil},
+	}
+	for _, tt := range tests {
+		op, _, params, ok := doc.Find(tt.method, tt.path)
+		if tt.op == nil {
+			if ok {
+				t.Errorf("%s %s: found %s, want nothing", tt.method, tt.path, op.OperationID)
+			}
+			continue
+		}
+		if !ok || op != tt.op {
+			t.Errorf("%s %s: got %v, want %s", tt.method, tt.path, op, tt.op.OperationID)
+			continue
+		}
+		if len(params) != len(tt.params) || params["id"] != tt.params["id"] {
+			t.Errorf("%s %s: got params %v, want %v", tt.method, tt.path, params, tt.params)
+		}
+	}
+}
+
+func TestValidateResponse(t *testing.T) {
+	doc := newDoc()
+	doc.AddOperation(http.MethodGet, "/pets/{id}", &openapi.Operation{
+		OperationID: "getPet",
+		Responses: map[string]*openapi.Response{
+			"200": {
+				Description: "The pet.",
+				Headers:     map[string]openapi.Header{"ETag": {Schema: openapi.String()}},
+				Content:     map[string]openapi.MediaType{openapi.JSON: {Schema: openapi.Ref("Pet")}},
+			},
+			"204":     {Description: "Nothing."},
+			"default": {Description: "Oops.", Content: map[string]openapi.MediaType{openapi.JSON: {Schema: openapi.String()}}},
+		},
+	})
+	jsonHeader := http.Header{"Content-Type": {"application/json; charset=utf-8"}, "Etag": {`"1"`}}
+	pet := `{"id": 1, "kind": "dog", "owner": null, "born_at": "2020-01-02T03:04:05Z", "weight": 30, "vaccinated": false}`
+
+	tests := []struct {
+		name    string
+		status  int
+		header  http.Header
+		body    string
+		problem string
+	}{
+		{"Valid", http.StatusOK, jsonHeader, pet, ""},
+		{"Invalid body", http.StatusOK, jsonHeader, `{"id": 1}`, "body: kind is required"},
+		{"Missing header", http.StatusOK, http.Header{"Content-Type": {"application/json"}}, pet, "header ETag: is missing"},
+		{"Wrong content type", http.StatusOK, http.Header{"Content-Type": {"text/html"}, "Etag": {`"1"`}}, pet, "undocumented content type"},
+		{"Empty", http.StatusNoContent, http.Header{}, "", ""},
+		{"Not empty", http.StatusNoContent, http.Header{}, "hi", "body: must be empty"},
+		{"Undocumented", http.StatusNotFound, jsonHeader, `"gone"`, "status 404 is not documented"},
+		{"Server error", http.StatusServiceUnavailable, jsonHeader, `"down"`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := doc.ValidateResponse(http.MethodGet, "/pets/1", tt.status, tt.header, []byte(tt.body))
+			switch {
+			case tt.problem == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case tt.problem != "" && (err == nil || !strings.Contains(err.Error(), tt.problem)):
+				t.Errorf("got error %v, want %q", err, tt.problem)
+			}
+		})
+	}
+
+	// operations not in the document aren't checked
+	err := doc.ValidateResponse(http.MethodGet, "/owners", http.StatusTeapot, http.Header{}, nil)
+	if err != nil {
+		t.Errorf("got error %v for an undocumented operation", err)
+	}
+}
+
+func TestValidateResponseHead(t *testing.T) {
+	doc := newDoc()
+	doc.AddOperation(http.MethodHead, "/pets/{id}", &openapi.Operation{
+		OperationID: "checkPet",
+		Responses: map[string]*openapi.Response{
+			"200": {
+				Description: "The pet exists.",
+				Headers:     map[string]openapi.Header{"ETag": {Schema: openapi.String()}},
+			},
+			"404": {Description: "It doesn't.", Content: map[string]openapi.MediaType{openapi.JSON: {Schema: openapi.String()}}},
+		},
+	})
+
+	// whatever the handler wrote, the body is never sent
+	err := doc.ValidateResponse(http.MethodHead, "/pets/1", http.StatusNotFound, http.Header{}, []byte(`{"error": {}}`))
+	if err != nil {
+		t.Errorf("got error %v, want the body left alone", err)
+	}
+	err = doc.ValidateResponse(http.MethodHead, "/pets/1", http.StatusOK, http.Header{}, nil)
+	if err == nil || !strings.Contains(err.Error(), "header ETag: is missing") {
+		t.Errorf("got error %v, want the headers checked", err)
+	}
+}
+
+func TestValidateRequestHeaders(t *testing.T) {
+	doc := newDoc()
+	doc.AddOperation(http.MethodPatch, "/pets/{id}/photo", &openapi.Operation{
+		OperationID: "uploadPhoto",
+		Parameters: []openapi.Parameter{
+			{Name: "Photo-Offset", In: "header", Required: true, Schema: openapi.Int(ptr(0), nil)},
+			{Name: "Photo-Checksum", In: "header", Schema: openapi.String()},
+		},
+		Responses: map[string]*openapi.Response{"204": {Description: "Received."}},
+	})
+
+	tests := []struct {
+		name    string
+		header  http.Header
+		problem string
+	}{
+		{"Valid", http.Header{"Photo-Offset": {"10"}}, ""},
+		{"Optional", http.Header{"Photo-Offset": {"0"}, "Photo-Checksum": {"sha1 abc"}}, ""},
+		{"Missing", http.Header{}, "header Photo-Offset: is required"},
+		{"Not a number", http.Header{"Photo-Offset": {"ten"}}, "header parameter Photo-Offset: must be a integer"},
+		{"Below minimum", http.Header{"Photo-Offset": {"-1"}}, "header parameter Photo-Offset: must be at least 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPatch, "/pets/1/photo", nil)
+			r.Header = tt.header
+			err := doc.ValidateRequest(r)
+			switch {
+			case tt.problem == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case tt.problem != "" && (err == nil || !strings.Contains(err.Error(), tt.problem)):
+				t.Errorf("got error %v, want %q", err, tt.problem)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
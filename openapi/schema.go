@@ -0,0 +1,195 @@
+package openapi
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema is the subset of the JSON Schema dialect of OpenAPI 3.0 that
+// Document.Schema generates and Document.Validate understands.
+type Schema struct {
+	Ref         string             `json:"$ref,omitempty"`
+	Type        string             `json:"type,omitempty"`
+	Format      string             `json:"format,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Nullable    bool               `json:"nullable,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	// AdditionalProperties is only ever false: the generated objects have
+	// exactly the fields of their Go type
+	AdditionalProperties *bool     `json:"additionalProperties,omitempty"`
+	Items                *Schema   `json:"items,omitempty"`
+	AllOf                []*Schema `json:"allOf,omitempty"`
+	Enum                 []string  `json:"enum,omitempty"`
+	MinLength            *int      `json:"minLength,omitempty"`
+	MaxLength            *int      `json:"maxLength,omitempty"`
+	Minimum              *int      `json:"minimum,omitempty"`
+	Maximum              *int      `json:"maximum,omitempty"`
+}
+
+// Ref returns a schema referring to the component schema name.
+func Ref(name string) *Schema {
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// Int returns an integer schema between min and max, either of which can be
+// nil.
+func Int(min, max *int) *Schema {
+	return &Schema{Type: "integer", Minimum: min, Maximum: max}
+}
+
+// String returns a string schema.
+func String() *Schema {
+	return &Schema{Type: "string"}
+}
+
+// Binary is the schema of a body that isn't JSON, like an image.
+func Binary() *Schema {
+	return &Schema{Type: "string", Format: "binary"}
+}
+
+// Component adds the schema of v's type to the document under name and
+// returns a reference to it. Other types refer to it by that name once it is
+// added, so the types used by others must be added first.
+func (d *Document) Component(name string, v any) *Schema {
+	t := reflect.TypeOf(v)
+	if _, ok := d.Components.Schemas[name]; ok {
+		panic(fmt.Sprintf("openapi: schema %s added twice", name))
+	}
+	if d.names == nil {
+		d.names = map[reflect.Type]string{}
+	}
+
+	d.Components.Schemas[name] = d.schema(t)
+	d.names[t] = name
+
+	return Ref(name)
+}
+
+// Schema returns the schema of v's type, referring to the components for the
+// types added with Component.
+func (d *Document) Schema(v any) *Schema {
+	return d.schemaOrRef(reflect.TypeOf(v))
+}
+
+func (d *Document) schemaOrRef(t reflect.Type) *Schema {
+	if name, ok := d.names[t]; ok {
+		return Ref(name)
+	}
+	return d.schema(t)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema maps a Go type to a schema the way encoding/json encodes it. Struct
+// fields can describe themselves with a doc tag and constrain their values
+// with an openapi tag, e.g. `openapi:"minLength=1"`.
+func (d *Document) schema(t reflect.Type) *Schema {
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Pointer:
+		s := *d.schemaOrRef(t.Elem())
+		if s.Ref != "" {
+			// siblings of $ref are ignored in OpenAPI 3.0, it has to be wrapped
+			return &Schema{Nullable: true, AllOf: []*Schema{&s}}
+		}
+		s.Nullable = true
+		return &s
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: d.schemaOrRef(t.Elem())}
+	case reflect.Struct:
+		return d.object(t)
+	}
+
+	panic(fmt.Sprintf("openapi: no schema for type %s", t))
+}
+
+func (d *Document) object(t reflect.Type) *Schema {
+	closed := false
+	s := &Schema{
+		Type:                 "object",
+		Properties:           map[string]*Schema{},
+		AdditionalProperties: &closed,
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		prop := d.schemaOrRef(f.Type)
+		// a $ref can't have a description of its own
+		if doc := f.Tag.Get("doc"); doc != "" && prop.Ref == "" {
+			prop.Description = doc
+		}
+		constrain(prop, f.Tag.Get("openapi"))
+		s.Properties[name] = prop
+
+		// pointers are how the types say a field is optional
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			s.Required = append(s.Required, name)
+		}
+	}
+
+	return s
+}
+
+// constrain applies the comma separated constraints of an openapi tag.
+func constrain(s *Schema, tag string) {
+	if tag == "" {
+		return
+	}
+	for _, c := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(c, "=")
+		switch key {
+		case "enum":
+			s.Enum = strings.Split(value, "|")
+			continue
+		case "format":
+			s.Format = value
+			continue
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			panic(fmt.Sprintf("openapi: invalid constraint %q", c))
+		}
+		switch key {
+		case "minLength":
+			s.MinLength = &n
+		case "maxLength":
+			s.MaxLength = &n
+		case "minimum":
+			s.Minimum = &n
+		case "maximum":
+			s.Maximum = &n
+		default:
+			panic(fmt.Sprintf("openapi: unknown constraint %q", c))
+		}
+	}
+}
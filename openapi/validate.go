@@ -0,0 +1,323 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxValidatedBody is the largest JSON request body ValidateRequest reads.
+// Larger ones are left for the handler to reject.
+const MaxValidatedBody = 1 << 20
+
+// ValidationError lists everything that doesn't match the document.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// problems collects the mismatches found while walking a value.
+type problems []string
+
+func (p *problems) add(path, format string, args ...any) {
+	*p = append(*p, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (p problems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: p}
+}
+
+// Validate checks v, a value decoded from JSON into an any, against s.
+func (d *Document) Validate(s *Schema, v any) error {
+	var p problems
+	d.validate(s, v, "body", &p)
+	return p.err()
+}
+
+func (d *Document) resolve(s *Schema) *Schema {
+	for s.Ref != "" {
+		name := strings.TrimPrefix(s.Ref, "#/components/schemas/")
+		ref, ok := d.Components.Schemas[name]
+		if !ok {
+			panic(fmt.Sprintf("openapi: unknown schema %s", s.Ref))
+		}
+		s = ref
+	}
+	return s
+}
+
+func (d *Document) validate(s *Schema, v any, path string, p *problems) {
+	s = d.resolve(s)
+	if v == nil {
+		if !s.Nullable {
+			p.add(path, "must not be null")
+		}
+		return
+	}
+	for _, sub := range s.AllOf {
+		d.validate(sub, v, path, p)
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			p.add(path, "must be an object")
+			return
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				p.add(path, "%s is required", name)
+			}
+		}
+		// sorted, so the problems always come in the same order
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					p.add(path, "unknown field %s", name)
+				}
+				continue
+			}
+			d.validate(prop, obj[name], path+"."+name, p)
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			p.add(path, "must be an array")
+			return
+		}
+		for i, item := range arr {
+			d.validate(s.Items, item, fmt.Sprintf("%s[%d]", path, i), p)
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			p.add(path, "must be a string")
+			return
+		}
+		if s.MinLength != nil && len([]rune(str)) < *s.MinLength {
+			p.add(path, "must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && len([]rune(str)) > *s.MaxLength {
+			p.add(path, "must be at most %d characters long", *s.MaxLength)
+		}
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, str) {
+			p.add(path, "must be one of %s", strings.Join(s.Enum, ", "))
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				p.add(path, "must be a date-time")
+			}
+		}
+	case "integer", "number":
+		n, ok := v.(float64)
+		if !ok {
+			p.add(path, "must be a %s", s.Type)
+			return
+		}
+		if s.Type == "integer" && n != math.Trunc(n) {
+			p.add(path, "must be an integer")
+		}
+		if s.Minimum != nil && n < float64(*s.Minimum) {
+			p.add(path, "must be at least %d", *s.Minimum)
+		}
+		if s.Maximum != nil && n > float64(*s.Maximum) {
+			p.add(path, "must be at most %d", *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			p.add(path, "must be a boolean")
+		}
+	}
+}
+
+// validateParam checks the raw value of a parameter, which is a number when
+// its schema says so.
+func (d *Document) validateParam(param Parameter, raw string, p *problems) {
+	path := param.In + " parameter " + param.Name
+	s := d.resolve(param.Schema)
+	if s.Type != "integer" && s.Type != "number" {
+		d.validate(s, raw, path, p)
+		return
+	}
+
+	n, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		p.add(path, "must be a %s", s.Type)
+		return
+	}
+	d.validate(s, n, path, p)
+}
+
+// ValidateRequest checks the parameters and the JSON body of r against its
+// operation. The body is read and put back for the handler. Requests that
+// match no operation are left for the router to answer.
+func (d *Document) ValidateRequest(r *http.Request) error {
+	op, _, params, ok := d.Find(r.Method, r.URL.Path)
+	if !ok {
+		return nil
+	}
+
+	var p problems
+	query := r.URL.Query()
+	for _, param := range op.Parameters {
+		switch param.In {
+		case "path":
+			raw, err := url.PathUnescape(params[param.Name])
+			if err != nil {
+				p.add("path parameter "+param.Name, "is not escaped properly")
+				continue
+			}
+			d.validateParam(param, raw, &p)
+		case "query":
+			if !query.Has(param.Name) {
+				if param.Required {
+					p.add("query parameter "+param.Name, "is required")
+				}
+				continue
+			}
+			d.validateParam(param, query.Get(param.Name), &p)
+		case "header":
+			value := r.Header.Get(param.Name)
+			if value == "" {
+				if param.Required {
+					p.add("header "+param.Name, "is required")
+				}
+				continue
+			}
+			d.validateParam(param, value, &p)
+		}
+	}
+
+	if op.RequestBody != nil {
+		d.validateRequestBody(r, op.RequestBody, &p)
+	}
+
+	return p.err()
+}
+
+func (d *Document) validateRequestBody(r *http.Request, body *RequestBody, p *problems) {
+	media, ok := body.Content[JSON]
+	if !ok {
+		// images and other bytes are the handler's business
+		return
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r.Body, MaxValidatedBody+1))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(b), r.Body))
+	if err != nil {
+		p.add("body", "can't be read: %v", err)
+		return
+	}
+	if len(b) > MaxValidatedBody {
+		return
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		if body.Required {
+			p.add("body", "is required")
+		}
+		return
+	}
+
+	var v any
+	err = json.Unmarshal(b, &v)
+	if err != nil {
+		p.add("body", "is not valid JSON: %v", err)
+		return
+	}
+	d.validate(media.Schema, v, "body", p)
+}
+
+// ValidateResponse checks a response to the request with the method and
+// path: its status has to be documented, with the headers and body it
+// promises. Requests that match no operation are not checked, and neither
+// are the bodies of responses to HEAD.
+func (d *Document) ValidateResponse(method, path string, status int, header http.Header, body []byte) error {
+	op, _, _, ok := d.Find(method, path)
+	if !ok {
+		return nil
+	}
+
+	resp, err := op.response(status)
+	if err != nil {
+		return &ValidationError{Problems: []string{err.Error()}}
+	}
+
+	var p problems
+	names := make([]string, 0, len(resp.Headers))
+	for name := range resp.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if header.Get(name) == "" {
+			p.add("header "+name, "is missing")
+		}
+	}
+
+	// the answers to HEAD only have the headers of the ones to GET
+	if method == http.MethodHead {
+		return p.err()
+	}
+	if len(resp.Content) == 0 {
+		if len(bytes.TrimSpace(body)) > 0 {
+			p.add("body", "must be empty")
+		}
+		return p.err()
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	media, ok := resp.Content[mediaType]
+	if !ok {
+		p.add("body", "has the undocumented content type %q", header.Get("Content-Type"))
+		return p.err()
+	}
+	if mediaType == JSON {
+		var v any
+		err := json.Unmarshal(body, &v)
+		if err != nil {
+			p.add("body", "is not valid JSON: %v", err)
+			return p.err()
+		}
+		d.validate(media.Schema, v, "body", &p)
+	}
+
+	return p.err()
+}
+
+// Middleware checks every request with ValidateRequest, handing the ones
+// that don't match the document to fail instead of next.
+func (d *Document) Middleware(fail func(http.ResponseWriter, *http.Request, error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err := d.ValidateRequest(r)
+			if err != nil {
+				fail(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
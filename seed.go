@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rafaelmdurante/lenslocked/cli"
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/seed"
+)
+
+// runSeed runs `lenslocked seed`, with the same configuration as the server
+// so the images end up in its storage directory.
+func runSeed(args []string) error {
+	cfg, args, err := commandConfig("lenslocked seed", cli.SeedUsage, args)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db, err := models.Open(cfg.PSQL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = checkSchema(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	s := cli.Seed{
+		Seeder: &seed.Seeder{
+			Users: &models.UserService{
+				DB:           db,
+				QueryTimeout: cfg.PSQL.QueryTimeout,
+			},
+			Galleries: &models.GalleryService{
+				DB:           db,
+				QueryTimeout: cfg.PSQL.QueryTimeout,
+			},
+			Images: &models.ImageService{
+				DB:           db,
+				Files:        models.ImageFiles{Dir: cfg.Storage.Dir},
+				QueryTimeout: cfg.PSQL.QueryTimeout,
+			},
+			Transactor: &models.Transactor{DB: db},
+		},
+		Out: os.Stdout,
+		Err: os.Stderr,
+	}
+
+	return s.Run(ctx, args)
+}
@@ -0,0 +1,76 @@
+package seed
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"sync"
+)
+
+// Generate returns a fixture of users users, each with galleries galleries
+// of images images, for load testing. Emails, titles and filenames are
+// numbered, so generating again, even with larger counts, seeds the same
+// users again rather than new ones. Every user gets password.
+func Generate(users, galleries, images int, password string) *Fixture {
+	palette := pngs()
+
+	fixture := &Fixture{Users: make([]User, users)}
+	for i := range fixture.Users {
+		user := User{
+			Email:     fmt.Sprintf("user%d@example.com", i+1),
+			Password:  password,
+			Galleries: make([]Gallery, galleries),
+		}
+		for j := range user.Galleries {
+			gallery := Gallery{
+				Title:  fmt.Sprintf("Gallery %d", j+1),
+				Images: make([]Image, images),
+			}
+			for k := range gallery.Images {
+				gallery.Images[k] = Image{
+					Filename: fmt.Sprintf("image-%d.png", k+1),
+					data:     palette[(i+j+k)%len(palette)],
+				}
+			}
+			user.Galleries[j] = gallery
+		}
+		fixture.Users[i] = user
+	}
+
+	return fixture
+}
+
+// pngs encodes a handful of plain coloured images, shared by every generated
+// image so that large fixtures don't take much memory.
+var pngs = sync.OnceValue(func() [][]byte {
+	colors := []color.RGBA{
+		{R: 0xef, G: 0x44, B: 0x44, A: 0xff},
+		{R: 0xf5, G: 0x9e, B: 0x0b, A: 0xff},
+		{R: 0x10, G: 0xb9, B: 0x81, A: 0xff},
+		{R: 0x3b, G: 0x82, B: 0xf6, A: 0xff},
+		{R: 0x8b, G: 0x5c, B: 0xf6, A: 0xff},
+		{R: 0xec, G: 0x48, B: 0x99, A: 0xff},
+	}
+
+	var encoded [][]byte
+	for _, c := range colors {
+		img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+		for x := 0; x < 320; x++ {
+			for y := 0; y < 240; y++ {
+				img.SetRGBA(x, y, c)
+			}
+		}
+
+		var buf bytes.Buffer
+		err := png.Encode(&buf, img)
+		if err != nil {
+			// encoding to memory can't fail
+			panic(err)
+		}
+		encoded = append(encoded, buf.Bytes())
+	}
+
+	return encoded
+})
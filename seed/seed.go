@@ -0,0 +1,358 @@
+// Package seed fills the database with users, galleries and images, either
+// described in a fixture file or generated in bulk for load testing.
+//
+// Seeding is idempotent: users are matched by email and galleries by title,
+// so only what is missing gets created, and images replace those with the
+// same filename. Running the same fixture twice leaves the data as after the
+// first run.
+//
+// A fixture is YAML, or JSON which is valid YAML too:
+//
+//	users:
+//	  - email: admin@user.com
+//	    password: admin
+//	    galleries:
+//	      - title: Landscapes
+//	        images:
+//	          - path: images/dunes.png
+//
+// Image paths are relative to the fixture file. Tests load the same files
+// into the in-memory services of the models/memory package.
+package seed
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/yaml.v3"
+)
+
+type Fixture struct {
+	Users []User `yaml:"users"`
+}
+
+type User struct {
+	Email    string `yaml:"email"`
+	Password string `yaml:"password"`
+	// Role is set when not empty, otherwise the user keeps theirs
+	Role      models.Role `yaml:"role"`
+	Galleries []Gallery   `yaml:"galleries"`
+}
+
+type Gallery struct {
+	Title  string  `yaml:"title"`
+	Images []Image `yaml:"images"`
+}
+
+type Image struct {
+	// Path is the file to read the image from
+	Path string `yaml:"path"`
+	// Filename is the name of the image in the gallery, the base name of
+	// Path when empty
+	Filename string `yaml:"filename"`
+
+	// data holds the generated images, which have no file
+	data []byte
+}
+
+func (img Image) filename() string {
+	if img.Filename != "" {
+		return img.Filename
+	}
+	return filepath.Base(img.Path)
+}
+
+func (img Image) open() (io.ReadCloser, error) {
+	if img.data != nil {
+		return io.NopCloser(bytes.NewReader(img.data)), nil
+	}
+	return os.Open(img.Path)
+}
+
+// Load reads the fixture file at path. Image paths are made relative to the
+// directory of the file, so fixtures can be loaded from anywhere.
+func Load(path string) (*Fixture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("load fixture: %w", err)
+	}
+	defer f.Close()
+
+	fixture, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("load fixture %s: %w", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	for _, user := range fixture.Users {
+		for _, gallery := range user.Galleries {
+			for i, img := range gallery.Images {
+				if !filepath.IsAbs(img.Path) {
+					gallery.Images[i].Path = filepath.Join(dir, img.Path)
+				}
+			}
+		}
+	}
+
+	return fixture, nil
+}
+
+// Parse decodes and validates a fixture. Unknown fields are an error, a typo
+// would otherwise be silently ignored.
+func Parse(r io.Reader) (*Fixture, error) {
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+
+	var fixture Fixture
+	err := dec.Decode(&fixture)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse fixture: %w", err)
+	}
+
+	err = fixture.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &fixture, nil
+}
+
+// validate checks what the services would reject halfway through seeding,
+// plus duplicates, which the idempotent seeding would otherwise merge.
+func (f *Fixture) validate() error {
+	var errs []error
+	emails := map[string]bool{}
+	for i, user := range f.Users {
+		email := strings.ToLower(user.Email)
+		switch {
+		case email == "":
+			errs = append(errs, fmt.Errorf("users[%d]: email is required", i))
+		case emails[email]:
+			errs = append(errs, fmt.Errorf("users[%d]: duplicate email %s", i, user.Email))
+		}
+		emails[email] = true
+		if user.Password == "" {
+			errs = append(errs, fmt.Errorf("users[%d]: password is required", i))
+		}
+		if user.Role != "" {
+			_, err := models.ParseRole(string(user.Role))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("users[%d]: %w", i, err))
+			}
+		}
+
+		titles := map[string]bool{}
+		for j, gallery := range user.Galleries {
+			switch {
+			case gallery.Title == "":
+				errs = append(errs, fmt.Errorf("users[%d].galleries[%d]: title is required", i, j))
+			case titles[gallery.Title]:
+				errs = append(errs, fmt.Errorf("users[%d].galleries[%d]: duplicate title %q", i, j, gallery.Title))
+			}
+			titles[gallery.Title] = true
+
+			filenames := map[string]bool{}
+			for k, img := range gallery.Images {
+				name := img.filename()
+				switch {
+				case img.Path == "" && img.data == nil:
+					errs = append(errs, fmt.Errorf("users[%d].galleries[%d].images[%d]: path is required", i, j, k))
+				case filenames[name]:
+					errs = append(errs, fmt.Errorf("users[%d].galleries[%d].images[%d]: duplicate filename %q", i, j, k, name))
+				}
+				filenames[name] = true
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+type UserService interface {
+	Create(ctx context.Context, email, password string) (*models.User, error)
+	ByEmail(ctx context.Context, email string) (*models.User, error)
+	UpdatePassword(ctx context.Context, userID int, password string) error
+	SetRole(ctx context.Context, userID int, role models.Role) error
+}
+
+type GalleryService interface {
+	Create(ctx context.Context, title string, userID int) (*models.Gallery, error)
+	ByUserID(ctx context.Context, userID int) ([]models.Gallery, error)
+}
+
+type ImageService interface {
+	Create(ctx context.Context, galleryID int, filename string, contents io.Reader) (*models.Image, error)
+}
+
+type Transactor interface {
+	InTx(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// Seeder writes fixtures through the services.
+type Seeder struct {
+	Users      UserService
+	Galleries  GalleryService
+	Images     ImageService
+	Transactor Transactor
+
+	// Concurrency is how many users are seeded at once. Hashing passwords
+	// takes most of the time, so it defaults to the number of CPUs.
+	Concurrency int
+	// Progress, when set, is called after each user is seeded. Calls may come
+	// from several goroutines at once.
+	Progress func(email string)
+}
+
+// Result counts what a seed went through, and how much of it was created
+// rather than already there.
+type Result struct {
+	Users            int `json:"users"`
+	UsersCreated     int `json:"users_created"`
+	Galleries        int `json:"galleries"`
+	GalleriesCreated int `json:"galleries_created"`
+	Images           int `json:"images"`
+}
+
+func (r *Result) add(o Result) {
+	r.Users += o.Users
+	r.UsersCreated += o.UsersCreated
+	r.Galleries += o.Galleries
+	r.GalleriesCreated += o.GalleriesCreated
+	r.Images += o.Images
+}
+
+// Seed creates what is missing from the fixture. Each user is seeded in a
+// transaction of its own together with its galleries, so a failure leaves no
+// user half seeded, while the users already seeded stay. The result only
+// counts those.
+func (s *Seeder) Seed(ctx context.Context, fixture *Fixture) (Result, error) {
+	err := fixture.validate()
+	if err != nil {
+		return Result{}, err
+	}
+
+	concurrency := s.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	results := make([]Result, len(fixture.Users))
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for i, user := range fixture.Users {
+		if ctx.Err() != nil {
+			break
+		}
+		i, user := i, user
+		g.Go(func() error {
+			var result Result
+			err := s.Transactor.InTx(ctx, func(ctx context.Context) error {
+				var err error
+				result, err = s.seedUser(ctx, user)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("seed %s: %w", user.Email, err)
+			}
+			results[i] = result
+			if s.Progress != nil {
+				s.Progress(user.Email)
+			}
+			return nil
+		})
+	}
+	err = g.Wait()
+
+	var total Result
+	for _, r := range results {
+		total.add(r)
+	}
+
+	return total, err
+}
+
+func (s *Seeder) seedUser(ctx context.Context, user User) (Result, error) {
+	result := Result{Users: 1}
+
+	u, err := s.Users.ByEmail(ctx, user.Email)
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		u, err = s.Users.Create(ctx, user.Email, user.Password)
+		if err != nil {
+			return result, err
+		}
+		result.UsersCreated++
+	case err != nil:
+		return result, err
+	default:
+		// the password may have been changed by hand, the fixture says
+		// what it should be
+		err = s.Users.UpdatePassword(ctx, u.ID, user.Password)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if user.Role != "" && user.Role != u.Role {
+		err = s.Users.SetRole(ctx, u.ID, user.Role)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	existing, err := s.Galleries.ByUserID(ctx, u.ID)
+	if err != nil {
+		return result, err
+	}
+	byTitle := map[string]int{}
+	for _, gallery := range existing {
+		byTitle[gallery.Title] = gallery.ID
+	}
+
+	for _, gallery := range user.Galleries {
+		result.Galleries++
+		id, ok := byTitle[gallery.Title]
+		if !ok {
+			created, err := s.Galleries.Create(ctx, gallery.Title, u.ID)
+			if err != nil {
+				return result, err
+			}
+			id = created.ID
+			result.GalleriesCreated++
+		}
+
+		for _, img := range gallery.Images {
+			err := s.createImage(ctx, id, img)
+			if err != nil {
+				return result, fmt.Errorf("gallery %q: %w", gallery.Title, err)
+			}
+			result.Images++
+		}
+	}
+
+	return result, nil
+}
+
+func (s *Seeder) createImage(ctx context.Context, galleryID int, img Image) error {
+	f, err := img.open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = s.Images.Create(ctx, galleryID, img.filename(), f)
+	if err != nil {
+		return fmt.Errorf("image %s: %w", img.filename(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,272 @@
+package seed_test
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/models/memory"
+	"github.com/rafaelmdurante/lenslocked/seed"
+)
+
+type testSeeder struct {
+	*seed.Seeder
+	users     *memory.UserService
+	galleries *memory.GalleryService
+	images    *memory.ImageService
+}
+
+func newTestSeeder(t *testing.T) *testSeeder {
+	t.Helper()
+
+	store := memory.NewStore()
+	ts := &testSeeder{
+		users:     &memory.UserService{Store: store},
+		galleries: &memory.GalleryService{Store: store},
+		images: &memory.ImageService{
+			Store: store,
+			Files: models.ImageFiles{Dir: t.TempDir()},
+		},
+	}
+	ts.Seeder = &seed.Seeder{
+		Users:      ts.users,
+		Galleries:  ts.galleries,
+		Images:     ts.images,
+		Transactor: &memory.Transactor{Store: store},
+		// the memory transactor doesn't isolate concurrent transactions
+		Concurrency: 1,
+	}
+
+	return ts
+}
+
+func (ts *testSeeder) seed(t *testing.T, fixture *seed.Fixture) seed.Result {
+	t.Helper()
+
+	result, err := ts.Seed(context.Background(), fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func load(t *testing.T, path string) *seed.Fixture {
+	t.Helper()
+
+	fixture, err := seed.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fixture
+}
+
+func TestLoad(t *testing.T) {
+	fromYAML := load(t, "testdata/fixture.yaml")
+	fromJSON := load(t, "testdata/fixture.json")
+
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		t.Fatalf("YAML and JSON fixtures differ:\n%+v\n%+v", fromYAML, fromJSON)
+	}
+
+	got := fromYAML.Users[0].Galleries[0].Images[0].Path
+	want := filepath.Join("testdata", "images", "red.png")
+	if got != want {
+		t.Errorf("image path is %q, want %q relative to the fixture", got, want)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		wantErr string
+	}{
+		{
+			"unknown field",
+			"users:\n  - email: a@example.com\n    pasword: secret\n",
+			"field pasword not found",
+		},
+		{
+			"missing password",
+			"users:\n  - email: a@example.com\n",
+			"users[0]: password is required",
+		},
+		{
+			"unknown role",
+			"users:\n  - {email: a@example.com, password: x, role: owner}\n",
+			`users[0]: unknown role "owner"`,
+		},
+		{
+			"duplicate email",
+			"users:\n  - {email: a@example.com, password: x}\n  - {email: A@example.com, password: x}\n",
+			"users[1]: duplicate email",
+		},
+		{
+			"duplicate gallery",
+			"users:\n  - email: a@example.com\n    password: x\n    galleries: [{title: Cats}, {title: Cats}]\n",
+			"users[0].galleries[1]: duplicate title",
+		},
+		{
+			"duplicate filename",
+			"users:\n  - email: a@example.com\n    password: x\n    galleries:\n      - title: Cats\n        images: [{path: a/cat.png}, {path: b/cat.png}]\n",
+			"users[0].galleries[0].images[1]: duplicate filename",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := seed.Parse(strings.NewReader(tt.fixture))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSeed(t *testing.T) {
+	ts := newTestSeeder(t)
+	ctx := context.Background()
+
+	result := ts.seed(t, load(t, "testdata/fixture.yaml"))
+	want := seed.Result{Users: 2, UsersCreated: 2, Galleries: 2, GalleriesCreated: 2, Images: 2}
+	if result != want {
+		t.Errorf("got %+v, want %+v", result, want)
+	}
+
+	alice, err := ts.users.Authenticate(ctx, "alice@example.com", "alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	galleries, err := ts.galleries.ByUserID(ctx, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(galleries) != 2 || galleries[0].Title != "Colours" {
+		t.Fatalf("got galleries %+v, want Colours and Empty", galleries)
+	}
+
+	if alice.Role != models.RoleUser {
+		t.Errorf("alice has role %q, want the default %q", alice.Role, models.RoleUser)
+	}
+	bob, err := ts.users.ByEmail(ctx, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.Role != models.RoleModerator {
+		t.Errorf("bob has role %q, want %q from the fixture", bob.Role, models.RoleModerator)
+	}
+
+	images, err := ts.images.ByGalleryID(ctx, galleries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var filenames []string
+	for _, image := range images {
+		filenames = append(filenames, image.Filename)
+		if image.ContentType != "image/png" {
+			t.Errorf("%s has content type %q, want image/png", image.Filename, image.ContentType)
+		}
+	}
+	if !reflect.DeepEqual(filenames, []string{"red.png", "sky.png"}) {
+		t.Errorf("got images %v, want red.png and sky.png", filenames)
+	}
+}
+
+func TestSeedIdempotent(t *testing.T) {
+	ts := newTestSeeder(t)
+	ctx := context.Background()
+	fixture := load(t, "testdata/fixture.yaml")
+
+	ts.seed(t, fixture)
+
+	// changes made in the meantime are kept, except for the passwords
+	alice, err := ts.users.ByEmail(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ts.users.UpdatePassword(ctx, alice.ID, "changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ts.galleries.Create(ctx, "Added by hand", alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := ts.seed(t, fixture)
+	want := seed.Result{Users: 2, Galleries: 2, Images: 2}
+	if result != want {
+		t.Errorf("got %+v, want %+v", result, want)
+	}
+
+	_, err = ts.users.Authenticate(ctx, "alice@example.com", "alice-secret")
+	if err != nil {
+		t.Errorf("password is not the fixture's one: %v", err)
+	}
+	galleries, err := ts.galleries.ByUserID(ctx, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(galleries) != 3 {
+		t.Errorf("got %d galleries, want the 2 seeded and the one added by hand", len(galleries))
+	}
+	images, err := ts.images.ByGalleryID(ctx, galleries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Errorf("got %d images, want 2", len(images))
+	}
+}
+
+func TestSeedFailureRollsBackUser(t *testing.T) {
+	ts := newTestSeeder(t)
+	ctx := context.Background()
+
+	fixture := &seed.Fixture{Users: []seed.User{{
+		Email:    "carol@example.com",
+		Password: "secret",
+		Galleries: []seed.Gallery{{
+			Title:  "Broken",
+			Images: []seed.Image{{Path: "testdata/images/missing.png"}},
+		}},
+	}}}
+
+	_, err := ts.Seed(ctx, fixture)
+	if err == nil || !strings.Contains(err.Error(), "carol@example.com") {
+		t.Fatalf("got error %v, want one about carol@example.com", err)
+	}
+
+	_, err = ts.users.ByEmail(ctx, "carol@example.com")
+	if err != models.ErrNotFound {
+		t.Errorf("got %v, want the user to be rolled back", err)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	ts := newTestSeeder(t)
+	ctx := context.Background()
+
+	result := ts.seed(t, seed.Generate(3, 2, 2, "password"))
+	want := seed.Result{Users: 3, UsersCreated: 3, Galleries: 6, GalleriesCreated: 6, Images: 12}
+	if result != want {
+		t.Errorf("got %+v, want %+v", result, want)
+	}
+
+	// generating more users only creates the new ones
+	result = ts.seed(t, seed.Generate(5, 2, 2, "password"))
+	want = seed.Result{Users: 5, UsersCreated: 2, Galleries: 10, GalleriesCreated: 4, Images: 20}
+	if result != want {
+		t.Errorf("got %+v, want %+v", result, want)
+	}
+
+	_, err := ts.users.Authenticate(ctx, "user5@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
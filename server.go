@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newServer builds the HTTP server with the timeouts from the config. A bare
+// http.ListenAndServe has no timeouts at all, which lets slow clients keep
+// connections open forever.
+func newServer(cfg config.Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.Server.Address,
+		Handler:           handler,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+	}
+}
+
+// workers keeps track of background jobs so they can be stopped before the
+// process exits. Jobs must return once their context is cancelled.
+type workers struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newWorkers() *workers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workers{ctx: ctx, cancel: cancel}
+}
+
+// Go runs job in its own goroutine.
+func (ws *workers) Go(job func(ctx context.Context)) {
+	ws.wg.Add(1)
+	go func() {
+		defer ws.wg.Done()
+		job(ws.ctx)
+	}()
+}
+
+// Every runs job right away, then every interval, logging its errors.
+func (ws *workers) Every(interval time.Duration, logger *slog.Logger, msg string, job func(ctx context.Context) error) {
+	ws.Go(func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			err := job(ctx)
+			if err != nil && ctx.Err() == nil {
+				logger.Error(msg, "err", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// Stop cancels every job and waits for them to return, or for ctx to be done.
+func (ws *workers) Stop(ctx context.Context) error {
+	ws.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		ws.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stop workers: %w", ctx.Err())
+	}
+}
+
+// listener is an http.Server together with the function that starts it,
+// which differs between plain http, certificate files and ACME.
+type listener struct {
+	srv   *http.Server
+	start func() error
+}
+
+// newListeners returns the app listener, serving handler over http or https
+// depending on cfg.TLS, plus the http to https redirect listener when enabled.
+func newListeners(cfg config.Config, handler http.Handler) ([]listener, error) {
+	if !cfg.TLS.Enabled() {
+		srv := newServer(cfg, handler)
+		return []listener{{srv: srv, start: srv.ListenAndServe}}, nil
+	}
+
+	srv := newServer(cfg, hsts(cfg.TLS.HSTSMaxAge, handler))
+	srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+	// the redirect listener only needs to answer quickly, a handful of
+	// conservative timeouts is enough
+	redirect := &http.Server{
+		Addr:              cfg.TLS.RedirectAddress,
+		Handler:           redirectToHTTPS(cfg.Server.Address),
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadHeaderTimeout,
+		WriteTimeout:      cfg.Server.ReadHeaderTimeout,
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+	}
+
+	var listeners []listener
+	switch cfg.TLS.Mode {
+	case config.TLSModeFiles:
+		listeners = append(listeners, listener{srv: srv, start: func() error {
+			return srv.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		}})
+	case config.TLSModeACME:
+		manager, err := newCertManager(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = manager.TLSConfig()
+		srv.TLSConfig.MinVersion = tls.VersionTLS12
+		// HTTP-01 challenges arrive on the plain http listener, everything
+		// else gets redirected
+		redirect.Handler = manager.HTTPHandler(redirect.Handler)
+		listeners = append(listeners, listener{srv: srv, start: func() error {
+			// the certificates come from srv.TLSConfig.GetCertificate
+			return srv.ListenAndServeTLS("", "")
+		}})
+	}
+
+	if cfg.TLS.RedirectAddress != "" {
+		listeners = append(listeners, listener{srv: redirect, start: redirect.ListenAndServe})
+	}
+
+	return listeners, nil
+}
+
+// newCertManager builds the ACME client that obtains certificates for the
+// configured domains and caches them on disk, so restarts don't hit the ACME
+// server's rate limits.
+func newCertManager(tc config.TLSConfig) (*autocert.Manager, error) {
+	httpClient := http.DefaultClient
+	if tc.ACME.CARoot != "" {
+		pem, err := os.ReadFile(tc.ACME.CARoot)
+		if err != nil {
+			return nil, fmt.Errorf("acme ca root: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("acme ca root: no certificates found in %s", tc.ACME.CARoot)
+		}
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(tc.ACME.CacheDir),
+		HostPolicy: autocert.HostWhitelist(tc.ACME.Domains...),
+		Email:      tc.ACME.Email,
+		Client: &acme.Client{
+			DirectoryURL: tc.ACME.DirectoryURL,
+			HTTPClient:   httpClient,
+		},
+	}, nil
+}
+
+// redirectToHTTPS sends every request to the same host and path over https,
+// on the port of the https listener at address.
+func redirectToHTTPS(address string) http.Handler {
+	_, port, _ := net.SplitHostPort(address)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
+
+// hsts tells browsers to only ever use https for this site from now on.
+func hsts(maxAge time.Duration, next http.Handler) http.Handler {
+	if maxAge <= 0 {
+		return next
+	}
+
+	value := fmt.Sprintf("max-age=%d; includeSubDomains", int(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve runs the listeners until one of them fails or ctx is cancelled. On
+// cancellation it calls draining, keeps serving for cfg.Server.DrainDelay,
+// then stops accepting connections, waits for in-flight requests, stops the
+// workers and closes the database, all within cfg.Server.ShutdownTimeout.
+// stop releases the signals ctx is cancelled on, so a second one kills the
+// process during all of that.
+func serve(ctx context.Context, stop context.CancelFunc, cfg config.Config, listeners []listener, ws *workers, db *sql.DB, draining func()) error {
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l listener) {
+			errCh <- l.start()
+		}(l)
+	}
+
+	var errs []error
+	select {
+	case err := <-errCh:
+		// a listener could not start (e.g. the address is in use), the others
+		// still have to be shut down
+		errs = append(errs, fmt.Errorf("serve: %w", err))
+	case <-ctx.Done():
+		slog.Info("shutting down", "grace_period", cfg.Server.ShutdownTimeout)
+	}
+	// the signals get their default handling back, a second Ctrl-C doesn't
+	// wait for the shutdown
+	stop()
+
+	// the parent ctx may already be cancelled, so the grace period needs a
+	// fresh one
+	shutdownCtx, cancel := context.WithTimeout(context.Background(),
+		cfg.Server.ShutdownTimeout)
+	defer cancel()
+
+	draining()
+	time.Sleep(cfg.Server.DrainDelay)
+
+	for _, l := range listeners {
+		err := l.srv.Shutdown(shutdownCtx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("shutdown server %s: %w", l.srv.Addr, err))
+		}
+	}
+
+	err := ws.Stop(shutdownCtx)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	// requests are drained and workers are done, nothing uses the db anymore
+	err = db.Close()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("close db: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
@@ -2,18 +2,22 @@ package views
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"io/fs"
-	"log"
 	"net/http"
 	"path"
+	"time"
 
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/gorilla/csrf"
 	"github.com/rafaelmdurante/lenslocked/context"
+	"github.com/rafaelmdurante/lenslocked/errors"
+	"github.com/rafaelmdurante/lenslocked/metrics"
 	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Template struct {
@@ -29,12 +33,12 @@ func (t Template) Execute(w http.ResponseWriter, r *http.Request, data interface
 	// ensure every incoming http request has their own template to work with
 	tpl, err := t.htmlTpl.Clone()
 	if err != nil {
-		log.Printf("cloning template: %v", err)
+		context.Logger(r.Context()).Error("cloning template", "err", err)
 		http.Error(w, "there was an error rendering the page", http.StatusInternalServerError)
 		return
 	}
 
-	errMessages := errMessages(errs...)
+	errMessages := errMessages(r, errs...)
 
 	// use the gorilla/csrf package to generate the csrf html code
 	tpl = tpl.Funcs(
@@ -62,9 +66,16 @@ func (t Template) Execute(w http.ResponseWriter, r *http.Request, data interface
 	// one way to avoid the superfluous error message si to buffer the results
 	// from the template execution
 	var b bytes.Buffer
+	_, span := tracing.Start(r.Context(), "template.execute",
+		attribute.String("template", tpl.Name()))
+	start := time.Now()
 	err = tpl.Execute(&b, data)
+	metrics.TemplateDuration.WithLabelValues(tpl.Name()).
+		Observe(time.Since(start).Seconds())
+	tracing.End(span, err)
 	if err != nil {
-		log.Printf("executing template: %v", err)
+		context.Logger(r.Context()).Error("executing template",
+			"template", tpl.Name(), "err", err)
 		http.Error(w, "there was an error executing the template",
 			http.StatusInternalServerError)
 		return
@@ -72,22 +83,39 @@ func (t Template) Execute(w http.ResponseWriter, r *http.Request, data interface
 
 	_, err = io.Copy(w, &b)
 	if err != nil {
-		log.Printf("executing template copying buffer: %v", err)
+		context.Logger(r.Context()).Error("copying template buffer",
+			"template", tpl.Name(), "err", err)
 		http.Error(w, "there was an error executing the template",
 			http.StatusInternalServerError)
 	}
 }
 
-func errMessages(errs ...error) []string {
+// errMessages turns errors into messages that are safe to show to users.
+// Errors without a public message are logged, and the user gets the request
+// ID so support can find the real error in the logs.
+func errMessages(r *http.Request, errs ...error) []string {
 	var messages []string
 	for _, err := range errs {
 		var publicError public
 		if errors.As(err, &publicError) {
 			messages = append(messages, publicError.Public())
-		} else {
-			fmt.Println(err)
-			messages = append(messages, "Something went wrong.")
+			continue
 		}
+
+		logger := context.Logger(r.Context())
+		switch {
+		case errors.Canceled(err), errors.Timeout(err):
+			// not a bug, the client left or the database was too slow
+			logger.Warn("rendering canceled request", "err", err)
+		default:
+			logger.Error("rendering error", "err", err)
+		}
+
+		msg := "Something went wrong."
+		if id := middleware.GetReqID(r.Context()); id != "" {
+			msg += fmt.Sprintf(" If the problem persists, contact support with the request ID %s.", id)
+		}
+		messages = append(messages, msg)
 	}
 
 	return messages
@@ -0,0 +1,295 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/metrics"
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// DefaultMaxAttempts spans about an hour with Backoff.
+	DefaultMaxAttempts = 8
+	// timeout bounds an attempt, lease how long a claimed delivery is left
+	// alone. The lease has to be longer, or a slow attempt would be retried
+	// while still going on.
+	timeout = 10 * time.Second
+	lease   = time.Minute
+)
+
+// Queue holds the deliveries. models.WebhookService and its in-memory
+// counterpart implement it.
+type Queue interface {
+	Claim(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookJob, error)
+	Delivered(ctx context.Context, id int64, statusCode int) error
+	Failed(ctx context.Context, id int64, statusCode int, message string, retryAt *time.Time) error
+}
+
+// Dispatcher attempts the due deliveries of the queue. An attempt succeeds
+// when the endpoint answers with a 2xx status, anything else is retried with
+// Backoff until MaxAttempts. Redirects are not followed.
+type Dispatcher struct {
+	Queue Queue
+	// AllowPrivate lets webhooks reach loopback and private addresses. It is
+	// off so that users can't make the server call what is only reachable
+	// from the inside, but handy on a development machine.
+	AllowPrivate bool
+	// Interval is how often the queue is checked. Defaults to 2 seconds.
+	Interval time.Duration
+	// BatchSize is how many deliveries are attempted at once. Defaults to 10.
+	BatchSize int
+	// MaxAttempts defaults to DefaultMaxAttempts.
+	MaxAttempts int
+	// Backoff is how long to wait before the next attempt, after attempt
+	// failed. Defaults to Backoff.
+	Backoff func(attempt int) time.Duration
+	// Now defaults to time.Now.
+	Now    func() time.Time
+	Logger *slog.Logger
+
+	once   sync.Once
+	client *http.Client
+}
+
+// Backoff waits 30 seconds after the first failed attempt, doubling every
+// time up to 6 hours, plus up to 10% so that the retries of an endpoint that
+// was down don't all come back at once.
+func Backoff(attempt int) time.Duration {
+	wait := 6 * time.Hour
+	if attempt < 20 {
+		wait = min(30*time.Second<<(attempt-1), wait)
+	}
+	return wait + time.Duration(rand.Int63n(int64(wait/10)+1))
+}
+
+func (d *Dispatcher) now() time.Time {
+	if d.Now == nil {
+		return time.Now()
+	}
+	return d.Now()
+}
+
+func (d *Dispatcher) logger() *slog.Logger {
+	if d.Logger == nil {
+		return slog.Default()
+	}
+	return d.Logger
+}
+
+func (d *Dispatcher) httpClient() *http.Client {
+	d.once.Do(func() {
+		dialer := &net.Dialer{Timeout: timeout}
+		if !d.AllowPrivate {
+			dialer.Control = refusePrivate
+		}
+		d.client = &http.Client{
+			Timeout: timeout,
+			// no proxy, the addresses checked must be the ones dialed
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: timeout,
+				MaxIdleConns:        10,
+				IdleConnTimeout:     90 * time.Second,
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	})
+	return d.client
+}
+
+var errPrivate = errors.New("webhooks: private addresses are not allowed")
+
+// privatePrefixes are the addresses that aren't public, from the IANA
+// special-purpose registries. The ones ending in the address of an IPv4 host,
+// like NAT64 and 6to4, are in too, as they can reach the private ones.
+var privatePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// refusePrivate is a net.Dialer Control refusing the addresses that aren't
+// public. It runs on the resolved address, so a public name pointing to a
+// private address is refused as well.
+func refusePrivate(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	// an IPv4 address can be dialed as ::ffff:a.b.c.d
+	ip := addrPort.Addr().Unmap().WithZone("")
+	for _, prefix := range privatePrefixes {
+		if prefix.Contains(ip) {
+			return fmt.Errorf("%w: %s", errPrivate, ip)
+		}
+	}
+	return nil
+}
+
+// Run delivers the due deliveries every Interval until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		_, err := d.DeliverDue(ctx)
+		if err != nil && ctx.Err() == nil {
+			d.logger().Error("delivering webhooks", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue attempts a batch of due deliveries, all at once, and returns
+// how many there were.
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+	batchSize := d.BatchSize
+	if batchSize <= 0 {
+		batchSize = 10
+	}
+	jobs, err := d.Queue.Claim(ctx, batchSize, lease)
+	if err != nil {
+		return 0, fmt.Errorf("deliver webhooks: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job models.WebhookJob) {
+			defer wg.Done()
+			d.deliver(ctx, job)
+		}(job)
+	}
+	wg.Wait()
+
+	return len(jobs), nil
+}
+
+// deliver attempts a delivery and records how it went.
+func (d *Dispatcher) deliver(ctx context.Context, job models.WebhookJob) {
+	delivery := job.Delivery
+	logger := d.logger().With("delivery_id", delivery.ID, "webhook_id", delivery.WebhookID,
+		"event", delivery.Event, "attempt", delivery.Attempts)
+	status, err := d.post(ctx, job)
+	metrics.WebhookDeliveries.WithLabelValues(metrics.Result(err)).Inc()
+	if err != nil && ctx.Err() != nil {
+		// shutting down, the attempt is retried once the lease is over
+		return
+	}
+
+	// recorded even when ctx is done by now, the queries have their own
+	// timeouts
+	ctx = context.WithoutCancel(ctx)
+	if err == nil {
+		err = d.Queue.Delivered(ctx, delivery.ID, status)
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			logger.Error("recording webhook delivery", "err", err)
+		}
+		return
+	}
+
+	var retryAt *time.Time
+	if delivery.Attempts < d.maxAttempts() {
+		backoff := d.Backoff
+		if backoff == nil {
+			backoff = Backoff
+		}
+		at := d.now().Add(backoff(delivery.Attempts))
+		retryAt = &at
+	}
+	logger.Warn("webhook delivery failed", "err", err, "retry_at", retryAt)
+
+	err = d.Queue.Failed(ctx, delivery.ID, status, err.Error(), retryAt)
+	// the webhook may have been deleted in the meantime
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		logger.Error("recording webhook delivery", "err", err)
+	}
+}
+
+func (d *Dispatcher) maxAttempts() int {
+	if d.MaxAttempts <= 0 {
+		return DefaultMaxAttempts
+	}
+	return d.MaxAttempts
+}
+
+// post sends the payload of job and returns the status code of the answer,
+// with an error unless it is a 2xx.
+func (d *Dispatcher) post(ctx context.Context, job models.WebhookJob) (status int, err error) {
+	ctx, span := tracing.Start(ctx, "webhook.deliver",
+		attribute.String("webhook.event", string(job.Delivery.Event)),
+		attribute.Int64("webhook.delivery_id", job.Delivery.ID))
+	defer func() { tracing.End(span, err) }()
+
+	body := []byte(job.Delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "lenslocked-webhooks/1")
+	req.Header.Set(EventHeader, string(job.Delivery.Event))
+	req.Header.Set(DeliveryHeader, fmt.Sprint(job.Delivery.ID))
+	req.Header.Set(SignatureHeader, Sign(job.Secret, d.now(), body))
+
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// read a little of the body, so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("the endpoint answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,96 @@
+// Package webhooks delivers the events of users to their webhooks, the
+// endpoints they registered, from the queue kept by the webhook services.
+//
+// Every delivery is a POST of a JSON Payload, signed with the secret of the
+// webhook in the Lenslocked-Signature header:
+//
+//	Lenslocked-Signature: t=1700000000,v1=5257a869e7ecebeda32affa62cdca3fa51cad7e77a0e56ff536d0ce8e108d8bd
+//
+// where v1 is the hex HMAC-SHA256 of the timestamp, a dot and the body, keyed
+// with the secret. Receivers check it with Verify, or its equivalent in their
+// language, and reject old timestamps so that a captured request can't be
+// replayed.
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+)
+
+const (
+	SignatureHeader = "Lenslocked-Signature"
+	EventHeader     = "Lenslocked-Event"
+	// DeliveryHeader is the id of the delivery, which redeliveries don't
+	// share: receivers can't rely on it to tell them apart
+	DeliveryHeader = "Lenslocked-Delivery"
+)
+
+// Payload is the body of every delivery. Data is the gallery or the image,
+// like the JSON API represents them.
+type Payload struct {
+	Event     models.WebhookEvent `json:"event"`
+	CreatedAt time.Time           `json:"created_at"`
+	Data      any                 `json:"data"`
+}
+
+var ErrSignature = errors.New("webhooks: invalid signature")
+
+func mac(secret string, timestamp int64, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(h, "%d.", timestamp)
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Sign returns the signature header of body, sent at t.
+func Sign(secret string, t time.Time, body []byte) string {
+	return fmt.Sprintf("t=%d,v1=%s", t.Unix(), hex.EncodeToString(mac(secret, t.Unix(), body)))
+}
+
+// Verify checks the signature header of body, and that it was sent at most
+// tolerance before now. Any v1 signature can match, which lets a receiver
+// check against several secrets.
+func Verify(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var timestamp int64
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%w: bad timestamp", ErrSignature)
+			}
+			timestamp = n
+		case "v1":
+			sig, err := hex.DecodeString(value)
+			if err != nil {
+				return fmt.Errorf("%w: bad signature", ErrSignature)
+			}
+			signatures = append(signatures, sig)
+		}
+	}
+	if timestamp == 0 || len(signatures) == 0 {
+		return fmt.Errorf("%w: missing timestamp or signature", ErrSignature)
+	}
+	if age := now.Sub(time.Unix(timestamp, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("%w: timestamp outside of the tolerance", ErrSignature)
+	}
+
+	want := mac(secret, timestamp, body)
+	for _, sig := range signatures {
+		if hmac.Equal(sig, want) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: no signature matches", ErrSignature)
+}
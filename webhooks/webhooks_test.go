@@ -0,0 +1,271 @@
+package webhooks_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelmdurante/lenslocked/models"
+	"github.com/rafaelmdurante/lenslocked/models/memory"
+	"github.com/rafaelmdurante/lenslocked/webhooks"
+)
+
+func TestSignVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"event":"gallery.created"}`)
+	header := webhooks.Sign("whsec_abc", now, body)
+	if !strings.HasPrefix(header, "t=1700000000,v1=") {
+		t.Fatalf("got header %q", header)
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		body   string
+		now    time.Time
+		ok     bool
+	}{
+		{"Valid", "whsec_abc", header, string(body), now.Add(time.Minute), true},
+		{"Other secrets", "whsec_abc", "v1=00," + header, string(body), now, true},
+		{"Wrong secret", "whsec_xyz", header, string(body), now, false},
+		{"Changed body", "whsec_abc", header, `{"event":"gallery.deleted"}`, now, false},
+		{"Too old", "whsec_abc", header, string(body), now.Add(6 * time.Minute), false},
+		{"Changed timestamp", "whsec_abc", strings.Replace(header, "t=1700000000", "t=1700000001", 1), string(body), now, false},
+		{"Garbage", "whsec_abc", "nope", string(body), now, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := webhooks.Verify(tt.secret, tt.header, []byte(tt.body), 5*time.Minute, tt.now)
+			if tt.ok && err != nil {
+				t.Errorf("got error %v, want none", err)
+			}
+			if !tt.ok && !errors.Is(err, webhooks.ErrSignature) {
+				t.Errorf("got error %v, want ErrSignature", err)
+			}
+		})
+	}
+}
+
+// receiver is a local endpoint answering with status, keeping the requests
+// it got.
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   []string
+}
+
+func newReceiver(t *testing.T) *receiver {
+	rcv := &receiver{status: http.StatusOK}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.requests = append(rcv.requests, r)
+		rcv.bodies = append(rcv.bodies, string(b))
+		w.WriteHeader(rcv.status)
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+// setup returns a queue with a webhook for rcv, subscribed to every event,
+// and a dispatcher for it with a clock the test moves.
+func setup(t *testing.T, url string) (*memory.WebhookService, *models.Webhook, *webhooks.Dispatcher, *time.Time) {
+	t.Helper()
+
+	store := memory.NewStore()
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+	user, err := (&memory.UserService{Store: store}).Create(context.Background(), "bob@example.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := &memory.WebhookService{Store: store, Now: clock}
+	webhook, err := queue.Create(context.Background(), user.ID, url, models.WebhookEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = queue.Enqueue(context.Background(), user.ID, models.WebhookImageUploaded, []byte(`{"event":"image.uploaded"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &webhooks.Dispatcher{
+		Queue:        queue,
+		AllowPrivate: true,
+		Now:          clock,
+		Backoff:      func(attempt int) time.Duration { return time.Duration(attempt) * time.Minute },
+		MaxAttempts:  3,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	return queue, webhook, d, &now
+}
+
+func deliveries(t *testing.T, queue *memory.WebhookService, webhookID int) []models.WebhookDelivery {
+	t.Helper()
+
+	ds, err := queue.Deliveries(context.Background(), webhookID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func TestDispatcher(t *testing.T) {
+	rcv := newReceiver(t)
+	queue, webhook, d, _ := setup(t, rcv.URL+"/hooks")
+	ctx := context.Background()
+
+	n, err := d.DeliverDue(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("got %d deliveries, %v, want 1", n, err)
+	}
+	if len(rcv.requests) != 1 {
+		t.Fatalf("the receiver got %d requests, want 1", len(rcv.requests))
+	}
+	req := rcv.requests[0]
+	if req.Method != http.MethodPost || req.URL.Path != "/hooks" ||
+		req.Header.Get("Content-Type") != "application/json" ||
+		req.Header.Get(webhooks.EventHeader) != "image.uploaded" ||
+		req.Header.Get(webhooks.DeliveryHeader) == "" {
+		t.Errorf("got request %s %s with headers %v", req.Method, req.URL, req.Header)
+	}
+	err = webhooks.Verify(webhook.Secret, req.Header.Get(webhooks.SignatureHeader),
+		[]byte(rcv.bodies[0]), 5*time.Minute, time.Unix(1700000000, 0))
+	if err != nil || rcv.bodies[0] != `{"event":"image.uploaded"}` {
+		t.Errorf("got body %q signed %v", rcv.bodies[0], err)
+	}
+
+	got := deliveries(t, queue, webhook.ID)
+	if len(got) != 1 || got[0].Pending() || got[0].DeliveredAt == nil || got[0].StatusCode != 200 {
+		t.Errorf("got %+v, want a delivered delivery", got)
+	}
+
+	// nothing is due anymore
+	n, err = d.DeliverDue(ctx)
+	if err != nil || n != 0 {
+		t.Errorf("got %d deliveries, %v, want none", n, err)
+	}
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	rcv := newReceiver(t)
+	rcv.status = http.StatusServiceUnavailable
+	queue, webhook, d, now := setup(t, rcv.URL)
+	ctx := context.Background()
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		n, err := d.DeliverDue(ctx)
+		if err != nil || n != 1 {
+			t.Fatalf("attempt %d: got %d deliveries, %v, want 1", attempt, n, err)
+		}
+		got := deliveries(t, queue, webhook.ID)[0]
+		if got.Attempts != attempt || got.StatusCode != 503 || !strings.Contains(got.Error, "503") {
+			t.Fatalf("attempt %d: got %+v", attempt, got)
+		}
+		if attempt == 3 {
+			if got.Pending() {
+				t.Fatalf("got %+v, want it given up on after 3 attempts", got)
+			}
+			break
+		}
+		if want := now.Add(time.Duration(attempt) * time.Minute); !got.NextAttemptAt.Equal(want) {
+			t.Fatalf("attempt %d: got the next one at %v, want %v", attempt, got.NextAttemptAt, want)
+		}
+
+		// not due before the backoff is over
+		n, err = d.DeliverDue(ctx)
+		if err != nil || n != 0 {
+			t.Fatalf("attempt %d: got %d deliveries during the backoff, %v", attempt, n, err)
+		}
+		*now = now.Add(time.Duration(attempt) * time.Minute)
+	}
+	if len(rcv.requests) != 3 {
+		t.Errorf("the receiver got %d requests, want 3", len(rcv.requests))
+	}
+
+	// redelivering starts over, as a new delivery
+	failed := deliveries(t, queue, webhook.ID)[0]
+	_, err := queue.Redeliver(ctx, webhook.ID, failed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcv.status = http.StatusNoContent
+	n, err := d.DeliverDue(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("got %d deliveries, %v, want the redelivery", n, err)
+	}
+	got := deliveries(t, queue, webhook.ID)
+	if len(got) != 2 || got[0].DeliveredAt == nil || got[0].Attempts != 1 || got[1].DeliveredAt != nil {
+		t.Errorf("got %+v, want the redelivery delivered and the original kept", got)
+	}
+}
+
+func TestDispatcherRedirects(t *testing.T) {
+	target := newReceiver(t)
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+	t.Cleanup(redirect.Close)
+	queue, webhook, d, _ := setup(t, redirect.URL)
+
+	_, err := d.DeliverDue(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := deliveries(t, queue, webhook.ID)[0]
+	if got.DeliveredAt != nil || got.StatusCode != http.StatusFound || len(target.requests) != 0 {
+		t.Errorf("got %+v, want the redirect not followed", got)
+	}
+}
+
+func TestDispatcherPrivateAddresses(t *testing.T) {
+	rcv := newReceiver(t)
+	for name, url := range map[string]string{
+		"Loopback":             rcv.URL,
+		"This network":         "http://0.1.2.3/",
+		"Shared address space": "http://100.64.0.1/",
+		"Benchmarking":         "http://198.18.0.1/",
+		"IPv4-mapped":          "http://[::ffff:10.0.0.1]/",
+		"NAT64":                "http://[64:ff9b::a00:1]/",
+		"Unique local":         "http://[fd00::1]/",
+	} {
+		t.Run(name, func(t *testing.T) {
+			queue, webhook, d, _ := setup(t, url)
+			d.AllowPrivate = false
+
+			_, err := d.DeliverDue(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := deliveries(t, queue, webhook.ID)[0]
+			if len(rcv.requests) != 0 || got.StatusCode != 0 || !strings.Contains(got.Error, "private addresses") {
+				t.Errorf("got %+v, want the address refused", got)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		5:  8 * time.Minute,
+		10: 256 * time.Minute,
+		11: 6 * time.Hour,
+		99: 6 * time.Hour,
+	} {
+		got := webhooks.Backoff(attempt)
+		if got < want || got > want+want/10 {
+			t.Errorf("attempt %d: got %v, want %v plus up to 10%%", attempt, got, want)
+		}
+	}
+}